@@ -146,6 +146,15 @@ func (ct CredentialType) AttributeType(ai AttributeTypeIdentifier) *AttributeTyp
 // TranslatedString is a map of translated strings.
 type TranslatedString map[string]string
 
+// Translate returns the translation of the string in the specified language, or in English if
+// it has no translation in that language.
+func (ts TranslatedString) Translate(lang string) string {
+	if text, ok := ts[lang]; ok {
+		return text
+	}
+	return ts["en"]
+}
+
 type xmlTranslation struct {
 	XMLName xml.Name
 	Text    string `xml:",chardata"`
@@ -134,6 +134,12 @@ func (th TestHandler) RequestSchemeManagerPermission(manager *irma.SchemeManager
 func (th TestHandler) RequestPin(remainingAttempts int, callback irmaclient.PinHandler) {
 	callback(true, "12345")
 }
+func (th TestHandler) RequestPairingCode(incorrect bool, callback irmaclient.PairingHandler) {
+	th.Failure(&irma.SessionError{Err: errors.New("Unexpected pairing code request")})
+}
+func (th TestHandler) RequestClientAttributes(request *irma.IssuanceRequest, callback irmaclient.ClientAttributesHandler) {
+	th.Failure(&irma.SessionError{Err: errors.New("Unexpected client attributes request")})
+}
 
 type SessionResult struct {
 	Err              error
@@ -154,6 +160,31 @@ func (th UnsatisfiableTestHandler) Success(result string) {
 	th.Failure(&irma.SessionError{ErrorType: irma.ErrorType("Unsatisfiable request succeeded")})
 }
 
+// PairingTestHandler embeds a TestHandler, entering the specified pairing codes one by one.
+type PairingTestHandler struct {
+	TestHandler
+	codes    []string
+	attempts int
+}
+
+func (th *PairingTestHandler) RequestPairingCode(incorrect bool, callback irmaclient.PairingHandler) {
+	require.Equal(th.t, th.attempts > 0, incorrect)
+	code := th.codes[th.attempts]
+	th.attempts++
+	callback(true, code)
+}
+
+// ClientAttributesTestHandler embeds a TestHandler, choosing the specified values for the client
+// attributes of the issuance request.
+type ClientAttributesTestHandler struct {
+	TestHandler
+	values []map[string]string
+}
+
+func (th ClientAttributesTestHandler) RequestClientAttributes(request *irma.IssuanceRequest, callback irmaclient.ClientAttributesHandler) {
+	callback(true, th.values)
+}
+
 // ManualTestHandler embeds a TestHandler to inherit its methods.
 // Below we overwrite the methods that require behaviour specific to manual settings.
 type ManualTestHandler struct {
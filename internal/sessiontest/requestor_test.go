@@ -2,17 +2,36 @@ package sessiontest
 
 import (
 	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
 	"io/ioutil"
 	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"reflect"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/privacybydesign/gabi"
+	"github.com/privacybydesign/gabi/big"
 	"github.com/privacybydesign/irmago"
+	"github.com/privacybydesign/irmago/internal/common"
 	"github.com/privacybydesign/irmago/internal/test"
 	"github.com/privacybydesign/irmago/irmaclient"
 	"github.com/privacybydesign/irmago/server"
+	"github.com/privacybydesign/irmago/server/irmaserver"
+	"github.com/privacybydesign/irmago/server/requestorserver"
+	"github.com/sirupsen/logrus"
+	logtest "github.com/sirupsen/logrus/hooks/test"
 	"github.com/stretchr/testify/require"
 )
 
@@ -25,6 +44,7 @@ const (
 	sessionOptionIgnoreError
 	sessionOptionReuseServer
 	sessionOptionClientWait
+	sessionOptionConcurrentPost
 )
 
 type requestorSessionResult struct {
@@ -102,6 +122,29 @@ func requestorSessionHelper(t *testing.T, request irma.SessionRequest, client *i
 		require.NoError(t, err)
 	}
 
+	if opts&sessionOptionConcurrentPost > 0 {
+		// Post the last message a few more times concurrently, each slightly different so that
+		// the response cache does not apply, as happens when the user double taps
+		statuses := make([]int, 3)
+		var wg sync.WaitGroup
+		for i := range statuses {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				message := h.(*TestHandler).result + strings.Repeat(" ", i+1)
+				res, err := http.Post(qr.URL+"/proofs", "application/json", strings.NewReader(message))
+				if err == nil {
+					statuses[i] = res.StatusCode
+					_ = res.Body.Close()
+				}
+			}(i)
+		}
+		wg.Wait()
+		for _, status := range statuses {
+			require.Equal(t, http.StatusOK, status)
+		}
+	}
+
 	return &requestorSessionResult{serverResult, nil}
 }
 
@@ -116,6 +159,42 @@ func TestRequestorInvalidRequest(t *testing.T) {
 	require.Error(t, err)
 }
 
+func TestRequestorDisjunctionLimits(t *testing.T) {
+	StartIrmaServer(t, false)
+	defer StopIrmaServer()
+	id1 := irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID")
+	id2 := irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.level")
+
+	irmaServerConfiguration.MaxDisjunctions = 1
+	_, _, err := irmaServer.StartSession(irma.NewDisclosureRequest(id1, id2), nil)
+	require.Error(t, err)
+
+	irmaServerConfiguration.MaxDisjunctions = 0
+	irmaServerConfiguration.MaxDisjunctionOptions = 1
+	request := irma.NewDisclosureRequest()
+	request.Disclose = irma.AttributeConDisCon{
+		irma.AttributeDisCon{irma.AttributeCon{{Type: id1}}, irma.AttributeCon{{Type: id2}}},
+	}
+	_, _, err = irmaServer.StartSession(request, nil)
+	require.Error(t, err)
+
+	irmaServerConfiguration.MaxDisjunctionOptions = 2
+	_, _, err = irmaServer.StartSession(request, nil)
+	require.NoError(t, err)
+}
+
+func TestRequestorEnabledActions(t *testing.T) {
+	StartIrmaServer(t, false)
+	defer StopIrmaServer()
+	irmaServerConfiguration.EnabledActions = []irma.Action{irma.ActionDisclosing}
+
+	_, _, err := irmaServer.StartSession(getIssuanceRequest(true), nil)
+	require.Error(t, err)
+	id := irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID")
+	_, _, err = irmaServer.StartSession(getDisclosureRequest(id), nil)
+	require.NoError(t, err)
+}
+
 func TestRequestorDoubleGET(t *testing.T) {
 	StartIrmaServer(t, false)
 	defer StopIrmaServer()
@@ -133,6 +212,168 @@ func TestRequestorDoubleGET(t *testing.T) {
 	require.NoError(t, transport.Get("", &o))
 }
 
+func TestRequestorLoadShedding(t *testing.T) {
+	StartIrmaServer(t, false)
+	defer StopIrmaServer()
+	irmaServerConfiguration.LoadShedding.MaxActiveSessions = 1
+	request := irma.NewDisclosureRequest(irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID"))
+
+	qr, _, err := irmaServer.StartSession(request, nil)
+	require.NoError(t, err)
+	res, err := http.Get(qr.URL + "/status")
+	require.NoError(t, err)
+	require.NoError(t, res.Body.Close())
+	require.Equal(t, http.StatusOK, res.StatusCode)
+
+	_, _, err = irmaServer.StartSession(request, nil)
+	require.NoError(t, err)
+	res, err = http.Get(qr.URL + "/status")
+	require.NoError(t, err)
+	require.NoError(t, res.Body.Close())
+	require.Equal(t, http.StatusServiceUnavailable, res.StatusCode)
+	require.Equal(t, "5", res.Header.Get("Retry-After"))
+}
+
+func TestRequestorPublicKey(t *testing.T) {
+	StartIrmaServer(t, false)
+	defer StopIrmaServer()
+	issid := irma.NewIssuerIdentifier("irma-demo.RU")
+	expected, err := irmaServerConfiguration.IrmaConfiguration.PublicKey(issid, 2)
+	require.NoError(t, err)
+
+	pk, err := irmaServer.PublicKey(issid, 2)
+	require.NoError(t, err)
+	require.Equal(t, expected, pk)
+	_, err = irmaServer.PublicKey(issid, 100)
+	require.Error(t, err)
+
+	request := irma.NewDisclosureRequest(irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID"))
+	qr, _, err := irmaServer.StartSession(request, nil)
+	require.NoError(t, err)
+	url := qr.URL[:strings.Index(qr.URL, "/session/")]
+
+	res, err := http.Get(url + "/publickey/irma-demo.RU/2")
+	require.NoError(t, err)
+	bts, err := ioutil.ReadAll(res.Body)
+	require.NoError(t, err)
+	require.NoError(t, res.Body.Close())
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	fetched, err := gabi.NewPublicKeyFromBytes(bts)
+	require.NoError(t, err)
+	require.Equal(t, expected.Counter, fetched.Counter)
+	require.Zero(t, expected.N.Cmp(fetched.N))
+
+	res, err = http.Get(url + "/publickey/irma-demo.RU/100")
+	require.NoError(t, err)
+	require.NoError(t, res.Body.Close())
+	require.Equal(t, http.StatusNotFound, res.StatusCode)
+}
+
+func TestRequestorSelfTestIssuance(t *testing.T) {
+	StartIrmaServer(t, false)
+	defer StopIrmaServer()
+
+	require.NoError(t, irmaServer.SelfTestIssuance(irma.NewIssuerIdentifier("irma-demo.RU")))
+	require.Error(t, irmaServer.SelfTestIssuance(irma.NewIssuerIdentifier("irma-demo.foo")))
+}
+
+func TestRequestorSessionDiagnostics(t *testing.T) {
+	StartIrmaServer(t, false)
+	defer StopIrmaServer()
+	qr, token, err := irmaServer.StartSession(irma.NewDisclosureRequest(
+		irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID"),
+	), nil)
+	require.NoError(t, err)
+
+	var o interface{}
+	transport := irma.NewHTTPTransport(qr.URL)
+	transport.SetHeader(irma.MinVersionHeader, "2.5")
+	transport.SetHeader(irma.MaxVersionHeader, "2.5")
+	require.NoError(t, transport.Get("", &o))
+	require.NoError(t, transport.Get("", &o))
+	var status string
+	require.NoError(t, transport.Get("status", &status))
+
+	diagnostics := irmaServer.GetSessionDiagnostics(token)
+	require.NotNil(t, diagnostics)
+	require.Equal(t, 2, diagnostics.RequestFetches)
+	require.Equal(t, 1, diagnostics.StatusPolls)
+	require.Nil(t, irmaServer.GetSessionDiagnostics("nonexistent"))
+}
+
+func TestRequestorReloadSchemes(t *testing.T) {
+	StartIrmaServer(t, false)
+	defer StopIrmaServer()
+	conf := irmaServerConfiguration.IrmaConfiguration
+
+	require.NoError(t, irmaServer.ReloadSchemes())
+	require.Equal(t, conf, irmaServerConfiguration.IrmaConfiguration) // left untouched
+	require.True(t, conf != irmaServer.Configuration().IrmaConfiguration)
+	// The update listeners are kept, with the one of the server replaced rather than added
+	require.Len(t, irmaServer.Configuration().IrmaConfiguration.UpdateListeners, len(conf.UpdateListeners))
+
+	// Reloading concurrently with running sessions is safe (run with -race)
+	done := make(chan struct{})
+	reloaded := make(chan struct{})
+	go func() {
+		defer close(reloaded)
+		for {
+			select {
+			case <-done:
+				return
+			default:
+				require.NoError(t, irmaServer.ReloadSchemes())
+			}
+		}
+	}()
+	id := irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID")
+	result := requestorSessionHelper(t, irma.NewDisclosureRequest(id), nil, sessionOptionReuseServer)
+	close(done)
+	<-reloaded
+	require.Nil(t, result.Err)
+	require.Equal(t, irma.ProofStatusValid, result.ProofStatus)
+}
+
+func TestRequestorSchemeUpdateDuringSession(t *testing.T) {
+	// Use a copy of the schemes, as we update them below
+	storage := test.CreateTestStorage(t)
+	defer test.ClearTestStorage(t, storage)
+	schemes := filepath.Join(storage, "irma_configuration")
+	require.NoError(t, common.CopyDirectory(filepath.Join(testdata, "irma_configuration"), schemes))
+	startIrmaServer(t, schemes)
+	defer StopIrmaServer()
+
+	newAttr := irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.newAttribute")
+	_, _, err := irmaServer.StartSession(irma.NewDisclosureRequest(newAttr), nil)
+	require.Error(t, err)
+
+	id := irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID")
+	qr, token, err := irmaServer.StartSession(irma.NewDisclosureRequest(id), nil)
+	require.NoError(t, err)
+
+	// Update the scheme in which an attribute was added to the studentCard credential type
+	require.NoError(t, os.RemoveAll(filepath.Join(schemes, "irma-demo")))
+	require.NoError(t, common.CopyDirectory(
+		filepath.Join(testdata, "irma_configuration_updated", "irma-demo"), filepath.Join(schemes, "irma-demo")))
+	require.NoError(t, irmaServer.ReloadSchemes())
+	_, _, err = irmaServer.StartSession(irma.NewDisclosureRequest(newAttr), nil)
+	require.NoError(t, err)
+
+	// The session started before the update still completes
+	client, handler := parseStorage(t)
+	defer test.ClearTestStorage(t, handler.storage)
+	clientChan := make(chan *SessionResult)
+	j, err := json.Marshal(qr)
+	require.NoError(t, err)
+	client.NewSession(string(j), &TestHandler{t, clientChan, client, nil, 0, ""})
+	if clientResult := <-clientChan; clientResult != nil {
+		require.NoError(t, clientResult.Err)
+	}
+	result := irmaServer.GetSessionResult(token)
+	require.Equal(t, server.StatusDone, result.Status)
+	require.Equal(t, irma.ProofStatusValid, result.ProofStatus)
+}
+
 func TestRequestorSignatureSession(t *testing.T) {
 	client, handler := parseStorage(t)
 	defer test.ClearTestStorage(t, handler.storage)
@@ -147,6 +388,13 @@ func TestRequestorSignatureSession(t *testing.T) {
 		require.NotEmpty(t, serverResult.Disclosed)
 		require.Equal(t, id, serverResult.Disclosed[0][0].Identifier)
 		require.Equal(t, "456", serverResult.Disclosed[0][0].Value["en"])
+
+		details := serverResult.SignatureDetails
+		require.NotNil(t, details)
+		require.Equal(t, "message", details.Message)
+		require.Equal(t, serverResult.Disclosed, details.Attributes)
+		require.Len(t, details.PublicKeys, 1)
+		require.Equal(t, id.CredentialTypeIdentifier().IssuerIdentifier(), details.PublicKeys[0].Issuer)
 	}
 
 	// Load the updated scheme in which an attribute was added to the studentCard credential type
@@ -165,7 +413,7 @@ func TestRequestorSignatureSession(t *testing.T) {
 func TestRequestorDisclosureSession(t *testing.T) {
 	id := irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID")
 	request := irma.NewDisclosureRequest(id)
-	for _, opt := range []sessionOption{0, sessionOptionRetryPost} {
+	for _, opt := range []sessionOption{0, sessionOptionRetryPost, sessionOptionConcurrentPost} {
 		serverResult := testRequestorDisclosure(t, request, opt)
 		require.Len(t, serverResult.Disclosed, 1)
 		require.Equal(t, id, serverResult.Disclosed[0][0].Identifier)
@@ -313,6 +561,7 @@ func TestOptionalDisclosure(t *testing.T) {
 			irma.AttributeCon{irma.AttributeRequest{Type: studentid}},
 		},
 	}
+	expiry := irma.Timestamp(client.Attributes(university.CredentialTypeIdentifier(), 0).Expiry())
 	disclosed1 := [][]*irma.DisclosedAttribute{
 		{
 			{
@@ -321,6 +570,7 @@ func TestOptionalDisclosure(t *testing.T) {
 				Identifier:   irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.university"),
 				Status:       irma.AttributeProofStatusPresent,
 				IssuanceTime: irma.Timestamp(client.Attributes(university.CredentialTypeIdentifier(), 0).SigningDate()),
+				ExpiryTime:   &expiry,
 			},
 		},
 		{},
@@ -352,3 +602,1854 @@ func TestOptionalDisclosure(t *testing.T) {
 		require.True(t, reflect.DeepEqual(args.disclosed, result.Disclosed))
 	}
 }
+
+func TestRequestorMaxAttributeValueLength(t *testing.T) {
+	StartIrmaServer(t, false)
+	defer StopIrmaServer()
+	irmaServerConfiguration.MaxAttributeValueLength = 2
+
+	// The disclosed studentID has value "456", which is too long
+	id := irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID")
+	result := requestorSessionHelper(t, getDisclosureRequest(id), nil, sessionOptionReuseServer, sessionOptionIgnoreError)
+	require.Equal(t, server.StatusCancelled, result.Status)
+	require.NotNil(t, result.Err)
+	require.Equal(t, string(server.ErrorMalformedInput.Type), result.Err.ErrorName)
+}
+
+func TestRequestorDisjunctionThresholds(t *testing.T) {
+	StartIrmaServer(t, false)
+	defer StopIrmaServer()
+	client, handler := parseStorage(t)
+	defer test.ClearTestStorage(t, handler.storage)
+
+	// TestHandler always prefers the first option, so it discloses studentID but not level
+	studentID := irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID")
+	level := irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.level")
+	request := irma.NewDisclosureRequest()
+	request.Disclose = irma.AttributeConDisCon{
+		irma.AttributeDisCon{irma.AttributeCon{{Type: studentID}}, irma.AttributeCon{}},
+		irma.AttributeDisCon{irma.AttributeCon{}, irma.AttributeCon{{Type: level}}},
+	}
+
+	request.Thresholds = []irma.DisjunctionThreshold{{Disjunctions: []int{0, 1}, Min: 1}}
+	result := requestorSessionHelper(t, request, client, sessionOptionReuseServer)
+	require.Equal(t, server.StatusDone, result.Status)
+	require.Equal(t, []int{1}, result.ThresholdsSatisfied)
+
+	request.Thresholds = []irma.DisjunctionThreshold{{Disjunctions: []int{0, 1}, Min: 2}}
+	result = requestorSessionHelper(t, request, client, sessionOptionReuseServer, sessionOptionIgnoreError)
+	require.Equal(t, server.StatusCancelled, result.Status)
+	require.NotNil(t, result.Err)
+	require.Equal(t, string(server.ErrorAttributesMissing.Type), result.Err.ErrorName)
+	require.Equal(t, []int{1}, result.ThresholdsSatisfied)
+}
+
+type memoryResultStore struct {
+	sync.Mutex
+	results map[string]*server.SessionResult
+}
+
+func (m *memoryResultStore) Put(result *server.SessionResult) error {
+	m.Lock()
+	defer m.Unlock()
+	m.results[result.Token] = result
+	return nil
+}
+
+func (m *memoryResultStore) Get(token string) (*server.SessionResult, error) {
+	m.Lock()
+	defer m.Unlock()
+	return m.results[token], nil
+}
+
+func TestRequestorResultStore(t *testing.T) {
+	StartIrmaServer(t, false)
+	defer StopIrmaServer()
+	store := &memoryResultStore{results: map[string]*server.SessionResult{}}
+	irmaServerConfiguration.ResultStore = store
+
+	id := irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID")
+	result := requestorSessionHelper(t, getDisclosureRequest(id), nil, sessionOptionReuseServer)
+	require.Equal(t, server.StatusDone, result.Status)
+	published, err := store.Get(result.Token)
+	require.NoError(t, err)
+	require.NotNil(t, published)
+	require.Equal(t, server.StatusDone, published.Status)
+	require.Equal(t, result.Disclosed, published.Disclosed)
+
+	// Results of sessions that this instance does not know are retrieved from the store
+	require.NoError(t, store.Put(&server.SessionResult{Token: "foo", Status: server.StatusDone}))
+	require.Equal(t, server.StatusDone, irmaServer.GetSessionResult("foo").Status)
+	require.Nil(t, irmaServer.GetSessionResult("bar"))
+}
+
+func TestRequestorStats(t *testing.T) {
+	StartIrmaServer(t, false)
+	defer StopIrmaServer()
+
+	id := irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID")
+	requestorSessionHelper(t, getDisclosureRequest(id), nil, sessionOptionReuseServer)
+
+	stats := irmaServer.Stats()
+	require.Equal(t, uint64(1), stats.Total)
+	require.Equal(t, uint64(1), stats.Finished)
+	require.Equal(t, uint64(0), stats.Active)
+	require.Equal(t, uint64(1), stats.Actions[irma.ActionDisclosing])
+	require.Equal(t, uint64(0), stats.Actions[irma.ActionIssuing])
+}
+
+func TestRequestorIssuableCredentials(t *testing.T) {
+	StartIrmaServer(t, false)
+	defer StopIrmaServer()
+
+	creds := irmaServer.IssuableCredentials()
+	require.Contains(t, creds, irma.NewCredentialTypeIdentifier("irma-demo.RU.studentCard"))
+	for _, id := range creds {
+		_, err := irmaServerConfiguration.IrmaConfiguration.PrivateKeyLatest(id.IssuerIdentifier())
+		require.NoError(t, err)
+	}
+}
+
+func TestRequestorEmptyDisclosure(t *testing.T) {
+	StartIrmaServer(t, false)
+	defer StopIrmaServer()
+
+	_, _, err := irmaServer.StartSession(irma.NewDisclosureRequest(), nil)
+	require.Error(t, err)
+	_, _, err = irmaServer.StartSession(irma.NewSignatureRequest("message"), nil)
+	require.Error(t, err)
+
+	irmaServerConfiguration.AllowEmptyDisclosure = true
+	_, _, err = irmaServer.StartSession(irma.NewDisclosureRequest(), nil)
+	require.NoError(t, err)
+}
+
+func TestRequestorMaintenance(t *testing.T) {
+	StartIrmaServer(t, false)
+	defer StopIrmaServer()
+
+	id := irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID")
+	irmaServer.SetMaintenance(true)
+	_, _, err := irmaServer.StartSession(getDisclosureRequest(id), nil)
+	require.Equal(t, irmaserver.ErrMaintenance, err)
+
+	irmaServer.SetMaintenance(false)
+	_, _, err = irmaServer.StartSession(getDisclosureRequest(id), nil)
+	require.NoError(t, err)
+}
+
+func TestRequestorCancelSessionsByRequestor(t *testing.T) {
+	StartIrmaServer(t, false)
+	defer StopIrmaServer()
+
+	id := irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID")
+	var tokens []string
+	for _, requestor := range []string{"tenant1", "tenant1", "tenant2"} {
+		_, token, err := irmaServer.StartSessionForRequestor(getDisclosureRequest(id), nil, requestor)
+		require.NoError(t, err)
+		tokens = append(tokens, token)
+	}
+
+	count, err := irmaServer.CancelSessionsByRequestor("tenant1")
+	require.NoError(t, err)
+	require.Equal(t, 2, count)
+	require.Equal(t, server.StatusCancelled, irmaServer.GetSessionResult(tokens[0]).Status)
+	require.Equal(t, server.StatusCancelled, irmaServer.GetSessionResult(tokens[1]).Status)
+	require.Equal(t, server.StatusInitialized, irmaServer.GetSessionResult(tokens[2]).Status)
+
+	// Already cancelled sessions are not counted again
+	count, err = irmaServer.CancelSessionsByRequestor("tenant1")
+	require.NoError(t, err)
+	require.Zero(t, count)
+}
+
+func TestRequestorWriteActiveSessions(t *testing.T) {
+	StartIrmaServer(t, false)
+	defer StopIrmaServer()
+
+	id := irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID")
+	_, token1, err := irmaServer.StartSessionForRequestor(getDisclosureRequest(id), nil, "tenant1")
+	require.NoError(t, err)
+	_, token2, err := irmaServer.StartSessionForRequestor(getDisclosureRequest(id), nil, "tenant2")
+	require.NoError(t, err)
+	_, token3, err := irmaServer.StartSession(getDisclosureRequest(id), nil)
+	require.NoError(t, err)
+	require.NoError(t, irmaServer.CancelSession(token3))
+
+	var buf bytes.Buffer
+	require.NoError(t, irmaServer.WriteActiveSessions(&buf))
+	var summaries []*server.SessionSummary
+	require.NoError(t, json.Unmarshal(buf.Bytes(), &summaries))
+	require.Len(t, summaries, 2)
+	require.ElementsMatch(t, []string{token1, token2}, []string{summaries[0].Token, summaries[1].Token})
+
+	buf.Reset()
+	require.NoError(t, irmaServer.WriteActiveSessions(&buf, func(summary *server.SessionSummary) bool {
+		return summary.Requestor == "tenant2"
+	}))
+	require.NoError(t, json.Unmarshal(buf.Bytes(), &summaries))
+	require.Len(t, summaries, 1)
+	require.Equal(t, token2, summaries[0].Token)
+	require.Equal(t, server.StatusInitialized, summaries[0].Status)
+}
+
+func TestRequestorUnsupportedContentType(t *testing.T) {
+	StartIrmaServer(t, false)
+	defer StopIrmaServer()
+	qr, _, err := irmaServer.StartSession(irma.NewDisclosureRequest(
+		irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID"),
+	), nil)
+	require.NoError(t, err)
+
+	res, err := http.Post(qr.URL+"/proofs", "application/x-www-form-urlencoded", bytes.NewBufferString("a=b"))
+	require.NoError(t, err)
+	defer res.Body.Close()
+	require.Equal(t, http.StatusUnsupportedMediaType, res.StatusCode)
+	rerr := &irma.RemoteError{}
+	require.NoError(t, json.NewDecoder(res.Body).Decode(rerr))
+	require.Equal(t, string(server.ErrorUnsupportedContentType.Type), rerr.ErrorName)
+}
+
+func TestRequestorSessionTokenHeader(t *testing.T) {
+	StartIrmaServer(t, false)
+	defer StopIrmaServer()
+	irmaServerConfiguration.SessionTokenHeader = "X-IRMA-Session"
+	qr, _, err := irmaServer.StartSession(irma.NewDisclosureRequest(
+		irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID"),
+	), nil)
+	require.NoError(t, err)
+	i := strings.LastIndex(qr.URL, "/")
+	url, token := qr.URL[:i], qr.URL[i+1:]
+
+	req, err := http.NewRequest(http.MethodGet, url+"/status", nil)
+	require.NoError(t, err)
+	req.Header.Set("X-IRMA-Session", token)
+	res, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer res.Body.Close()
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	var status server.Status
+	require.NoError(t, json.NewDecoder(res.Body).Decode(&status))
+	require.Equal(t, server.StatusInitialized, status)
+
+	// Paths containing a token are left alone
+	req.URL.Path = "/session/" + token + "/status"
+	req.Header.Set("X-IRMA-Session", "foo")
+	res, err = http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	require.NoError(t, res.Body.Close())
+	require.Equal(t, http.StatusOK, res.StatusCode)
+
+	// Malformed tokens are not inserted into the path
+	req.URL.Path = "/session/status"
+	for _, malformed := range []string{"foo", token + "/..", strings.Repeat("a", 19) + "!"} {
+		req.Header.Set("X-IRMA-Session", malformed)
+		res, err = http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		require.NoError(t, res.Body.Close())
+		require.Equal(t, http.StatusBadRequest, res.StatusCode)
+	}
+
+	irmaServerConfiguration.SessionTokenHeader = ""
+	req.URL.Path = "/session/status"
+	req.Header.Set("X-IRMA-Session", token)
+	res, err = http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	require.NoError(t, res.Body.Close())
+	require.NotEqual(t, http.StatusOK, res.StatusCode)
+}
+
+func TestRequestorErrorFormatter(t *testing.T) {
+	StartRequestorServer(&requestorserver.Configuration{
+		Configuration: &server.Configuration{
+			URL:                  "http://localhost:48682/irma",
+			Logger:               logger,
+			DisableSchemesUpdate: true,
+			SchemesPath:          filepath.Join(testdata, "irma_configuration"),
+			EnableSSE:            true,
+			ErrorFormatter: func(err *irma.RemoteError) interface{} {
+				return map[string]map[string]string{"error": {"code": err.ErrorName, "message": err.Description}}
+			},
+		},
+		DisableRequestorAuthentication: true,
+		ListenAddress:                  "localhost",
+		Port:                           48682,
+	})
+	defer StopRequestorServer()
+
+	// Errors of the requestor API are formatted
+	res, err := http.Get("http://localhost:48682/session/foo/result")
+	require.NoError(t, err)
+	defer res.Body.Close()
+	require.Equal(t, server.ErrorSessionUnknown.Status, res.StatusCode)
+	var formatted map[string]map[string]string
+	require.NoError(t, json.NewDecoder(res.Body).Decode(&formatted))
+	require.Equal(t, string(server.ErrorSessionUnknown.Type), formatted["error"]["code"])
+	require.Equal(t, server.ErrorSessionUnknown.Description, formatted["error"]["message"])
+
+	// Errors sent to the IRMA app are not
+	res, err = http.Get("http://localhost:48682/irma/session/foo/status")
+	require.NoError(t, err)
+	defer res.Body.Close()
+	rerr := &irma.RemoteError{}
+	require.NoError(t, json.NewDecoder(res.Body).Decode(rerr))
+	require.Equal(t, string(server.ErrorSessionUnknown.Type), rerr.ErrorName)
+
+	// Server sent events still work
+	bts, err := json.Marshal(getDisclosureRequest(irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID")))
+	require.NoError(t, err)
+	res, err = http.Post("http://localhost:48682/session", "application/json", bytes.NewReader(bts))
+	require.NoError(t, err)
+	defer res.Body.Close()
+	pkg := &server.SessionPackage{}
+	require.NoError(t, json.NewDecoder(res.Body).Decode(pkg))
+	events, err := http.Get("http://localhost:48682/session/" + pkg.Token + "/statusevents")
+	require.NoError(t, err)
+	defer events.Body.Close()
+	require.Equal(t, http.StatusOK, events.StatusCode)
+}
+
+func TestRequestorSessionGroup(t *testing.T) {
+	StartIrmaServer(t, false)
+	defer StopIrmaServer()
+
+	id := irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID")
+	request := func(group string) *irma.ServiceProviderRequest {
+		return &irma.ServiceProviderRequest{
+			RequestorBaseRequest: irma.RequestorBaseRequest{SessionGroup: group},
+			Request:              getDisclosureRequest(id),
+		}
+	}
+	_, token1, err := irmaServer.StartSession(request("user1"), nil)
+	require.NoError(t, err)
+	_, token2, err := irmaServer.StartSession(request("user2"), nil)
+	require.NoError(t, err)
+	_, token3, err := irmaServer.StartSession(request("user1"), nil)
+	require.NoError(t, err)
+
+	require.Equal(t, server.StatusCancelled, irmaServer.GetSessionResult(token1).Status)
+	require.Equal(t, server.StatusInitialized, irmaServer.GetSessionResult(token2).Status)
+	require.Equal(t, server.StatusInitialized, irmaServer.GetSessionResult(token3).Status)
+}
+
+func TestRequestorPartialIssuance(t *testing.T) {
+	StartIrmaServer(t, false)
+	defer StopIrmaServer()
+	irmaServerConfiguration.AllowPartialIssuance = true
+	client, handler := parseStorage(t)
+	defer test.ClearTestStorage(t, handler.storage)
+
+	// As no revocation server is running, the revocation-enabled credential cannot be issued,
+	// while the student card can
+	studentCard := irma.NewCredentialTypeIdentifier("irma-demo.RU.studentCard")
+	count := func(id irma.CredentialTypeIdentifier) int {
+		i := 0
+		for client.Attributes(id, i) != nil {
+			i++
+		}
+		return i
+	}
+	studentCards := count(studentCard)
+	root := client.Attributes(revocationTestCred, 0)
+	request := revocationIssuanceRequest(t, revocationTestCred)
+	request.Credentials = append(request.Credentials, getIssuanceRequest(true).Credentials...)
+
+	result := requestorSessionHelper(t, request, client, sessionOptionReuseServer)
+	require.Nil(t, result.Err)
+	require.Equal(t, server.StatusDone, result.Status)
+	require.Len(t, result.Issued, 2)
+	require.Equal(t, revocationTestCred, result.Issued[0].Credential)
+	require.False(t, result.Issued[0].Issued)
+	require.NotEmpty(t, result.Issued[0].Err)
+	require.Equal(t, studentCard, result.Issued[1].Credential)
+	require.True(t, result.Issued[1].Issued)
+
+	// The client stored the issued credential and skipped the other one
+	require.Equal(t, studentCards+1, count(studentCard))
+	require.True(t, client.Attributes(revocationTestCred, 0) == root)
+}
+
+func TestRequestorExportImportSessions(t *testing.T) {
+	StartIrmaServer(t, false)
+	qr, token, err := irmaServer.StartSessionForRequestor(irma.NewDisclosureRequest(
+		irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID"),
+	), nil, "tenant1")
+	require.NoError(t, err)
+
+	var o interface{}
+	transport := irma.NewHTTPTransport(qr.URL)
+	transport.SetHeader(irma.MinVersionHeader, "2.5")
+	transport.SetHeader(irma.MaxVersionHeader, "2.5")
+	require.NoError(t, transport.Get("", &o))
+
+	exported, err := irmaServer.ExportSessions()
+	require.NoError(t, err)
+	StopIrmaServer()
+
+	// Continue the session at a new server
+	StartIrmaServer(t, false)
+	defer StopIrmaServer()
+	require.NoError(t, irmaServer.ImportSessions(exported))
+	require.Error(t, irmaServer.ImportSessions(exported))
+
+	var status string
+	require.NoError(t, transport.Get("status", &status))
+	require.Equal(t, string(server.StatusConnected), status)
+	require.Equal(t, server.StatusConnected, irmaServer.GetSessionResult(token).Status)
+	stats := irmaServer.Stats()
+	require.Equal(t, uint64(1), stats.Total)
+	require.Equal(t, uint64(1), stats.Active)
+
+	count, err := irmaServer.CancelSessionsByRequestor("tenant1")
+	require.NoError(t, err)
+	require.Equal(t, 1, count)
+	stats = irmaServer.Stats()
+	require.Equal(t, uint64(1), stats.Finished)
+	require.Equal(t, uint64(0), stats.Active)
+}
+
+func TestRequestorQRRewriter(t *testing.T) {
+	StartIrmaServer(t, false)
+	defer StopIrmaServer()
+
+	id := irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID")
+	irmaServerConfiguration.QRRewriter = func(qr *irma.Qr, token string) *irma.Qr {
+		qr.URL = "https://example.com/deeplink?url=" + qr.URL
+		return qr
+	}
+	qr, _, err := irmaServer.StartSession(getDisclosureRequest(id), nil)
+	require.NoError(t, err)
+	require.True(t, strings.HasPrefix(qr.URL, "https://example.com/deeplink?url="))
+
+	// A rewriter returning no QR fails the session start instead of panicking, also when tracing
+	irmaServerConfiguration.QRRewriter = func(*irma.Qr, string) *irma.Qr { return nil }
+	tracer := &testTracer{attributes: map[string]string{}}
+	irmaServerConfiguration.TracerProvider = tracer
+	qr, token, err := irmaServer.StartSession(getDisclosureRequest(id), nil)
+	require.Error(t, err)
+	require.Nil(t, qr)
+	require.Empty(t, token)
+	require.Contains(t, tracer.attributes, "error")
+	require.Equal(t, uint64(0), irmaServer.Stats().Active)
+}
+
+// testTracer is a server.TracerProvider recording the attributes of its spans.
+type testTracer struct {
+	attributes map[string]string
+}
+
+func (tracer *testTracer) StartSpan(ctx context.Context, _ string) (context.Context, server.Span) {
+	return ctx, tracer
+}
+
+func (tracer *testTracer) SetAttribute(key, value string) {
+	tracer.attributes[key] = value
+}
+
+func (tracer *testTracer) End() {}
+
+func TestRequestorAttributeFormats(t *testing.T) {
+	StartIrmaServer(t, false)
+	defer StopIrmaServer()
+
+	request := getIssuanceRequest(true)
+	request.Credentials[0].AttributeFormats = map[string]string{"studentID": "s[0-9]{7}"}
+	_, _, err := irmaServer.StartSession(request, nil)
+	require.NoError(t, err)
+
+	request.Credentials[0].Attributes["studentID"] = "1234567"
+	_, _, err = irmaServer.StartSession(request, nil)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "studentID")
+	require.Contains(t, err.Error(), "s[0-9]{7}")
+}
+
+func TestRequestorQrExpiry(t *testing.T) {
+	StartIrmaServer(t, false)
+	defer StopIrmaServer()
+
+	request := &irma.ServiceProviderRequest{
+		RequestorBaseRequest: irma.RequestorBaseRequest{ClientTimeout: 60},
+		Request:              getDisclosureRequest(irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID")),
+	}
+	qr, _, err := irmaServer.StartSession(request, nil)
+	require.NoError(t, err)
+	require.NotNil(t, qr.Expiry)
+	require.False(t, qr.Expired())
+	require.WithinDuration(t, time.Now().Add(time.Minute), time.Time(*qr.Expiry), 5*time.Second)
+
+	// A client scanning an expired QR refuses it without contacting the server
+	client, handler := parseStorage(t)
+	defer test.ClearTestStorage(t, handler.storage)
+	expiry := irma.Timestamp(time.Now().Add(-time.Second))
+	qr.Expiry = &expiry
+	require.True(t, qr.Expired())
+	clientChan := make(chan *SessionResult, 1)
+	j, err := json.Marshal(qr)
+	require.NoError(t, err)
+	client.NewSession(string(j), &TestHandler{t, clientChan, client, nil, 0, ""})
+	clientResult := <-clientChan
+	require.Error(t, clientResult.Err)
+	serr, ok := clientResult.Err.(*irma.SessionError)
+	require.True(t, ok)
+	require.Equal(t, irma.ErrorSessionExpired, serr.ErrorType)
+}
+
+func TestRequestorExternalConfirmation(t *testing.T) {
+	StartIrmaServer(t, false)
+	defer StopIrmaServer()
+	client, handler := parseStorage(t)
+	defer test.ClearTestStorage(t, handler.storage)
+
+	startSession := func() (string, chan *SessionResult) {
+		request := &irma.IdentityProviderRequest{
+			RequestorBaseRequest: irma.RequestorBaseRequest{ExternalConfirmation: true},
+			Request:              getIssuanceRequest(true),
+		}
+		qr, token, err := irmaServer.StartSession(request, nil)
+		require.NoError(t, err)
+		clientChan := make(chan *SessionResult, 1)
+		j, err := json.Marshal(qr)
+		require.NoError(t, err)
+		client.NewSession(string(j), &TestHandler{t, clientChan, client, nil, 0, ""})
+		return token, clientChan
+	}
+	awaitStatus := func(token string, status server.Status) {
+		for i := 0; i < 100 && irmaServer.GetSessionResult(token).Status != status; i++ {
+			time.Sleep(50 * time.Millisecond)
+		}
+		require.Equal(t, status, irmaServer.GetSessionResult(token).Status)
+	}
+
+	// Issuance is held off until confirmed
+	token, clientChan := startSession()
+	awaitStatus(token, server.StatusConfirming)
+	require.NoError(t, irmaServer.ConfirmExternal(token))
+	if clientResult := <-clientChan; clientResult != nil {
+		require.NoError(t, clientResult.Err)
+	}
+	require.Equal(t, server.StatusDone, irmaServer.GetSessionResult(token).Status)
+	require.Error(t, irmaServer.ConfirmExternal(token))
+
+	// Without confirmation the session fails after the timeout
+	irmaServerConfiguration.ConfirmationTimeout = 1
+	token, clientChan = startSession()
+	awaitStatus(token, server.StatusConfirming)
+	clientResult := <-clientChan
+	require.NotNil(t, clientResult)
+	require.Error(t, clientResult.Err)
+	require.Equal(t, server.StatusCancelled, irmaServer.GetSessionResult(token).Status)
+
+	// Sessions awaiting confirmation don't occupy a verification worker
+	StopIrmaServer()
+	irmaServerConfiguration.VerificationWorkers = 1
+	irmaServerConfiguration.ConfirmationTimeout = 10
+	serveIrmaServer(t)
+	token, clientChan = startSession()
+	awaitStatus(token, server.StatusConfirming)
+	qr, _, err := irmaServer.StartSession(getDisclosureRequest(irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID")), nil)
+	require.NoError(t, err)
+	req, err := http.NewRequest(http.MethodGet, qr.URL, nil)
+	require.NoError(t, err)
+	req.Header.Set(irma.MinVersionHeader, "2.5")
+	req.Header.Set(irma.MaxVersionHeader, "2.6")
+	httpClient := &http.Client{Timeout: 5 * time.Second}
+	res, err := httpClient.Do(req)
+	require.NoError(t, err)
+	require.NoError(t, res.Body.Close())
+	res, err = httpClient.Post(qr.URL+"/proofs", "application/json", strings.NewReader("{}"))
+	require.NoError(t, err) // does not time out waiting for the worker
+	require.NoError(t, res.Body.Close())
+	require.NoError(t, irmaServer.ConfirmExternal(token))
+	if clientResult := <-clientChan; clientResult != nil {
+		require.NoError(t, clientResult.Err)
+	}
+
+	// Only issuance sessions can require external confirmation
+	_, _, err = irmaServer.StartSession(&irma.ServiceProviderRequest{
+		RequestorBaseRequest: irma.RequestorBaseRequest{ExternalConfirmation: true},
+		Request:              getDisclosureRequest(irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID")),
+	}, nil)
+	require.Error(t, err)
+}
+
+func TestRequestorMaxCredentialsPerIssuance(t *testing.T) {
+	StartIrmaServer(t, false)
+	defer StopIrmaServer()
+	irmaServerConfiguration.MaxCredentialsPerIssuance = 1
+	irmaServerConfiguration.RequestorMaxCredentials = map[string]int{"bulk": 2}
+
+	request := getIssuanceRequest(true)
+	request.Credentials = append(request.Credentials, getNameIssuanceRequest().Credentials[0])
+	_, _, err := irmaServer.StartSession(request, nil)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "exceeding the maximum of 1")
+	_, _, err = irmaServer.StartSessionForRequestor(request, nil, "other")
+	require.Error(t, err)
+
+	_, _, err = irmaServer.StartSessionForRequestor(request, nil, "bulk")
+	require.NoError(t, err)
+}
+
+func TestRequestorVerificationError(t *testing.T) {
+	StartIrmaServer(t, false)
+	defer StopIrmaServer()
+	id := irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID")
+
+	result := requestorSessionHelper(t, getDisclosureRequest(id), nil, sessionOptionReuseServer)
+	require.Equal(t, server.StatusDone, result.Status)
+	require.Nil(t, irmaServer.GetVerificationError(result.Token))
+
+	// The disclosed studentID has value "456", which is too long
+	irmaServerConfiguration.MaxAttributeValueLength = 2
+	result = requestorSessionHelper(t, getDisclosureRequest(id), nil, sessionOptionReuseServer, sessionOptionIgnoreError)
+	require.Equal(t, server.StatusCancelled, result.Status)
+	verr := irmaServer.GetVerificationError(result.Token)
+	require.NotNil(t, verr)
+	require.Equal(t, irma.ProofStatusValid, verr.ProofStatus)
+	require.Equal(t, server.ErrorMalformedInput.Type, verr.Error)
+	require.Contains(t, verr.Reason, "exceeds maximum length")
+	require.Len(t, verr.PublicKeys, 1)
+	require.True(t, strings.HasPrefix(verr.PublicKeys[0], "irma-demo.RU-"))
+}
+
+func TestRequestorReturnHashed(t *testing.T) {
+	StartIrmaServer(t, false)
+	defer StopIrmaServer()
+	client, handler := parseStorage(t)
+	defer test.ClearTestStorage(t, handler.storage)
+
+	id := irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID")
+	request := &irma.ServiceProviderRequest{
+		RequestorBaseRequest: irma.RequestorBaseRequest{HashSalt: "salt"},
+		Request:              irma.NewDisclosureRequest(),
+	}
+	request.Request.Disclose = irma.AttributeConDisCon{{{{Type: id, ReturnHashed: true}}}}
+
+	qr, token, err := irmaServer.StartSession(request, nil)
+	require.NoError(t, err)
+	clientChan := make(chan *SessionResult, 1)
+	j, err := json.Marshal(qr)
+	require.NoError(t, err)
+	client.NewSession(string(j), &TestHandler{t, clientChan, client, nil, 0, ""})
+	if clientResult := <-clientChan; clientResult != nil {
+		require.NoError(t, clientResult.Err)
+	}
+
+	result := irmaServer.GetSessionResult(token)
+	require.Equal(t, server.StatusDone, result.Status)
+	mac := hmac.New(sha256.New, []byte("salt"))
+	mac.Write([]byte("456"))
+	require.Equal(t, hex.EncodeToString(mac.Sum(nil)), *result.Disclosed[0][0].RawValue)
+
+	// Without a salt the request is refused
+	request.HashSalt = ""
+	_, _, err = irmaServer.StartSession(request, nil)
+	require.Error(t, err)
+}
+
+func TestRequestorTokenPrefix(t *testing.T) {
+	StartIrmaServer(t, false)
+	defer StopIrmaServer()
+	irmaServerConfiguration.TokenPrefix = "staging-"
+
+	id := irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID")
+	result := requestorSessionHelper(t, getDisclosureRequest(id), nil, sessionOptionReuseServer)
+	require.Equal(t, server.StatusDone, result.Status)
+	require.True(t, strings.HasPrefix(result.Token, "staging-"))
+
+	// Tokens lacking the prefix are unknown, even if they would otherwise match a session
+	qr, token, err := irmaServer.StartSession(getDisclosureRequest(id), nil)
+	require.NoError(t, err)
+	require.True(t, strings.Contains(qr.URL, "/session/staging-"))
+	require.NotNil(t, irmaServer.GetRequest(token))
+	irmaServerConfiguration.TokenPrefix = "production-"
+	require.Nil(t, irmaServer.GetRequest(token))
+}
+
+func TestRequestorAllowedUserAgents(t *testing.T) {
+	StartIrmaServer(t, false)
+	defer StopIrmaServer()
+	client, handler := parseStorage(t)
+	defer test.ClearTestStorage(t, handler.storage)
+	id := irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID")
+
+	// irmago sends "irmago" as user agent
+	irmaServerConfiguration.AllowedUserAgents = []string{"^IRMA-app/"}
+	qr, token, err := irmaServer.StartSession(getDisclosureRequest(id), nil)
+	require.NoError(t, err)
+	clientChan := make(chan *SessionResult, 1)
+	j, err := json.Marshal(qr)
+	require.NoError(t, err)
+	client.NewSession(string(j), &TestHandler{t, clientChan, client, nil, 0, ""})
+	clientResult := <-clientChan
+	require.NotNil(t, clientResult)
+	require.Error(t, clientResult.Err)
+	serr, ok := clientResult.Err.(*irma.SessionError)
+	require.True(t, ok)
+	require.NotNil(t, serr.RemoteError)
+	require.Equal(t, string(server.ErrorClientNotAllowed.Type), serr.RemoteError.ErrorName)
+	require.Equal(t, server.StatusInitialized, irmaServer.GetSessionResult(token).Status)
+
+	irmaServerConfiguration.AllowedUserAgents = []string{"^IRMA-app/", "^irmago$"}
+	result := requestorSessionHelper(t, getDisclosureRequest(id), client, sessionOptionReuseServer)
+	require.Equal(t, server.StatusDone, result.Status)
+}
+
+func TestRequestorUnavailableKeyCounter(t *testing.T) {
+	StartIrmaServer(t, false)
+	defer StopIrmaServer()
+
+	request := getIssuanceRequest(true)
+	request.Credentials[0].KeyCounter = 1000
+	_, _, err := irmaServer.StartSession(request, nil)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "requested key counter 1000 for issuer irma-demo.RU not available; available: ")
+
+	irmaServerConfiguration.KeyCounterFallback = true
+	_, _, err = irmaServer.StartSession(request, nil)
+	require.NoError(t, err)
+	latest := request.Credentials[0].KeyCounter
+	require.NotEqual(t, uint(1000), latest)
+
+	// Explicitly requesting an available key counter works without fallback
+	irmaServerConfiguration.KeyCounterFallback = false
+	_, _, err = irmaServer.StartSession(request, nil)
+	require.NoError(t, err)
+	require.Equal(t, latest, request.Credentials[0].KeyCounter)
+}
+
+func TestRequestorIssueCustodial(t *testing.T) {
+	StartIrmaServer(t, false)
+	defer StopIrmaServer()
+
+	secret := big.NewInt(123456789)
+	cred := getIssuanceRequest(true).Credentials[0]
+	issued, err := irmaServer.IssueCustodial(cred, secret)
+	require.NoError(t, err)
+	require.Equal(t, secret, issued.Attributes[0])
+	attrs := irma.NewAttributeListFromInts(issued.Attributes[1:], irmaServerConfiguration.IrmaConfiguration)
+	require.Equal(t, cred.CredentialTypeID, attrs.CredentialType().Identifier())
+	require.Equal(t, "s1234567", *attrs.UntranslatedAttribute(irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID")))
+
+	// Credentials of schemes with a keyshare server are refused
+	_, err = irmaServer.IssueCustodial(&irma.CredentialRequest{
+		CredentialTypeID: irma.NewCredentialTypeIdentifier("test.test.email"),
+		Attributes:       map[string]string{"email": "example@example.com"},
+	}, secret)
+	require.Error(t, err)
+}
+
+func TestRequestorMaxSSEConnections(t *testing.T) {
+	StartRequestorServer(&requestorserver.Configuration{
+		Configuration: &server.Configuration{
+			URL:                      "http://localhost:48682/irma",
+			Logger:                   logger,
+			DisableSchemesUpdate:     true,
+			SchemesPath:              filepath.Join(testdata, "irma_configuration"),
+			EnableSSE:                true,
+			MaxSessionSSEConnections: 1,
+		},
+		DisableRequestorAuthentication: true,
+		ListenAddress:                  "localhost",
+		Port:                           48682,
+	})
+	defer StopRequestorServer()
+
+	bts, err := json.Marshal(getDisclosureRequest(irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID")))
+	require.NoError(t, err)
+	res, err := http.Post("http://localhost:48682/session", "application/json", bytes.NewReader(bts))
+	require.NoError(t, err)
+	defer res.Body.Close()
+	pkg := &server.SessionPackage{}
+	require.NoError(t, json.NewDecoder(res.Body).Decode(pkg))
+
+	// The first subscription stays open, the second one exceeds the per-session maximum
+	url := "http://localhost:48682/session/" + pkg.Token + "/statusevents"
+	first, err := http.Get(url)
+	require.NoError(t, err)
+	defer first.Body.Close()
+	require.Equal(t, http.StatusOK, first.StatusCode)
+
+	second, err := http.Get(url)
+	require.NoError(t, err)
+	defer second.Body.Close()
+	require.Equal(t, server.ErrorOverloaded.Status, second.StatusCode)
+
+	// When the first client disconnects, its subscription is cleaned up so that another may subscribe
+	require.NoError(t, first.Body.Close())
+	time.Sleep(100 * time.Millisecond)
+	third, err := http.Get(url)
+	require.NoError(t, err)
+	defer third.Body.Close()
+	require.Equal(t, http.StatusOK, third.StatusCode)
+}
+
+func TestRequestorIncludeSchemeVersions(t *testing.T) {
+	StartIrmaServer(t, false)
+	defer StopIrmaServer()
+	client, handler := parseStorage(t)
+	defer test.ClearTestStorage(t, handler.storage)
+
+	id := irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID")
+	request := &irma.ServiceProviderRequest{
+		RequestorBaseRequest: irma.RequestorBaseRequest{IncludeSchemeVersions: true},
+		Request:              getDisclosureRequest(id),
+	}
+
+	qr, token, err := irmaServer.StartSession(request, nil)
+	require.NoError(t, err)
+	clientChan := make(chan *SessionResult, 1)
+	j, err := json.Marshal(qr)
+	require.NoError(t, err)
+	client.NewSession(string(j), &TestHandler{t, clientChan, client, nil, 0, ""})
+	if clientResult := <-clientChan; clientResult != nil {
+		require.NoError(t, clientResult.Err)
+	}
+
+	result := irmaServer.GetSessionResult(token)
+	require.Equal(t, server.StatusDone, result.Status)
+	require.Len(t, result.SchemeVersions, 1)
+	scheme := irmaServerConfiguration.IrmaConfiguration.SchemeManagers[irma.NewSchemeManagerIdentifier("irma-demo")]
+	require.Equal(t, &server.CredentialSchemeVersion{
+		CredentialTypeID: id.CredentialTypeIdentifier(),
+		Scheme:           scheme.Identifier(),
+		Timestamp:        scheme.Timestamp,
+	}, result.SchemeVersions[0])
+}
+
+func TestRequestorAllowProofRetry(t *testing.T) {
+	StartIrmaServer(t, false)
+	defer StopIrmaServer()
+	irmaServerConfiguration.AllowProofRetry = true
+	irmaServerConfiguration.MaxProofRetries = 1
+
+	id := irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID")
+	qr, token, err := irmaServer.StartSession(getDisclosureRequest(id), nil)
+	require.NoError(t, err)
+
+	req, err := http.NewRequest(http.MethodGet, qr.URL, nil)
+	require.NoError(t, err)
+	req.Header.Set(irma.MinVersionHeader, "2.4")
+	req.Header.Set(irma.MaxVersionHeader, "2.6")
+	res, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	require.NoError(t, res.Body.Close())
+	require.Equal(t, http.StatusOK, res.StatusCode)
+
+	// Proofs failing verification leave the session open for a retry, at most once
+	post := func(message string) {
+		res, err := http.Post(qr.URL+"/proofs", "application/json", strings.NewReader(message))
+		require.NoError(t, err)
+		require.NoError(t, res.Body.Close())
+	}
+	post(`{"proofs":[]}`)
+	require.Equal(t, server.StatusConnected, irmaServer.GetSessionResult(token).Status)
+	require.Equal(t, 1, irmaServer.GetSessionDiagnostics(token).ProofAttempts)
+	require.NotNil(t, irmaServer.GetVerificationError(token))
+
+	post(`{"proofs":[] }`)
+	require.True(t, irmaServer.GetSessionResult(token).Status.Finished())
+	require.Equal(t, 2, irmaServer.GetSessionDiagnostics(token).ProofAttempts)
+}
+
+func TestRequestorTrustedIssuers(t *testing.T) {
+	StartIrmaServer(t, false)
+	defer StopIrmaServer()
+	client, handler := parseStorage(t)
+	defer test.ClearTestStorage(t, handler.storage)
+	irmaServerConfiguration.TrustedIssuers = []string{"irma-demo.MijnOverheid"}
+	irmaServerConfiguration.RequestorTrustedIssuers = map[string][]string{"university": {"irma-demo.RU"}}
+
+	id := irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID")
+	session := func(requestor string) *server.SessionResult {
+		qr, token, err := irmaServer.StartSessionForRequestor(getDisclosureRequest(id), nil, requestor)
+		require.NoError(t, err)
+		clientChan := make(chan *SessionResult, 1)
+		j, err := json.Marshal(qr)
+		require.NoError(t, err)
+		client.NewSession(string(j), &TestHandler{t, clientChan, client, nil, 0, ""})
+		<-clientChan
+		return irmaServer.GetSessionResult(token)
+	}
+
+	// The global trust policy applies to requestors without their own
+	result := session("other")
+	require.Equal(t, server.StatusCancelled, result.Status)
+	require.Equal(t, string(server.ErrorIssuerNotTrusted.Type), result.Err.ErrorName)
+
+	result = session("university")
+	require.Equal(t, server.StatusDone, result.Status)
+	require.Equal(t, irma.ProofStatusValid, result.ProofStatus)
+}
+
+func TestRequestorAbortReason(t *testing.T) {
+	StartIrmaServer(t, false)
+	defer StopIrmaServer()
+
+	id := irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID")
+	qr, token, err := irmaServer.StartSession(getDisclosureRequest(id), nil)
+	require.NoError(t, err)
+
+	// Unknown reasons are refused, leaving the session intact
+	res, err := http.Post(qr.URL+"/abort", "application/json", strings.NewReader(`{"reason":"bored"}`))
+	require.NoError(t, err)
+	require.NoError(t, res.Body.Close())
+	require.Equal(t, server.ErrorMalformedInput.Status, res.StatusCode)
+	require.Equal(t, server.StatusInitialized, irmaServer.GetSessionResult(token).Status)
+
+	res, err = http.Post(qr.URL+"/abort", "application/json", strings.NewReader(`{"reason":"error","message":"out of memory"}`))
+	require.NoError(t, err)
+	require.NoError(t, res.Body.Close())
+	require.Equal(t, http.StatusNoContent, res.StatusCode)
+	result := irmaServer.GetSessionResult(token)
+	require.Equal(t, server.StatusCancelled, result.Status)
+	require.Equal(t, &irma.SessionAbortMessage{Reason: irma.AbortReasonError, Message: "out of memory"}, result.Abort)
+
+	qr, token, err = irmaServer.StartSession(getDisclosureRequest(id), nil)
+	require.NoError(t, err)
+	res, err = http.Post(qr.URL+"/abort", "application/json", strings.NewReader(`{"reason":"declined"}`))
+	require.NoError(t, err)
+	require.NoError(t, res.Body.Close())
+	require.Equal(t, server.StatusDeclined, irmaServer.GetSessionResult(token).Status)
+}
+
+func TestRequestorCompression(t *testing.T) {
+	StartIrmaServer(t, false)
+	defer StopIrmaServer()
+
+	id := irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID")
+	get := func(encoding string) *http.Response {
+		request := getDisclosureRequest(id)
+		request.Labels = map[int]irma.TranslatedString{0: {"en": strings.Repeat("label ", 500)}}
+		qr, _, err := irmaServer.StartSession(request, nil)
+		require.NoError(t, err)
+		req, err := http.NewRequest(http.MethodGet, qr.URL, nil)
+		require.NoError(t, err)
+		req.Header.Set(irma.MinVersionHeader, "2.4")
+		req.Header.Set(irma.MaxVersionHeader, "2.6")
+		req.Header.Set("Accept-Encoding", encoding)
+		res, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		require.Equal(t, http.StatusOK, res.StatusCode)
+		return res
+	}
+
+	res := get("gzip")
+	defer res.Body.Close()
+	require.Equal(t, "gzip", res.Header.Get("Content-Encoding"))
+	reader, err := gzip.NewReader(res.Body)
+	require.NoError(t, err)
+	request := &irma.DisclosureRequest{}
+	require.NoError(t, json.NewDecoder(reader).Decode(request))
+	require.Equal(t, id, request.Disclose[0][0][0].Type)
+
+	res = get("deflate")
+	defer res.Body.Close()
+	require.Equal(t, "deflate", res.Header.Get("Content-Encoding"))
+	zreader, err := zlib.NewReader(res.Body)
+	require.NoError(t, err)
+	request = &irma.DisclosureRequest{}
+	require.NoError(t, json.NewDecoder(zreader).Decode(request))
+	require.Equal(t, id, request.Disclose[0][0][0].Type)
+
+	irmaServerConfiguration.DisableCompression = true
+	res = get("gzip")
+	defer res.Body.Close()
+	require.Empty(t, res.Header.Get("Content-Encoding"))
+}
+
+func TestRequestorMaxSessionRequestSize(t *testing.T) {
+	StartIrmaServer(t, false)
+	defer StopIrmaServer()
+
+	bts, err := json.Marshal(getDisclosureRequest(irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID")))
+	require.NoError(t, err)
+	irmaServerConfiguration.MaxSessionRequestSize = len(bts) - 1
+	_, _, err = irmaServer.StartSession(bts, nil)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "exceeds the maximum size")
+	_, _, err = irmaServer.StartSession(string(bts), nil)
+	require.Error(t, err)
+
+	irmaServerConfiguration.MaxSessionRequestSize = len(bts)
+	_, _, err = irmaServer.StartSession(bts, nil)
+	require.NoError(t, err)
+}
+
+func TestRequestorCrossAttributeValidator(t *testing.T) {
+	StartIrmaServer(t, false)
+	defer StopIrmaServer()
+	irmaServerConfiguration.CrossAttributeValidator = func(credtype irma.CredentialTypeIdentifier, values map[string]string) error {
+		if credtype.Name() == "studentCard" && values["studentCardNumber"] != values["studentID"] {
+			return &server.AttributeConsistencyError{
+				CredentialTypeID: credtype,
+				Attributes:       []string{"studentCardNumber", "studentID"},
+				Reason:           "must be equal",
+			}
+		}
+		return nil
+	}
+
+	request := getIssuanceRequest(true)
+	_, _, err := irmaServer.StartSession(request, nil)
+	require.Error(t, err)
+	cerr, ok := err.(*server.AttributeConsistencyError)
+	require.True(t, ok)
+	require.Equal(t, []string{"studentCardNumber", "studentID"}, cerr.Attributes)
+
+	request.Credentials[0].Attributes["studentCardNumber"] = request.Credentials[0].Attributes["studentID"]
+	_, _, err = irmaServer.StartSession(request, nil)
+	require.NoError(t, err)
+}
+
+func TestRequestorServerName(t *testing.T) {
+	StartIrmaServer(t, false)
+	defer StopIrmaServer()
+	irmaServerConfiguration.ServerName = irma.TranslatedString{"en": "Example server", "nl": "Voorbeeldserver"}
+
+	id := irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID")
+	_, token, err := irmaServer.StartSession(getDisclosureRequest(id), nil)
+	require.NoError(t, err)
+	require.Equal(t, irmaServerConfiguration.ServerName, irmaServer.GetRequest(token).SessionRequest().Base().RequestorName)
+
+	// A name specified by the requestor takes precedence
+	request := getDisclosureRequest(id)
+	request.RequestorName = irma.TranslatedString{"en": "Requestor"}
+	_, token, err = irmaServer.StartSession(request, nil)
+	require.NoError(t, err)
+	require.Equal(t, request.RequestorName, irmaServer.GetRequest(token).SessionRequest().Base().RequestorName)
+}
+
+func TestRequestorExpiredKeys(t *testing.T) {
+	StartIrmaServer(t, false)
+	defer StopIrmaServer()
+	irmaServerConfiguration.AllowExpiredKeys = false
+
+	// Public key 1 of irma-demo.RU has expired, key 2 has not
+	request := getIssuanceRequest(true)
+	request.Credentials[0].KeyCounter = 1
+	_, _, err := irmaServer.StartSession(request, nil)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "public key irma-demo.RU-1 expired")
+
+	irmaServerConfiguration.AllowExpiredKeys = true
+	_, _, err = irmaServer.StartSession(request, nil)
+	require.NoError(t, err)
+
+	// Without a requested key counter the latest key is used, which is refused if it has expired
+	irmaServerConfiguration.AllowExpiredKeys = false
+	request = getIssuanceRequest(true)
+	_, _, err = irmaServer.StartSession(request, nil)
+	require.NoError(t, err)
+	require.Equal(t, uint(2), request.Credentials[0].KeyCounter)
+
+	_, _, err = irmaServer.StartSession(getNameIssuanceRequest(), nil)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "public key irma-demo.MijnOverheid-2 expired")
+}
+
+func TestRequestorProgressStatuses(t *testing.T) {
+	StartIrmaServer(t, false)
+	defer StopIrmaServer()
+	client, handler := parseStorage(t)
+	defer test.ClearTestStorage(t, handler.storage)
+	irmaServerConfiguration.ProgressStatuses = true
+
+	// Record the status of the session while the issuance commitments are being verified
+	var token string
+	var status server.Status
+	irmaServerConfiguration.IssuanceValidity = func(*irma.CredentialRequest, [][]*irma.DisclosedAttribute) (*irma.Timestamp, error) {
+		status = irmaServer.GetSessionResult(token).Status
+		return nil, nil
+	}
+
+	qr, token, err := irmaServer.StartSession(getIssuanceRequest(true), nil)
+	require.NoError(t, err)
+	clientChan := make(chan *SessionResult, 1)
+	j, err := json.Marshal(qr)
+	require.NoError(t, err)
+	client.NewSession(string(j), &TestHandler{t, clientChan, client, nil, 0, ""})
+	if clientResult := <-clientChan; clientResult != nil {
+		require.NoError(t, clientResult.Err)
+	}
+
+	require.Equal(t, server.StatusVerifying, status)
+	require.Equal(t, server.StatusConnected, status.Coarse())
+	require.Equal(t, server.StatusDone, irmaServer.GetSessionResult(token).Status)
+
+	// While the proofs of another session wait for the only verification worker, that session
+	// has status RECEIVED_PROOF, while apps see CONNECTED. Retries of the proofs meanwhile
+	// receive the response to the original proofs instead of being refused.
+	var clientStatus server.Status
+	responses := make(chan string, 2)
+	StopIrmaServer()
+	irmaServerConfiguration.VerificationWorkers = 1
+	serveIrmaServer(t)
+	id := irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID")
+	irmaServerConfiguration.IssuanceValidity = func(*irma.CredentialRequest, [][]*irma.DisclosedAttribute) (*irma.Timestamp, error) {
+		qr, other, err := irmaServer.StartSession(getDisclosureRequest(id), nil)
+		if err != nil {
+			return nil, err
+		}
+		req, err := http.NewRequest(http.MethodGet, qr.URL, nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set(irma.MinVersionHeader, "2.5")
+		req.Header.Set(irma.MaxVersionHeader, "2.6")
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		_ = res.Body.Close()
+		post := func() {
+			res, err := http.Post(qr.URL+"/proofs", "application/json", strings.NewReader("{}"))
+			if err != nil {
+				responses <- err.Error()
+				return
+			}
+			bts, _ := ioutil.ReadAll(res.Body)
+			_ = res.Body.Close()
+			responses <- string(bts)
+		}
+		go post()
+		for i := 0; i < 100 && irmaServer.GetSessionResult(other).Status != server.StatusReceivedProof; i++ {
+			time.Sleep(20 * time.Millisecond)
+		}
+		status = irmaServer.GetSessionResult(other).Status
+		if res, err := http.Get(qr.URL + "/status"); err == nil {
+			_ = json.NewDecoder(res.Body).Decode(&clientStatus)
+			_ = res.Body.Close()
+		}
+		go post()
+		time.Sleep(100 * time.Millisecond)
+		return nil, nil
+	}
+
+	qr, _, err = irmaServer.StartSession(getIssuanceRequest(true), nil)
+	require.NoError(t, err)
+	j, err = json.Marshal(qr)
+	require.NoError(t, err)
+	client.NewSession(string(j), &TestHandler{t, clientChan, client, nil, 0, ""})
+	if clientResult := <-clientChan; clientResult != nil {
+		require.NoError(t, clientResult.Err)
+	}
+	require.Equal(t, server.StatusReceivedProof, status)
+	require.Equal(t, server.StatusConnected, clientStatus)
+	response := <-responses
+	require.NotContains(t, response, string(server.ErrorUnexpectedRequest.Type))
+	require.Equal(t, response, <-responses)
+}
+
+func TestRequestorOnSessionCreated(t *testing.T) {
+	StartIrmaServer(t, false)
+	defer StopIrmaServer()
+
+	var created string
+	irmaServerConfiguration.OnSessionCreated = func(token string, req irma.RequestorRequest) {
+		created = token
+		req.SessionRequest().Base().ClientReturnURL = "https://example.com/" + token
+	}
+
+	id := irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID")
+	_, token, err := irmaServer.StartSession(getDisclosureRequest(id), nil)
+	require.NoError(t, err)
+	require.Equal(t, token, created)
+	require.Equal(t, "https://example.com/"+token, irmaServer.GetRequest(token).SessionRequest().Base().ClientReturnURL)
+
+	// Requests that the hook makes invalid are refused
+	irmaServerConfiguration.MaxDisjunctions = 1
+	irmaServerConfiguration.OnSessionCreated = func(token string, req irma.RequestorRequest) {
+		disclosure := req.SessionRequest().Disclosure()
+		disclosure.Disclose = append(disclosure.Disclose, disclosure.Disclose[0])
+	}
+	_, _, err = irmaServer.StartSession(getDisclosureRequest(id), nil)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "OnSessionCreated")
+}
+
+func TestRequestorStrictDisjunctions(t *testing.T) {
+	StartIrmaServer(t, false)
+	defer StopIrmaServer()
+	irmaServerConfiguration.StrictDisjunctions = true
+
+	request := irma.NewDisclosureRequest()
+	request.Disclose = irma.AttributeConDisCon{
+		irma.AttributeDisCon{
+			irma.AttributeCon{irma.NewAttributeRequest(revocationTestAttr.String())},
+			irma.AttributeCon{irma.NewAttributeRequest("irma-demo.RU.studentCard.studentID")},
+		},
+	}
+	_, _, err := irmaServer.StartSession(request, nil)
+	require.NoError(t, err)
+
+	// Only the first option requires a nonrevocation proof
+	request.Revocation = irma.NonRevocationParameters{revocationTestCred: {}}
+	_, _, err = irmaServer.StartSession(request, nil)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "disjunction 0 of request mixes options requiring nonrevocation proofs")
+}
+
+func TestRequestorInMemoryScheme(t *testing.T) {
+	StartIrmaServer(t, false)
+	defer StopIrmaServer()
+	client, handler := parseStorage(t)
+	defer test.ClearTestStorage(t, handler.storage)
+
+	credid := irma.NewCredentialTypeIdentifier("mem.issuer.credential")
+	require.NoError(t, irmaServerConfiguration.AddInMemoryScheme(server.InMemoryScheme{
+		CredentialType: credid,
+		Attributes:     []string{"name"},
+	}))
+
+	// Make the scheme known to the client as well
+	irmaconf := irmaServerConfiguration.IrmaConfiguration
+	issid := credid.IssuerIdentifier()
+	pk, err := irmaconf.PublicKey(issid, 0)
+	require.NoError(t, err)
+	client.Configuration.AddCredentialType(
+		irmaconf.SchemeManagers[issid.SchemeManagerIdentifier()], irmaconf.Issuers[issid], irmaconf.CredentialTypes[credid],
+	)
+	client.Configuration.AddPublicKey(issid, pk)
+	clientpk, err := client.Configuration.PublicKey(issid, 0)
+	require.NoError(t, err)
+	require.True(t, clientpk != pk) // the key of the server is left alone
+	require.Equal(t, issid.String(), clientpk.Issuer)
+
+	issuance := irma.NewIssuanceRequest([]*irma.CredentialRequest{{
+		CredentialTypeID: credid,
+		Attributes:       map[string]string{"name": "Alice"},
+	}})
+	result := requestorSessionHelper(t, issuance, client, sessionOptionReuseServer)
+	require.Nil(t, result.Err)
+
+	attr := irma.NewAttributeTypeIdentifier("mem.issuer.credential.name")
+	result = requestorSessionHelper(t, getDisclosureRequest(attr), client, sessionOptionReuseServer)
+	require.Equal(t, irma.ProofStatusValid, result.ProofStatus)
+	require.Equal(t, "Alice", *result.Disclosed[0][0].RawValue)
+
+	// Schemes cannot be added twice
+	require.Error(t, irmaServerConfiguration.AddInMemoryScheme(server.InMemoryScheme{
+		CredentialType: credid,
+		Attributes:     []string{"name"},
+	}))
+}
+
+func TestRequestorResultEncryption(t *testing.T) {
+	StartIrmaServer(t, false)
+	defer StopIrmaServer()
+	store := &memoryResultStore{results: map[string]*server.SessionResult{}}
+	irmaServerConfiguration.ResultStore = store
+	irmaServerConfiguration.ResultEncryptionKey = base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{42}, 32))
+
+	id := irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID")
+	result := requestorSessionHelper(t, getDisclosureRequest(id), nil, sessionOptionReuseServer)
+	require.Equal(t, server.StatusDone, result.Status)
+
+	// The stored result does not contain the disclosed attributes in plaintext
+	published, err := store.Get(result.Token)
+	require.NoError(t, err)
+	require.Equal(t, server.StatusDone, published.Status)
+	require.Nil(t, published.Disclosed)
+	require.NotEmpty(t, published.Encrypted)
+
+	// Another instance, which does not know the session, decrypts the result from the store
+	StopIrmaServer()
+	StartIrmaServer(t, false)
+	irmaServerConfiguration.ResultStore = store
+	irmaServerConfiguration.ResultEncryptionKey = base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{42}, 32))
+	retrieved := irmaServer.GetSessionResult(result.Token)
+	require.NotNil(t, retrieved)
+	require.Nil(t, retrieved.Encrypted)
+	require.Len(t, retrieved.Disclosed, 1)
+	require.Equal(t, result.Disclosed[0][0].RawValue, retrieved.Disclosed[0][0].RawValue)
+
+	// The encrypted attributes are bound to the session token
+	tampered := *published
+	tampered.Token = "foo"
+	require.NoError(t, store.Put(&tampered))
+	require.Nil(t, irmaServer.GetSessionResult("foo"))
+
+	// and so are its type and statuses
+	tampered = *published
+	tampered.ProofStatus = irma.ProofStatusExpired
+	require.NoError(t, store.Put(&tampered))
+	require.Nil(t, irmaServer.GetSessionResult(result.Token))
+}
+
+func TestRequestorNounAliases(t *testing.T) {
+	StartIrmaServer(t, false)
+	defer StopIrmaServer()
+	irmaServerConfiguration.NounAliases = map[string]string{"state": "status"}
+
+	id := irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID")
+	qr, _, err := irmaServer.StartSession(getDisclosureRequest(id), nil)
+	require.NoError(t, err)
+
+	for noun, status := range map[string]int{
+		"status": http.StatusOK,
+		"STATUS": http.StatusOK,
+		"State":  http.StatusOK,
+		"bogus":  http.StatusNotFound,
+	} {
+		res, err := http.Get(qr.URL + "/" + noun)
+		require.NoError(t, err)
+		require.NoError(t, res.Body.Close())
+		require.Equal(t, status, res.StatusCode, noun)
+	}
+}
+
+func TestRequestorCredentialValidityRange(t *testing.T) {
+	StartIrmaServer(t, false)
+	defer StopIrmaServer()
+	irmaServerConfiguration.MinCredentialValidity = 7 * 24 * 60 * 60
+	irmaServerConfiguration.MaxCredentialValidity = 365 * 24 * 60 * 60
+
+	tooShort := irma.Timestamp(time.Now().Add(time.Hour))
+	tooLong := irma.Timestamp(time.Now().AddDate(2, 0, 0))
+	for _, validity := range []*irma.Timestamp{&tooShort, &tooLong} {
+		request := getIssuanceRequest(true)
+		request.Credentials[0].Validity = validity
+		_, _, err := irmaServer.StartSession(request, nil)
+		require.Error(t, err)
+	}
+
+	// The default validity of 6 months lies within the range
+	request := getIssuanceRequest(true)
+	_, _, err := irmaServer.StartSession(request, nil)
+	require.NoError(t, err)
+
+	// Clamped validities apply to the expiry date of the issued credential, which is rounded to weeks
+	irmaServerConfiguration.ClampCredentialValidity = true
+	client, handler := parseStorage(t)
+	defer test.ClearTestStorage(t, handler.storage)
+	issuedExpiry := func(validity *irma.Timestamp, studentID string) time.Time {
+		request := getIssuanceRequest(true)
+		request.Credentials[0].Validity = validity
+		request.Credentials[0].Attributes["studentID"] = studentID
+		result := requestorSessionHelper(t, request, client, sessionOptionReuseServer)
+		require.Nil(t, result.Err)
+		id := irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID")
+		for i := 0; client.Attributes(id.CredentialTypeIdentifier(), i) != nil; i++ {
+			attrs := client.Attributes(id.CredentialTypeIdentifier(), i)
+			if value := attrs.UntranslatedAttribute(id); value != nil && *value == studentID {
+				return attrs.Expiry()
+			}
+		}
+		require.Fail(t, "issued credential not found")
+		return time.Time{}
+	}
+
+	before := time.Now()
+	expiry := issuedExpiry(&tooShort, "short")
+	require.False(t, expiry.Before(before.Add(7*24*time.Hour)))
+
+	expiry = issuedExpiry(&tooLong, "long")
+	require.False(t, expiry.After(time.Now().Add(365*24*time.Hour)))
+}
+
+func TestRequestorPairing(t *testing.T) {
+	StartIrmaServer(t, false)
+	defer StopIrmaServer()
+	client, handler := parseStorage(t)
+	defer test.ClearTestStorage(t, handler.storage)
+
+	id := irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID")
+	request := &irma.ServiceProviderRequest{
+		RequestorBaseRequest: irma.RequestorBaseRequest{Pairing: true},
+		Request:              getDisclosureRequest(id),
+	}
+
+	// The pairing code is available to the requestor, but not sent to the client
+	qr, token, err := irmaServer.StartSession(request, nil)
+	require.NoError(t, err)
+	code := irmaServer.GetPairingCode(token)
+	require.Len(t, code, 4)
+	req, err := http.NewRequest(http.MethodGet, qr.URL, nil)
+	require.NoError(t, err)
+	req.Header.Set(irma.MinVersionHeader, "2.5")
+	req.Header.Set(irma.MaxVersionHeader, "2.6")
+	res, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	bts, err := ioutil.ReadAll(res.Body)
+	require.NoError(t, err)
+	require.NoError(t, res.Body.Close())
+	require.Contains(t, string(bts), `"pairingRequired":true`)
+	require.NotContains(t, string(bts), code)
+	require.Equal(t, server.StatusPairing, irmaServer.GetSessionResult(token).Status)
+
+	// The client may retry after entering an incorrect code
+	qr, token, err = irmaServer.StartSession(request, nil)
+	require.NoError(t, err)
+	code = irmaServer.GetPairingCode(token)
+	clientChan := make(chan *SessionResult, 1)
+	j, err := json.Marshal(qr)
+	require.NoError(t, err)
+	h := &PairingTestHandler{TestHandler: TestHandler{t, clientChan, client, nil, 0, ""}, codes: []string{"wrong", code}}
+	client.NewSession(string(j), h)
+	if clientResult := <-clientChan; clientResult != nil {
+		require.NoError(t, clientResult.Err)
+	}
+	require.Equal(t, 2, h.attempts)
+	require.Equal(t, server.StatusDone, irmaServer.GetSessionResult(token).Status)
+
+	// After too many incorrect codes the session fails
+	qr, token, err = irmaServer.StartSession(request, nil)
+	require.NoError(t, err)
+	j, err = json.Marshal(qr)
+	require.NoError(t, err)
+	h = &PairingTestHandler{TestHandler: TestHandler{t, clientChan, client, nil, 0, ""}, codes: []string{"a", "b", "c"}}
+	client.NewSession(string(j), h)
+	clientResult := <-clientChan
+	require.NotNil(t, clientResult)
+	require.Error(t, clientResult.Err)
+	serr, ok := clientResult.Err.(*irma.SessionError)
+	require.True(t, ok)
+	require.Equal(t, "PAIRING_FAILED", serr.RemoteError.ErrorName)
+	require.Equal(t, server.StatusCancelled, irmaServer.GetSessionResult(token).Status)
+}
+
+func TestRequestorClientIPHeader(t *testing.T) {
+	StartIrmaServer(t, false)
+	defer StopIrmaServer()
+	irmaServerConfiguration.RecordClientInfo = true
+	irmaServerConfiguration.ClientIPHeader = "X-Forwarded-For"
+
+	id := irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID")
+	clientIP := func(header ...string) string {
+		qr, token, err := irmaServer.StartSession(getDisclosureRequest(id), nil)
+		require.NoError(t, err)
+		req, err := http.NewRequest(http.MethodGet, qr.URL, nil)
+		require.NoError(t, err)
+		req.Header.Set(irma.MinVersionHeader, "2.5")
+		req.Header.Set(irma.MaxVersionHeader, "2.6")
+		for _, h := range header {
+			req.Header.Add("X-Forwarded-For", h)
+		}
+		res, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		require.NoError(t, res.Body.Close())
+		require.Equal(t, http.StatusOK, res.StatusCode)
+		return irmaServer.GetClientInfo(token).IP
+	}
+
+	require.Contains(t, []string{"127.0.0.1", "::1"}, clientIP())
+	require.Equal(t, "1.2.3.4", clientIP("1.2.3.4"))
+
+	// Entries left of the one appended by the trusted proxy are spoofed by the client
+	require.Equal(t, "1.2.3.4", clientIP("6.6.6.6, 1.2.3.4"))
+	require.Equal(t, "1.2.3.4", clientIP("6.6.6.6", "1.2.3.4"))
+
+	irmaServerConfiguration.ClientIPHeaderProxies = 2
+	require.Equal(t, "1.2.3.4", clientIP("6.6.6.6, 1.2.3.4, 10.0.0.1"))
+	require.Equal(t, "1.2.3.4", clientIP("1.2.3.4, 10.0.0.1"))
+}
+
+func TestRequestorClientAttributes(t *testing.T) {
+	StartIrmaServer(t, false)
+	defer StopIrmaServer()
+	client, handler := parseStorage(t)
+	defer test.ClearTestStorage(t, handler.storage)
+
+	request := getIssuanceRequest(true)
+	delete(request.Credentials[0].Attributes, "studentID")
+	request.Credentials[0].ClientAttributes = map[string]string{"studentID": "s[0-9]{7}"}
+
+	issue := func(values []map[string]string) (string, *SessionResult) {
+		qr, token, err := irmaServer.StartSession(request, nil)
+		require.NoError(t, err)
+		j, err := json.Marshal(qr)
+		require.NoError(t, err)
+		clientChan := make(chan *SessionResult, 1)
+		h := &ClientAttributesTestHandler{TestHandler: TestHandler{t, clientChan, client, nil, 0, ""}, values: values}
+		client.NewSession(string(j), h)
+		return token, <-clientChan
+	}
+
+	// The value chosen by the client is issued and included in the session result
+	values := []map[string]string{{"studentID": "s7654321"}}
+	token, clientResult := issue(values)
+	if clientResult != nil {
+		require.NoError(t, clientResult.Err)
+	}
+	result := irmaServer.GetSessionResult(token)
+	require.Equal(t, server.StatusDone, result.Status)
+	require.Equal(t, values, result.ClientAttributes)
+
+	id := irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID")
+	found := false
+	for i := 0; client.Attributes(id.CredentialTypeIdentifier(), i) != nil; i++ {
+		if value := client.Attributes(id.CredentialTypeIdentifier(), i).UntranslatedAttribute(id); value != nil && *value == "s7654321" {
+			found = true
+		}
+	}
+	require.True(t, found)
+
+	// Values not matching the format are refused by the client
+	_, clientResult = issue([]map[string]string{{"studentID": "abc"}})
+	require.NotNil(t, clientResult)
+	require.Error(t, clientResult.Err)
+}
+
+func TestRequestorVerificationWorkers(t *testing.T) {
+	StartIrmaServer(t, false)
+	StopIrmaServer()
+	irmaServerConfiguration.VerificationWorkers = 1
+	serveIrmaServer(t)
+	defer StopIrmaServer()
+	client, handler := parseStorage(t)
+	defer test.ClearTestStorage(t, handler.storage)
+
+	id := irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID")
+	qr, _, err := irmaServer.StartSession(getDisclosureRequest(id), nil)
+	require.NoError(t, err)
+	req, err := http.NewRequest(http.MethodGet, qr.URL, nil)
+	require.NoError(t, err)
+	req.Header.Set(irma.MinVersionHeader, "2.5")
+	req.Header.Set(irma.MaxVersionHeader, "2.6")
+	res, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	require.NoError(t, res.Body.Close())
+
+	// While the commitments of an issuance session are verified, the proofs of the other session
+	// wait for the only worker, meanwhile not keeping its status from being polled
+	done := make(chan struct{})
+	waited := false
+	var polled server.Status
+	irmaServerConfiguration.IssuanceValidity = func(*irma.CredentialRequest, [][]*irma.DisclosedAttribute) (*irma.Timestamp, error) {
+		go func() {
+			if res, err := http.Post(qr.URL+"/proofs", "application/json", strings.NewReader("{}")); err == nil {
+				_ = res.Body.Close()
+			}
+			close(done)
+		}()
+		time.Sleep(100 * time.Millisecond)
+		if res, err := (&http.Client{Timeout: time.Second}).Get(qr.URL + "/status"); err == nil {
+			_ = json.NewDecoder(res.Body).Decode(&polled)
+			_ = res.Body.Close()
+		}
+		select {
+		case <-done:
+		case <-time.After(500 * time.Millisecond):
+			waited = true
+		}
+		return nil, nil
+	}
+	result := requestorSessionHelper(t, getIssuanceRequest(true), client, sessionOptionReuseServer)
+	require.Nil(t, result.Err)
+	require.True(t, waited)
+	require.Equal(t, server.StatusConnected, polled)
+	<-done
+
+	// The workers are released after use
+	irmaServerConfiguration.IssuanceValidity = nil
+	result = requestorSessionHelper(t, getDisclosureRequest(id), client, sessionOptionReuseServer)
+	require.Equal(t, server.StatusDone, result.Status)
+}
+
+func TestRequestorPrivateKeysPathStrayFiles(t *testing.T) {
+	StartIrmaServer(t, false)
+	StopIrmaServer()
+
+	dir := test.CreateTestStorage(t)
+	defer test.ClearTestStorage(t, dir)
+	sk, err := ioutil.ReadFile(filepath.Join(test.FindTestdataFolder(t), "irma_configuration", "irma-demo", "RU", "PrivateKeys", "2.xml"))
+	require.NoError(t, err)
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "irma-demo.RU.2.xml"), sk, 0600))
+
+	// None of these are private keys, so they are skipped instead of failing startup
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "README"), []byte("keys"), 0600))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, ".DS_Store"), nil, 0600))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "irma-demo.RU.backup.xml"), sk, 0600))
+	require.NoError(t, os.Mkdir(filepath.Join(dir, "irma-demo.RU.xml"), 0700))
+
+	irmaServerConfiguration.IssuerPrivateKeysPath = dir
+	serveIrmaServer(t)
+	defer StopIrmaServer()
+
+	keys := irmaServerConfiguration.IssuerPrivateKeys
+	require.Len(t, keys, 1)
+	require.Len(t, keys[irma.NewIssuerIdentifier("irma-demo.RU")], 1)
+	require.NotNil(t, keys[irma.NewIssuerIdentifier("irma-demo.RU")][2])
+
+	result := requestorSessionHelper(t, getIssuanceRequest(true), nil, sessionOptionReuseServer)
+	require.Equal(t, server.StatusDone, result.Status)
+}
+
+func TestRequestorRequestTemplates(t *testing.T) {
+	StartIrmaServer(t, false)
+	StopIrmaServer()
+
+	id := irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID")
+	template := getDisclosureRequest(id)
+	placeholder := "{{studentID}}"
+	template.Disclose[0][0][0].Value = &placeholder
+	template.Labels = map[int]irma.TranslatedString{0: {"en": "Student {{studentID}} of {{university}}"}}
+	irmaServerConfiguration.RequestTemplates = map[string]interface{}{"student": template}
+	serveIrmaServer(t)
+	defer StopIrmaServer()
+
+	_, token, err := irmaServer.StartSessionFromTemplate("student",
+		map[string]string{"studentID": "456", "university": "Radboud"}, nil)
+	require.NoError(t, err)
+	request := irmaServer.GetRequest(token).SessionRequest().Disclosure()
+	require.Equal(t, "456", *request.Disclose[0][0][0].Value)
+	require.Equal(t, "Student 456 of Radboud", request.Labels[0]["en"])
+
+	// The template itself is not modified
+	_, token, err = irmaServer.StartSessionFromTemplate("student",
+		map[string]string{"studentID": "123", "university": "Radboud"}, nil)
+	require.NoError(t, err)
+	require.Equal(t, "123", *irmaServer.GetRequest(token).SessionRequest().Disclosure().Disclose[0][0][0].Value)
+
+	_, _, err = irmaServer.StartSessionFromTemplate("student", map[string]string{"studentID": "456"}, nil)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "{{university}}")
+
+	_, _, err = irmaServer.StartSessionFromTemplate("teacher", nil, nil)
+	require.Error(t, err)
+}
+
+func TestRequestorReplayFinishedSessions(t *testing.T) {
+	StartIrmaServer(t, false)
+	client, handler := parseStorage(t)
+	defer test.ClearTestStorage(t, handler.storage)
+
+	id := irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID")
+	serverChan := make(chan *server.SessionResult, 1)
+	qr, _, err := irmaServer.StartSession(getDisclosureRequest(id), func(result *server.SessionResult) {
+		serverChan <- result
+	})
+	require.NoError(t, err)
+	clientChan := make(chan *SessionResult, 1)
+	j, err := json.Marshal(qr)
+	require.NoError(t, err)
+	client.NewSession(string(j), &TestHandler{t, clientChan, client, nil, 0, ""})
+	if clientResult := <-clientChan; clientResult != nil {
+		require.NoError(t, clientResult.Err)
+	}
+	require.Equal(t, server.StatusDone, (<-serverChan).Status)
+
+	// Move the end of the session beyond the period in which retries are always answered
+	bts, err := irmaServer.ExportSessions()
+	require.NoError(t, err)
+	var export map[string]interface{}
+	require.NoError(t, json.Unmarshal(bts, &export))
+	exported := export["sessions"].([]interface{})[0].(map[string]interface{})
+	exported["finishedAt"] = time.Now().Add(-time.Minute)
+	bts, err = json.Marshal(export)
+	require.NoError(t, err)
+	StopIrmaServer()
+	StartIrmaServer(t, false)
+	defer StopIrmaServer()
+	require.NoError(t, irmaServer.ImportSessions(bts))
+
+	postProofs := func(url string) (int, string) {
+		res, err := http.Post(url+"/proofs", "application/json", strings.NewReader("{}"))
+		require.NoError(t, err)
+		body, err := ioutil.ReadAll(res.Body)
+		require.NoError(t, err)
+		require.NoError(t, res.Body.Close())
+		return res.StatusCode, string(body)
+	}
+
+	status, body := postProofs(qr.URL)
+	require.NotEqual(t, http.StatusOK, status)
+	require.Contains(t, body, string(server.ErrorUnexpectedRequest.Type))
+
+	irmaServerConfiguration.ReplayFinishedSessions = true
+	status, body = postProofs(qr.URL)
+	require.Equal(t, http.StatusOK, status)
+	require.Equal(t, `"VALID"`, body)
+
+	// Only the proof status of successfully finished sessions is replayed
+	qr, token, err := irmaServer.StartSession(getDisclosureRequest(id), nil)
+	require.NoError(t, err)
+	require.NoError(t, irmaServer.CancelSession(token))
+	status, _ = postProofs(qr.URL)
+	require.NotEqual(t, http.StatusOK, status)
+}
+
+func TestRequestorIssuanceValidity(t *testing.T) {
+	StartIrmaServer(t, false)
+	defer StopIrmaServer()
+	client, handler := parseStorage(t)
+	defer test.ClearTestStorage(t, handler.storage)
+
+	var validity irma.Timestamp
+	irmaServerConfiguration.IssuanceValidity = func(cred *irma.CredentialRequest, _ [][]*irma.DisclosedAttribute) (*irma.Timestamp, error) {
+		return &validity, nil
+	}
+
+	// The request asks for a validity of one year
+	validity = irma.Timestamp(time.Now().AddDate(0, 1, 0))
+	qr, token, err := irmaServer.StartSession(getIssuanceRequest(false), nil)
+	require.NoError(t, err)
+	clientChan := make(chan *SessionResult, 1)
+	j, err := json.Marshal(qr)
+	require.NoError(t, err)
+	client.NewSession(string(j), &TestHandler{t, clientChan, client, nil, 0, ""})
+	clientResult := <-clientChan
+	require.NotNil(t, clientResult)
+	require.Error(t, clientResult.Err)
+	serr, ok := clientResult.Err.(*irma.SessionError)
+	require.True(t, ok)
+	require.NotNil(t, serr.RemoteError)
+	require.Equal(t, string(server.ErrorIssuanceFailed.Type), serr.RemoteError.ErrorName)
+	require.Contains(t, serr.RemoteError.Message, "exceeds validity")
+	require.Equal(t, server.StatusCancelled, irmaServer.GetSessionResult(token).Status)
+
+	validity = irma.Timestamp(time.Now().AddDate(2, 0, 0))
+	result := requestorSessionHelper(t, getIssuanceRequest(false), client, sessionOptionReuseServer)
+	require.Equal(t, server.StatusDone, result.Status)
+}
+
+func TestRequestorStatusPolling(t *testing.T) {
+	StartIrmaServer(t, false)
+	defer StopIrmaServer()
+	irmaServerConfiguration.StatusPollingHint = true
+	irmaServerConfiguration.StatusGoneAfter = 1
+
+	id := irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID")
+	qr, token, err := irmaServer.StartSession(getDisclosureRequest(id), nil)
+	require.NoError(t, err)
+
+	res, err := http.Get(qr.URL + "/status")
+	require.NoError(t, err)
+	require.NoError(t, res.Body.Close())
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	require.Empty(t, res.Header.Get("X-IRMA-Polling-Done"))
+
+	require.NoError(t, irmaServer.CancelSession(token))
+	res, err = http.Get(qr.URL + "/status")
+	require.NoError(t, err)
+	require.NoError(t, res.Body.Close())
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	require.Equal(t, "true", res.Header.Get("X-IRMA-Polling-Done"))
+
+	time.Sleep(1500 * time.Millisecond)
+	res, err = http.Get(qr.URL + "/status")
+	require.NoError(t, err)
+	body, err := ioutil.ReadAll(res.Body)
+	require.NoError(t, err)
+	require.NoError(t, res.Body.Close())
+	require.Equal(t, http.StatusGone, res.StatusCode)
+	require.Contains(t, string(body), string(server.ErrorSessionGone.Type))
+}
+
+func TestRequestorIssueWithRequestedKeyCounter(t *testing.T) {
+	StartIrmaServer(t, false)
+	defer StopIrmaServer()
+	client, handler := parseStorage(t)
+	defer test.ClearTestStorage(t, handler.storage)
+
+	request := getIssuanceRequest(true)
+	credid := request.Credentials[0].CredentialTypeID
+	countWithKey := func(counter uint) int {
+		count := 0
+		for i := 0; client.Attributes(credid, i) != nil; i++ {
+			if client.Attributes(credid, i).MetadataAttribute.KeyCounter() == counter {
+				count++
+			}
+		}
+		return count
+	}
+	before := countWithKey(1)
+
+	// The credential must be signed with the private key belonging to the requested public key,
+	// instead of with the latest private key
+	request.Credentials[0].KeyCounter = 1
+	result := requestorSessionHelper(t, request, client, sessionOptionReuseServer)
+	require.Equal(t, server.StatusDone, result.Status)
+	require.Equal(t, before+1, countWithKey(1))
+}
+
+func TestRequestorFinishedSessionRetention(t *testing.T) {
+	StartIrmaServer(t, false)
+	StopIrmaServer()
+	irmaServerConfiguration.ExpiryCheckInterval = 1
+	irmaServerConfiguration.FinishedSessionRetention = 3
+	serveIrmaServer(t)
+	defer StopIrmaServer()
+
+	id := irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID")
+	_, token, err := irmaServer.StartSession(getDisclosureRequest(id), nil)
+	require.NoError(t, err)
+	require.NoError(t, irmaServer.CancelSession(token))
+
+	// The result remains available during the retention period, and is deleted afterwards
+	time.Sleep(1500 * time.Millisecond)
+	require.NotNil(t, irmaServer.GetSessionResult(token))
+	deadline := time.Now().Add(5 * time.Second)
+	for irmaServer.GetSessionResult(token) != nil && time.Now().Before(deadline) {
+		time.Sleep(200 * time.Millisecond)
+	}
+	require.Nil(t, irmaServer.GetSessionResult(token))
+}
+
+func TestRequestorLogOutcome(t *testing.T) {
+	StartIrmaServer(t, false)
+	StopIrmaServer()
+	logger, hook := logtest.NewNullLogger()
+	irmaServerConfiguration.Logger = logger
+	serveIrmaServer(t)
+	defer StopIrmaServer()
+
+	id := irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID")
+	result := requestorSessionHelper(t, getDisclosureRequest(id), nil, sessionOptionReuseServer)
+	require.Equal(t, server.StatusDone, result.Status)
+
+	var outcome *logrus.Entry
+	deadline := time.Now().Add(time.Second)
+	for outcome == nil && time.Now().Before(deadline) {
+		for _, entry := range hook.AllEntries() {
+			if entry.Message == "Session finished" && entry.Data["session"] == result.Token {
+				outcome = entry
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	require.NotNil(t, outcome)
+	require.Equal(t, logrus.InfoLevel, outcome.Level)
+	require.Equal(t, irma.ActionDisclosing, outcome.Data["action"])
+	require.Equal(t, server.StatusDone, outcome.Data["status"])
+	require.Equal(t, 1, outcome.Data["attributes"])
+	require.Contains(t, outcome.Data, "duration")
+
+	// The summary does not contain attribute values
+	for field := range outcome.Data {
+		require.Contains(t, []string{"session", "action", "status", "attributes", "duration"}, field)
+	}
+}
+
+func TestRequestorMetrics(t *testing.T) {
+	var mutex sync.Mutex
+	var reported []string
+	metrics := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		mutex.Lock()
+		reported = append(reported, r.Method+" "+r.URL.Path+" "+string(body))
+		mutex.Unlock()
+		_, _ = w.Write([]byte(`""`))
+	}))
+	defer metrics.Close()
+
+	// Without EnableMetrics nothing is reported, even if an email address is configured
+	StartIrmaServer(t, false)
+	StopIrmaServer()
+	irmaServerConfiguration.Email = "admin@example.com"
+	irmaServerConfiguration.MetricsURL = metrics.URL
+	serveIrmaServer(t)
+	StopIrmaServer()
+	mutex.Lock()
+	require.Empty(t, reported)
+	mutex.Unlock()
+
+	irmaServerConfiguration.EnableMetrics = true
+	serveIrmaServer(t)
+	defer StopIrmaServer()
+	mutex.Lock()
+	defer mutex.Unlock()
+	require.Equal(t, []string{`POST /email "admin@example.com"`}, reported)
+}
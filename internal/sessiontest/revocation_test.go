@@ -488,6 +488,39 @@ func TestRevocationAll(t *testing.T) {
 		}
 	})
 
+	t.Run("RevokeIssuedBetween", func(t *testing.T) {
+		startRevocationServer(t, true)
+		defer stopRevocationServer()
+		rev := revocationConfiguration.IrmaConfiguration.Revocation
+		sacc, err := rev.Accumulator(revocationTestCred, revocationPkCounter)
+		require.NoError(t, err)
+
+		insertIssuanceRecord(t, "1", rev, sacc.Accumulator)
+		from := time.Now()
+		insertIssuanceRecord(t, "2", rev, sacc.Accumulator)
+		insertIssuanceRecord(t, "3", rev, sacc.Accumulator)
+		to := time.Now()
+		insertIssuanceRecord(t, "4", rev, sacc.Accumulator)
+
+		// only the records issued within the window are revoked
+		count, err := revocationServer.RevokeIssuedBetween(revocationTestCred, from, to)
+		require.NoError(t, err)
+		require.Equal(t, 2, count)
+		for _, key := range []string{"2", "3"} {
+			_, err = rev.IssuanceRecords(revocationTestCred, key, time.Time{})
+			require.Equal(t, irma.ErrUnknownRevocationKey, err)
+		}
+		for _, key := range []string{"1", "4"} {
+			_, err = rev.IssuanceRecords(revocationTestCred, key, time.Time{})
+			require.NoError(t, err)
+		}
+
+		// already revoked credentials are not revoked again
+		count, err = revocationServer.RevokeIssuedBetween(revocationTestCred, from, to)
+		require.NoError(t, err)
+		require.Zero(t, count)
+	})
+
 	t.Run("RevocationTolerance", func(t *testing.T) {
 		client, handler := revocationSetup(t)
 		defer test.ClearTestStorage(t, handler.storage)
@@ -703,6 +736,7 @@ func revocationConf(_ *testing.T) *server.Configuration {
 		EnableSSE:            true,
 		DisableSchemesUpdate: true,
 		SchemesPath:          filepath.Join(testdata, "irma_configuration"),
+		AllowExpiredKeys:     true,
 		RevocationSettings: irma.RevocationSettings{
 			revocationTestCred:  {Authority: true},
 			revKeyshareTestCred: {Authority: true},
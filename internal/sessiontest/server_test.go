@@ -59,20 +59,29 @@ func StartIrmaServer(t *testing.T, updatedIrmaConf bool) {
 	if updatedIrmaConf {
 		irmaconf += "_updated"
 	}
+	startIrmaServer(t, filepath.Join(testdata, irmaconf))
+}
 
-	var err error
+func startIrmaServer(t *testing.T, schemesPath string) {
 	irmaServerConfiguration = &server.Configuration{
 		URL:                  "http://localhost:48680",
 		Logger:               logger,
 		DisableSchemesUpdate: true,
-		SchemesPath:          filepath.Join(testdata, irmaconf),
+		SchemesPath:          schemesPath,
+		// Some of the keys in testdata used for issuance have expired
+		AllowExpiredKeys: true,
 		RevocationSettings: irma.RevocationSettings{
 			revocationTestCred:  {RevocationServerURL: "http://localhost:48683", SSE: true},
 			revKeyshareTestCred: {RevocationServerURL: "http://localhost:48683"},
 		},
 	}
-	irmaServer, err = irmaserver.New(irmaServerConfiguration)
+	serveIrmaServer(t)
+}
 
+// serveIrmaServer starts an IRMA server using the current irmaServerConfiguration.
+func serveIrmaServer(t *testing.T) {
+	var err error
+	irmaServer, err = irmaserver.New(irmaServerConfiguration)
 	require.NoError(t, err)
 
 	mux := http.NewServeMux()
@@ -95,6 +104,7 @@ var IrmaServerConfiguration = &requestorserver.Configuration{
 		DisableSchemesUpdate:  true,
 		SchemesPath:           filepath.Join(testdata, "irma_configuration"),
 		IssuerPrivateKeysPath: filepath.Join(testdata, "privatekeys"),
+		AllowExpiredKeys:      true,
 		RevocationSettings: irma.RevocationSettings{
 			revocationTestCred:  {RevocationServerURL: "http://localhost:48683"},
 			revKeyshareTestCred: {RevocationServerURL: "http://localhost:48683"},
@@ -112,6 +122,7 @@ var JwtServerConfiguration = &requestorserver.Configuration{
 		DisableSchemesUpdate:  true,
 		SchemesPath:           filepath.Join(testdata, "irma_configuration"),
 		IssuerPrivateKeysPath: filepath.Join(testdata, "privatekeys"),
+		AllowExpiredKeys:      true,
 		RevocationSettings: irma.RevocationSettings{
 			revocationTestCred:  {RevocationServerURL: "http://localhost:48683"},
 			revKeyshareTestCred: {RevocationServerURL: "http://localhost:48683"},
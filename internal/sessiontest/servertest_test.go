@@ -0,0 +1,61 @@
+package sessiontest
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/privacybydesign/irmago"
+	"github.com/privacybydesign/irmago/internal/test"
+	"github.com/privacybydesign/irmago/server"
+	"github.com/privacybydesign/irmago/server/irmaserver/servertest"
+	"github.com/stretchr/testify/require"
+)
+
+func TestServertestDisclosureSession(t *testing.T) {
+	StartIrmaServer(t, false)
+	defer StopIrmaServer()
+
+	storage := test.SetupTestStorage(t)
+	defer test.ClearTestStorage(t, storage)
+	client, err := servertest.NewClient(filepath.Join(storage, "client"), filepath.Join(testdata, "irma_configuration"))
+	require.NoError(t, err)
+	defer func() { require.NoError(t, client.Close()) }()
+
+	id := irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID")
+	result, err := client.RunDisclosureSession(irmaServer, getDisclosureRequest(id))
+	require.NoError(t, err)
+	require.Equal(t, server.StatusDone, result.Status)
+	require.Equal(t, irma.ProofStatusValid, result.ProofStatus)
+	require.Equal(t, "456", result.Disclosed[0][0].Value["en"])
+
+	_, err = client.RunDisclosureSession(irmaServer, getSigningRequest(id))
+	require.Error(t, err)
+}
+
+func TestServertestAcceptedSchemes(t *testing.T) {
+	StartIrmaServer(t, false)
+	defer StopIrmaServer()
+
+	storage := test.SetupTestStorage(t)
+	defer test.ClearTestStorage(t, storage)
+	client, err := servertest.NewClient(filepath.Join(storage, "client"), filepath.Join(testdata, "irma_configuration"))
+	require.NoError(t, err)
+	defer func() { require.NoError(t, client.Close()) }()
+
+	id := irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID")
+	request := func(scheme string) *irma.ServiceProviderRequest {
+		return &irma.ServiceProviderRequest{
+			Request: getDisclosureRequest(id),
+			RequestorBaseRequest: irma.RequestorBaseRequest{
+				AcceptedSchemes: []irma.SchemeManagerIdentifier{irma.NewSchemeManagerIdentifier(scheme)},
+			},
+		}
+	}
+
+	result, err := client.RunDisclosureSession(irmaServer, request("irma-demo"))
+	require.NoError(t, err)
+	require.Equal(t, server.StatusDone, result.Status)
+
+	_, err = client.RunDisclosureSession(irmaServer, request("test"))
+	require.Error(t, err)
+}
@@ -6,6 +6,7 @@ import (
 	"path/filepath"
 	"strings"
 	"syscall"
+	"time"
 
 	"github.com/go-errors/errors"
 	"github.com/mitchellh/mapstructure"
@@ -89,6 +90,9 @@ func setFlags(cmd *cobra.Command, production bool) error {
 	flags.StringP("schemes-path", "s", schemespath, "path to irma_configuration")
 	flags.String("schemes-assets-path", "", "if specified, copy schemes from here into --schemes-path")
 	flags.Int("schemes-update", 60, "update IRMA schemes every x minutes (0 to disable)")
+	flags.Int("scheme-http-timeout", 0, "timeout in seconds of requests downloading schemes (0 means 3 seconds, retried twice)")
+	flags.StringSlice("scheme-mirrors", nil, "base URLs of mirrors from which to download schemes, tried in order before the scheme's own URL")
+	flags.String("scheme-pins", "", "maximum versions (timestamps) up to which schemes are updated, per scheme ID (in JSON)")
 	flags.StringP("privkeys", "k", "", "path to IRMA private keys")
 	flags.String("static-path", "", "Host files under this path as static files (leave empty to disable)")
 	flags.String("static-prefix", "/", "Host static files under this URL prefix")
@@ -96,6 +100,50 @@ func setFlags(cmd *cobra.Command, production bool) error {
 	flags.String("revocation-db-type", "", "database type for revocation database (supported: mysql, postgres)")
 	flags.String("revocation-db-str", "", "connection string for revocation database")
 	flags.Bool("sse", false, "Enable server sent for status updates (experimental)")
+	flags.Int("max-sse-connections", 0, "maximum number of concurrent server sent event connections (0 means unlimited)")
+	flags.Int("max-session-sse-connections", 0, "maximum number of concurrent server sent event connections per session (0 means unlimited)")
+	flags.Int("max-attribute-value-length", 0, "maximum length of disclosed attribute values (0 means unlimited)")
+	flags.Int("max-disjunctions", 100, "maximum number of disjunctions in disclosure and signature requests")
+	flags.Int("max-disjunction-options", 100, "maximum number of options per disjunction in disclosure and signature requests")
+	flags.Int("max-session-request-size", 1<<20, "maximum size in bytes of session requests (0 means unlimited)")
+	flags.Int("max-credentials-per-issuance", 50, "maximum number of credentials issued in a single issuance session")
+	flags.Int("min-credential-validity", 0, "minimum amount of seconds that issued credentials must remain valid (0 means no minimum)")
+	flags.Int("max-credential-validity", 0, "maximum amount of seconds that issued credentials may remain valid (0 means no maximum)")
+	flags.Bool("clamp-credential-validity", false, "adjust credential validities outside the allowed range instead of refusing the request")
+	flags.StringSlice("enabled-actions", nil, "session types that may be started: disclosing, signing and/or issuing (default all)")
+	flags.Int("nonce-cache-size", 0, "amount of session nonces to remember to detect proof replays (0 means disabled)")
+	flags.Int("nonce-cache-ttl", 600, "amount of seconds that session nonces are remembered to detect proof replays")
+	flags.Int("verification-workers", 0, "maximum number of proofs verified concurrently (0 means unlimited)")
+	flags.Int("load-shedding-max-sessions", 0, "ask apps to back off when more sessions than this are active (0 means unlimited)")
+	flags.Int("load-shedding-max-verifications", 0, "ask apps to back off when more proofs than this are being verified (0 means unlimited)")
+	flags.Int("load-shedding-retry-after", 5, "amount of seconds after which apps that were asked to back off should retry")
+	flags.Bool("replay-finished-sessions", false, "answer proofs posted to finished sessions with the stored proof status")
+	flags.Bool("progress-statuses", false, "report the RECEIVED_PROOF and VERIFYING statuses while processing the response of the IRMA app")
+	flags.Bool("allow-empty-disclosure", false, "allow disclosure and signature requests that do not request any attributes")
+	flags.Bool("strict-disjunctions", false, "refuse requests with disjunctions mixing options with and without nonrevocation or demo attributes")
+	flags.Bool("allow-partial-issuance", false, "issue the credentials that can be issued even if others fail")
+	flags.Bool("key-counter-fallback", false, "issue using the latest private key if the key counter requested in an issuance request is not available")
+	flags.Bool("allow-expired-keys", false, "issue using private keys whose public key has expired (not recommended)")
+	flags.Int("key-expiry-warning", 30, "warn at startup about issuer public keys expiring within this many days")
+	flags.Bool("record-client-info", false, "record and log IP address and user agent of clients")
+	flags.StringSlice("allowed-user-agents", nil, "regular expressions of which the user agent of IRMA apps must match one (default all)")
+	flags.StringSlice("trusted-issuers", nil, "schemes or issuers from whose credentials attributes are accepted in disclosures (default all)")
+	flags.String("client-ip-header", "", "header from a trusted reverse proxy containing the client IP address (e.g. X-Forwarded-For)")
+	flags.Int("client-ip-header-proxies", 1, "number of trusted reverse proxies appending to the client IP header")
+	flags.String("session-token-header", "", "header in which the IRMA app may pass the session token if absent from the URL path (e.g. X-IRMA-Session)")
+	flags.String("noun-aliases", "", "aliases of the path components following the session token in requests of the IRMA app (in JSON)")
+	flags.String("token-prefix", "", "prefix of session tokens, to distinguish tokens of servers in different environments")
+	flags.Int("expiry-check-interval", 10, "interval in seconds at which expired sessions are cleaned up")
+	flags.Int("finished-session-retention", 300, "amount of seconds that finished sessions are kept for their result to be retrieved")
+	flags.Int("confirmation-timeout", 60, "amount of seconds that issuance sessions wait for external confirmation, if required")
+	flags.Bool("allow-proof-retry", false, "leave sessions open for a retry when disclosure proofs fail verification")
+	flags.Int("max-proof-retries", 3, "maximum number of retries of disclosure proofs failing verification, if allowed")
+	flags.String("default-language", "", "language (e.g. en or nl) of attribute names and values in session results")
+	flags.Bool("status-polling-hint", false, "indicate to clients polling the status of finished sessions that they can stop")
+	flags.Bool("disable-compression", false, "disable compression of large responses to IRMA apps")
+	flags.Int("status-gone-after", 0, "answer status requests of sessions finished this many seconds ago with 410 Gone (0 to disable)")
+	flags.Bool("universal-links", false, "include a universal link to the session in responses to new session requests")
+	flags.String("server-name", "", "name of this server shown to users in the IRMA app, per language (in JSON)")
 
 	flags.IntP("port", "p", 8088, "port at which to listen")
 	flags.StringP("listen-addr", "l", "", "address at which to listen (default 0.0.0.0)")
@@ -133,10 +181,13 @@ func setFlags(cmd *cobra.Command, production bool) error {
 	flags.String("client-tls-privkey", "", "TLS private key for IRMA app server")
 	flags.String("client-tls-privkey-file", "", "path to TLS private key for IRMA app server")
 	flags.Bool("no-tls", false, "Disable TLS")
+	flags.Bool("require-https", false, "refuse to start if the url does not begin with https://")
 	flags.Lookup("tls-cert").Header = "TLS configuration (leave empty to disable TLS)"
 
 	flags.StringP("email", "e", "", "Email address of server admin, for incidental notifications such as breaking API changes")
 	flags.Bool("no-email", !production, "Opt out of prodiding an email address with --email")
+	flags.Bool("enable-metrics", false, "Report the email address of the server admin at startup")
+	flags.String("metrics-url", "", "URL of the endpoint to which the email address is reported (default https://metrics.privacybydesign.foundation/history)")
 	flags.Lookup("email").Header = "Email address (see README for more info)"
 
 	flags.CountP("verbose", "v", "verbose (repeatable)")
@@ -200,26 +251,75 @@ func configureServer(cmd *cobra.Command) error {
 	// Read configuration from flags and/or environmental variables
 	conf = &requestorserver.Configuration{
 		Configuration: &server.Configuration{
-			SchemesPath:           viper.GetString("schemes-path"),
-			SchemesAssetsPath:     viper.GetString("schemes-assets-path"),
-			SchemesUpdateInterval: viper.GetInt("schemes-update"),
-			DisableSchemesUpdate:  viper.GetInt("schemes-update") == 0,
-			IssuerPrivateKeysPath: viper.GetString("privkeys"),
-			RevocationDBType:      viper.GetString("revocation-db-type"),
-			RevocationDBConnStr:   viper.GetString("revocation-db-str"),
-			RevocationSettings:    irma.RevocationSettings{},
-			URL:                   viper.GetString("url"),
-			DisableTLS:            viper.GetBool("no-tls"),
-			Email:                 viper.GetString("email"),
-			EnableSSE:             viper.GetBool("sse"),
-			Verbose:               viper.GetInt("verbose"),
-			Quiet:                 viper.GetBool("quiet"),
-			LogJSON:               viper.GetBool("log-json"),
-			Logger:                logger,
-			Production:            viper.GetBool("production"),
-			JwtIssuer:             viper.GetString("jwt-issuer"),
-			JwtPrivateKey:         viper.GetString("jwt-privkey"),
-			JwtPrivateKeyFile:     viper.GetString("jwt-privkey-file"),
+			SchemesPath:              viper.GetString("schemes-path"),
+			SchemesAssetsPath:        viper.GetString("schemes-assets-path"),
+			SchemesUpdateInterval:    viper.GetInt("schemes-update"),
+			DisableSchemesUpdate:     viper.GetInt("schemes-update") == 0,
+			SchemeHTTPTimeout:        viper.GetInt("scheme-http-timeout"),
+			SchemeMirrors:            viper.GetStringSlice("scheme-mirrors"),
+			IssuerPrivateKeysPath:    viper.GetString("privkeys"),
+			RevocationDBType:         viper.GetString("revocation-db-type"),
+			RevocationDBConnStr:      viper.GetString("revocation-db-str"),
+			RevocationSettings:       irma.RevocationSettings{},
+			URL:                      viper.GetString("url"),
+			DisableTLS:               viper.GetBool("no-tls"),
+			RequireHTTPS:             viper.GetBool("require-https"),
+			Email:                    viper.GetString("email"),
+			EnableMetrics:            viper.GetBool("enable-metrics"),
+			MetricsURL:               viper.GetString("metrics-url"),
+			EnableSSE:                viper.GetBool("sse"),
+			MaxSSEConnections:        viper.GetInt("max-sse-connections"),
+			MaxSessionSSEConnections: viper.GetInt("max-session-sse-connections"),
+			MaxAttributeValueLength:  viper.GetInt("max-attribute-value-length"),
+			MaxDisjunctions:          viper.GetInt("max-disjunctions"),
+			MaxDisjunctionOptions:    viper.GetInt("max-disjunction-options"),
+			ReplayFinishedSessions:   viper.GetBool("replay-finished-sessions"),
+			ProgressStatuses:         viper.GetBool("progress-statuses"),
+			AllowEmptyDisclosure:     viper.GetBool("allow-empty-disclosure"),
+			StrictDisjunctions:       viper.GetBool("strict-disjunctions"),
+			AllowPartialIssuance:     viper.GetBool("allow-partial-issuance"),
+			KeyCounterFallback:       viper.GetBool("key-counter-fallback"),
+			AllowExpiredKeys:         viper.GetBool("allow-expired-keys"),
+			KeyExpiryWarning:         viper.GetInt("key-expiry-warning"),
+			RecordClientInfo:         viper.GetBool("record-client-info"),
+			ClientIPHeader:           viper.GetString("client-ip-header"),
+			ClientIPHeaderProxies:    viper.GetInt("client-ip-header-proxies"),
+			AllowedUserAgents:        viper.GetStringSlice("allowed-user-agents"),
+			TrustedIssuers:           viper.GetStringSlice("trusted-issuers"),
+			SessionTokenHeader:       viper.GetString("session-token-header"),
+			TokenPrefix:              viper.GetString("token-prefix"),
+			ExpiryCheckInterval:      viper.GetInt("expiry-check-interval"),
+			FinishedSessionRetention: viper.GetInt("finished-session-retention"),
+			ConfirmationTimeout:      viper.GetInt("confirmation-timeout"),
+			AllowProofRetry:          viper.GetBool("allow-proof-retry"),
+			MaxProofRetries:          viper.GetInt("max-proof-retries"),
+			DefaultLanguage:          viper.GetString("default-language"),
+			StatusPollingHint:        viper.GetBool("status-polling-hint"),
+			DisableCompression:       viper.GetBool("disable-compression"),
+			StatusGoneAfter:          viper.GetInt("status-gone-after"),
+			UniversalLinks:           viper.GetBool("universal-links"),
+			Verbose:                  viper.GetInt("verbose"),
+			Quiet:                    viper.GetBool("quiet"),
+			LogJSON:                  viper.GetBool("log-json"),
+			Logger:                   logger,
+			Production:               viper.GetBool("production"),
+			JwtIssuer:                viper.GetString("jwt-issuer"),
+			JwtPrivateKey:            viper.GetString("jwt-privkey"),
+			JwtPrivateKeyFile:        viper.GetString("jwt-privkey-file"),
+			EnabledActions:           enabledActions(),
+			VerificationWorkers:      viper.GetInt("verification-workers"),
+			NonceCacheSize:           viper.GetInt("nonce-cache-size"),
+			NonceCacheTTL:            viper.GetInt("nonce-cache-ttl"),
+			LoadShedding: server.LoadShedding{
+				MaxActiveSessions: viper.GetInt("load-shedding-max-sessions"),
+				MaxVerifications:  viper.GetInt("load-shedding-max-verifications"),
+				RetryAfter:        viper.GetInt("load-shedding-retry-after"),
+			},
+			MaxCredentialsPerIssuance: viper.GetInt("max-credentials-per-issuance"),
+			MaxSessionRequestSize:     viper.GetInt("max-session-request-size"),
+			MinCredentialValidity:     viper.GetInt("min-credential-validity"),
+			MaxCredentialValidity:     viper.GetInt("max-credential-validity"),
+			ClampCredentialValidity:   viper.GetBool("clamp-credential-validity"),
 		},
 		Permissions: requestorserver.Permissions{
 			Disclosing: handlePermission("disclose-perms"),
@@ -263,6 +363,12 @@ func configureServer(cmd *cobra.Command) error {
 	if err = handleMapOrString("static-sessions", &conf.StaticSessions); err != nil {
 		return err
 	}
+	if err = handleMapOrString("server-name", &conf.ServerName); err != nil {
+		return err
+	}
+	if err = handleMapOrString("noun-aliases", &conf.NounAliases); err != nil {
+		return err
+	}
 	var m map[string]*irma.RevocationSetting
 	if err = handleMapOrString("revocation-settings", &m); err != nil {
 		return err
@@ -270,6 +376,16 @@ func configureServer(cmd *cobra.Command) error {
 	for i, s := range m {
 		conf.RevocationSettings[irma.NewCredentialTypeIdentifier(i)] = s
 	}
+	var pins map[string]int64
+	if err = handleMapOrString("scheme-pins", &pins); err != nil {
+		return err
+	}
+	if len(pins) > 0 {
+		conf.SchemePins = map[irma.SchemeManagerIdentifier]irma.Timestamp{}
+		for id, pin := range pins {
+			conf.SchemePins[irma.NewSchemeManagerIdentifier(id)] = irma.Timestamp(time.Unix(pin, 0))
+		}
+	}
 
 	logger.Debug("Done configuring")
 
@@ -308,6 +424,14 @@ func handlePermission(typ string) []string {
 	return perms
 }
 
+func enabledActions() []irma.Action {
+	var actions []irma.Action
+	for _, action := range viper.GetStringSlice("enabled-actions") {
+		actions = append(actions, irma.Action(action))
+	}
+	return actions
+}
+
 // productionMode examines the arguments passed to the executably to see if --production is enabled.
 // (This should really be done using viper, but when the help message is printed, viper is not yet
 // initialized.)
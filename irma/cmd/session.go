@@ -155,9 +155,10 @@ func serverRequest(
 			return
 		}
 
-		// Wait until client finishes
-		status = <-statuschan
-		if status != server.StatusCancelled && status != server.StatusDone {
+		// Wait until client finishes, skipping the statuses reported while its response is processed
+		for status = <-statuschan; status.Coarse() == server.StatusConnected; status = <-statuschan {
+		}
+		if !status.Finished() || status == server.StatusTimeout {
 			err = errors.Errorf("Unexpected status: %s", status)
 			return
 		}
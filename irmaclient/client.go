@@ -725,6 +725,33 @@ func (client *Client) CheckSatisfiability(request irma.SessionRequest) (
 		}
 	}
 
+	// If too few of the disjunctions of a threshold can be satisfied by a nonempty option, the
+	// attributes of those that can only be satisfied by their empty option are missing
+	nonempty := func(i int) bool {
+		for _, cand := range candidates[i] {
+			if len(cand) > 0 {
+				return true
+			}
+		}
+		return false
+	}
+	for _, t := range request.Disclosure().Thresholds {
+		satisfiable := 0
+		for _, i := range t.Disjunctions {
+			if i < len(candidates) && nonempty(i) {
+				satisfiable++
+			}
+		}
+		if satisfiable >= t.Min {
+			continue
+		}
+		for _, i := range t.Disjunctions {
+			if i < len(candidates) && !nonempty(i) {
+				missing[i] = client.missingAttributes(condiscon[i])
+			}
+		}
+	}
+
 	return
 }
 
@@ -889,28 +916,40 @@ func (client *Client) IssueCommitments(request *irma.IssuanceRequest, choice *ir
 			Proofs: builders.BuildProofList(request.GetContext(), request.GetNonce(nil), false),
 			Nonce2: issuerProofNonce,
 		},
-		Indices: choices,
+		Indices:          choices,
+		ClientAttributes: request.ClientAttributeValues(),
 	}, builders, nil
 }
 
 // ConstructCredentials constructs and saves new credentials using the specified issuance signature messages
-// and credential builders.
-func (client *Client) ConstructCredentials(msg []*gabi.IssueSignatureMessage, request *irma.IssuanceRequest, builders gabi.ProofBuilderList) error {
-	if len(msg) > len(builders) {
+// and credential builders, skipping the credentials that the server did not issue in case of partial issuance.
+func (client *Client) ConstructCredentials(msg *irma.IssueSignatureMessages, request *irma.IssuanceRequest, builders gabi.ProofBuilderList) error {
+	if len(msg.Signatures)+len(msg.Failed) > len(builders) {
 		return errors.New("Received unexpected amount of signatures")
 	}
+	failed := map[int]bool{}
+	for _, i := range msg.Failed {
+		failed[i] = true
+	}
 
 	// First collect all credentials in a slice, so that if one of them induces an error,
 	// we save none of them to fail the session cleanly
 	gabicreds := []*gabi.Credential{}
-	offset := 0
+	offset, sigs := 0, msg.Signatures
 	for i, builder := range builders {
 		credbuilder, ok := builder.(*gabi.CredentialBuilder)
 		if !ok { // Skip builders of disclosure proofs
 			offset++
 			continue
 		}
-		sig := msg[i-offset]
+		if failed[i-offset] {
+			continue
+		}
+		if len(sigs) == 0 {
+			return errors.New("Received unexpected amount of signatures")
+		}
+		sig := sigs[0]
+		sigs = sigs[1:]
 
 		var nonrevAttr *big.Int
 		if sig.NonRevocationWitness != nil {
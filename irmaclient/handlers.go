@@ -65,6 +65,12 @@ func (h *keyshareEnrollmentHandler) RequestSignaturePermission(request *irma.Sig
 func (h *keyshareEnrollmentHandler) RequestSchemeManagerPermission(manager *irma.SchemeManager, callback func(proceed bool)) {
 	callback(false)
 }
+func (h *keyshareEnrollmentHandler) RequestPairingCode(incorrect bool, callback PairingHandler) {
+	callback(false, "")
+}
+func (h *keyshareEnrollmentHandler) RequestClientAttributes(request *irma.IssuanceRequest, callback ClientAttributesHandler) {
+	callback(false, nil)
+}
 func (h *keyshareEnrollmentHandler) Cancelled() {
 	h.fail(errors.New("Keyshare enrollment session unexpectedly cancelled"))
 }
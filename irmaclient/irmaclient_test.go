@@ -201,6 +201,32 @@ func TestCandidateConjunctionOrder(t *testing.T) {
 	}
 }
 
+func TestCandidatesThresholds(t *testing.T) {
+	client, handler := parseStorage(t)
+	defer test.ClearTestStorage(t, handler.storage)
+
+	studentID := irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID")
+	value := "nonexistent"
+	req := &irma.DisclosureRequest{
+		BaseRequest: irma.BaseRequest{ProtocolVersion: maxVersion},
+		Disclose: irma.AttributeConDisCon{
+			irma.AttributeDisCon{irma.AttributeCon{{Type: studentID}}, irma.AttributeCon{}},
+			irma.AttributeDisCon{irma.AttributeCon{{Type: studentID, Value: &value}}, irma.AttributeCon{}},
+		},
+		Thresholds: []irma.DisjunctionThreshold{{Disjunctions: []int{0, 1}, Min: 1}},
+	}
+	_, missing, err := client.CheckSatisfiability(req)
+	require.NoError(t, err)
+	require.Empty(t, missing)
+
+	// The second disjunction can only be satisfied by its empty option
+	req.Thresholds[0].Min = 2
+	_, missing, err = client.CheckSatisfiability(req)
+	require.NoError(t, err)
+	require.Len(t, missing, 1)
+	require.Contains(t, missing, 1)
+}
+
 func TestCredentialRemoval(t *testing.T) {
 	client, handler := parseStorage(t)
 	defer test.ClearTestStorage(t, handler.storage)
@@ -28,6 +28,13 @@ type PermissionHandler func(proceed bool, choice *irma.DisclosureChoice)
 // PinHandler is used to provide the user's PIN code.
 type PinHandler func(proceed bool, pin string)
 
+// PairingHandler is used to provide the pairing code that the frontend showed to the user.
+type PairingHandler func(proceed bool, code string)
+
+// ClientAttributesHandler is used to provide, per credential request of an issuance request,
+// the values that the user chose for the client attributes of the credential request.
+type ClientAttributesHandler func(proceed bool, values []map[string]string)
+
 // A Handler contains callbacks for communication to the user.
 type Handler interface {
 	StatusUpdate(action irma.Action, status irma.Status)
@@ -60,6 +67,12 @@ type Handler interface {
 		callback func(proceed bool))
 
 	RequestPin(remainingAttempts int, callback PinHandler)
+	// RequestPairingCode asks the user for the pairing code shown by the frontend. If incorrect
+	// is true, the previously entered code was rejected by the server.
+	RequestPairingCode(incorrect bool, callback PairingHandler)
+	// RequestClientAttributes asks the user to choose values for the client attributes of the
+	// credential requests, which must match the regular expression of the client attribute.
+	RequestClientAttributes(request *irma.IssuanceRequest, callback ClientAttributesHandler)
 }
 
 // SessionDismisser can dismiss the current IRMA session.
@@ -78,11 +91,13 @@ type session struct {
 	client         *Client
 	request        irma.SessionRequest
 	done           bool
+	declined       bool       // whether the user declined the session
 	prepRevocation chan error // used when nonrevocation preprocessing is done
 
 	// State for issuance sessions
-	issuerProofNonce *big.Int
-	builders         gabi.ProofBuilderList
+	issuerProofNonce       *big.Int
+	builders               gabi.ProofBuilderList
+	clientAttributesChosen bool
 
 	// State for signature sessions
 	timestamp *atum.Timestamp
@@ -96,6 +111,10 @@ type session struct {
 // We implement the handler for the keyshare protocol
 var _ keyshareSessionHandler = (*session)(nil)
 
+// Time on top of the confirmation timeout of the server that we wait for its response to our
+// issuance commitments, if the issuance needs to be confirmed externally
+const confirmationMargin = 10 * time.Second
+
 // Supported protocol versions. Minor version numbers should be sorted.
 var supportedVersions = map[int][]int{
 	2: {
@@ -184,6 +203,10 @@ func (client *Client) newQrSession(qr *irma.Qr, handler Handler) SessionDismisse
 		}
 		return client.newQrSession(newqr, handler)
 	}
+	if qr.Expired() {
+		handler.Failure(&irma.SessionError{ErrorType: irma.ErrorSessionExpired, Err: errors.New("session QR has expired")})
+		return nil
+	}
 
 	client.PauseJobs()
 
@@ -242,6 +265,44 @@ func (session *session) getSessionInfo() {
 		return
 	}
 
+	if session.request.Base().PairingRequired {
+		session.requestPairingCode(false)
+		return
+	}
+	session.processSessionInfo()
+}
+
+// requestPairingCode asks the user for the pairing code shown by the frontend, which the server
+// requires before the session can proceed.
+func (session *session) requestPairingCode(incorrect bool) {
+	session.Handler.RequestPairingCode(incorrect, func(proceed bool, code string) {
+		go session.pair(proceed, code)
+	})
+}
+
+// pair submits the pairing code entered by the user to the server, continuing the session if it
+// is accepted and asking the user again if it is incorrect.
+func (session *session) pair(proceed bool, code string) {
+	defer session.recoverFromPanic()
+
+	if !proceed {
+		session.declined = true
+		session.cancel()
+		return
+	}
+	session.Handler.StatusUpdate(session.Action, irma.StatusCommunicating)
+
+	err := session.transport.Post("pairing", nil, &irma.PairingMessage{PairingCode: code})
+	if err != nil {
+		serr := err.(*irma.SessionError)
+		if serr.RemoteError != nil && serr.RemoteError.ErrorName == "PAIRING_REJECTED" {
+			session.requestPairingCode(true)
+			return
+		}
+		session.fail(serr)
+		return
+	}
+
 	session.processSessionInfo()
 }
 
@@ -291,6 +352,14 @@ func (session *session) processSessionInfo() {
 
 	if session.Action == irma.ActionIssuing {
 		ir := session.request.(*irma.IssuanceRequest)
+		if ir.HasClientAttributes() && !session.clientAttributesChosen {
+			// The values of the client attributes must be known before the credentials to be
+			// issued are computed and shown to the user, so we continue once they are chosen
+			session.Handler.RequestClientAttributes(ir, func(proceed bool, values []map[string]string) {
+				go session.setClientAttributes(proceed, values)
+			})
+			return
+		}
 		_, err := ir.GetCredentialInfoList(session.client.Configuration, session.Version)
 		if err != nil {
 			session.fail(&irma.SessionError{ErrorType: irma.ErrorUnknownIdentifier, Err: err})
@@ -369,6 +438,24 @@ func (session *session) processSessionInfo() {
 	}
 }
 
+// setClientAttributes incorporates the values that the user chose for the client attributes into
+// the issuance request, after which it continues processing the session.
+func (session *session) setClientAttributes(proceed bool, values []map[string]string) {
+	defer session.recoverFromPanic()
+
+	if !proceed {
+		session.declined = true
+		session.cancel()
+		return
+	}
+	if err := session.request.(*irma.IssuanceRequest).SetClientAttributes(values); err != nil {
+		session.fail(&irma.SessionError{ErrorType: irma.ErrorInvalidRequest, Err: err})
+		return
+	}
+	session.clientAttributesChosen = true
+	session.processSessionInfo()
+}
+
 // doSession performs the session: it computes all proofs of knowledge, constructs credentials in case of issuance,
 // asks for the pin and performs the keyshare session, and finishes the session by either POSTing the result to the
 // API server or returning it to the caller (in case of interactive and noninteractive sessions, respectively).
@@ -376,6 +463,7 @@ func (session *session) doSession(proceed bool) {
 	defer session.recoverFromPanic()
 
 	if !proceed {
+		session.declined = true
 		session.cancel()
 		return
 	}
@@ -476,7 +564,11 @@ func (session *session) sendResponse(message interface{}) {
 			raven.CaptureError(err, nil)
 		}
 	case irma.ActionIssuing:
-		response := []*gabi.IssueSignatureMessage{}
+		response := &irma.IssueSignatureMessages{}
+		if timeout := session.request.(*irma.IssuanceRequest).ConfirmationTimeout; timeout > 0 {
+			// The server may hold off its response until the issuance is confirmed externally
+			session.transport.SetTimeout(time.Duration(timeout)*time.Second + confirmationMargin)
+		}
 		if err = session.transport.Post("commitments", &response, message); err != nil {
 			session.fail(err.(*irma.SessionError))
 			return
@@ -683,7 +775,11 @@ func panicToError(e interface{}) *irma.SessionError {
 func (session *session) finish() bool {
 	if !session.done {
 		if session.IsInteractive() {
-			session.transport.Delete()
+			if session.declined {
+				session.transport.DeleteWithMessage(&irma.SessionDeleteMessage{Declined: true})
+			} else {
+				session.transport.Delete()
+			}
 		}
 		session.client.nonrevRepopulateCaches(session.request)
 		session.client.StartJobs()
@@ -726,6 +822,7 @@ func (session *session) KeyshareDone(message interface{}) {
 		session.sendResponse(&irma.IssueCommitmentMessage{
 			IssueCommitmentMessage: message.(*gabi.IssueCommitmentMessage),
 			Indices:                session.attrIndices,
+			ClientAttributes:       session.request.(*irma.IssuanceRequest).ClientAttributeValues(),
 		})
 	}
 }
@@ -6,6 +6,7 @@ import (
 	"encoding/xml"
 	"io/ioutil"
 	"os"
+	"path"
 	"path/filepath"
 	"reflect"
 	"regexp"
@@ -63,8 +64,36 @@ type Configuration struct {
 
 	Warnings []string
 
+	// SchemePins optionally pins schemes to a maximum version: a scheme present in this map is
+	// only updated if the timestamp of its remote version is not after the pinned timestamp.
+	SchemePins map[SchemeManagerIdentifier]Timestamp
+
+	// SchemePublicKeys optionally pins the public keys (in PEM) with which schemes may be signed:
+	// the index of a scheme present in this map must be signed by one of its pinned keys, which are
+	// tried in order, instead of by the public key stored in the scheme. This allows controlled
+	// rotation of scheme signing keys.
+	SchemePublicKeys map[SchemeManagerIdentifier][][]byte
+
+	// UnpinnedKeyListeners are invoked when a scheme present in SchemePublicKeys is signed by its
+	// own public key which is not one of its pinned keys, e.g. because the key has been rotated.
+	UnpinnedKeyListeners []func(id SchemeManagerIdentifier, pk []byte)
+
+	// SchemeHTTPTimeout, if nonzero, is the duration after which HTTP requests made to download or
+	// update schemes time out, in which case they fail with an error of type ErrorTimeout.
+	SchemeHTTPTimeout time.Duration
+
+	// SchemeMirrors optionally lists base URLs of mirrors from which schemes are downloaded and
+	// updated: the files of a scheme are fetched from the first of <mirror>/<scheme ID> that works,
+	// falling back to the URL of the scheme itself. The downloaded files are verified against the
+	// scheme's signature as usual.
+	SchemeMirrors []string
+
+	// UpdateListeners are invoked after UpdateSchemes() has updated and reparsed one or more schemes.
+	UpdateListeners []func(updated *IrmaIdentifierSet)
+
 	kssPublicKeys map[SchemeManagerIdentifier]map[int]*rsa.PublicKey
 	publicKeys    map[IssuerIdentifier]map[uint]*gabi.PublicKey
+	addedKeys     map[IssuerIdentifier]map[uint]*gabi.PublicKey // see AddPublicKey()
 	reverseHashes map[string]CredentialTypeIdentifier
 	initialized   bool
 	assets        string
@@ -164,6 +193,26 @@ func (conf *Configuration) clear() {
 	conf.reverseHashes = make(map[string]CredentialTypeIdentifier)
 }
 
+// Reparse parses the schemes in the storage path into a new Configuration having the same options,
+// scheme pins and listeners, leaving the current instance untouched so that it remains usable by those
+// holding on to it. The revocation storage and scheduler of the current instance are shared with
+// the new one.
+func (conf *Configuration) Reparse() (*Configuration, error) {
+	newconf, err := NewConfiguration(conf.Path, conf.options)
+	if err != nil {
+		return nil, err
+	}
+	newconf.Revocation, newconf.Scheduler = conf.Revocation, conf.Scheduler
+	newconf.SchemePins, newconf.SchemeHTTPTimeout = conf.SchemePins, conf.SchemeHTTPTimeout
+	newconf.SchemeMirrors = conf.SchemeMirrors
+	newconf.SchemePublicKeys, newconf.UnpinnedKeyListeners = conf.SchemePublicKeys, conf.UnpinnedKeyListeners
+	newconf.UpdateListeners = append([]func(*IrmaIdentifierSet){}, conf.UpdateListeners...)
+	if err = newconf.ParseFolder(); err != nil {
+		return nil, err
+	}
+	return newconf, nil
+}
+
 // ParseFolder populates the current Configuration by parsing the storage path,
 // listing the containing scheme managers, issuers and credential types.
 func (conf *Configuration) ParseFolder() (err error) {
@@ -386,6 +435,48 @@ func (conf *Configuration) PublicKey(id IssuerIdentifier, counter uint) (*gabi.P
 	return conf.publicKeys[id][counter], nil
 }
 
+// AddCredentialType adds the specified credential type, along with its attribute types and the
+// scheme manager and issuer to which it belongs, to the Configuration, in addition to the schemes
+// parsed from disk. Mainly intended for tests, together with AddPublicKey().
+func (conf *Configuration) AddCredentialType(scheme *SchemeManager, issuer *Issuer, cred *CredentialType) {
+	conf.SchemeManagers[scheme.Identifier()] = scheme
+	conf.Issuers[issuer.Identifier()] = issuer
+	conf.addCredentialType(cred)
+}
+
+func (conf *Configuration) addCredentialType(cred *CredentialType) {
+	credid := cred.Identifier()
+	conf.CredentialTypes[credid] = cred
+	conf.addReverseHash(credid)
+	for index, attr := range cred.AttributeTypes {
+		attr.Index = index
+		attr.SchemeManagerID = cred.SchemeManagerID
+		attr.IssuerID = cred.IssuerID
+		attr.CredentialTypeID = cred.ID
+		conf.AttributeTypes[attr.GetAttributeTypeIdentifier()] = attr
+	}
+}
+
+// AddPublicKey adds a copy of the specified public key of the specified issuer to the
+// Configuration, in addition to the public keys parsed from the scheme of the issuer. Mainly
+// intended for tests.
+func (conf *Configuration) AddPublicKey(id IssuerIdentifier, pk *gabi.PublicKey) {
+	if conf.addedKeys == nil {
+		conf.addedKeys = make(map[IssuerIdentifier]map[uint]*gabi.PublicKey)
+	}
+	if conf.addedKeys[id] == nil {
+		conf.addedKeys[id] = map[uint]*gabi.PublicKey{}
+	}
+	if conf.publicKeys[id] == nil {
+		conf.publicKeys[id] = map[uint]*gabi.PublicKey{}
+	}
+	// The caller may still use the key with another issuer or configuration, so we don't modify it
+	cpy := *pk
+	cpy.Issuer = id.String()
+	conf.addedKeys[id][pk.Counter] = &cpy
+	conf.publicKeys[id][pk.Counter] = &cpy
+}
+
 // PublicKeyLatest returns the latest private key of the specified issuer.
 func (conf *Configuration) PublicKeyLatest(id IssuerIdentifier) (*gabi.PublicKey, error) {
 	indices, err := conf.PublicKeyIndices(id)
@@ -516,6 +607,9 @@ func (conf *Configuration) DeleteSchemeManager(id SchemeManagerIdentifier) error
 func (conf *Configuration) parseKeysFolder(issuerid IssuerIdentifier) error {
 	manager := conf.SchemeManagers[issuerid.SchemeManagerIdentifier()]
 	conf.publicKeys[issuerid] = map[uint]*gabi.PublicKey{}
+	for counter, pk := range conf.addedKeys[issuerid] {
+		conf.publicKeys[issuerid][counter] = pk
+	}
 	path := fmt.Sprintf(pubkeyPattern, conf.Path, issuerid.SchemeManagerIdentifier().Name(), issuerid.Name())
 	files, err := filepath.Glob(path)
 	if err != nil {
@@ -584,7 +678,15 @@ func (conf *Configuration) PrivateKeyIndices(issuerid IssuerIdentifier) (i []uin
 }
 
 func (conf *Configuration) PublicKeyIndices(issuerid IssuerIdentifier) (i []uint, err error) {
-	return conf.matchKeyPattern(issuerid, pubkeyPattern)
+	filekeys, err := conf.matchKeyPattern(issuerid, pubkeyPattern)
+	if err != nil {
+		return nil, err
+	}
+	var mapkeys []uint
+	for _, pk := range conf.addedKeys[issuerid] {
+		mapkeys = append(mapkeys, pk.Counter)
+	}
+	return unionset(filekeys, mapkeys), nil
 }
 
 func (conf *Configuration) matchKeyPattern(issuerid IssuerIdentifier, pattern string) (ints []uint, err error) {
@@ -633,16 +735,7 @@ func (conf *Configuration) parseCredentialsFolder(manager *SchemeManager, issuer
 			}
 		}
 		cred.Valid = conf.SchemeManagers[cred.SchemeManagerIdentifier()].Valid
-		credid := cred.Identifier()
-		conf.CredentialTypes[credid] = cred
-		conf.addReverseHash(credid)
-		for index, attr := range cred.AttributeTypes {
-			attr.Index = index
-			attr.SchemeManagerID = cred.SchemeManagerID
-			attr.IssuerID = cred.IssuerID
-			attr.CredentialTypeID = cred.ID
-			conf.AttributeTypes[attr.GetAttributeTypeIdentifier()] = attr
-		}
+		conf.addCredentialType(cred)
 		return nil
 	})
 	if !foundcred {
@@ -727,6 +820,10 @@ func (conf *Configuration) CopyManagerFromAssets(scheme SchemeManagerIdentifier)
 // DownloadSchemeManager downloads and returns a scheme manager description.xml file
 // from the specified URL.
 func DownloadSchemeManager(url string) (*SchemeManager, error) {
+	return downloadSchemeManager(url, 0, nil)
+}
+
+func downloadSchemeManager(url string, timeout time.Duration, mirrors []string) (*SchemeManager, error) {
 	if !strings.HasPrefix(url, "http://") && !strings.HasPrefix(url, "https://") {
 		url = "https://" + url
 	}
@@ -736,7 +833,7 @@ func DownloadSchemeManager(url string) (*SchemeManager, error) {
 	if strings.HasSuffix(url, "/description.xml") {
 		url = url[:len(url)-len("/description.xml")]
 	}
-	b, err := NewHTTPTransport(url).GetBytes("description.xml")
+	b, err := newSchemeTransport(url, timeout, mirrors).GetBytes("description.xml")
 	if err != nil {
 		return nil, err
 	}
@@ -783,7 +880,7 @@ func (conf *Configuration) ReinstallSchemeManager(manager *SchemeManager) (err e
 
 	// Check if downloading stuff from the remote works before we uninstall the specified manager:
 	// If we can't download anything we should keep the broken version
-	manager, err = DownloadSchemeManager(manager.URL)
+	manager, err = downloadSchemeManager(manager.URL, conf.SchemeHTTPTimeout, conf.SchemeMirrors)
 	if err != nil {
 		return
 	}
@@ -806,7 +903,7 @@ func (conf *Configuration) InstallSchemeManager(manager *SchemeManager, publicke
 		return err
 	}
 
-	t := NewHTTPTransport(manager.URL)
+	t := newSchemeTransport(manager.URL, conf.SchemeHTTPTimeout, conf.SchemeMirrors)
 	if err := conf.downloadFile(t, name, "description.xml"); err != nil {
 		return err
 	}
@@ -837,7 +934,7 @@ func (conf *Configuration) DownloadSchemeManagerSignature(manager *SchemeManager
 		return errors.New("cannot download into a read-only configuration")
 	}
 
-	t := NewHTTPTransport(manager.URL)
+	t := newSchemeTransport(manager.URL, conf.SchemeHTTPTimeout, conf.SchemeMirrors)
 	if err = conf.downloadFile(t, manager.ID, "index"); err != nil {
 		return
 	}
@@ -1203,7 +1300,25 @@ func (conf *Configuration) VerifySignature(id SchemeManagerIdentifier) (err erro
 		return err
 	}
 
-	return signed.Verify(pk, indexbts, sig)
+	pinned, ok := conf.SchemePublicKeys[id]
+	if !ok {
+		return signed.Verify(pk, indexbts, sig)
+	}
+	for _, pinnedbts := range pinned {
+		pinnedpk, err := signed.UnmarshalPemPublicKey(pinnedbts)
+		if err != nil {
+			return err
+		}
+		if signed.Verify(pinnedpk, indexbts, sig) == nil {
+			return nil
+		}
+	}
+	if signed.Verify(pk, indexbts, sig) == nil {
+		for _, listener := range conf.UnpinnedKeyListeners {
+			listener(id, pkbts)
+		}
+	}
+	return errors.Errorf("Scheme manager index of %s not signed by any of its pinned public keys", id)
 }
 
 func (hash ConfigurationFileHash) String() string {
@@ -1227,6 +1342,15 @@ func (conf *Configuration) UpdateSchemeManager(id SchemeManagerIdentifier, downl
 	if !contains {
 		return errors.Errorf("Cannot update unknown scheme manager %s", id)
 	}
+	pin, pinned := conf.SchemePins[id]
+	if pinned {
+		// Check the remote timestamp before downloading anything else, so that we leave our stored
+		// copy of the scheme intact if the remote version is newer than the pinned version
+		exceeds, err := conf.exceedsPin(manager, pin)
+		if err != nil || exceeds {
+			return err
+		}
+	}
 
 	// Download the new index and its signature, and check that the new index
 	// is validly signed by the new signature
@@ -1242,7 +1366,7 @@ func (conf *Configuration) UpdateSchemeManager(id SchemeManagerIdentifier, downl
 	}
 
 	// Check remote timestamp, verify it against the new index, and see if we have to do anything
-	transport := NewHTTPTransport(manager.URL + "/")
+	transport := newSchemeTransport(manager.URL, conf.SchemeHTTPTimeout, conf.SchemeMirrors)
 	err = conf.downloadSignedFile(transport, manager.ID, "timestamp", newIndex[manager.ID+"/timestamp"])
 	if err != nil {
 		return err
@@ -1255,6 +1379,9 @@ func (conf *Configuration) UpdateSchemeManager(id SchemeManagerIdentifier, downl
 	if err != nil {
 		return err
 	}
+	if pinned && timestamp.After(pin) {
+		return errors.Errorf("Remote version of scheme %s changed to a version beyond its pin during update", id)
+	}
 	if !manager.Timestamp.Before(*timestamp) {
 		return nil
 	}
@@ -1307,8 +1434,53 @@ func (conf *Configuration) UpdateSchemeManager(id SchemeManagerIdentifier, downl
 	return
 }
 
+// exceedsPin returns whether the remote version of the scheme is newer than the specified pinned
+// version, in which case the scheme should not be updated.
+func (conf *Configuration) exceedsPin(manager *SchemeManager, pin Timestamp) (bool, error) {
+	// The remote timestamp is not yet verified against the index signature here; an attacker
+	// that can modify it can at most prevent the update, which it can do anyway. If the scheme is
+	// updated, the timestamp is verified later on.
+	bts, err := newSchemeTransport(manager.URL, conf.SchemeHTTPTimeout, conf.SchemeMirrors).GetBytes("timestamp")
+	if err != nil {
+		return false, err
+	}
+	if len(bts) == 0 {
+		return false, errors.Errorf("Empty remote timestamp of scheme %s", manager.ID)
+	}
+	remote, err := parseTimestamp(bts)
+	if err != nil {
+		return false, err
+	}
+	if remote.After(pin) {
+		Logger.WithField("scheme", manager.ID).Warnf(
+			"Not updating scheme: remote version %s is newer than pinned version %s", remote.String(), pin.String())
+		return true, nil
+	}
+	return false, nil
+}
+
 func (conf *Configuration) UpdateSchemes() error {
-	updated := IrmaIdentifierSet{
+	updated, err := conf.DownloadSchemeUpdates()
+	if err != nil {
+		return err
+	}
+	if updated.Empty() {
+		return nil
+	}
+	if err = conf.ParseFolder(); err != nil {
+		return err
+	}
+	for _, listener := range conf.UpdateListeners {
+		listener(updated)
+	}
+	return nil
+}
+
+// DownloadSchemeUpdates downloads updates of all schemes into the storage path, returning what
+// was updated. Unlike UpdateSchemes() it does not reparse the schemes, so that the caller can
+// choose to parse them into a new instance using Reparse().
+func (conf *Configuration) DownloadSchemeUpdates() (*IrmaIdentifierSet, error) {
+	updated := &IrmaIdentifierSet{
 		SchemeManagers:  map[SchemeManagerIdentifier]struct{}{},
 		Issuers:         map[IssuerIdentifier]struct{}{},
 		CredentialTypes: map[CredentialTypeIdentifier]struct{}{},
@@ -1316,14 +1488,11 @@ func (conf *Configuration) UpdateSchemes() error {
 	}
 	for id := range conf.SchemeManagers {
 		Logger.WithField("scheme", id).Info("Auto-updating scheme")
-		if err := conf.UpdateSchemeManager(id, &updated); err != nil {
-			return err
+		if err := conf.UpdateSchemeManager(id, updated); err != nil {
+			return nil, err
 		}
 	}
-	if !updated.Empty() {
-		return conf.ParseFolder()
-	}
-	return nil
+	return updated, nil
 }
 
 func (conf *Configuration) AutoUpdateSchemes(interval uint) {
@@ -1347,7 +1516,7 @@ func (conf *Configuration) AutoUpdateSchemes(interval uint) {
 }
 
 func (conf *Configuration) downloadSignedFile(
-	transport *HTTPTransport, scheme, path string, hash ConfigurationFileHash,
+	transport *schemeTransport, scheme, path string, hash ConfigurationFileHash,
 ) error {
 	b, err := transport.GetBytes(path)
 	if err != nil {
@@ -1364,10 +1533,56 @@ func (conf *Configuration) downloadSignedFile(
 	return common.SaveFile(dest, b)
 }
 
-func (conf *Configuration) downloadFile(transport *HTTPTransport, scheme string, path string) error {
+func (conf *Configuration) downloadFile(transport *schemeTransport, scheme string, path string) error {
 	return conf.downloadSignedFile(transport, scheme, path, nil)
 }
 
+// schemeTransport downloads scheme files from the first of its URLs from which that works.
+type schemeTransport struct {
+	transports []*HTTPTransport
+	current    int // index of the transport that worked last, with which the next download starts
+}
+
+// newSchemeTransport returns a schemeTransport for downloading the files of the scheme at the
+// specified URL from the specified mirrors, if any, and finally from the URL itself, whose requests
+// time out after the specified duration if nonzero.
+func newSchemeTransport(url string, timeout time.Duration, mirrors []string) *schemeTransport {
+	scheme := path.Base(strings.TrimSuffix(url, "/"))
+	t := &schemeTransport{}
+	for _, u := range append(mirrorURLs(mirrors, scheme), url) {
+		transport := NewHTTPTransport(u)
+		if timeout > 0 {
+			transport.SetTimeout(timeout)
+		}
+		t.transports = append(t.transports, transport)
+	}
+	return t
+}
+
+func mirrorURLs(mirrors []string, scheme string) []string {
+	urls := make([]string, 0, len(mirrors))
+	for _, mirror := range mirrors {
+		urls = append(urls, strings.TrimSuffix(mirror, "/")+"/"+scheme)
+	}
+	return urls
+}
+
+// GetBytes downloads the specified file, failing over to the next URL on error.
+func (t *schemeTransport) GetBytes(file string) ([]byte, error) {
+	var err error
+	for i := t.current; i < len(t.transports); i++ {
+		var bts []byte
+		if bts, err = t.transports[i].GetBytes(file); err == nil {
+			t.current = i
+			return bts, nil
+		}
+		if i < len(t.transports)-1 {
+			Logger.WithField("url", t.transports[i].Server).Warnf("Downloading scheme file %s failed, trying next URL: %s", file, err)
+		}
+	}
+	return nil, err
+}
+
 // Validation methods containing consistency checks on irma_configuration
 func validateDemoPrefix(ts TranslatedString) error {
 	prefix := "Demo "
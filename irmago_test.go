@@ -3,8 +3,14 @@ package irma
 import (
 	"crypto/rand"
 	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"path/filepath"
 	"reflect"
+	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -336,8 +342,12 @@ func TestSessionRequests(t *testing.T) {
 
 		{
 			expected: &SignatureRequest{
-				DisclosureRequest{BaseRequest{LDContext: LDContextSignatureRequest}, base.Disclose, base.Labels},
-				sigMessage,
+				DisclosureRequest: DisclosureRequest{
+					BaseRequest: BaseRequest{LDContext: LDContextSignatureRequest},
+					Disclose:    base.Disclose,
+					Labels:      base.Labels,
+				},
+				Message: sigMessage,
 			},
 			old: &SignatureRequest{},
 			oldJson: `{
@@ -391,7 +401,11 @@ func TestSessionRequests(t *testing.T) {
 
 		{
 			expected: &IssuanceRequest{
-				DisclosureRequest: DisclosureRequest{BaseRequest{LDContext: LDContextIssuanceRequest}, base.Disclose, base.Labels},
+				DisclosureRequest: DisclosureRequest{
+					BaseRequest: BaseRequest{LDContext: LDContextIssuanceRequest},
+					Disclose:    base.Disclose,
+					Labels:      base.Labels,
+				},
 				Credentials: []*CredentialRequest{
 					{
 						CredentialTypeID: NewCredentialTypeIdentifier("irma-demo.MijnOverheid.root"),
@@ -662,3 +676,279 @@ func revoke(t *testing.T, acc *revocation.Accumulator, parent *revocation.Event,
 	require.NoError(t, err)
 	return acc, event
 }
+
+func TestClientAttributes(t *testing.T) {
+	conf := parseConfiguration(t)
+	newRequest := func() *IssuanceRequest {
+		return NewIssuanceRequest([]*CredentialRequest{{
+			CredentialTypeID: NewCredentialTypeIdentifier("irma-demo.RU.studentCard"),
+			Attributes: map[string]string{
+				"university":        "Radboud",
+				"studentCardNumber": "31415927",
+				"level":             "Max",
+			},
+			ClientAttributes: map[string]string{"studentID": "[0-9]+"},
+		}})
+	}
+
+	request := newRequest()
+	require.NoError(t, request.Credentials[0].Validate(conf))
+	require.Error(t, request.SetClientAttributes(nil))
+	require.Error(t, request.SetClientAttributes([]map[string]string{{"studentID": "abc"}}))
+	require.Error(t, request.SetClientAttributes([]map[string]string{{"studentID": "456", "level": "Min"}}))
+
+	// Client side: choose value and compute the values to send along with the commitments
+	request.Credentials[0].Attributes["studentID"] = "456"
+	values := request.ClientAttributeValues()
+	require.Equal(t, []map[string]string{{"studentID": "456"}}, values)
+
+	// Server side: incorporate the client-chosen values
+	request = newRequest()
+	require.NoError(t, request.SetClientAttributes(values))
+	require.Equal(t, "456", request.Credentials[0].Attributes["studentID"])
+	_, err := request.Credentials[0].AttributeList(conf, 0x03, nil)
+	require.NoError(t, err)
+}
+
+func TestAbsentAttributes(t *testing.T) {
+	conf := parseConfiguration(t)
+	request := &CredentialRequest{
+		CredentialTypeID: NewCredentialTypeIdentifier("irma-demo.MijnOverheid.fullName"),
+		Attributes: map[string]string{
+			"firstnames": "Johan Pieter",
+			"firstname":  "Johan",
+			"familyname": "Stuivezand",
+		},
+		AbsentAttributes: []string{"prefix"},
+	}
+	require.NoError(t, request.Validate(conf))
+	list, err := request.AttributeList(conf, 0x03, nil)
+	require.NoError(t, err)
+	require.Nil(t, list.UntranslatedAttribute(NewAttributeTypeIdentifier("irma-demo.MijnOverheid.fullName.prefix")))
+
+	request.Attributes["prefix"] = ""
+	require.Error(t, request.Validate(conf))
+
+	delete(request.Attributes, "prefix")
+	request.AbsentAttributes = []string{"familyname"}
+	require.Error(t, request.Validate(conf))
+}
+
+func TestDisjunctionThresholds(t *testing.T) {
+	request := NewDisclosureRequest(
+		NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID"),
+		NewAttributeTypeIdentifier("irma-demo.RU.studentCard.level"),
+	)
+	request.Thresholds = []DisjunctionThreshold{{Disjunctions: []int{0, 1}, Min: 2}}
+	require.NoError(t, request.Validate())
+
+	for _, invalid := range []DisjunctionThreshold{
+		{Disjunctions: []int{0, 1}, Min: 0},
+		{Disjunctions: []int{0, 1}, Min: 3},
+		{Disjunctions: []int{0, 2}, Min: 1},
+		{Disjunctions: []int{0, 0}, Min: 1},
+	} {
+		request.Thresholds = []DisjunctionThreshold{invalid}
+		require.Error(t, request.Validate())
+	}
+
+	threshold := DisjunctionThreshold{Disjunctions: []int{0, 2}, Min: 1}
+	attr := &DisclosedAttribute{}
+	require.Equal(t, 1, threshold.Satisfied([][]*DisclosedAttribute{{attr}, {attr}, {}}))
+	require.Equal(t, 2, threshold.Satisfied([][]*DisclosedAttribute{{attr}, {}, {attr}}))
+}
+
+func TestSchemePublicKeys(t *testing.T) {
+	conf := parseConfiguration(t)
+	id := NewSchemeManagerIdentifier("irma-demo")
+	demopk, err := ioutil.ReadFile(filepath.Join("testdata", "irma_configuration", "irma-demo", "pk.pem"))
+	require.NoError(t, err)
+	testpk, err := ioutil.ReadFile(filepath.Join("testdata", "irma_configuration", "test", "pk.pem"))
+	require.NoError(t, err)
+
+	var unpinned []byte
+	conf.UnpinnedKeyListeners = []func(SchemeManagerIdentifier, []byte){
+		func(_ SchemeManagerIdentifier, pk []byte) { unpinned = pk },
+	}
+	conf.SchemePublicKeys = map[SchemeManagerIdentifier][][]byte{id: {testpk, demopk}}
+	require.NoError(t, conf.VerifySignature(id))
+	require.Nil(t, unpinned)
+
+	conf.SchemePublicKeys = map[SchemeManagerIdentifier][][]byte{id: {testpk}}
+	require.Error(t, conf.VerifySignature(id))
+	require.Equal(t, demopk, unpinned)
+}
+
+func TestSessionRequestCBOR(t *testing.T) {
+	validity := Timestamp(time.Unix(time.Now().AddDate(1, 0, 0).Unix(), 0))
+	request := NewIssuanceRequest([]*CredentialRequest{{
+		Validity:         &validity,
+		CredentialTypeID: NewCredentialTypeIdentifier("irma-demo.RU.studentCard"),
+		Attributes:       map[string]string{"studentID": "456"},
+	}}, NewAttributeTypeIdentifier("irma-demo.MijnOverheid.root.BSN"))
+
+	bts, err := MarshalBinary(request)
+	require.NoError(t, err)
+	parsed := &IssuanceRequest{}
+	require.NoError(t, UnmarshalBinary(bts, parsed))
+	require.Equal(t, request.Credentials[0].CredentialTypeID, parsed.Credentials[0].CredentialTypeID)
+	require.Equal(t, request.Credentials[0].Attributes, parsed.Credentials[0].Attributes)
+	require.True(t, time.Time(validity).Equal(time.Time(*parsed.Credentials[0].Validity)))
+	require.Equal(t, request.Disclose[0][0][0].Type, parsed.Disclose[0][0][0].Type)
+}
+
+func TestAttributeRequestNotEmpty(t *testing.T) {
+	id := NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID")
+	empty, nonempty := "", "456"
+	ar := &AttributeRequest{Type: id, NotEmpty: true}
+	require.False(t, ar.Satisfy(id, nil))
+	require.False(t, ar.Satisfy(id, &empty))
+	require.True(t, ar.Satisfy(id, &nonempty))
+
+	bts, err := json.Marshal(ar)
+	require.NoError(t, err)
+	parsed := &AttributeRequest{}
+	require.NoError(t, json.Unmarshal(bts, parsed))
+	require.Equal(t, ar, parsed)
+}
+
+func TestQrUniversalLink(t *testing.T) {
+	qr := &Qr{URL: "https://example.com/irma/session/abc", Type: ActionDisclosing}
+	link, err := qr.UniversalLink()
+	require.NoError(t, err)
+	require.True(t, strings.HasPrefix(link, UniversalLinkPrefix))
+
+	unescaped, err := url.QueryUnescape(strings.TrimPrefix(link, UniversalLinkPrefix))
+	require.NoError(t, err)
+	parsed := &Qr{}
+	require.NoError(t, json.Unmarshal([]byte(unescaped), parsed))
+	require.Equal(t, qr, parsed)
+}
+
+func TestAttributeRequestMatchMode(t *testing.T) {
+	id := NewAttributeTypeIdentifier("irma-demo.MijnOverheid.fullName.firstname")
+	required, val := "John@Example.com", " john@example.com "
+	ar := &AttributeRequest{Type: id, Value: &required}
+	require.False(t, ar.Satisfy(id, &val))
+	ar.MatchMode = AttributeMatchTrimmed
+	require.False(t, ar.Satisfy(id, &val))
+	ar.MatchMode = AttributeMatchCaseInsensitive
+	require.True(t, ar.Satisfy(id, &val))
+
+	require.NoError(t, AttributeCon{*ar}.Validate())
+	ar.MatchMode = "fuzzy"
+	require.Error(t, AttributeCon{*ar}.Validate())
+}
+
+func TestSchemeHTTPTimeout(t *testing.T) {
+	hung := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-hung
+	}))
+	defer srv.Close()
+	defer close(hung)
+
+	start := time.Now()
+	_, err := downloadSchemeManager(srv.URL, 100*time.Millisecond, nil)
+	require.Error(t, err)
+	serr, ok := err.(*SessionError)
+	require.True(t, ok)
+	require.Equal(t, ErrorTimeout, serr.ErrorType)
+	require.True(t, time.Since(start) < time.Second) // not retried
+}
+
+func TestSchemeMirrors(t *testing.T) {
+	test.StartSchemeManagerHttpServer()
+	defer test.StopSchemeManagerHttpServer()
+
+	url := "http://localhost:48681/nonexistent/irma-demo"
+	_, err := downloadSchemeManager(url, 0, nil)
+	require.Error(t, err)
+
+	// The first mirror fails, the second one has the scheme
+	mirrors := []string{"http://localhost:48681/nonexistent", "http://localhost:48681/irma_configuration/"}
+	scheme, err := downloadSchemeManager(url, 0, mirrors)
+	require.NoError(t, err)
+	require.Equal(t, "irma-demo", scheme.ID)
+	require.Equal(t, url, scheme.URL)
+
+	transport := newSchemeTransport(url, 0, mirrors)
+	_, err = transport.GetBytes("index")
+	require.NoError(t, err)
+	require.Equal(t, 1, transport.current)
+}
+
+func TestSchemePins(t *testing.T) {
+	test.StartSchemeManagerHttpServer()
+	defer test.StopSchemeManagerHttpServer()
+	storage := test.CreateTestStorage(t)
+	defer test.ClearTestStorage(t, storage)
+
+	path := filepath.Join("testdata", "tmp", "client", "irma_configuration")
+	require.NoError(t, common.CopyDirectory(filepath.Join("testdata", "irma_configuration"), path))
+	conf, err := NewConfiguration(path, ConfigurationOptions{})
+	require.NoError(t, err)
+	require.NoError(t, conf.ParseFolder())
+
+	// Pin the scheme to its current version, older than the updated one
+	schemeid := NewSchemeManagerIdentifier("irma-demo")
+	pin := conf.SchemeManagers[schemeid].Timestamp
+	conf.SchemePins = map[SchemeManagerIdentifier]Timestamp{schemeid: pin}
+	attrid := NewAttributeTypeIdentifier("irma-demo.RU.studentCard.newAttribute")
+
+	// The remote version is newer than the pin, so the scheme is not updated
+	conf.SchemeManagers[schemeid].URL = "http://localhost:48681/irma_configuration_updated/irma-demo"
+	require.NoError(t, conf.UpdateSchemeManager(schemeid, nil))
+	require.NoError(t, conf.ParseFolder())
+	require.False(t, conf.CredentialTypes[attrid.CredentialTypeIdentifier()].ContainsAttribute(attrid))
+	require.Equal(t, pin, conf.SchemeManagers[schemeid].Timestamp)
+
+	// The remote version is initially reported to be the pinned version, but it turns out to have
+	// changed beyond the pin during the update
+	var fetched int32
+	files := http.FileServer(http.Dir("testdata"))
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/timestamp") && atomic.CompareAndSwapInt32(&fetched, 0, 1) {
+			_, _ = w.Write([]byte(pin.String()))
+			return
+		}
+		files.ServeHTTP(w, r)
+	}))
+	defer srv.Close()
+	conf.SchemeManagers[schemeid].URL = srv.URL + "/irma_configuration_updated/irma-demo"
+	err = conf.UpdateSchemeManager(schemeid, nil)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "beyond its pin")
+	require.Equal(t, int32(1), atomic.LoadInt32(&fetched))
+}
+
+func TestRefreshRequests(t *testing.T) {
+	conf := parseConfiguration(t)
+	credtype := NewCredentialTypeIdentifier("irma-demo.RU.studentCard")
+
+	disclosure, err := NewRefreshDisclosureRequest(conf, credtype)
+	require.NoError(t, err)
+	require.NoError(t, disclosure.Validate())
+	require.Len(t, disclosure.Disclose, 1)
+	require.Len(t, disclosure.Disclose[0], 1)
+	require.Len(t, disclosure.Disclose[0][0], 4)
+
+	values := map[string]string{"university": "Radboud", "studentCardNumber": "31415927", "studentID": "s1234567", "level": "42"}
+	var disclosed []*DisclosedAttribute
+	for _, attr := range disclosure.Disclose[0][0] {
+		value := values[attr.Type.Name()]
+		disclosed = append(disclosed, &DisclosedAttribute{Identifier: attr.Type, RawValue: &value})
+	}
+	validity := Timestamp(time.Now().AddDate(1, 0, 0))
+	issuance, err := NewRefreshIssuanceRequest(conf, credtype, [][]*DisclosedAttribute{disclosed}, &validity)
+	require.NoError(t, err)
+	require.Len(t, issuance.Credentials, 1)
+	require.Equal(t, credtype, issuance.Credentials[0].CredentialTypeID)
+	require.Equal(t, values, issuance.Credentials[0].Attributes)
+	require.Equal(t, &validity, issuance.Credentials[0].Validity)
+
+	_, err = NewRefreshIssuanceRequest(conf, credtype, [][]*DisclosedAttribute{disclosed[1:]}, nil)
+	require.Error(t, err)
+	_, err = NewRefreshDisclosureRequest(conf, NewCredentialTypeIdentifier("irma-demo.RU.nonexistent"))
+	require.Error(t, err)
+}
@@ -235,20 +235,22 @@ func (sr *SignatureRequest) UnmarshalJSON(bts []byte) (err error) {
 	if ldContext != "" {
 		var req struct { // Identical type with default JSON unmarshaler
 			BaseRequest
-			Disclose AttributeConDisCon       `json:"disclose"`
-			Labels   map[int]TranslatedString `json:"labels"`
-			Message  string                   `json"string"`
+			Disclose   AttributeConDisCon       `json:"disclose"`
+			Labels     map[int]TranslatedString `json:"labels"`
+			Thresholds []DisjunctionThreshold   `json:"thresholds"`
+			Message    string                   `json"string"`
 		}
 		if err = json.Unmarshal(bts, &req); err != nil {
 			return err
 		}
 		*sr = SignatureRequest{
-			DisclosureRequest{
-				req.BaseRequest,
-				req.Disclose,
-				req.Labels,
+			DisclosureRequest: DisclosureRequest{
+				BaseRequest: req.BaseRequest,
+				Disclose:    req.Disclose,
+				Labels:      req.Labels,
+				Thresholds:  req.Thresholds,
 			},
-			req.Message,
+			Message: req.Message,
 		}
 		return nil
 	}
@@ -294,14 +296,20 @@ func (ir *IssuanceRequest) UnmarshalJSON(bts []byte) (err error) {
 			BaseRequest
 			Disclose    AttributeConDisCon       `json:"disclose"`
 			Labels      map[int]TranslatedString `json:"labels"`
+			Thresholds  []DisjunctionThreshold   `json:"thresholds"`
 			Credentials []*CredentialRequest     `json:"credentials"`
 		}
 		if err = json.Unmarshal(bts, &req); err != nil {
 			return err
 		}
 		*ir = IssuanceRequest{
-			DisclosureRequest: DisclosureRequest{req.BaseRequest, req.Disclose, req.Labels},
-			Credentials:       req.Credentials,
+			DisclosureRequest: DisclosureRequest{
+				BaseRequest: req.BaseRequest,
+				Disclose:    req.Disclose,
+				Labels:      req.Labels,
+				Thresholds:  req.Thresholds,
+			},
+			Credentials: req.Credentials,
 		}
 		return nil
 	}
@@ -6,6 +6,7 @@ import (
 	"net/url"
 	"strconv"
 	"strings"
+	"time"
 
 	"fmt"
 
@@ -165,6 +166,8 @@ type Qr struct {
 	URL string `json:"u"`
 	// Session type (disclosing, signing, issuing)
 	Type Action `json:"irmaqr"`
+	// Time after which the session will have expired if it was not yet started, if specified
+	Expiry *Timestamp `json:"exp,omitempty"`
 }
 
 type SchemeManagerRequest Qr
@@ -193,6 +196,8 @@ const (
 	ErrorProtocolVersionNotSupported = ErrorType("protocolVersionNotSupported")
 	// Error in HTTP communication
 	ErrorTransport = ErrorType("transport")
+	// HTTP request timed out
+	ErrorTimeout = ErrorType("timeout")
 	// Invalid client JWT in first IRMA message
 	ErrorInvalidJWT = ErrorType("invalidJwt")
 	// Unkown session type (not disclosing, signing, or issuing)
@@ -227,6 +232,8 @@ const (
 	ErrorInvalidRequest = ErrorType("invalidRequest")
 	// Recovered panic
 	ErrorPanic = ErrorType("panic")
+	// The session of a QR had already expired when it was scanned
+	ErrorSessionExpired = ErrorType("sessionExpired")
 )
 
 type Disclosure struct {
@@ -246,9 +253,79 @@ type DisclosedAttributeIndex struct {
 	Identifier      CredentialIdentifier `json:"-"` // credential from which this attribute was disclosed
 }
 
+// SessionDeleteMessage is optionally included by the client in the body of the DELETE with which
+// it aborts a session, indicating why it does so.
+type SessionDeleteMessage struct {
+	Declined bool `json:"declined,omitempty"` // The user declined the session
+}
+
+// PairingMessage is POSTed by the client in sessions requiring pairing, containing the pairing
+// code that the frontend showed to the user.
+type PairingMessage struct {
+	PairingCode string `json:"pairingCode"`
+}
+
+// AbortReason indicates why the client aborted a session.
+type AbortReason string
+
+const (
+	AbortReasonDeclined AbortReason = "declined" // The user declined the session
+	AbortReasonError    AbortReason = "error"    // An error occurred in the client
+	AbortReasonTimeout  AbortReason = "timeout"  // The client gave up waiting, e.g. for the user
+)
+
+// maxAbortMessageLength is the maximum length of the human-readable message in a SessionAbortMessage.
+const maxAbortMessageLength = 256
+
+// SessionAbortMessage is POSTed by the client to abort a session, indicating why it does so.
+type SessionAbortMessage struct {
+	Reason  AbortReason `json:"reason"`
+	Message string      `json:"message,omitempty"` // Optional human-readable details, without personal data
+}
+
+func (m *SessionAbortMessage) Validate() error {
+	switch m.Reason {
+	case AbortReasonDeclined, AbortReasonError, AbortReasonTimeout:
+	default:
+		return errors.Errorf("unknown abort reason %s", m.Reason)
+	}
+	if len(m.Message) > maxAbortMessageLength {
+		return errors.Errorf("abort message exceeds maximum length of %d", maxAbortMessageLength)
+	}
+	return nil
+}
+
 type IssueCommitmentMessage struct {
 	*gabi.IssueCommitmentMessage
-	Indices DisclosedAttributeIndices `json:"indices,omitempty"`
+	Indices          DisclosedAttributeIndices `json:"indices,omitempty"`
+	ClientAttributes []map[string]string       `json:"clientAttributes,omitempty"`
+}
+
+// IssueSignatureMessages is the response of the server to an IssueCommitmentMessage, containing
+// the signatures of the issued credentials in the order of the issuance request. If the server
+// allows partial issuance, Failed lists the indices within the issuance request of the
+// credentials that could not be issued, for which Signatures contains no signature.
+// It is encoded as the plain list of signatures if all credentials were issued.
+type IssueSignatureMessages struct {
+	Signatures []*gabi.IssueSignatureMessage `json:"signatures"`
+	Failed     []int                         `json:"failed,omitempty"`
+}
+
+func (msg *IssueSignatureMessages) MarshalJSON() ([]byte, error) {
+	if len(msg.Failed) == 0 {
+		return json.Marshal(msg.Signatures)
+	}
+	type issueSignatureMessages IssueSignatureMessages
+	return json.Marshal((*issueSignatureMessages)(msg))
+}
+
+func (msg *IssueSignatureMessages) UnmarshalJSON(bts []byte) error {
+	if bts = bytes.TrimSpace(bts); len(bts) > 0 && bts[0] == '[' {
+		msg.Failed = nil
+		return json.Unmarshal(bts, &msg.Signatures)
+	}
+	type issueSignatureMessages IssueSignatureMessages
+	return json.Unmarshal(bts, (*issueSignatureMessages)(msg))
 }
 
 func (err ErrorType) Error() string {
@@ -326,6 +403,24 @@ func ParseRequestorJwt(action string, requestorJwt string) (RequestorJwt, error)
 	return retval, nil
 }
 
+// UniversalLinkPrefix is the prefix of universal links that open a session in the IRMA app.
+const UniversalLinkPrefix = "https://irma.app/-/session#"
+
+// UniversalLink returns a link that, when opened on a mobile device having the IRMA app installed,
+// starts the session of this QR in the IRMA app.
+func (qr *Qr) UniversalLink() (string, error) {
+	bts, err := json.Marshal(qr)
+	if err != nil {
+		return "", err
+	}
+	return UniversalLinkPrefix + strings.Replace(url.QueryEscape(string(bts)), "+", "%20", -1), nil
+}
+
+// Expired returns true if the QR contains an expiry timestamp that has passed.
+func (qr *Qr) Expired() bool {
+	return qr.Expiry != nil && time.Time(*qr.Expiry).Before(time.Now())
+}
+
 func (qr *Qr) Validate() (err error) {
 	if qr.URL == "" {
 		return errors.New("No URL specified")
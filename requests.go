@@ -5,11 +5,14 @@ import (
 	"encoding/xml"
 	"fmt"
 	"io/ioutil"
+	"regexp"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/bwesterb/go-atum"
 	"github.com/dgrijalva/jwt-go"
+	"github.com/fxamacker/cbor"
 	"github.com/go-errors/errors"
 	"github.com/privacybydesign/gabi"
 	"github.com/privacybydesign/gabi/big"
@@ -33,6 +36,7 @@ type BaseRequest struct {
 	Context         *big.Int         `json:"context,omitempty"`
 	Nonce           *big.Int         `json:"nonce,omitempty"`
 	ProtocolVersion *ProtocolVersion `json:"protocolVersion,omitempty"`
+	PairingRequired bool             `json:"pairingRequired,omitempty"` // The client must submit the pairing code shown by the frontend before proceeding
 
 	// Revocation is set by the requestor to indicate that it requires nonrevocation proofs for the
 	// specified credential types.
@@ -44,6 +48,9 @@ type BaseRequest struct {
 	Type   Action `json:"type,omitempty"` // Session type, only used in legacy code
 
 	ClientReturnURL string `json:"clientReturnUrl,omitempty"` // URL to proceed to when IRMA session is completed
+
+	// RequestorName is the name of the requestor to be shown to the user.
+	RequestorName TranslatedString `json:"requestorName,omitempty"`
 }
 
 // An AttributeCon is only satisfied if all of its containing attribute requests are satisfied.
@@ -60,8 +67,17 @@ type AttributeConDisCon []AttributeDisCon
 type DisclosureRequest struct {
 	BaseRequest
 
-	Disclose AttributeConDisCon       `json:"disclose,omitempty"`
-	Labels   map[int]TranslatedString `json:"labels,omitempty"`
+	Disclose   AttributeConDisCon       `json:"disclose,omitempty"`
+	Labels     map[int]TranslatedString `json:"labels,omitempty"`
+	Thresholds []DisjunctionThreshold   `json:"thresholds,omitempty"`
+}
+
+// DisjunctionThreshold requires at least Min of the specified disjunctions of a disclosure request
+// to be satisfied by a nonempty option. Together with optional disjunctions, i.e. disjunctions
+// containing an empty option, this allows requesting e.g. at least 2 out of 3 credentials.
+type DisjunctionThreshold struct {
+	Disjunctions []int `json:"disjunctions"`
+	Min          int   `json:"min"`
 }
 
 // A SignatureRequest is a a request to sign a message with certain attributes. Construct new
@@ -77,6 +93,9 @@ type SignatureRequest struct {
 type IssuanceRequest struct {
 	DisclosureRequest
 	Credentials []*CredentialRequest `json:"credentials"`
+	// Amount of seconds that the server may wait for external confirmation of the issuance before
+	// responding to the issuance commitments, if the issuance needs to be confirmed externally
+	ConfirmationTimeout int `json:"confirmationTimeout,omitempty"`
 
 	// Derived data
 	CredentialInfoList        CredentialInfoList `json:",omitempty"`
@@ -86,11 +105,24 @@ type IssuanceRequest struct {
 // A CredentialRequest contains the attributes and metadata of a credential
 // that will be issued in an IssuanceRequest.
 type CredentialRequest struct {
-	Validity         *Timestamp               `json:"validity,omitempty"`
+	Validity *Timestamp `json:"validity,omitempty"`
+	// Counter of the private key of the issuer with which the credential is issued. As 0 is the
+	// default, it means that the latest private key is used instead of the key with counter 0,
+	// which can thus only be used when it is the latest key of the issuer.
 	KeyCounter       uint                     `json:"keyCounter,omitempty"`
 	CredentialTypeID CredentialTypeIdentifier `json:"credential"`
 	Attributes       map[string]string        `json:"attributes"`
 	RevocationKey    string                   `json:"revocationKey,omitempty"`
+	// Attributes whose value is chosen by the client instead of by the issuer, mapped to a regular
+	// expression that the chosen value must match (the empty string allows any value). The client
+	// puts its chosen values in Attributes, and sends them along with its issuance commitments.
+	ClientAttributes map[string]string `json:"clientAttributes,omitempty"`
+	// Optional attributes that are explicitly not issued, i.e. that are null in the credential
+	// (as opposed to the empty string). These may not occur in Attributes or ClientAttributes.
+	AbsentAttributes []string `json:"absentAttributes,omitempty"`
+	// Attributes mapped to a regular expression that their value in Attributes must match,
+	// checked by the IRMA server before the issuance session is started.
+	AttributeFormats map[string]string `json:"attributeFormats,omitempty"`
 }
 
 // SessionRequest instances contain all information the irmaclient needs to perform an IRMA session.
@@ -120,6 +152,28 @@ type RequestorBaseRequest struct {
 	ResultJwtValidity int    `json:"validity,omitempty"`    // Validity of session result JWT in seconds
 	ClientTimeout     int    `json:"timeout,omitempty"`     // Wait this many seconds for the IRMA app to connect before the session times out
 	CallbackURL       string `json:"callbackUrl,omitempty"` // URL to post session result to
+	Pairing           bool   `json:"pairing,omitempty"`     // Require the IRMA app to submit the pairing code shown by the frontend before the session proceeds
+
+	// If specified, only attributes from credentials of these schemes are accepted
+	AcceptedSchemes []SchemeManagerIdentifier `json:"acceptedSchemes,omitempty"`
+	// If specified, only attributes from credentials that remain valid for at least this many seconds are accepted
+	MinRemainingValidity int `json:"minRemainingValidity,omitempty"`
+	// If specified, starting this session cancels any unfinished session of the same requestor in the
+	// same group, e.g. an identifier of the user for which the session is started
+	SessionGroup string `json:"sessionGroup,omitempty"`
+	// Language (e.g. "en" or "nl") of human-readable names and values in the session result and in
+	// error messages, overriding the default language of the IRMA server
+	Language string `json:"language,omitempty"`
+	// Include this request (without revocation keys) in the session result posted to CallbackURL
+	CallbackIncludeRequest bool `json:"callbackIncludeRequest,omitempty"`
+	// In issuance sessions, hold off signing the credentials after the client has sent its
+	// commitments until the issuance is confirmed externally, e.g. after a payment has been received
+	ExternalConfirmation bool `json:"externalConfirmation,omitempty"`
+	// Key of the HMAC with which the values of attributes requested with ReturnHashed are hashed
+	HashSalt string `json:"hashSalt,omitempty"`
+	// Include in the session result the version of the scheme of each disclosed credential type,
+	// so that it can later be established which credential definitions were in force
+	IncludeSchemeVersions bool `json:"includeSchemeVersions,omitempty"`
 }
 
 // RequestorRequest is the message with which requestors start an IRMA session. It contains a
@@ -189,11 +243,26 @@ type DisclosureChoice struct {
 // An AttributeRequest asks for an instance of an attribute type, possibly requiring it to have
 // a specified value, in a session request.
 type AttributeRequest struct {
-	Type    AttributeTypeIdentifier `json:"type"`
-	Value   *string                 `json:"value,omitempty"`
-	NotNull bool                    `json:"notNull,omitempty"`
+	Type      AttributeTypeIdentifier `json:"type"`
+	Value     *string                 `json:"value,omitempty"`
+	MatchMode AttributeMatchMode      `json:"matchMode,omitempty"` // How Value is compared, exact by default
+	NotNull   bool                    `json:"notNull,omitempty"`
+	NotEmpty  bool                    `json:"notEmpty,omitempty"` // Require a present and nonempty value
+	// In disclosure sessions, return to the requestor an HMAC of the attribute value using the
+	// HashSalt of the request as key, instead of the value itself
+	ReturnHashed bool `json:"returnHashed,omitempty"`
 }
 
+// AttributeMatchMode specifies how an attribute value is compared to the value required
+// by an AttributeRequest.
+type AttributeMatchMode string
+
+const (
+	AttributeMatchExact           AttributeMatchMode = "exact"
+	AttributeMatchCaseInsensitive AttributeMatchMode = "caseInsensitive" // also ignores surrounding whitespace
+	AttributeMatchTrimmed         AttributeMatchMode = "trimmed"         // ignores surrounding whitespace
+)
+
 type RevocationRequest struct {
 	LDContext      string                   `json:"@context,omitempty"`
 	CredentialType CredentialTypeIdentifier `json:"type"`
@@ -302,6 +371,9 @@ func (c AttributeCon) Validate() error {
 	var last CredentialTypeIdentifier
 	for _, attr := range c {
 		typ := attr.Type.CredentialTypeIdentifier()
+		if !attr.MatchMode.valid() {
+			return errors.Errorf("Unknown matchMode %s", attr.MatchMode)
+		}
 		if _, contains := credtypes[typ]; contains && last != typ {
 			return errors.New("Within inner conjunctions, attributes from the same credential type must be adjacent")
 		}
@@ -327,7 +399,7 @@ func (ar *AttributeRequest) UnmarshalJSON(bts []byte) error {
 }
 
 func (ar *AttributeRequest) MarshalJSON() ([]byte, error) {
-	if !ar.NotNull && ar.Value == nil {
+	if !ar.NotNull && !ar.NotEmpty && ar.Value == nil && ar.MatchMode == "" && !ar.ReturnHashed {
 		return json.Marshal(ar.Type)
 	}
 	return json.Marshal((*jsonAttributeRequest)(ar))
@@ -337,7 +409,28 @@ func (ar *AttributeRequest) MarshalJSON() ([]byte, error) {
 func (ar *AttributeRequest) Satisfy(attr AttributeTypeIdentifier, val *string) bool {
 	return ar.Type == attr &&
 		(!ar.NotNull || val != nil) &&
-		(ar.Value == nil || (val != nil && *ar.Value == *val))
+		(!ar.NotEmpty || (val != nil && *val != "")) &&
+		(ar.Value == nil || (val != nil && ar.MatchMode.match(*ar.Value, *val)))
+}
+
+func (mode AttributeMatchMode) valid() bool {
+	switch mode {
+	case "", AttributeMatchExact, AttributeMatchCaseInsensitive, AttributeMatchTrimmed:
+		return true
+	default:
+		return false
+	}
+}
+
+func (mode AttributeMatchMode) match(required, val string) bool {
+	switch mode {
+	case AttributeMatchCaseInsensitive:
+		return strings.EqualFold(strings.TrimSpace(required), strings.TrimSpace(val))
+	case AttributeMatchTrimmed:
+		return strings.TrimSpace(required) == strings.TrimSpace(val)
+	default:
+		return required == val
+	}
 }
 
 // Satisfy returns if each of the attributes specified by proofs and indices satisfies each of
@@ -393,6 +486,39 @@ func (dc AttributeDisCon) Satisfy(proofs gabi.ProofList, indices []*DisclosedAtt
 	return false, nil, nil
 }
 
+// SatisfiedBy returns the index of the first of the contained AttributeCon's that is satisfied by
+// the specified disclosed attributes, or -1 if there is none.
+func (dc AttributeDisCon) SatisfiedBy(attrs []*DisclosedAttribute) int {
+	for i, con := range dc {
+		if len(con) != len(attrs) {
+			continue
+		}
+		satisfied := true
+		for j := range con {
+			if !con[j].Satisfy(attrs[j].Identifier, attrs[j].RawValue) {
+				satisfied = false
+				break
+			}
+		}
+		if satisfied {
+			return i
+		}
+	}
+	return -1
+}
+
+// Satisfied returns how many of the disjunctions of the threshold are satisfied by a nonempty
+// option in the specified disclosed attributes.
+func (t DisjunctionThreshold) Satisfied(disclosed [][]*DisclosedAttribute) int {
+	count := 0
+	for _, i := range t.Disjunctions {
+		if i < len(disclosed) && len(disclosed[i]) > 0 {
+			count++
+		}
+	}
+	return count
+}
+
 func (cdc AttributeConDisCon) Validate(conf *Configuration) error {
 	for _, discon := range cdc {
 		for _, con := range discon {
@@ -485,6 +611,57 @@ func NewIssuanceRequest(creds []*CredentialRequest, attrs ...AttributeTypeIdenti
 	}
 }
 
+// NewRefreshDisclosureRequest returns a disclosure request for all attributes of a credential of
+// the specified type, with which a credential can be renewed: pass the disclosed attributes to
+// NewRefreshIssuanceRequest() to construct the issuance request of the renewed credential.
+func NewRefreshDisclosureRequest(conf *Configuration, credtype CredentialTypeIdentifier) (*DisclosureRequest, error) {
+	typ := conf.CredentialTypes[credtype]
+	if typ == nil {
+		return nil, errors.Errorf("unknown credential type %s", credtype)
+	}
+	con := AttributeCon{}
+	for _, attr := range typ.AttributeTypes {
+		if !attr.RevocationAttribute {
+			con = append(con, AttributeRequest{Type: attr.GetAttributeTypeIdentifier()})
+		}
+	}
+	request := NewDisclosureRequest()
+	request.Disclose = AttributeConDisCon{AttributeDisCon{con}}
+	return request, nil
+}
+
+// NewRefreshIssuanceRequest returns an issuance request that renews the credential of the specified
+// type, copying its attribute values from the disclosed attributes of a session started with
+// NewRefreshDisclosureRequest(), with the specified validity (nil for the default). The caller
+// should check that the proof status of the session was valid, and if the credential type supports
+// revocation, set the revocation key of the returned request.
+func NewRefreshIssuanceRequest(
+	conf *Configuration, credtype CredentialTypeIdentifier, disclosed [][]*DisclosedAttribute, validity *Timestamp,
+) (*IssuanceRequest, error) {
+	typ := conf.CredentialTypes[credtype]
+	if typ == nil {
+		return nil, errors.Errorf("unknown credential type %s", credtype)
+	}
+	attrs := map[string]string{}
+	for _, list := range disclosed {
+		for _, attr := range list {
+			if attr.Identifier.CredentialTypeIdentifier() == credtype && attr.RawValue != nil {
+				attrs[attr.Identifier.Name()] = *attr.RawValue
+			}
+		}
+	}
+	for _, attr := range typ.AttributeTypes {
+		if _, present := attrs[attr.ID]; !present && !attr.IsOptional() && !attr.RevocationAttribute {
+			return nil, errors.Errorf("attribute %s was not disclosed", attr.GetAttributeTypeIdentifier())
+		}
+	}
+	return NewIssuanceRequest([]*CredentialRequest{{
+		Validity:         validity,
+		CredentialTypeID: credtype,
+		Attributes:       attrs,
+	}}), nil
+}
+
 func (dr *DisclosureRequest) Disclosure() *DisclosureRequest {
 	return dr
 }
@@ -536,6 +713,22 @@ func (dr *DisclosureRequest) Validate() error {
 			return err
 		}
 	}
+	return dr.validateThresholds()
+}
+
+func (dr *DisclosureRequest) validateThresholds() error {
+	for _, t := range dr.Thresholds {
+		if t.Min < 1 || t.Min > len(t.Disjunctions) {
+			return errors.New("Disjunction threshold minimum out of range")
+		}
+		seen := map[int]bool{}
+		for _, i := range t.Disjunctions {
+			if i < 0 || i >= len(dr.Disclose) || seen[i] {
+				return errors.New("Disjunction threshold refers to invalid or duplicate disjunction")
+			}
+			seen[i] = true
+		}
+	}
 	return nil
 }
 
@@ -558,7 +751,15 @@ func (cr *CredentialRequest) Validate(conf *Configuration) error {
 
 	// Check that there are no attributes in the credential request that aren't
 	// in the credential descriptor.
+	names := make([]string, 0, len(cr.Attributes)+len(cr.ClientAttributes)+len(cr.AbsentAttributes))
 	for crName := range cr.Attributes {
+		names = append(names, crName)
+	}
+	for crName := range cr.ClientAttributes {
+		names = append(names, crName)
+	}
+	names = append(names, cr.AbsentAttributes...)
+	for _, crName := range names {
 		found := false
 		for _, ad := range credtype.AttributeTypes {
 			if ad.ID == crName {
@@ -573,6 +774,22 @@ func (cr *CredentialRequest) Validate(conf *Configuration) error {
 
 	for _, attrtype := range credtype.AttributeTypes {
 		_, present := cr.Attributes[attrtype.ID]
+		_, client := cr.ClientAttributes[attrtype.ID]
+		if cr.absent(attrtype.ID) {
+			if attrtype.Optional != "true" {
+				return errors.Errorf("attribute %s is not optional and cannot be absent", attrtype.ID)
+			}
+			if present || client {
+				return errors.Errorf("absent attribute %s cannot have a value", attrtype.ID)
+			}
+			continue
+		}
+		if client {
+			if attrtype.RevocationAttribute {
+				return errors.New("revocation attribute cannot be chosen by client")
+			}
+			continue
+		}
 		if !present && !attrtype.RevocationAttribute && attrtype.Optional != "true" {
 			return errors.New("Required attribute not present in credential request")
 		}
@@ -584,6 +801,16 @@ func (cr *CredentialRequest) Validate(conf *Configuration) error {
 	return nil
 }
 
+// absent returns whether the specified attribute is marked as absent in the credential request.
+func (cr *CredentialRequest) absent(attr string) bool {
+	for _, a := range cr.AbsentAttributes {
+		if a == attr {
+			return true
+		}
+	}
+	return false
+}
+
 // AttributeList returns the list of attributes from this credential request.
 func (cr *CredentialRequest) AttributeList(
 	conf *Configuration,
@@ -622,7 +849,7 @@ func (cr *CredentialRequest) AttributeList(
 		if attrtype.RevocationAttribute {
 			continue
 		}
-		attrs[i+1] = new(big.Int)
+		attrs[i+1] = new(big.Int) // Absent attributes are encoded as zero
 		if str, present := cr.Attributes[attrtype.ID]; present {
 			// Set attribute to str << 1 + 1
 			attrs[i+1].SetBytes([]byte(str))
@@ -679,6 +906,76 @@ func (ir *IssuanceRequest) GetCredentialInfoList(conf *Configuration, version *P
 	return ir.CredentialInfoList, nil
 }
 
+// HasClientAttributes returns whether any of the credential requests has attributes whose
+// value is chosen by the client.
+func (ir *IssuanceRequest) HasClientAttributes() bool {
+	for _, cred := range ir.Credentials {
+		if len(cred.ClientAttributes) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// ClientAttributeValues returns, per credential request, the values that the client chose for
+// the client attributes of the credential request, or nil if there are no client attributes.
+func (ir *IssuanceRequest) ClientAttributeValues() []map[string]string {
+	var values []map[string]string
+	for i, cred := range ir.Credentials {
+		if len(cred.ClientAttributes) == 0 {
+			continue
+		}
+		if values == nil {
+			values = make([]map[string]string, len(ir.Credentials))
+		}
+		values[i] = map[string]string{}
+		for attr := range cred.ClientAttributes {
+			if value, present := cred.Attributes[attr]; present {
+				values[i][attr] = value
+			}
+		}
+	}
+	return values
+}
+
+// SetClientAttributes checks the specified client-chosen attribute values, as returned by
+// ClientAttributeValues(), against the client attributes of the credential requests and their
+// formats, and puts them in the attributes of the credential requests.
+func (ir *IssuanceRequest) SetClientAttributes(values []map[string]string) error {
+	if len(values) > len(ir.Credentials) {
+		return errors.New("received client attributes for too many credentials")
+	}
+	for i, cred := range ir.Credentials {
+		var credValues map[string]string
+		if i < len(values) {
+			credValues = values[i]
+		}
+		for attr := range credValues {
+			if _, ok := cred.ClientAttributes[attr]; !ok {
+				return errors.Errorf("attribute %s of %s cannot be chosen by client", attr, cred.CredentialTypeID)
+			}
+		}
+		for attr, format := range cred.ClientAttributes {
+			value, present := credValues[attr]
+			if !present {
+				return errors.Errorf("missing client-chosen value for attribute %s of %s", attr, cred.CredentialTypeID)
+			}
+			r, err := regexp.Compile("^(?:" + format + ")$")
+			if err != nil {
+				return errors.WrapPrefix(err, "invalid format of client attribute", 0)
+			}
+			if !r.MatchString(value) {
+				return errors.Errorf("client-chosen value for attribute %s of %s has invalid format", attr, cred.CredentialTypeID)
+			}
+			if cred.Attributes == nil {
+				cred.Attributes = map[string]string{}
+			}
+			cred.Attributes[attr] = value
+		}
+	}
+	return nil
+}
+
 func (ir *IssuanceRequest) Action() Action { return ActionIssuing }
 
 func (ir *IssuanceRequest) Validate() error {
@@ -748,7 +1045,7 @@ func (sr *SignatureRequest) Validate() error {
 			return err
 		}
 	}
-	return nil
+	return sr.validateThresholds()
 }
 
 // Check if Timestamp is before other Timestamp. Used for checking expiry of attributes
@@ -793,6 +1090,21 @@ func (t *Timestamp) UnmarshalJSON(b []byte) error {
 	return nil
 }
 
+// MarshalCBOR marshals a timestamp.
+func (t *Timestamp) MarshalCBOR() ([]byte, error) {
+	return cbor.Marshal(time.Time(*t).Unix(), cbor.EncOptions{})
+}
+
+// UnmarshalCBOR unmarshals a timestamp.
+func (t *Timestamp) UnmarshalCBOR(data []byte) error {
+	var ts int64
+	if err := cbor.Unmarshal(data, &ts); err != nil {
+		return err
+	}
+	*t = Timestamp(time.Unix(ts, 0))
+	return nil
+}
+
 // Timestamp implements Stringer.
 func (t *Timestamp) String() string {
 	return fmt.Sprint(time.Time(*t).Unix())
@@ -390,15 +390,47 @@ func (rs *RevocationStorage) Revoke(id CredentialTypeIdentifier, key string, iss
 	})
 }
 
+// RevokeIssuedBetween revokes all credentials of the specified type issued between from and to
+// (inclusive) that are not already revoked, e.g. because the private key with which they were
+// issued is suspected to be compromised. It returns the number of revoked credentials.
+func (rs *RevocationStorage) RevokeIssuedBetween(id CredentialTypeIdentifier, from, to time.Time) (int, error) {
+	if !rs.settings.Get(id).Authority {
+		return 0, errors.Errorf("cannot revoke %s", id)
+	}
+	if to.Before(from) {
+		return 0, errors.New("illegal issuance interval")
+	}
+	var count int
+	err := rs.sqldb.Transaction(func(tx sqlRevStorage) error {
+		var issrecords []*IssuanceRecord
+		err := tx.Find(&issrecords, "cred_type = ? and revoked_at = 0 and issued between ? and ?",
+			id, from.UnixNano(), to.UnixNano())
+		if err != nil || len(issrecords) == 0 {
+			return err
+		}
+		count = len(issrecords)
+		return rs.revokeRecords(tx, id, issrecords)
+	})
+	if err != nil {
+		return 0, err
+	}
+	return count, nil
+}
+
 func (rs *RevocationStorage) revoke(tx sqlRevStorage, id CredentialTypeIdentifier, key string, issued time.Time) error {
-	var err error
 	issrecords, err := rs.IssuanceRecords(id, key, issued)
 	if err != nil {
 		return err
 	}
+	return rs.revokeRecords(tx, id, issrecords)
+}
 
+func (rs *RevocationStorage) revokeRecords(tx sqlRevStorage, id CredentialTypeIdentifier, issrecords []*IssuanceRecord) error {
 	// get all relevant accumulators and events from the database
 	accs, events, err := rs.revokeReadRecords(tx, id, issrecords)
+	if err != nil {
+		return err
+	}
 
 	// For each issuance record, perform revocation, adding an Event and advancing the accumulator
 	for _, issrecord := range issrecords {
@@ -36,7 +36,7 @@ func (conf *Configuration) DownloadDefaultSchemes() error {
 	Logger.Info("downloading default schemes (may take a while)")
 	for _, s := range DefaultSchemeManagers {
 		Logger.Debugf("Downloading scheme at %s", s.Url)
-		scheme, err := DownloadSchemeManager(s.Url)
+		scheme, err := downloadSchemeManager(s.Url, conf.SchemeHTTPTimeout, conf.SchemeMirrors)
 		if err != nil {
 			return err
 		}
@@ -57,7 +57,7 @@ func (conf *Configuration) downloadDemoPrivateKeys(scheme *SchemeManager) error
 	}
 
 	Logger.Debugf("Attempting downloading of private keys of scheme %s", scheme.ID)
-	transport := NewHTTPTransport(scheme.URL)
+	transport := newSchemeTransport(scheme.URL, conf.SchemeHTTPTimeout, conf.SchemeMirrors)
 
 	err := conf.downloadFile(transport, scheme.ID, "sk.pem")
 	if err != nil { // If downloading of any of the private key fails just log it, and then continue
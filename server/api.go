@@ -1,8 +1,11 @@
 package server
 
 import (
+	"bufio"
 	"bytes"
+	"context"
 	"crypto/rsa"
+	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
@@ -13,7 +16,10 @@ import (
 	"runtime"
 	"runtime/debug"
 	"strings"
+	"sync"
 	"time"
+	"unicode"
+	"unicode/utf8"
 
 	"github.com/dgrijalva/jwt-go"
 	"github.com/go-chi/chi/middleware"
@@ -26,8 +32,10 @@ import (
 var Logger *logrus.Logger = logrus.StandardLogger()
 
 type SessionPackage struct {
-	SessionPtr *irma.Qr `json:"sessionPtr"`
-	Token      string   `json:"token"`
+	SessionPtr    *irma.Qr `json:"sessionPtr"`
+	Token         string   `json:"token"`
+	UniversalLink string   `json:"universalLink,omitempty"` // Only present if enabled in the configuration
+	PairingCode   string   `json:"pairingCode,omitempty"`   // Only present if pairing is required; to be shown by the frontend
 }
 
 // SessionResult contains session information such as the session status, type, possible errors,
@@ -40,10 +48,186 @@ type SessionResult struct {
 	Disclosed   [][]*irma.DisclosedAttribute `json:"disclosed,omitempty"`
 	Signature   *irma.SignedMessage          `json:"signature,omitempty"`
 	Err         *irma.RemoteError            `json:"error,omitempty"`
+	Issued      []*CredentialIssuanceResult  `json:"issued,omitempty"`  // Only present if partial issuance is allowed
+	Request     json.RawMessage              `json:"request,omitempty"` // Only present in result callbacks, if requested
+
+	// Only present in signing sessions in which a valid signature was received
+	SignatureDetails *SignatureDetails `json:"signatureDetails,omitempty"`
+
+	// Only present in issuance sessions having client attributes: per credential request,
+	// the attribute values that the client chose
+	ClientAttributes []map[string]string `json:"clientAttributes,omitempty"`
+
+	// Per threshold of the disclosure request, how many of its disjunctions were disclosed
+	ThresholdsSatisfied []int `json:"thresholdsSatisfied,omitempty"`
+
+	// Only present if the client aborted the session by POSTing a reason
+	Abort *irma.SessionAbortMessage `json:"abort,omitempty"`
+
+	// Only present if requested with IncludeSchemeVersions
+	SchemeVersions []*CredentialSchemeVersion `json:"schemeVersions,omitempty"`
+
+	// Only present in results stored in a ResultStore if a ResultEncryptionKey is configured, in which
+	// case it contains the encrypted attributes, signature, request and abort reason of the result
+	Encrypted []byte `json:"encrypted,omitempty"`
 
 	LegacySession bool `json:"-"` // true if request was started with legacy (i.e. pre-condiscon) session request
 }
 
+// SignatureDetails describes how the attribute-based signature of a signing session was verified,
+// so that the signature can be recorded along with the context of its verification.
+type SignatureDetails struct {
+	Message          string                       `json:"message"`
+	Attributes       [][]*irma.DisclosedAttribute `json:"attributes"`
+	PublicKeys       []PublicKeyIdentifier        `json:"publicKeys"`          // issuer keys against which the proofs were verified
+	Timestamp        *irma.Timestamp              `json:"timestamp,omitempty"` // as signed by the timestamp server, if any
+	TimestampServer  string                       `json:"timestampServer,omitempty"`
+	VerifiedAt       irma.Timestamp               `json:"verifiedAt"`
+	SignatureVersion int                          `json:"signatureVersion"`
+	ProtocolVersion  *irma.ProtocolVersion        `json:"protocolVersion,omitempty"`
+}
+
+// PublicKeyIdentifier identifies a public key of an issuer.
+type PublicKeyIdentifier struct {
+	Issuer  irma.IssuerIdentifier `json:"issuer"`
+	Counter uint                  `json:"counter"`
+}
+
+// CredentialSchemeVersion records the version (i.e. timestamp) of the scheme that defined a
+// disclosed credential type at the moment the disclosure was verified.
+type CredentialSchemeVersion struct {
+	CredentialTypeID irma.CredentialTypeIdentifier `json:"credentialType"`
+	Scheme           irma.SchemeManagerIdentifier  `json:"scheme"`
+	Timestamp        irma.Timestamp                `json:"timestamp"`
+}
+
+// ClientInfo contains information about the client of a session, for diagnostic purposes.
+type ClientInfo struct {
+	IP        string `json:"ip"`
+	UserAgent string `json:"userAgent"`
+}
+
+// SessionDiagnostics contains counters of the requests made by the client of a session,
+// for diagnosing misbehaving or stuck clients.
+type SessionDiagnostics struct {
+	Status         Status      `json:"status"`
+	RequestFetches int         `json:"requestFetches"` // Number of GETs of the session request
+	StatusPolls    int         `json:"statusPolls"`    // Number of status polls, including statusevents
+	ProofAttempts  int         `json:"proofAttempts"`  // Number of disclosure proofs received
+	Client         *ClientInfo `json:"client,omitempty"`
+}
+
+// VerificationError describes why the proofs or issuance commitments that the client sent in a
+// session were not accepted, for debugging failed sessions afterwards.
+type VerificationError struct {
+	ProofStatus irma.ProofStatus `json:"proofStatus"`
+	Error       ErrorType        `json:"error,omitempty"`      // Error returned to the client, if any
+	Reason      string           `json:"reason"`               // Details on the failure
+	PublicKeys  []string         `json:"publicKeys,omitempty"` // Issuer public keys (issuer-counter) used to verify the proofs
+	Time        time.Time        `json:"time"`
+}
+
+// SessionSummary contains the main properties of a session, for listing active sessions.
+type SessionSummary struct {
+	Token      string      `json:"token"`
+	Type       irma.Action `json:"type"`
+	Status     Status      `json:"status"`
+	Requestor  string      `json:"requestor,omitempty"`
+	LastActive time.Time   `json:"lastActive"`
+}
+
+// CBORContentType is the content type of CBOR-encoded messages. Clients may request the session
+// request to be CBOR-encoded instead of JSON-encoded by including it in their Accept header.
+const CBORContentType = "application/cbor"
+
+// ServerStats contains cumulative session counters since the server was started.
+type ServerStats struct {
+	Total    uint64                 `json:"total"`    // Number of sessions started
+	Finished uint64                 `json:"finished"` // Number of sessions that reached a final status
+	Active   uint64                 `json:"active"`   // Number of sessions started but not yet finished
+	Actions  map[irma.Action]uint64 `json:"actions"`  // Number of sessions started per session type
+}
+
+// CredentialIssuanceResult reports whether one of the credentials of an issuance session was issued.
+type CredentialIssuanceResult struct {
+	Credential irma.CredentialTypeIdentifier `json:"credential"`
+	Issued     bool                          `json:"issued"`
+	Err        string                        `json:"error,omitempty"`
+}
+
+// TracerProvider creates spans for tracing IRMA sessions, for example by wrapping an OpenTelemetry
+// tracer. If set in the Configuration, the IRMA server creates a span per started session and
+// per request of the IRMA app, having attributes such as the session type and (hashed) token.
+type TracerProvider interface {
+	StartSpan(ctx context.Context, name string) (context.Context, Span)
+}
+
+// Span is a span created by a TracerProvider.
+type Span interface {
+	SetAttribute(key, value string)
+	End()
+}
+
+// NonceCache remembers the nonces of sessions of which proofs were accepted, so that replays of
+// these proofs can be detected, also across IRMA server instances if the cache is shared.
+type NonceCache interface {
+	// Add records the nonce for the specified duration, returning false if it was already recorded.
+	Add(nonce string, ttl time.Duration) (bool, error)
+}
+
+// ResultStore stores the results of finished sessions centrally, decoupling the IRMA server
+// instance that handled the protocol messages of the IRMA app from the ones serving the results.
+type ResultStore interface {
+	// Put stores the result of a session that just finished.
+	Put(result *SessionResult) error
+	// Get returns the result of the session with the specified token, or nil if it is not present.
+	Get(token string) (*SessionResult, error)
+}
+
+type memoryNonceCache struct {
+	sync.Mutex
+	size   int
+	nonces map[string]time.Time // maps nonces to the time they expire
+}
+
+// NewMemoryNonceCache returns a NonceCache that keeps at most the specified amount of nonces in
+// memory. When full, expired nonces are removed, or else the nonce that expires first.
+func NewMemoryNonceCache(size int) NonceCache {
+	return &memoryNonceCache{size: size, nonces: make(map[string]time.Time, size)}
+}
+
+func (c *memoryNonceCache) Add(nonce string, ttl time.Duration) (bool, error) {
+	c.Lock()
+	defer c.Unlock()
+
+	now := time.Now()
+	if expiry, ok := c.nonces[nonce]; ok && expiry.After(now) {
+		return false, nil
+	}
+	if len(c.nonces) >= c.size {
+		var first string
+		for n, expiry := range c.nonces {
+			if !expiry.After(now) {
+				delete(c.nonces, n)
+			} else if first == "" || expiry.Before(c.nonces[first]) {
+				first = n
+			}
+		}
+		if len(c.nonces) >= c.size {
+			delete(c.nonces, first)
+		}
+	}
+	c.nonces[nonce] = now.Add(ttl)
+	return true, nil
+}
+
+// HashToken hashes a session token for inclusion in traces or logs, so that spans of the same
+// session can be correlated without including the token itself.
+func HashToken(token string) string {
+	h := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(h[:8])
+}
+
 // SessionHandler is a function that can handle a session result
 // once an IRMA session has completed.
 type SessionHandler func(*SessionResult)
@@ -57,10 +241,21 @@ type LogOptions struct {
 
 const (
 	StatusInitialized Status = "INITIALIZED" // The session has been started and is waiting for the client
+	StatusPairing     Status = "PAIRING"     // The client has retrieved the session request, we wait for it to submit the pairing code
 	StatusConnected   Status = "CONNECTED"   // The client has retrieved the session request, we wait for its response
+	StatusConfirming  Status = "CONFIRMING"  // The client has sent its issuance commitments, we wait for external confirmation of the issuance
 	StatusCancelled   Status = "CANCELLED"   // The session is cancelled, possibly due to an error
 	StatusDone        Status = "DONE"        // The session has completed successfully
 	StatusTimeout     Status = "TIMEOUT"     // Session timed out
+	StatusDeclined    Status = "DECLINED"    // The user declined the session in the IRMA app
+)
+
+// Finer-grained statuses of a session of which the response of the client is being processed,
+// only reported instead of StatusConnected to requestors if ProgressStatuses is enabled. IRMA apps
+// always see StatusConnected.
+const (
+	StatusReceivedProof Status = "RECEIVED_PROOF" // The client has sent its response, which awaits a verification worker
+	StatusVerifying     Status = "VERIFYING"      // The response of the client is being verified
 )
 
 const (
@@ -89,8 +284,113 @@ func (r *SessionResult) Legacy() *LegacySessionResult {
 	return &LegacySessionResult{r.Token, r.Status, r.Type, r.ProofStatus, disclosed, r.Signature, r.Err}
 }
 
+// Unmarshal stores the disclosed attributes of the session result in the struct pointed to by v.
+// Its fields specify the attribute they receive using tags of the form
+// `irma:"irma-demo.MijnOverheid.fullName.firstname"`, and must be of type string, *string,
+// irma.DisclosedAttribute or *irma.DisclosedAttribute. If the tag contains the option "required",
+// as in `irma:"pbdf.pbdf.email.email,required"`, an error is returned if the attribute was not
+// disclosed or was null. An error is also returned if the disclosure proofs were not valid.
+func (r *SessionResult) Unmarshal(v interface{}) error {
+	if r.ProofStatus != "" && r.ProofStatus != irma.ProofStatusValid {
+		return errors.Errorf("cannot unmarshal session result having proof status %s", r.ProofStatus)
+	}
+	ptr := reflect.ValueOf(v)
+	if ptr.Kind() != reflect.Ptr || ptr.IsNil() || ptr.Elem().Kind() != reflect.Struct {
+		return errors.New("can only unmarshal session result into a non-nil pointer to a struct")
+	}
+
+	disclosed := map[irma.AttributeTypeIdentifier]*irma.DisclosedAttribute{}
+	for _, con := range r.Disclosed {
+		for _, attr := range con {
+			if _, ok := disclosed[attr.Identifier]; !ok {
+				disclosed[attr.Identifier] = attr
+			}
+		}
+	}
+
+	val := ptr.Elem()
+	for i := 0; i < val.NumField(); i++ {
+		field := val.Type().Field(i)
+		tag, ok := field.Tag.Lookup("irma")
+		if !ok || tag == "-" {
+			continue
+		}
+		if !val.Field(i).CanSet() {
+			return errors.Errorf("cannot unmarshal into unexported field %s", field.Name)
+		}
+		options := strings.Split(tag, ",")
+		id := irma.NewAttributeTypeIdentifier(options[0])
+		required := false
+		for _, option := range options[1:] {
+			if option != "required" {
+				return errors.Errorf("unknown option %s in irma tag of field %s", option, field.Name)
+			}
+			required = true
+		}
+
+		attr := disclosed[id]
+		if required && (attr == nil || attr.RawValue == nil) {
+			return errors.Errorf("required attribute %s was not disclosed", id)
+		}
+		switch f := val.Field(i).Addr().Interface().(type) {
+		case *string:
+			if attr != nil && attr.RawValue != nil {
+				*f = *attr.RawValue
+			}
+		case **string:
+			if attr != nil {
+				*f = attr.RawValue
+			}
+		case *irma.DisclosedAttribute:
+			if attr != nil {
+				*f = *attr
+			}
+		case **irma.DisclosedAttribute:
+			*f = attr
+		default:
+			return errors.Errorf("cannot unmarshal attribute into field %s of type %s", field.Name, field.Type)
+		}
+	}
+	return nil
+}
+
+// DisclosedDisjunction contains the attributes with which a disjunction of the session request
+// was satisfied, see SessionResult.DisclosedDisjunctions().
+type DisclosedDisjunction struct {
+	Index      int                        `json:"index"`  // index of the disjunction in the request
+	Option     int                        `json:"option"` // index of the satisfied option, or -1
+	Attributes []*irma.DisclosedAttribute `json:"attributes,omitempty"`
+}
+
+// DisclosedDisjunctions returns, for each disjunction of the specified session request (which
+// must be the request with which the session was started), the attributes that were disclosed
+// for it and which of its options (inner conjunctions) these satisfied. Disclosed attributes
+// that were not requested are not included.
+func (r *SessionResult) DisclosedDisjunctions(request irma.SessionRequest) []*DisclosedDisjunction {
+	disclose := request.Disclosure().Disclose
+	disjunctions := make([]*DisclosedDisjunction, 0, len(disclose))
+	for i, discon := range disclose {
+		disjunction := &DisclosedDisjunction{Index: i, Option: -1}
+		if i < len(r.Disclosed) && r.Disclosed[i] != nil {
+			disjunction.Attributes = r.Disclosed[i]
+			disjunction.Option = discon.SatisfiedBy(r.Disclosed[i])
+		}
+		disjunctions = append(disjunctions, disjunction)
+	}
+	return disjunctions
+}
+
 func (status Status) Finished() bool {
-	return status == StatusDone || status == StatusCancelled || status == StatusTimeout
+	return status == StatusDone || status == StatusCancelled || status == StatusTimeout || status == StatusDeclined
+}
+
+// Coarse maps the finer-grained statuses reported if ProgressStatuses is enabled to
+// StatusConnected, for consumers that only know the coarse statuses.
+func (status Status) Coarse() Status {
+	if status == StatusReceivedProof || status == StatusVerifying {
+		return StatusConnected
+	}
+	return status
 }
 
 // RemoteError converts an error and an explaining message to an *irma.RemoteError.
@@ -121,6 +421,20 @@ func JsonResponse(v interface{}, err *irma.RemoteError) (int, []byte) {
 	return encodeValOrError(v, err, json.Marshal)
 }
 
+// FormattedJsonResponse is like JsonResponse, but encodes errors as returned by the specified
+// formatter if not nil, see Configuration.ErrorFormatter.
+func FormattedJsonResponse(v interface{}, err *irma.RemoteError, format func(*irma.RemoteError) interface{}) (int, []byte) {
+	if err == nil || format == nil {
+		return JsonResponse(v, err)
+	}
+	b, e := json.Marshal(format(err))
+	if e != nil {
+		Logger.Error("Failed to serialize response:", e.Error())
+		return http.StatusInternalServerError, nil
+	}
+	return err.Status, b
+}
+
 func BinaryResponse(v interface{}, err *irma.RemoteError) (int, []byte) {
 	return encodeValOrError(v, err, irma.MarshalBinary)
 }
@@ -157,9 +471,24 @@ func WriteBinaryResponse(w http.ResponseWriter, object interface{}, rerr *irma.R
 	_, _ = w.Write(bts)
 }
 
+// WriteCBORResponse writes the specified object or error as CBOR to the http.ResponseWriter.
+func WriteCBORResponse(w http.ResponseWriter, object interface{}, rerr *irma.RemoteError) {
+	status, bts := BinaryResponse(object, rerr)
+	w.Header().Set("Content-Type", CBORContentType)
+	w.WriteHeader(status)
+	_, err := w.Write(bts)
+	if err != nil {
+		LogWarning(errors.WrapPrefix(err, "failed to write response", 0))
+	}
+}
+
 // WriteResponse writes the specified object or error as JSON to the http.ResponseWriter.
 func WriteResponse(w http.ResponseWriter, object interface{}, rerr *irma.RemoteError) {
-	status, bts := JsonResponse(object, rerr)
+	var format func(*irma.RemoteError) interface{}
+	if fw, ok := w.(*errorFormattingWriter); ok {
+		format = fw.format
+	}
+	status, bts := FormattedJsonResponse(object, rerr, format)
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(status)
 	_, err := w.Write(bts)
@@ -168,6 +497,45 @@ func WriteResponse(w http.ResponseWriter, object interface{}, rerr *irma.RemoteE
 	}
 }
 
+// errorFormattingWriter makes WriteResponse format errors using its formatter.
+type errorFormattingWriter struct {
+	http.ResponseWriter
+	format func(*irma.RemoteError) interface{}
+}
+
+// Flush implements http.Flusher, needed for server sent events.
+func (w *errorFormattingWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// CloseNotify implements http.CloseNotifier, needed for server sent events.
+func (w *errorFormattingWriter) CloseNotify() <-chan bool {
+	if cn, ok := w.ResponseWriter.(http.CloseNotifier); ok {
+		return cn.CloseNotify()
+	}
+	return make(chan bool) // never fires, as we cannot detect the client disconnecting
+}
+
+// Hijack implements http.Hijacker.
+func (w *errorFormattingWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if h, ok := w.ResponseWriter.(http.Hijacker); ok {
+		return h.Hijack()
+	}
+	return nil, nil, errors.New("underlying http.ResponseWriter does not implement http.Hijacker")
+}
+
+// ErrorFormattingMiddleware makes WriteResponse and the functions using it format error responses
+// using the specified formatter, see Configuration.ErrorFormatter.
+func ErrorFormattingMiddleware(format func(*irma.RemoteError) interface{}) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			next.ServeHTTP(&errorFormattingWriter{ResponseWriter: w, format: format}, r)
+		})
+	}
+}
+
 // WriteString writes the specified string to the http.ResponseWriter.
 func WriteString(w http.ResponseWriter, str string) {
 	w.Header().Set("Content-Type", "text/plain")
@@ -229,6 +597,30 @@ func tryUnmarshalJson(bts []byte, attempts []irma.Validator) (irma.Validator, er
 	return nil, errors.New("")
 }
 
+// MaxPathLength is the maximum length of URL paths that ParsePath accepts.
+const MaxPathLength = 2048
+
+// ParsePath splits the specified URL path into its nonempty components. It returns an error if the
+// path is too long, is not valid UTF-8, or contains control characters such as null bytes.
+func ParsePath(path string) ([]string, error) {
+	if len(path) > MaxPathLength {
+		return nil, errors.Errorf("path too long (%d bytes)", len(path))
+	}
+	if !utf8.ValidString(path) {
+		return nil, errors.New("path is not valid UTF-8")
+	}
+	if strings.IndexFunc(path, unicode.IsControl) >= 0 {
+		return nil, errors.New("path contains control characters")
+	}
+	var components []string
+	for _, c := range strings.Split(path, "/") {
+		if c != "" {
+			components = append(components, c)
+		}
+	}
+	return components, nil
+}
+
 // LocalIP returns the IP address of one of the (non-loopback) network interfaces
 func LocalIP() (string, error) {
 	// Based on https://play.golang.org/p/BDt3qEQ_2H from https://stackoverflow.com/a/23558495
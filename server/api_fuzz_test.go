@@ -0,0 +1,43 @@
+//go:build go1.18
+// +build go1.18
+
+package server_test
+
+import (
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	"github.com/privacybydesign/irmago/server"
+)
+
+func FuzzParsePath(f *testing.F) {
+	for _, path := range []string{
+		"",
+		"/",
+		"/irma/session/abcdef",
+		"/irma/session/abcdef/status",
+		"//session//abc//",
+		"/session/\x00",
+		"/session/\xff\xfe",
+		"/session/‮",
+		"/" + strings.Repeat("a", server.MaxPathLength),
+	} {
+		f.Add(path)
+	}
+
+	f.Fuzz(func(t *testing.T, path string) {
+		components, err := server.ParsePath(path)
+		if err != nil {
+			return
+		}
+		if len(path) > server.MaxPathLength || !utf8.ValidString(path) {
+			t.Fatalf("malformed path %q accepted", path)
+		}
+		for _, c := range components {
+			if c == "" || strings.Contains(c, "/") || strings.ContainsRune(c, 0) {
+				t.Fatalf("invalid component %q in path %q", c, path)
+			}
+		}
+	})
+}
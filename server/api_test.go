@@ -4,9 +4,12 @@ import (
 	"encoding/json"
 	"fmt"
 	"github.com/privacybydesign/irmago"
+	"github.com/privacybydesign/irmago/internal/test"
 	"github.com/privacybydesign/irmago/server"
 	"github.com/stretchr/testify/require"
+	"path/filepath"
 	"testing"
+	"time"
 )
 
 func TestParseSessionRequest(t *testing.T) {
@@ -73,3 +76,177 @@ func TestParseSessionRequest(t *testing.T) {
 		require.Error(t, err)
 	})
 }
+
+func TestConfigurationValidate(t *testing.T) {
+	require.NoError(t, (&server.Configuration{URL: "http://localhost:8088/irma/"}).Validate())
+	require.NoError(t, (&server.Configuration{URL: "http://192.168.1.2:port"}).Validate())
+	require.Error(t, (&server.Configuration{URL: "http://localhost:8088/irma/",
+		MinCredentialValidity: 7 * 24 * 60 * 60, MaxCredentialValidity: 10 * 24 * 60 * 60}).Validate())
+
+	conf := &server.Configuration{
+		URL:                     "http://localhost:8088/irma/",
+		Production:              true,
+		Email:                   "nobody",
+		MaxAttributeValueLength: -1,
+	}
+	err := conf.Validate()
+	require.IsType(t, server.ConfigurationErrors{}, err)
+	errs := err.(server.ConfigurationErrors)
+	require.Len(t, errs, 3)
+	require.Equal(t, "url", errs[0].Option)
+	require.Equal(t, "email", errs[1].Option)
+	require.Equal(t, "max_attribute_value_length", errs[2].Option)
+
+	conf.DisableTLS = true
+	conf.Email, conf.MaxAttributeValueLength = "", 0
+	require.NoError(t, conf.Validate())
+
+	conf.EnabledActions = []irma.Action{irma.ActionDisclosing, irma.ActionRevoking}
+	require.Error(t, conf.Validate())
+	conf.EnabledActions = []irma.Action{irma.ActionDisclosing}
+	require.NoError(t, conf.Validate())
+	require.True(t, conf.ActionEnabled(irma.ActionDisclosing))
+	require.False(t, conf.ActionEnabled(irma.ActionIssuing))
+
+	// RequireHTTPS takes precedence over DisableTLS
+	conf.RequireHTTPS = true
+	err = conf.Validate()
+	require.IsType(t, server.ConfigurationErrors{}, err)
+	errs = err.(server.ConfigurationErrors)
+	require.Len(t, errs, 1)
+	require.Equal(t, "url", errs[0].Option)
+	conf.URL = "https://example.com/irma/"
+	require.NoError(t, conf.Validate())
+
+	conf.EnableMetrics = true
+	require.Error(t, conf.Validate())
+	conf.Email = "admin@example.com"
+	require.NoError(t, conf.Validate())
+	conf.MetricsURL = "metrics.example.com"
+	require.Error(t, conf.Validate())
+	conf.MetricsURL = "https://metrics.example.com/"
+	require.NoError(t, conf.Validate())
+}
+
+func TestMemoryNonceCache(t *testing.T) {
+	cache := server.NewMemoryNonceCache(2)
+	add := func(nonce string, ttl time.Duration) bool {
+		fresh, err := cache.Add(nonce, ttl)
+		require.NoError(t, err)
+		return fresh
+	}
+
+	require.True(t, add("1", time.Minute))
+	require.False(t, add("1", time.Minute))
+	require.True(t, add("2", time.Millisecond))
+	time.Sleep(2 * time.Millisecond)
+	require.True(t, add("2", time.Minute)) // expired
+
+	// The cache is full, so the nonce that expires first is removed
+	require.True(t, add("3", time.Hour))
+	require.True(t, add("1", time.Minute))
+	require.False(t, add("3", time.Minute))
+}
+
+func TestSessionResultDisclosedDisjunctions(t *testing.T) {
+	email, name := "foo@example.com", "Foo"
+	emailID := irma.NewAttributeTypeIdentifier("pbdf.pbdf.email.email")
+	nameID := irma.NewAttributeTypeIdentifier("irma-demo.MijnOverheid.fullName.firstname")
+	request := irma.NewDisclosureRequest()
+	request.Disclose = irma.AttributeConDisCon{
+		irma.AttributeDisCon{irma.AttributeCon{{Type: nameID}}, irma.AttributeCon{{Type: emailID}}},
+		irma.AttributeDisCon{irma.AttributeCon{{Type: nameID}}},
+	}
+	result := &server.SessionResult{
+		Disclosed: [][]*irma.DisclosedAttribute{
+			{{Identifier: emailID, RawValue: &email}},
+			nil,
+			{{Identifier: nameID, RawValue: &name, Status: irma.AttributeProofStatusExtra}},
+		},
+	}
+
+	disjunctions := result.DisclosedDisjunctions(request)
+	require.Len(t, disjunctions, 2)
+	require.Equal(t, 0, disjunctions[0].Index)
+	require.Equal(t, 1, disjunctions[0].Option)
+	require.Equal(t, result.Disclosed[0], disjunctions[0].Attributes)
+	require.Equal(t, 1, disjunctions[1].Index)
+	require.Equal(t, -1, disjunctions[1].Option)
+	require.Nil(t, disjunctions[1].Attributes)
+}
+
+func TestSessionResultUnmarshal(t *testing.T) {
+	email, name := "foo@example.com", "Foo"
+	result := &server.SessionResult{
+		ProofStatus: irma.ProofStatusValid,
+		Disclosed: [][]*irma.DisclosedAttribute{
+			{{Identifier: irma.NewAttributeTypeIdentifier("pbdf.pbdf.email.email"), RawValue: &email}},
+			{{Identifier: irma.NewAttributeTypeIdentifier("irma-demo.MijnOverheid.fullName.firstname"), RawValue: &name}},
+		},
+	}
+
+	var user struct {
+		Email     string                   `irma:"pbdf.pbdf.email.email,required"`
+		FirstName *string                  `irma:"irma-demo.MijnOverheid.fullName.firstname"`
+		LastName  *string                  `irma:"irma-demo.MijnOverheid.fullName.familyname"`
+		Attr      *irma.DisclosedAttribute `irma:"pbdf.pbdf.email.email"`
+		Other     string
+	}
+	require.NoError(t, result.Unmarshal(&user))
+	require.Equal(t, email, user.Email)
+	require.Equal(t, name, *user.FirstName)
+	require.Nil(t, user.LastName)
+	require.Equal(t, result.Disclosed[0][0], user.Attr)
+
+	var missing struct {
+		LastName string `irma:"irma-demo.MijnOverheid.fullName.familyname,required"`
+	}
+	require.Error(t, result.Unmarshal(&missing))
+
+	result.ProofStatus = irma.ProofStatusInvalid
+	require.Error(t, result.Unmarshal(&user))
+}
+
+func TestConfigurationIssuerTrusted(t *testing.T) {
+	conf := &server.Configuration{DisableTLS: true, URL: "http://localhost:8088/irma/"}
+	issuer := irma.NewIssuerIdentifier("irma-demo.RU")
+	require.True(t, conf.IssuerTrusted("", issuer))
+
+	conf.TrustedIssuers = []string{"irma-demo.MijnOverheid"}
+	conf.RequestorTrustedIssuers = map[string][]string{"tenant": {"irma-demo"}}
+	require.NoError(t, conf.Validate())
+	require.False(t, conf.IssuerTrusted("", issuer))
+	require.False(t, conf.IssuerTrusted("other", issuer))
+	require.True(t, conf.IssuerTrusted("other", irma.NewIssuerIdentifier("irma-demo.MijnOverheid")))
+	require.True(t, conf.IssuerTrusted("tenant", issuer))
+
+	conf.TrustedIssuers = []string{"irma-demo.RU.studentCard"}
+	require.Error(t, conf.Validate())
+}
+
+func TestDisclosureRequestBuilder(t *testing.T) {
+	conf, err := irma.NewConfiguration(filepath.Join(test.FindTestdataFolder(t), "irma_configuration"), irma.ConfigurationOptions{})
+	require.NoError(t, err)
+	require.NoError(t, conf.ParseFolder())
+
+	request, err := server.NewDisclosureRequest().
+		Require("irma-demo.RU.studentCard.studentID").
+		Optional("irma-demo.MijnOverheid.root.BSN").
+		WithValue("irma-demo.RU.studentCard.studentID", "456").
+		Build(conf)
+	require.NoError(t, err)
+	require.Len(t, request.Disclose, 2)
+	require.Equal(t, "456", *request.Disclose[0][0][0].Value)
+	require.Len(t, request.Disclose[1], 2)
+	require.Empty(t, request.Disclose[1][1])
+
+	_, err = server.NewDisclosureRequest().Require("irma-demo.RU.studentCard.studentId").Build(conf)
+	require.Error(t, err)
+	_, err = server.NewDisclosureRequest().
+		Require("irma-demo.RU.studentCard.studentID").
+		WithValue("irma-demo.RU.studentCard.level", "high").
+		Build(conf)
+	require.Error(t, err)
+	_, err = server.NewDisclosureRequest().Build(conf)
+	require.Error(t, err)
+}
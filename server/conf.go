@@ -2,13 +2,16 @@ package server
 
 import (
 	"crypto/rsa"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"net/url"
 	"path/filepath"
 	"regexp"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/dgrijalva/jwt-go"
 	"github.com/go-errors/errors"
@@ -33,28 +36,231 @@ type Configuration struct {
 	DisableSchemesUpdate bool `json:"disable_schemes_update" mapstructure:"disable_schemes_update"`
 	// Update all schemes every x minutes (default value 0 means 60) (use DisableSchemesUpdate to disable)
 	SchemesUpdateInterval int `json:"schemes_update" mapstructure:"schemes_update"`
+	// Timeout in seconds of HTTP requests made to download or update schemes, after which they fail
+	// without being retried (default value 0 means 3 seconds, retried twice)
+	SchemeHTTPTimeout int `json:"scheme_http_timeout" mapstructure:"scheme_http_timeout"`
+	// Base URLs of mirrors from which schemes are downloaded and updated, tried in order before the
+	// URL of the scheme itself: scheme files are fetched from <mirror>/<scheme ID>
+	SchemeMirrors []string `json:"scheme_mirrors" mapstructure:"scheme_mirrors"`
+	// Pin schemes to a maximum version (i.e., scheme timestamp): pinned schemes are only updated if
+	// their remote version is not newer than the pinned version. In JSON, and in the configuration of
+	// the irma server, this maps scheme IDs to Unix timestamps.
+	SchemePins map[irma.SchemeManagerIdentifier]irma.Timestamp `json:"scheme_pins" mapstructure:"scheme_pins"`
+	// Pin the public keys (in PEM) with which schemes may be signed, tried in order: schemes present
+	// here must be signed by one of their pinned keys, allowing controlled rotation of scheme keys
+	SchemePublicKeys map[irma.SchemeManagerIdentifier][]string `json:"scheme_public_keys" mapstructure:"scheme_public_keys"`
 	// Path to issuer private keys to parse
 	IssuerPrivateKeysPath string `json:"privkeys" mapstructure:"privkeys"`
 	// Issuer private keys
 	IssuerPrivateKeys map[irma.IssuerIdentifier]map[uint]*gabi.PrivateKey `json:"-"`
 	// URL at which the IRMA app can reach this server during sessions
 	URL string `json:"url" mapstructure:"url"`
+	// Name of this server to be shown to users in the IRMA app, used in session requests in which the
+	// requestor did not specify a name itself
+	ServerName irma.TranslatedString `json:"server_name" mapstructure:"server_name"`
 	// Required to be set to true if URL does not begin with https:// in production mode.
 	// In this case, the server would communicate with IRMA apps over plain HTTP. You must otherwise
 	// ensure (using eg a reverse proxy with TLS enabled) that the attributes are protected in transit.
 	DisableTLS bool `json:"disable_tls" mapstructure:"disable_tls"`
+	// Refuse to start if URL does not begin with https://, e.g. to prevent accidentally deploying
+	// a server whose QRs point the IRMA app to plain HTTP. Takes precedence over DisableTLS.
+	RequireHTTPS bool `json:"require_https" mapstructure:"require_https"`
 	// (Optional) email address of server admin, for incidental notifications such as breaking API changes
 	// See https://github.com/privacybydesign/irmago/tree/master/server#specifying-an-email-address
 	// for more information
 	Email string `json:"email" mapstructure:"email"`
+	// Report the email address of the server admin at startup to MetricsURL. Disabled by default.
+	EnableMetrics bool `json:"enable_metrics" mapstructure:"enable_metrics"`
+	// URL of the endpoint to which the email address is reported if EnableMetrics is set, e.g. an
+	// internal collector (default https://metrics.privacybydesign.foundation/history)
+	MetricsURL string `json:"metrics_url" mapstructure:"metrics_url"`
 	// Enable server sent events for status updates (experimental; tends to hang when a reverse proxy is used)
 	EnableSSE bool `json:"enable_sse" mapstructure:"enable_sse"`
+	// Maximum number of concurrent server sent event connections in total, and per session. Further
+	// subscriptions are refused with 503 Service Unavailable. The default value 0 means unlimited.
+	MaxSSEConnections        int `json:"max_sse_connections" mapstructure:"max_sse_connections"`
+	MaxSessionSSEConnections int `json:"max_session_sse_connections" mapstructure:"max_session_sse_connections"`
+	// Maximum length of disclosed attribute values (default value 0 means unlimited). Enforced after
+	// the disclosure proofs have been cryptographically verified, on the disclosed attribute values.
+	MaxAttributeValueLength int `json:"max_attribute_value_length" mapstructure:"max_attribute_value_length"`
+	// Maximum number of disjunctions in disclosure and signature requests (default 100), and the
+	// maximum number of options per disjunction (default 100). Requests exceeding these are refused,
+	// so that crafted requests cannot make verification arbitrarily expensive.
+	MaxDisjunctions       int `json:"max_disjunctions" mapstructure:"max_disjunctions"`
+	MaxDisjunctionOptions int `json:"max_disjunction_options" mapstructure:"max_disjunction_options"`
+	// Maximum size in bytes of session requests passed as JSON to StartSession(), or POSTed to the
+	// irma server (of the JWT, if signed), checked before parsing them (default value 0 means unlimited)
+	MaxSessionRequestSize int `json:"max_session_request_size" mapstructure:"max_session_request_size"`
+	// Maximum number of credentials that a single issuance session may issue (default 50).
+	// Issuance requests exceeding this are refused.
+	MaxCredentialsPerIssuance int `json:"max_credentials_per_issuance" mapstructure:"max_credentials_per_issuance"`
+	// Per-requestor overrides of MaxCredentialsPerIssuance, keyed by the requestor names with which
+	// sessions are started using StartSessionForRequestor(), for flows needing bulk issuance
+	RequestorMaxCredentials map[string]int `json:"requestor_max_credentials" mapstructure:"requestor_max_credentials"`
+	// Minimum amount of seconds that issued credentials must remain valid, applied to the validity
+	// requested in issuance requests or the default of 6 months (default value 0 means no minimum).
+	// As credential expiry dates are rounded down to weeks, the expiry date is checked against the
+	// first week boundary after the minimum.
+	MinCredentialValidity int `json:"min_credential_validity" mapstructure:"min_credential_validity"`
+	// Maximum amount of seconds that issued credentials may remain valid (default value 0 means no maximum)
+	MaxCredentialValidity int `json:"max_credential_validity" mapstructure:"max_credential_validity"`
+	// If set, credential validities outside the range set by MinCredentialValidity and
+	// MaxCredentialValidity are adjusted to its nearest bound, instead of refusing the request
+	ClampCredentialValidity bool `json:"clamp_credential_validity" mapstructure:"clamp_credential_validity"`
+	// If specified, only attributes from credentials of these schemes or issuers (e.g. "pbdf" or
+	// "pbdf.gemeente") are accepted in disclosures, and sessions disclosing others fail
+	TrustedIssuers []string `json:"trusted_issuers" mapstructure:"trusted_issuers"`
+	// Per-requestor overrides of TrustedIssuers, keyed by the requestor names with which sessions
+	// are started using StartSessionForRequestor(), for servers shared by multiple tenants
+	RequestorTrustedIssuers map[string][]string `json:"requestor_trusted_issuers" mapstructure:"requestor_trusted_issuers"`
+	// Session types (disclosing, signing, issuing) that may be started (default all). If issuing is
+	// not enabled, no issuer private keys are loaded.
+	EnabledActions []irma.Action `json:"enabled_actions" mapstructure:"enabled_actions"`
+	// If nonzero and no NonceCache is set, proof replays are detected using a NonceCache in memory
+	// holding this many nonces, each for NonceCacheTTL seconds (default 600)
+	NonceCacheSize int `json:"nonce_cache_size" mapstructure:"nonce_cache_size"`
+	NonceCacheTTL  int `json:"nonce_cache_ttl" mapstructure:"nonce_cache_ttl"`
+	// Maximum number of proofs and commitments that are verified concurrently (default value 0
+	// means unlimited). Further messages wait until a verification finishes.
+	VerificationWorkers int `json:"verification_workers" mapstructure:"verification_workers"`
+	// Settings for asking IRMA apps to back off when the server is under high load
+	LoadShedding LoadShedding `json:"load_shedding" mapstructure:"load_shedding"`
+	// If true, proofs POSTed to a disclosure or signature session that already successfully finished
+	// are answered with the stored proof status, instead of with an error. This makes retries by
+	// the client of its last message idempotent.
+	ReplayFinishedSessions bool `json:"replay_finished_sessions" mapstructure:"replay_finished_sessions"`
+	// Report the finer-grained statuses StatusReceivedProof and StatusVerifying while the response
+	// of the client is processed, instead of StatusConnected. Consumers of the session status must
+	// know these statuses, or map them to StatusConnected using Status.Coarse(). The status reported
+	// to IRMA apps is always coarse.
+	ProgressStatuses bool `json:"progress_statuses" mapstructure:"progress_statuses"`
+	// Allow disclosure and signature session requests that do not request any attributes, which
+	// trivially succeed. These are refused by default.
+	AllowEmptyDisclosure bool `json:"allow_empty_disclosure" mapstructure:"allow_empty_disclosure"`
+	// Refuse session requests containing a disjunction of which the options differ in whether they
+	// require nonrevocation proofs, or in whether they contain attributes from demo schemes, as
+	// these options would then satisfy the disjunction with different guarantees.
+	StrictDisjunctions bool `json:"strict_disjunctions" mapstructure:"strict_disjunctions"`
+	// In issuance sessions of multiple credentials, issue the credentials that can be issued even if
+	// others fail, instead of failing the session. The session result then reports per credential
+	// whether it was issued.
+	AllowPartialIssuance bool `json:"allow_partial_issuance" mapstructure:"allow_partial_issuance"`
+	// If an issuance request specifies a key counter of which the private key is not available,
+	// issue using the latest private key of the issuer instead of refusing the request
+	KeyCounterFallback bool `json:"key_counter_fallback" mapstructure:"key_counter_fallback"`
+	// Issue using private keys whose public key has expired, instead of refusing to do so.
+	// Not recommended: credentials issued with such keys cannot be verified.
+	AllowExpiredKeys bool `json:"allow_expired_keys" mapstructure:"allow_expired_keys"`
+	// Warn at startup about issuer public keys that expire within this many days
+	// (default value 0 means 30)
+	KeyExpiryWarning int `json:"key_expiry_warning" mapstructure:"key_expiry_warning"`
+	// Record the IP address and user agent of the client when it first connects to a session, for
+	// abuse investigation. These can be retrieved using GetClientInfo(), and are logged.
+	RecordClientInfo bool `json:"record_client_info" mapstructure:"record_client_info"`
+	// If set, the client IP address is taken from this header (e.g. X-Forwarded-For) as set by a
+	// trusted reverse proxy, instead of from the remote address of the connection.
+	ClientIPHeader string `json:"client_ip_header" mapstructure:"client_ip_header"`
+	// Number of trusted reverse proxies that append to ClientIPHeader. The client IP address is the
+	// entry appended by the outermost of these, counting from the right, as entries to the left of
+	// it are controlled by the client (default value 0 means 1, i.e. the rightmost entry)
+	ClientIPHeaderProxies int `json:"client_ip_header_proxies" mapstructure:"client_ip_header_proxies"`
+	// If specified, only IRMA apps whose user agent matches one of these regular expressions may
+	// retrieve session requests, e.g. to refuse unofficial or incompatible apps (default all)
+	AllowedUserAgents []string `json:"allowed_user_agents" mapstructure:"allowed_user_agents"`
+	// If set, the IRMA app may pass the session token in this header (e.g. X-IRMA-Session) instead
+	// of in the URL path, for deployments behind proxies that strip or rewrite path segments.
+	SessionTokenHeader string `json:"session_token_header" mapstructure:"session_token_header"`
+	// Aliases (in lower case) of the path components following the session token in requests of the
+	// IRMA app, e.g. {"state": "status"}, in addition to the built-in alias events of statusevents.
+	// These components are matched case-insensitively; aliases of unknown components are ignored.
+	NounAliases map[string]string `json:"noun_aliases" mapstructure:"noun_aliases"`
+	// If set, prepended to all session tokens (e.g. "staging-"), so that tokens of servers in other
+	// environments are refused immediately. May contain only letters, digits, '-' and '_'.
+	TokenPrefix string `json:"token_prefix" mapstructure:"token_prefix"`
+	// Include the header X-IRMA-Polling-Done in responses to status requests of finished sessions,
+	// indicating to the client that it can stop polling
+	StatusPollingHint bool `json:"status_polling_hint" mapstructure:"status_polling_hint"`
+	// Disable compressing (using gzip or deflate, if the IRMA app accepts those) large responses to
+	// the IRMA app, such as session requests with many attributes
+	DisableCompression bool `json:"disable_compression" mapstructure:"disable_compression"`
+	// If nonzero, status requests of sessions that finished longer than this many seconds ago are
+	// answered with 410 Gone, so that misbehaving clients stop polling
+	StatusGoneAfter int `json:"status_gone_after" mapstructure:"status_gone_after"`
+	// Include in the response to new session requests, next to the session QR, a universal link
+	// that starts the same session in the IRMA app when opened on a mobile device
+	UniversalLinks bool `json:"universal_links" mapstructure:"universal_links"`
+	// Amount of seconds that finished sessions are kept, so that the requestor can retrieve their
+	// result, before they are deleted (default 300)
+	FinishedSessionRetention int `json:"finished_session_retention" mapstructure:"finished_session_retention"`
+	// Language (e.g. "en" or "nl") of human-readable names and values in session results and in
+	// error messages, unless the session request specifies another. If empty, these are omitted
+	// from session results.
+	DefaultLanguage string `json:"default_language" mapstructure:"default_language"`
+	// Interval in seconds at which expired sessions are checked for and cleaned up (default 10)
+	ExpiryCheckInterval int `json:"expiry_check_interval" mapstructure:"expiry_check_interval"`
+	// Amount of seconds that issuance sessions requiring external confirmation wait for
+	// ConfirmExternal() after receiving the issuance commitments, before failing (default 60)
+	ConfirmationTimeout int `json:"confirmation_timeout" mapstructure:"confirmation_timeout"`
+	// If set, disclosure proofs that fail verification leave the session open so that the client
+	// can retry, instead of finishing the session, at most MaxProofRetries times (default 3)
+	AllowProofRetry bool `json:"allow_proof_retry" mapstructure:"allow_proof_retry"`
+	MaxProofRetries int  `json:"max_proof_retries" mapstructure:"max_proof_retries"`
+	// If set, invoked in issuance sessions after the disclosed attributes (if any) have been verified,
+	// to compute from those the validity that each credential to be issued should at most have, e.g.
+	// to keep it in sync with the expiry date of a disclosed credential. As the client already
+	// received the requested validity before disclosing, it cannot be changed at this point; instead
+	// issuance is refused if a credential's requested validity exceeds the computed one. If the
+	// function returns nil for a credential, its requested validity is accepted.
+	IssuanceValidity func(cred *irma.CredentialRequest, disclosed [][]*irma.DisclosedAttribute) (*irma.Timestamp, error) `json:"-"`
+	// If set, invoked when starting issuance sessions with the type and attribute values (which it
+	// must not modify) of each credential to be issued, to enforce consistency rules between them
+	// (e.g. that fullName equals firstName and lastName). Sessions for which it returns an error,
+	// preferably an *AttributeConsistencyError naming the inconsistent attributes, are refused.
+	CrossAttributeValidator func(credtype irma.CredentialTypeIdentifier, values map[string]string) error `json:"-"`
+	// If set, invoked at the end of StartSession() with the QR of the new session and its requestor
+	// token, to transform the QR (e.g. wrap its URL in a custom deep link) before it is returned.
+	// If it returns nil, the session is cancelled and StartSession() returns an error.
+	QRRewriter func(qr *irma.Qr, token string) *irma.Qr `json:"-"`
+	// If set, invoked (in a separate goroutine) with the requestor token of a session when the
+	// client first retrieves its session request, i.e., when the user has scanned the QR
+	OnClientConnected func(token string) `json:"-"`
+	// If set, invoked with the requestor token and the request of each new session just before it
+	// is stored, e.g. to record it in other systems or to enrich the request, before the QR is
+	// returned by StartSession(). The request is validated again afterwards, and StartSession()
+	// fails if the hook made it invalid.
+	OnSessionCreated func(token string, req irma.RequestorRequest) `json:"-"`
+	// If set, used to create spans for tracing sessions
+	TracerProvider TracerProvider `json:"-"`
+	// If set, used to detect and refuse replays of proofs of disclosure and signature sessions,
+	// e.g. to sessions that were imported into another server instance
+	NonceCache NonceCache `json:"-"`
+	// If set, used to format the error responses of the requestor API, e.g. to match the API
+	// conventions of the application. Error responses to the IRMA app are not affected.
+	ErrorFormatter func(err *irma.RemoteError) interface{} `json:"-"`
+	// If set, invoked when a scheme present in SchemePublicKeys is signed by a public key that is not
+	// pinned, e.g. because it rotated its key, in which case verification of the scheme fails
+	OnUnpinnedSchemeKey func(scheme irma.SchemeManagerIdentifier, pk []byte) `json:"-"`
+	// If set, the results of sessions are published here when they finish, and the results of
+	// sessions not present in this instance are retrieved from here
+	ResultStore ResultStore `json:"-"`
+	// AES key (16, 24 or 32 bytes, base64 encoded) with which the attributes, signature, request
+	// and abort reason of session results are encrypted before they are stored in the ResultStore,
+	// authenticating their token, type and statuses. They are decrypted when retrieved by
+	// GetSessionResult(), which fails if the stored result was tampered with.
+	ResultEncryptionKey string `json:"result_encryption_key" mapstructure:"result_encryption_key"`
 
 	// Static session requests that can be created by POST /session/{name}
 	StaticSessions map[string]interface{} `json:"static_sessions"`
 	// Static session requests after parsing
 	StaticSessionRequests map[string]irma.RequestorRequest `json:"-"`
 
+	// Session request templates that can be started using StartSessionFromTemplate(). Placeholders
+	// of the form {{name}} in required attribute values and labels of the disclosure request are
+	// substituted by the parameters passed along when starting the session.
+	RequestTemplates map[string]interface{} `json:"request_templates" mapstructure:"request_templates"`
+	// Session request templates after parsing
+	RequestTemplateRequests map[string]irma.RequestorRequest `json:"-"`
+
 	// Used in the "iss" field of result JWTs from /result-jwt and /getproof
 	JwtIssuer string `json:"jwt_issuer" mapstructure:"jwt_issuer"`
 	// Private key to sign result JWTs with. If absent, /result-jwt and /getproof are disabled.
@@ -81,6 +287,9 @@ type Configuration struct {
 
 	// Production mode: enables safer and stricter defaults and config checking
 	Production bool `json:"production" mapstructure:"production"`
+
+	// Index of schemesUpdated() within the UpdateListeners of the IrmaConfiguration
+	schemesListener int
 }
 
 // Check ensures that the Configuration is loaded, usable and free of errors.
@@ -93,12 +302,14 @@ func (conf *Configuration) Check() error {
 
 	// loop to avoid repetetive err != nil line triplets
 	for _, f := range []func() error{
+		conf.Validate,
 		conf.verifyIrmaConf,
 		conf.verifyPrivateKeys,
 		conf.verifyURL,
 		conf.verifyEmail,
 		conf.verifyRevocation,
 		conf.verifyStaticSessions,
+		conf.verifyRequestTemplates,
 		conf.verifyJwtPrivateKey,
 	} {
 		if err := f(); err != nil {
@@ -115,6 +326,199 @@ func (conf *Configuration) Check() error {
 	return nil
 }
 
+// LoadShedding configures when the server sheds load: if the number of active sessions or the
+// number of proofs being verified exceeds its maximum, then fetches of session requests and status
+// polls by IRMA apps are answered with ErrorOverloaded and a Retry-After header, so that the apps
+// back off instead of adding to the load. Maximums of 0 (the default) are not enforced.
+type LoadShedding struct {
+	MaxActiveSessions int `json:"max_active_sessions" mapstructure:"max_active_sessions"`
+	MaxVerifications  int `json:"max_verifications" mapstructure:"max_verifications"`
+	// Amount of seconds after which apps should retry (default 5)
+	RetryAfter int `json:"retry_after" mapstructure:"retry_after"`
+}
+
+// ConfigurationError describes a problem with a configuration option.
+type ConfigurationError struct {
+	Option  string // name of the option, as in the configuration file
+	Message string
+}
+
+func (err *ConfigurationError) Error() string {
+	return err.Option + ": " + err.Message
+}
+
+// ConfigurationErrors contains all problems found by Validate().
+type ConfigurationErrors []*ConfigurationError
+
+func (errs ConfigurationErrors) Error() string {
+	msgs := make([]string, 0, len(errs))
+	for _, err := range errs {
+		msgs = append(msgs, err.Error())
+	}
+	return "invalid configuration: " + strings.Join(msgs, "; ")
+}
+
+// AttributeConsistencyError may be returned by the CrossAttributeValidator, naming the attributes
+// of a credential to be issued whose values are mutually inconsistent.
+type AttributeConsistencyError struct {
+	CredentialTypeID irma.CredentialTypeIdentifier
+	Attributes       []string
+	Reason           string
+}
+
+func (err *AttributeConsistencyError) Error() string {
+	return fmt.Sprintf("inconsistent values of attributes %s of %s: %s",
+		strings.Join(err.Attributes, ", "), err.CredentialTypeID, err.Reason)
+}
+
+// SchemesReloadError is returned by ReloadSchemes() when the schemes could not be reloaded,
+// e.g. because they failed to parse or are inconsistent with the issuer private keys.
+type SchemesReloadError struct {
+	SchemesPath string
+	Err         error
+}
+
+func (err *SchemesReloadError) Error() string {
+	return fmt.Sprintf("failed to reload schemes from %s: %s", err.SchemesPath, err.Err.Error())
+}
+
+// Validate checks the configuration for invalid or mutually inconsistent option values, returning
+// all problems found as ConfigurationErrors. Unlike Check(), it has no side effects such as parsing
+// schemes or keys, so it can be used to validate a configuration before starting a server.
+// It is also invoked by Check().
+func (conf *Configuration) Validate() error {
+	var errs ConfigurationErrors
+	check := func(ok bool, option, message string) {
+		if !ok {
+			errs = append(errs, &ConfigurationError{Option: option, Message: message})
+		}
+	}
+
+	check(conf.SchemesAssetsPath == "" || conf.SchemesPath != "" || conf.IrmaConfiguration != nil,
+		"schemes_assets_path", "requires schemes_path to be set")
+	check(conf.SchemesUpdateInterval >= 0, "schemes_update", "must not be negative")
+	check(conf.SchemeHTTPTimeout >= 0, "scheme_http_timeout", "must not be negative")
+	for _, mirror := range conf.SchemeMirrors {
+		check(strings.HasPrefix(mirror, "http://") || strings.HasPrefix(mirror, "https://"),
+			"scheme_mirrors", fmt.Sprintf("mirror %s must begin with http:// or https://", mirror))
+	}
+	if conf.URL != "" {
+		// Accept the ":port" placeholder, which the requestor server replaces by its port later on
+		u, err := url.Parse(strings.Replace(conf.URL, ":port", "", 1))
+		check(err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != "",
+			"url", "must be an absolute http:// or https:// URL")
+		check(!conf.Production || conf.DisableTLS || strings.HasPrefix(conf.URL, "https://"),
+			"url", "running without TLS in production mode is unsafe without a reverse proxy; "+
+				"either use a https:// URL or explicitly disable TLS")
+	}
+	check(!conf.RequireHTTPS || strings.HasPrefix(conf.URL, "https://"),
+		"url", "must begin with https:// as require_https is enabled")
+	// Very basic sanity checks
+	check(conf.Email == "" || (strings.Contains(conf.Email, "@") && !strings.Contains(conf.Email, "\n")),
+		"email", "invalid email address")
+	check(!conf.EnableMetrics || conf.Email != "", "enable_metrics", "requires an email address to be configured")
+	check(conf.MetricsURL == "" || strings.HasPrefix(conf.MetricsURL, "http://") || strings.HasPrefix(conf.MetricsURL, "https://"),
+		"metrics_url", "must begin with http:// or https://")
+	check(conf.MaxAttributeValueLength >= 0, "max_attribute_value_length", "must not be negative")
+	check(conf.MaxDisjunctions >= 0, "max_disjunctions", "must not be negative")
+	check(conf.MaxCredentialsPerIssuance >= 0, "max_credentials_per_issuance", "must not be negative")
+	check(conf.MaxSessionRequestSize >= 0, "max_session_request_size", "must not be negative")
+	check(conf.ClientIPHeaderProxies >= 0, "client_ip_header_proxies", "must not be negative")
+	check(conf.MinCredentialValidity >= 0, "min_credential_validity", "must not be negative")
+	check(conf.MaxCredentialValidity >= 0, "max_credential_validity", "must not be negative")
+	check(conf.MaxCredentialValidity == 0 || conf.MinCredentialValidity == 0 ||
+		conf.MinCredentialValidity+irma.ExpiryFactor <= conf.MaxCredentialValidity,
+		"max_credential_validity", "must exceed min_credential_validity by at least a week, as credential expiry dates are rounded to weeks")
+	for alias := range conf.NounAliases {
+		check(alias == strings.ToLower(alias), "noun_aliases", fmt.Sprintf("alias %s must be in lower case", alias))
+	}
+	if conf.ResultEncryptionKey != "" {
+		key, err := base64.StdEncoding.DecodeString(conf.ResultEncryptionKey)
+		check(err == nil && (len(key) == 16 || len(key) == 24 || len(key) == 32),
+			"result_encryption_key", "must be a base64 encoded key of 16, 24 or 32 bytes")
+	}
+	for requestor, max := range conf.RequestorMaxCredentials {
+		check(max >= 0, "requestor_max_credentials", fmt.Sprintf("must not be negative for requestor %s", requestor))
+	}
+	check(conf.MaxDisjunctionOptions >= 0, "max_disjunction_options", "must not be negative")
+	for _, id := range conf.TrustedIssuers {
+		check(validTrustedIssuer(id), "trusted_issuers", fmt.Sprintf("invalid scheme or issuer %s", id))
+	}
+	for requestor, ids := range conf.RequestorTrustedIssuers {
+		for _, id := range ids {
+			check(validTrustedIssuer(id), "requestor_trusted_issuers",
+				fmt.Sprintf("invalid scheme or issuer %s for requestor %s", id, requestor))
+		}
+	}
+	for _, action := range conf.EnabledActions {
+		check(action == irma.ActionDisclosing || action == irma.ActionSigning || action == irma.ActionIssuing,
+			"enabled_actions", fmt.Sprintf("unsupported session type %s", action))
+	}
+	for _, pattern := range conf.AllowedUserAgents {
+		_, err := regexp.Compile(pattern)
+		check(err == nil, "allowed_user_agents", fmt.Sprintf("invalid regular expression %s", pattern))
+	}
+	check(conf.MaxSSEConnections >= 0, "max_sse_connections", "must not be negative")
+	check(conf.MaxSessionSSEConnections >= 0, "max_session_sse_connections", "must not be negative")
+	check(conf.NonceCacheSize >= 0, "nonce_cache_size", "must not be negative")
+	check(conf.NonceCacheTTL >= 0, "nonce_cache_ttl", "must not be negative")
+	check(conf.VerificationWorkers >= 0, "verification_workers", "must not be negative")
+	check(conf.LoadShedding.MaxActiveSessions >= 0, "load_shedding.max_active_sessions", "must not be negative")
+	check(conf.LoadShedding.MaxVerifications >= 0, "load_shedding.max_verifications", "must not be negative")
+	check(conf.LoadShedding.RetryAfter >= 0, "load_shedding.retry_after", "must not be negative")
+	check(conf.StatusGoneAfter >= 0, "status_gone_after", "must not be negative")
+	check(conf.ExpiryCheckInterval >= 0, "expiry_check_interval", "must not be negative")
+	check(conf.FinishedSessionRetention >= 0, "finished_session_retention", "must not be negative")
+	check(conf.ConfirmationTimeout >= 0, "confirmation_timeout", "must not be negative")
+	check(conf.MaxProofRetries >= 0, "max_proof_retries", "must not be negative")
+	check(regexp.MustCompile("^[a-zA-Z0-9_-]{0,32}$").MatchString(conf.TokenPrefix),
+		"token_prefix", "must consist of at most 32 letters, digits, '-' or '_'")
+	check(conf.JwtPrivateKey == "" || conf.JwtPrivateKeyFile == "",
+		"jwt_privkey", "cannot be combined with jwt_privkey_file")
+	check(conf.RevocationDBConnStr == "" || conf.RevocationDBType == "postgres" || conf.RevocationDBType == "mysql",
+		"revocation_db_type", "must be postgres or mysql")
+
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// SetTestIssuerKey registers the specified private key and corresponding public key of the
+// specified issuer in memory, so that the server can issue its credentials without these keys
+// being present on disk. The issuer and its credential types must be present in the
+// IrmaConfiguration. This is intended for tests: normally, issuer private keys are loaded from
+// IssuerPrivateKeysPath and public keys from the scheme of the issuer.
+func (conf *Configuration) SetTestIssuerKey(issid irma.IssuerIdentifier, sk *gabi.PrivateKey, pk *gabi.PublicKey) error {
+	if conf.IrmaConfiguration == nil {
+		return errors.New("IrmaConfiguration must be set before adding issuer keys")
+	}
+	if _, ok := conf.IrmaConfiguration.Issuers[issid]; !ok {
+		return errors.Errorf("unknown issuer %s", issid)
+	}
+	if sk.Counter != pk.Counter || new(big.Int).Mul(sk.P, sk.Q).Cmp(pk.N) != 0 {
+		return errors.Errorf("private key %s-%d does not belong to public key", issid, sk.Counter)
+	}
+	conf.IrmaConfiguration.AddPublicKey(issid, pk)
+	if conf.IssuerPrivateKeys == nil {
+		conf.IssuerPrivateKeys = make(map[irma.IssuerIdentifier]map[uint]*gabi.PrivateKey)
+	}
+	if conf.IssuerPrivateKeys[issid] == nil {
+		conf.IssuerPrivateKeys[issid] = map[uint]*gabi.PrivateKey{}
+	}
+	conf.IssuerPrivateKeys[issid][sk.Counter] = sk
+
+	// Also register the private key directly, in case this is called after Check()
+	if conf.IrmaConfiguration.PrivateKeys == nil {
+		conf.IrmaConfiguration.PrivateKeys = make(map[irma.IssuerIdentifier]map[uint]*gabi.PrivateKey)
+	}
+	if conf.IrmaConfiguration.PrivateKeys[issid] == nil {
+		conf.IrmaConfiguration.PrivateKeys[issid] = map[uint]*gabi.PrivateKey{}
+	}
+	conf.IrmaConfiguration.PrivateKeys[issid][sk.Counter] = sk
+	return nil
+}
+
 func (conf *Configuration) HavePrivateKeys() bool {
 	var err error
 	for id := range conf.IrmaConfiguration.Issuers {
@@ -153,6 +557,22 @@ func (conf *Configuration) verifyStaticSessions() error {
 	return nil
 }
 
+func (conf *Configuration) verifyRequestTemplates() error {
+	conf.RequestTemplateRequests = make(map[string]irma.RequestorRequest)
+	for name, r := range conf.RequestTemplates {
+		j, err := json.Marshal(r)
+		if err != nil {
+			return errors.WrapPrefix(err, "failed to parse request template "+name, 0)
+		}
+		rrequest, err := ParseSessionRequest(j)
+		if err != nil {
+			return errors.WrapPrefix(err, "failed to parse request template "+name, 0)
+		}
+		conf.RequestTemplateRequests[name] = rrequest
+	}
+	return nil
+}
+
 func (conf *Configuration) verifyIrmaConf() error {
 	if conf.IrmaConfiguration == nil {
 		var (
@@ -188,23 +608,129 @@ func (conf *Configuration) verifyIrmaConf() error {
 		conf.IrmaConfiguration.PrivateKeys = conf.IssuerPrivateKeys
 	}
 
+	if conf.SchemeHTTPTimeout > 0 {
+		conf.IrmaConfiguration.SchemeHTTPTimeout = time.Duration(conf.SchemeHTTPTimeout) * time.Second
+	}
+	conf.IrmaConfiguration.SchemeMirrors = conf.SchemeMirrors
 	if len(conf.IrmaConfiguration.SchemeManagers) == 0 {
 		conf.Logger.Infof("No schemes found in %s, downloading default (irma-demo and pbdf)", conf.SchemesPath)
 		if err := conf.IrmaConfiguration.DownloadDefaultSchemes(); err != nil {
+			conf.LogSchemeTimeout(err)
 			return err
 		}
 	}
 	if conf.SchemesUpdateInterval == 0 {
 		conf.SchemesUpdateInterval = 60
 	}
-	if !conf.DisableSchemesUpdate {
-		conf.IrmaConfiguration.AutoUpdateSchemes(uint(conf.SchemesUpdateInterval))
+	if len(conf.SchemePins) > 0 {
+		for id := range conf.SchemePins {
+			if _, ok := conf.IrmaConfiguration.SchemeManagers[id]; !ok {
+				return errors.Errorf("Unknown scheme %s in scheme pins", id)
+			}
+		}
+		conf.IrmaConfiguration.SchemePins = conf.SchemePins
+	}
+	if len(conf.SchemePublicKeys) > 0 {
+		irmaconf := conf.IrmaConfiguration
+		irmaconf.SchemePublicKeys = map[irma.SchemeManagerIdentifier][][]byte{}
+		irmaconf.UnpinnedKeyListeners = append(irmaconf.UnpinnedKeyListeners, conf.unpinnedSchemeKey)
+		for id, pks := range conf.SchemePublicKeys {
+			if _, ok := irmaconf.SchemeManagers[id]; !ok {
+				return errors.Errorf("Unknown scheme %s in scheme public keys", id)
+			}
+			for _, pk := range pks {
+				irmaconf.SchemePublicKeys[id] = append(irmaconf.SchemePublicKeys[id], []byte(pk))
+			}
+			if err := irmaconf.VerifySignature(id); err != nil {
+				return err
+			}
+		}
 	}
+	conf.schemesListener = len(conf.IrmaConfiguration.UpdateListeners)
+	conf.IrmaConfiguration.UpdateListeners = append(conf.IrmaConfiguration.UpdateListeners, conf.schemesUpdated)
 
 	return nil
 }
 
+// LogSchemeTimeout logs a warning if the specified error, returned when downloading or updating
+// schemes, was caused by a scheme server not responding within SchemeHTTPTimeout.
+func (conf *Configuration) LogSchemeTimeout(err error) {
+	if e, ok := err.(*errors.Error); ok {
+		err = e.Err
+	}
+	if e, ok := err.(*irma.SessionError); ok && e.ErrorType == irma.ErrorTimeout {
+		conf.Logger.WithField("timeout", conf.IrmaConfiguration.SchemeHTTPTimeout).
+			Warn("Scheme server did not respond in time, consider increasing scheme_http_timeout")
+	}
+}
+
+// ActionEnabled returns whether sessions of the specified type may be started, see EnabledActions.
+func (conf *Configuration) ActionEnabled(action irma.Action) bool {
+	if len(conf.EnabledActions) == 0 {
+		return true
+	}
+	for _, a := range conf.EnabledActions {
+		if a == action {
+			return true
+		}
+	}
+	return false
+}
+
+// validTrustedIssuer returns whether the specified trusted issuers entry is a scheme or an issuer
+// identifier.
+func validTrustedIssuer(id string) bool {
+	parts := strings.Split(id, ".")
+	if len(parts) > 2 {
+		return false
+	}
+	for _, part := range parts {
+		if part == "" {
+			return false
+		}
+	}
+	return true
+}
+
+// IssuerTrusted returns whether attributes from credentials of the specified issuer are accepted
+// in sessions of the specified requestor, according to its entry in RequestorTrustedIssuers if
+// present and otherwise according to TrustedIssuers.
+func (conf *Configuration) IssuerTrusted(requestor string, issuer irma.IssuerIdentifier) bool {
+	trusted := conf.TrustedIssuers
+	if ids, ok := conf.RequestorTrustedIssuers[requestor]; ok && requestor != "" {
+		trusted = ids
+	}
+	if len(trusted) == 0 {
+		return true
+	}
+	for _, id := range trusted {
+		if id == issuer.String() || id == issuer.SchemeManagerIdentifier().String() {
+			return true
+		}
+	}
+	return false
+}
+
+// UserAgentAllowed returns whether IRMA apps with the specified user agent may perform sessions.
+func (conf *Configuration) UserAgentAllowed(useragent string) bool {
+	if len(conf.AllowedUserAgents) == 0 {
+		return true
+	}
+	for _, pattern := range conf.AllowedUserAgents {
+		if matched, err := regexp.MatchString(pattern, useragent); err == nil && matched {
+			return true
+		}
+	}
+	return false
+}
+
 func (conf *Configuration) verifyPrivateKeys() error {
+	if !conf.ActionEnabled(irma.ActionIssuing) {
+		if conf.IssuerPrivateKeysPath != "" || len(conf.IssuerPrivateKeys) > 0 {
+			conf.Logger.Warn("Issuing is disabled, ignoring issuer private keys")
+		}
+		return nil
+	}
 	if conf.IssuerPrivateKeys == nil {
 		conf.IssuerPrivateKeys = make(map[irma.IssuerIdentifier]map[uint]*gabi.PrivateKey)
 	}
@@ -216,7 +742,7 @@ func (conf *Configuration) verifyPrivateKeys() error {
 		for _, file := range files {
 			filename := file.Name()
 			dotcount := strings.Count(filename, ".")
-			if filepath.Ext(filename) != ".xml" || filename[0] == '.' || dotcount < 2 || dotcount > 3 {
+			if file.IsDir() || filepath.Ext(filename) != ".xml" || filename[0] == '.' || dotcount < 2 || dotcount > 3 {
 				conf.Logger.WithField("file", filename).Infof("Skipping non-private key file encountered in private keys path")
 				continue
 			}
@@ -227,14 +753,16 @@ func (conf *Configuration) verifyPrivateKeys() error {
 				index := strings.LastIndex(base, ".")
 				counter, err = strconv.Atoi(base[index+1:])
 				if err != nil {
-					return err
+					// Not of the form issuer.counter.xml, so it can't be a private key
+					conf.Logger.WithField("file", filename).Warnf("Skipping file with invalid private key counter encountered in private keys path")
+					continue
 				}
 				base = base[:index]
 			}
 
 			issid := irma.NewIssuerIdentifier(base) // strip .xml
 			if _, ok := conf.IrmaConfiguration.Issuers[issid]; !ok {
-				return errors.Errorf("Private key %s belongs to an unknown issuer", filename)
+				return errors.Errorf("Private key %s belongs to an unknown issuer (private key files must be named scheme.issuer.xml or scheme.issuer.counter.xml)", filename)
 			}
 			sk, err := gabi.NewPrivateKeyFromFile(filepath.Join(conf.IssuerPrivateKeysPath, filename))
 			if err != nil {
@@ -249,6 +777,55 @@ func (conf *Configuration) verifyPrivateKeys() error {
 			conf.IssuerPrivateKeys[issid][sk.Counter] = sk
 		}
 	}
+	if len(conf.IssuerPrivateKeys) > 0 {
+		conf.IrmaConfiguration.PrivateKeys = conf.IssuerPrivateKeys
+	}
+
+	if err := conf.verifyKeyPairs(); err != nil {
+		return err
+	}
+	return conf.verifyKeyExpiry()
+}
+
+// verifyKeyExpiry warns about private keys whose public key has expired or expires soon, as
+// credentials issued with such keys cannot be verified (for long).
+func (conf *Configuration) verifyKeyExpiry() error {
+	days := conf.KeyExpiryWarning
+	if days == 0 {
+		days = 30
+	}
+	now := time.Now()
+	soon := now.AddDate(0, 0, days)
+	for issid := range conf.IrmaConfiguration.Issuers {
+		indices, err := conf.IrmaConfiguration.PrivateKeyIndices(issid)
+		if err != nil {
+			return err
+		}
+		for _, counter := range indices {
+			pk, err := conf.IrmaConfiguration.PublicKey(issid, counter)
+			if err != nil {
+				return err
+			}
+			if pk == nil {
+				continue
+			}
+			expiry := time.Unix(pk.ExpiryDate, 0)
+			entry := conf.Logger.WithFields(logrus.Fields{"issuer": issid, "counter": counter, "expiry": expiry})
+			switch {
+			case expiry.Before(now) && conf.AllowExpiredKeys:
+				entry.Warn("Public key of private key has expired, credentials issued with it cannot be verified")
+			case expiry.Before(now):
+				entry.Warn("Public key of private key has expired, refusing to issue with it")
+			case expiry.Before(soon):
+				entry.Warn("Public key of private key expires soon")
+			}
+		}
+	}
+	return nil
+}
+
+// verifyKeyPairs checks that all private keys belong to a public key in the IrmaConfiguration.
+func (conf *Configuration) verifyKeyPairs() error {
 	for issid := range conf.IssuerPrivateKeys {
 		for _, sk := range conf.IssuerPrivateKeys[issid] {
 			pk, err := conf.IrmaConfiguration.PublicKey(issid, sk.Counter)
@@ -267,6 +844,49 @@ func (conf *Configuration) verifyPrivateKeys() error {
 	return nil
 }
 
+// schemesUpdated is invoked after the IrmaConfiguration has updated and reparsed its schemes.
+// Reparsing discards the private keys, so we put them back, and check them against the
+// public keys of the updated schemes so that key rollovers do not require a restart.
+func (conf *Configuration) schemesUpdated(*irma.IrmaIdentifierSet) {
+	if len(conf.IssuerPrivateKeys) > 0 {
+		conf.IrmaConfiguration.PrivateKeys = conf.IssuerPrivateKeys
+	}
+	if err := conf.verifyKeyPairs(); err != nil {
+		conf.Logger.WithField("error", err).Error("Private keys inconsistent with updated schemes")
+	}
+}
+
+// unpinnedSchemeKey is invoked when a scheme is signed by a public key not pinned in
+// SchemePublicKeys.
+func (conf *Configuration) unpinnedSchemeKey(id irma.SchemeManagerIdentifier, pk []byte) {
+	conf.Logger.WithField("scheme", id).Warn("Scheme signed by public key that is not pinned in scheme_public_keys")
+	if conf.OnUnpinnedSchemeKey != nil {
+		conf.OnUnpinnedSchemeKey(id, pk)
+	}
+}
+
+// ReloadSchemes returns a copy of the configuration in which the IrmaConfiguration is replaced by
+// one freshly parsed from the schemes path, with the issuer private keys installed and checked.
+// The current configuration is left untouched, so that it can keep serving the sessions that
+// were started with it. If reloading fails, a *SchemesReloadError is returned.
+func (conf *Configuration) ReloadSchemes() (*Configuration, error) {
+	irmaconf, err := conf.IrmaConfiguration.Reparse()
+	if err != nil {
+		return nil, &SchemesReloadError{SchemesPath: conf.IrmaConfiguration.Path, Err: err}
+	}
+	reloaded := *conf
+	reloaded.IrmaConfiguration = irmaconf
+	if len(conf.IssuerPrivateKeys) > 0 {
+		irmaconf.PrivateKeys = conf.IssuerPrivateKeys
+	}
+	if err = reloaded.verifyKeyPairs(); err != nil {
+		return nil, &SchemesReloadError{SchemesPath: conf.IrmaConfiguration.Path, Err: err}
+	}
+	// Reparse() copied our listener for the current configuration, so we replace it
+	irmaconf.UpdateListeners[conf.schemesListener] = reloaded.schemesUpdated
+	return &reloaded, nil
+}
+
 func (conf *Configuration) prepareRevocation(credid irma.CredentialTypeIdentifier) error {
 	sks, err := conf.IrmaConfiguration.PrivateKeyIndices(credid.IssuerIdentifier())
 	if err != nil {
@@ -368,14 +988,10 @@ func (conf *Configuration) verifyURL() error {
 			conf.URL = conf.URL + "/"
 		}
 		if !strings.HasPrefix(conf.URL, "https://") {
-			if !conf.Production || conf.DisableTLS {
-				conf.DisableTLS = true
-				conf.Logger.Warnf("TLS is not enabled on the url \"%s\" to which the IRMA app will connect. "+
-					"Ensure that attributes are encrypted in transit by either enabling TLS or adding TLS in a reverse proxy.", conf.URL)
-			} else {
-				return errors.Errorf("Running without TLS in production mode is unsafe without a reverse proxy. " +
-					"Either use a https:// URL or explicitly disable TLS.")
-			}
+			// Validate() ensured that we are not in production mode, or that TLS was explicitly disabled
+			conf.DisableTLS = true
+			conf.Logger.Warnf("TLS is not enabled on the url \"%s\" to which the IRMA app will connect. "+
+				"Ensure that attributes are encrypted in transit by either enabling TLS or adding TLS in a reverse proxy.", conf.URL)
 		}
 	} else {
 		conf.Logger.Warn("No url parameter specified in configuration; unless an url is elsewhere prepended in the QR, the IRMA client will not be able to connect")
@@ -383,13 +999,15 @@ func (conf *Configuration) verifyURL() error {
 	return nil
 }
 
+const defaultMetricsURL = "https://metrics.privacybydesign.foundation/history"
+
 func (conf *Configuration) verifyEmail() error {
-	if conf.Email != "" {
-		// Very basic sanity checks
-		if !strings.Contains(conf.Email, "@") || strings.Contains(conf.Email, "\n") {
-			return errors.New("Invalid email address specified")
+	if conf.EnableMetrics && conf.Email != "" {
+		metricsURL := conf.MetricsURL
+		if metricsURL == "" {
+			metricsURL = defaultMetricsURL
 		}
-		t := irma.NewHTTPTransport("https://metrics.privacybydesign.foundation/history")
+		t := irma.NewHTTPTransport(metricsURL)
 		t.SetHeader("User-Agent", "irmaserver")
 		var x string
 		_ = t.Post("email", &x, conf.Email)
@@ -26,13 +26,26 @@ var (
 	ErrorUnexpectedRequest    Error = Error{Type: "UNEXPECTED_REQUEST", Status: 403, Description: "Unexpected request in this state"}
 	ErrorUnknownPublicKey     Error = Error{Type: "UNKNOWN_PUBLIC_KEY", Status: 403, Description: "Attributes were not valid against a known public key"}
 	ErrorKeyshareProofMissing Error = Error{Type: "KEYSHARE_PROOF_MISSING", Status: 403, Description: "ProofP object from a keyshare server missing"}
+	ErrorPairingRejected      Error = Error{Type: "PAIRING_REJECTED", Status: 403, Description: "Incorrect pairing code"}
+	ErrorPairingFailed        Error = Error{Type: "PAIRING_FAILED", Status: 403, Description: "Too many incorrect pairing codes"}
+	ErrorConfirmationTimeout  Error = Error{Type: "CONFIRMATION_TIMEOUT", Status: 403, Description: "Issuance was not confirmed in time"}
+	ErrorClientNotAllowed     Error = Error{Type: "CLIENT_NOT_ALLOWED", Status: 403, Description: "This IRMA app is not allowed by this server"}
+	ErrorSchemeNotAccepted    Error = Error{Type: "SCHEME_NOT_ACCEPTED", Status: 403, Description: "Attributes were disclosed from a scheme that is not accepted"}
+	ErrorIssuerNotTrusted     Error = Error{Type: "ISSUER_NOT_TRUSTED", Status: 403, Description: "Attributes were disclosed from an issuer that is not trusted"}
+	ErrorNonceReused          Error = Error{Type: "NONCE_REUSED", Status: 403, Description: "Proofs were already received for this session nonce"}
 	ErrorSessionUnknown       Error = Error{Type: "SESSION_UNKNOWN", Status: 400, Description: "Unknown or expired session"}
+	ErrorSessionGone          Error = Error{Type: "SESSION_GONE", Status: 410, Description: "Session finished, stop polling"}
 	ErrorMalformedInput       Error = Error{Type: "MALFORMED_INPUT", Status: 400, Description: "Input could not be parsed"}
+	ErrorRequestTooLarge      Error = Error{Type: "REQUEST_TOO_LARGE", Status: 413, Description: "Session request exceeds maximum size"}
 	ErrorUnknown              Error = Error{Type: "EXCEPTION", Status: 500, Description: "Encountered unexpected problem"}
 	ErrorRevocation           Error = Error{Type: "REVOCATION", Status: 500, Description: "Revocation error"}
+	ErrorPublicKeyNotFound    Error = Error{Type: "PUBLIC_KEY_NOT_FOUND", Status: 404, Description: "The requested issuer public key is not known to this server"}
 	ErrorUnknownRevocationKey Error = Error{Type: "UNKNOWN_REVOCATION_KEY", Status: 404, Description: "No issuance records correspond to the given revocationKey"}
 
-	ErrorUnsupported     Error = Error{Type: "UNSUPPORTED", Status: 501, Description: "Unsupported by this server"}
-	ErrorInvalidRequest  Error = Error{Type: "INVALID_REQUEST", Status: 400, Description: "Invalid HTTP request"}
-	ErrorProtocolVersion Error = Error{Type: "PROTOCOL_VERSION", Status: 400, Description: "Protocol version negotiation failed"}
+	ErrorUnsupported            Error = Error{Type: "UNSUPPORTED", Status: 501, Description: "Unsupported by this server"}
+	ErrorMaintenance            Error = Error{Type: "MAINTENANCE", Status: 503, Description: "Server is in maintenance mode and does not accept new sessions"}
+	ErrorOverloaded             Error = Error{Type: "OVERLOADED", Status: 503, Description: "Server is under high load, retry later"}
+	ErrorInvalidRequest         Error = Error{Type: "INVALID_REQUEST", Status: 400, Description: "Invalid HTTP request"}
+	ErrorUnsupportedContentType Error = Error{Type: "UNSUPPORTED_CONTENT_TYPE", Status: 415, Description: "Unsupported Content-Type, expected application/json"}
+	ErrorProtocolVersion        Error = Error{Type: "PROTOCOL_VERSION", Status: 400, Description: "Protocol version negotiation failed"}
 )
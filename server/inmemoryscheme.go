@@ -0,0 +1,104 @@
+package server
+
+import (
+	"strings"
+	"time"
+
+	"github.com/go-errors/errors"
+	"github.com/privacybydesign/gabi"
+	"github.com/privacybydesign/irmago"
+)
+
+// InMemoryScheme describes a throwaway demo scheme containing a single issuer and credential type,
+// which AddInMemoryScheme() adds to the configuration without scheme files on disk, e.g. for tests
+// and local development.
+type InMemoryScheme struct {
+	// Identifier of the credential type, e.g. "mem.issuer.credential", of which the first parts
+	// identify the scheme and issuer to be created
+	CredentialType irma.CredentialTypeIdentifier
+	// Names of the attributes of the credential type
+	Attributes []string
+	// Key pair of the issuer. If both are nil, a 1024-bit key pair is generated, valid for a year.
+	PrivateKey *gabi.PrivateKey
+	PublicKey  *gabi.PublicKey
+}
+
+// AddInMemoryScheme adds the specified scheme, along with its issuer, credential type and key pair,
+// to the IrmaConfiguration, which must already have been parsed. Unlike schemes on disk, it is
+// never updated and is lost when the schemes are reloaded. For IRMA clients to accept its
+// credentials, it must be added to their configuration too, using
+// (*irma.Configuration).AddCredentialType() and AddPublicKey().
+func (conf *Configuration) AddInMemoryScheme(scheme InMemoryScheme) error {
+	if conf.IrmaConfiguration == nil {
+		return errors.New("irma configuration not yet parsed")
+	}
+	credid := scheme.CredentialType
+	if strings.Count(credid.String(), ".") != 2 {
+		return errors.Errorf("invalid credential type identifier %s", credid)
+	}
+	issid := credid.IssuerIdentifier()
+	schemeid := issid.SchemeManagerIdentifier()
+	if _, exists := conf.IrmaConfiguration.SchemeManagers[schemeid]; exists {
+		return errors.Errorf("scheme %s already exists", schemeid)
+	}
+	if len(scheme.Attributes) == 0 {
+		return errors.Errorf("credential type %s has no attributes", credid)
+	}
+	if (scheme.PrivateKey == nil) != (scheme.PublicKey == nil) {
+		return errors.New("either both or neither of the private and public key must be specified")
+	}
+
+	sk, pk := scheme.PrivateKey, scheme.PublicKey
+	if sk == nil {
+		var err error
+		// Besides the attributes, the key must accommodate the secret key and metadata attribute
+		sk, pk, err = gabi.GenerateKeyPair(gabi.DefaultSystemParameters[1024], len(scheme.Attributes)+2, 0, time.Now().AddDate(1, 0, 0))
+		if err != nil {
+			return err
+		}
+	}
+
+	name := func(s string) irma.TranslatedString {
+		return irma.TranslatedString{"en": s, "nl": s}
+	}
+	attrs := make([]*irma.AttributeType, 0, len(scheme.Attributes))
+	for _, attr := range scheme.Attributes {
+		attrs = append(attrs, &irma.AttributeType{ID: attr, Name: name(attr), Description: name(attr)})
+	}
+	conf.IrmaConfiguration.AddCredentialType(
+		&irma.SchemeManager{
+			ID:          schemeid.Name(),
+			Name:        name("Demo " + schemeid.Name()),
+			Description: name("In-memory scheme " + schemeid.Name()),
+			Demo:        true,
+			Status:      irma.SchemeManagerStatusValid,
+			Valid:       true,
+		},
+		&irma.Issuer{
+			ID:              issid.Name(),
+			Name:            name("Demo " + issid.Name()),
+			ShortName:       name("Demo " + issid.Name()),
+			SchemeManagerID: schemeid.Name(),
+			Valid:           true,
+		},
+		&irma.CredentialType{
+			ID:              credid.Name(),
+			Name:            name("Demo " + credid.Name()),
+			ShortName:       name("Demo " + credid.Name()),
+			Description:     name("Demo " + credid.Name()),
+			IssuerID:        issid.Name(),
+			SchemeManagerID: schemeid.Name(),
+			AttributeTypes:  attrs,
+			XMLVersion:      4,
+			Valid:           true,
+		},
+	)
+	conf.IrmaConfiguration.AddPublicKey(issid, pk)
+
+	if conf.IssuerPrivateKeys == nil {
+		conf.IssuerPrivateKeys = make(map[irma.IssuerIdentifier]map[uint]*gabi.PrivateKey)
+	}
+	conf.IssuerPrivateKeys[issid] = map[uint]*gabi.PrivateKey{sk.Counter: sk}
+	conf.IrmaConfiguration.PrivateKeys[issid] = conf.IssuerPrivateKeys[issid]
+	return nil
+}
@@ -5,31 +5,54 @@
 package irmaserver
 
 import (
+	"context"
+	"encoding/json"
+	"io"
 	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/alexandrevicenzi/go-sse"
 	"github.com/go-chi/chi"
 	"github.com/go-errors/errors"
 	"github.com/jasonlvhit/gocron"
+	"github.com/privacybydesign/gabi"
+	"github.com/privacybydesign/gabi/big"
 	"github.com/privacybydesign/irmago"
+	"github.com/privacybydesign/irmago/internal/common"
 	"github.com/privacybydesign/irmago/server"
 	"github.com/sirupsen/logrus"
 )
 
 type Server struct {
-	conf             *server.Configuration
+	config           atomic.Value // *server.Configuration, accessed using conf() as ReloadSchemes() replaces it
 	router           *chi.Mux
 	sessions         sessionStore
 	scheduler        *gocron.Scheduler
 	stopScheduler    chan bool
 	handlers         map[string]server.SessionHandler
 	serverSentEvents *sse.Server
+	interceptors     []func(next http.Handler) http.Handler
+	stats            *sessionStats
+	maintenance      int32         // accessed atomically, nonzero if in maintenance mode
+	verifications    int64         // accessed atomically, number of proofs and commitments being handled
+	sseConnections   int64         // accessed atomically, number of open server sent event connections
+	workers          chan struct{} // if not nil, bounds the number of proofs and commitments verified concurrently
+	reloadLock       sync.Mutex
 }
 
 // Default server instance
 var s *Server
 
+// ErrMaintenance is returned by StartSession() when the server is in maintenance mode.
+var ErrMaintenance = errors.New("server is in maintenance mode and does not accept new sessions")
+
+// ErrTooManySSEConnections is returned by SubscribeServerSentEvents() when the maximum number of
+// server sent event connections, in total or of the session, is reached.
+var ErrTooManySSEConnections = errors.New("too many server sent event connections")
+
 // Initialize the default server instance with the specified configuration using New().
 func Initialize(conf *server.Configuration) (err error) {
 	s, err = New(conf)
@@ -47,33 +70,49 @@ func New(conf *server.Configuration) (*Server, error) {
 	conf.IrmaConfiguration.Revocation.ServerSentEvents = e
 
 	s := &Server{
-		conf:      conf,
-		scheduler: gocron.NewScheduler(),
-		sessions: &memorySessionStore{
-			requestor: make(map[string]*session),
-			client:    make(map[string]*session),
-			conf:      conf,
-		},
+		scheduler:        gocron.NewScheduler(),
 		handlers:         make(map[string]server.SessionHandler),
 		serverSentEvents: e,
+		stats:            newSessionStats(),
+	}
+	s.config.Store(conf)
+	s.sessions = &memorySessionStore{
+		requestor: make(map[string]*session),
+		client:    make(map[string]*session),
+		conf:      s.conf,
+	}
+	if conf.NonceCache == nil && conf.NonceCacheSize > 0 {
+		conf.NonceCache = server.NewMemoryNonceCache(conf.NonceCacheSize)
+	}
+	if conf.VerificationWorkers > 0 {
+		s.workers = make(chan struct{}, conf.VerificationWorkers)
 	}
 
-	s.scheduler.Every(10).Seconds().Do(func() {
+	interval := conf.ExpiryCheckInterval
+	if interval <= 0 {
+		interval = defaultExpiryCheckInterval
+	}
+	s.scheduler.Every(uint64(interval)).Seconds().Do(func() {
 		s.sessions.deleteExpired()
 	})
 
 	s.scheduler.Every(irma.RevocationParameters.RequestorUpdateInterval).Seconds().Do(func() {
-		for credid, settings := range s.conf.RevocationSettings {
+		for credid, settings := range s.conf().RevocationSettings {
 			if settings.Authority {
 				continue
 			}
-			if err := s.conf.IrmaConfiguration.Revocation.SyncIfOld(credid, settings.Tolerance/2); err != nil {
-				s.conf.Logger.Errorf("failed to update revocation database for %s", credid.String())
+			if err := s.conf().IrmaConfiguration.Revocation.SyncIfOld(credid, settings.Tolerance/2); err != nil {
+				s.conf().Logger.Errorf("failed to update revocation database for %s", credid.String())
 				_ = server.LogError(err)
 			}
 		}
 	})
 
+	if !conf.DisableSchemesUpdate {
+		s.scheduler.Every(uint64(conf.SchemesUpdateInterval)).Minutes().Do(s.updateSchemes)
+		go s.updateSchemes()
+	}
+
 	s.stopScheduler = s.scheduler.Start()
 
 	return s, nil
@@ -96,10 +135,13 @@ func (s *Server) HandlerFunc() http.HandlerFunc {
 
 	r := chi.NewRouter()
 	s.router = r
-	if s.conf.Verbose >= 2 {
+	r.Use(s.pathMiddleware)
+	r.Use(s.sessionTokenHeaderMiddleware)
+	if s.conf().Verbose >= 2 {
 		opts := server.LogOptions{Response: true, Headers: true, From: false, EncodeBinary: true}
 		r.Use(server.LogMiddleware("client", opts))
 	}
+	r.Use(s.interceptors...)
 
 	notfound := &irma.RemoteError{Status: 404, ErrorName: string(server.ErrorInvalidRequest.Type)}
 	notallowed := &irma.RemoteError{Status: 405, ErrorName: string(server.ErrorInvalidRequest.Type)}
@@ -107,11 +149,18 @@ func (s *Server) HandlerFunc() http.HandlerFunc {
 	r.MethodNotAllowed(errorWriter(notallowed, server.WriteResponse))
 
 	r.Route("/session/{token}", func(r chi.Router) {
+		r.Use(contentTypeMiddleware)
+		r.Use(s.loadSheddingMiddleware)
 		r.Use(s.sessionMiddleware)
+		r.Use(s.traceMiddleware)
 		r.Delete("/", s.handleSessionDelete)
 		r.Get("/status", s.handleSessionStatus)
 		r.Get("/statusevents", s.handleSessionStatusEvents)
+		r.Post("/pairing", s.handleSessionPairing)
+		r.Post("/abort", s.handleSessionAbort)
 		r.Group(func(r chi.Router) {
+			// Compress outside of the cache, so that it caches and replays uncompressed responses
+			r.Use(s.compressionMiddleware)
 			r.Use(s.cacheMiddleware)
 			r.Get("/", s.handleSessionGet)
 			r.Post("/commitments", s.handleSessionCommitments)
@@ -119,6 +168,7 @@ func (s *Server) HandlerFunc() http.HandlerFunc {
 		})
 	})
 	r.Post("/session/{name}", s.handleStaticMessage)
+	r.Get("/publickey/{issuer}/{counter:\\d+}", s.handlePublicKey)
 
 	r.Route("/revocation/{id}", func(r chi.Router) {
 		r.NotFound(errorWriter(notfound, server.WriteBinaryResponse))
@@ -138,7 +188,7 @@ func Stop() {
 	s.Stop()
 }
 func (s *Server) Stop() {
-	if err := s.conf.IrmaConfiguration.Revocation.Close(); err != nil {
+	if err := s.conf().IrmaConfiguration.Revocation.Close(); err != nil {
 		server.LogWarning(err)
 	}
 	s.stopScheduler <- true
@@ -154,6 +204,39 @@ func StartSession(request interface{}, handler server.SessionHandler) (*irma.Qr,
 	return s.StartSession(request, handler)
 }
 func (s *Server) StartSession(req interface{}, handler server.SessionHandler) (*irma.Qr, string, error) {
+	return s.StartSessionForRequestor(req, handler, "")
+}
+
+// StartSessionForRequestor is like StartSession(), but additionally records the specified
+// requestor as the requestor that started the session, so that all sessions of the requestor can
+// be cancelled using CancelSessionsByRequestor().
+func StartSessionForRequestor(request interface{}, handler server.SessionHandler, requestor string) (*irma.Qr, string, error) {
+	return s.StartSessionForRequestor(request, handler, requestor)
+}
+func (s *Server) StartSessionForRequestor(req interface{}, handler server.SessionHandler, requestor string) (*irma.Qr, string, error) {
+	if s.conf().TracerProvider == nil {
+		return s.startSession(req, handler, requestor)
+	}
+	_, span := s.conf().TracerProvider.StartSpan(context.Background(), "irma.StartSession")
+	defer span.End()
+	qr, token, err := s.startSession(req, handler, requestor)
+	if err != nil {
+		span.SetAttribute("error", err.Error())
+		return qr, token, err
+	}
+	span.SetAttribute("action", string(qr.Type))
+	span.SetAttribute("token", server.HashToken(token))
+	span.SetAttribute("status", string(server.StatusInitialized))
+	return qr, token, nil
+}
+
+func (s *Server) startSession(req interface{}, handler server.SessionHandler, requestor string) (*irma.Qr, string, error) {
+	if atomic.LoadInt32(&s.maintenance) != 0 {
+		return nil, "", ErrMaintenance
+	}
+	if err := s.checkSessionRequestSize(req); err != nil {
+		return nil, "", err
+	}
 	rrequest, err := server.ParseSessionRequest(req)
 	if err != nil {
 		return nil, "", err
@@ -161,46 +244,356 @@ func (s *Server) StartSession(req interface{}, handler server.SessionHandler) (*
 
 	request := rrequest.SessionRequest()
 	action := request.Action()
+	if !s.conf().ActionEnabled(action) {
+		return nil, "", errors.Errorf("%s sessions are disabled on this server", action)
+	}
+	if base := request.Base(); len(base.RequestorName) == 0 && len(s.conf().ServerName) > 0 {
+		base.RequestorName = s.conf().ServerName
+	}
 
-	if err := s.validateRequest(request); err != nil {
+	if err := s.validateSessionRequest(rrequest, requestor); err != nil {
 		return nil, "", err
 	}
 
-	if action == irma.ActionIssuing {
-		if err := s.validateIssuanceRequest(request.(*irma.IssuanceRequest)); err != nil {
-			return nil, "", err
-		}
+	if group := rrequest.Base().SessionGroup; group != "" {
+		s.cancelSessions(func(session *session) bool {
+			return session.requestor == requestor && session.rrequest.Base().SessionGroup == group
+		})
 	}
 
-	session := s.newSession(action, rrequest)
-	s.conf.Logger.WithFields(logrus.Fields{"action": action, "session": session.token}).Infof("Session started")
-	if s.conf.Logger.IsLevelEnabled(logrus.DebugLevel) {
-		s.conf.Logger.WithFields(logrus.Fields{"session": session.token, "clienttoken": session.clientToken}).Info("Session request: ", server.ToJson(rrequest))
+	session, err := s.newSession(action, rrequest, requestor)
+	if err != nil {
+		return nil, "", err
+	}
+	s.conf().Logger.WithFields(logrus.Fields{"action": action, "session": session.token}).Infof("Session started")
+	if s.conf().Logger.IsLevelEnabled(logrus.DebugLevel) {
+		s.conf().Logger.WithFields(logrus.Fields{"session": session.token, "clienttoken": session.clientToken}).Info("Session request: ", server.ToJson(rrequest))
 	} else {
-		s.conf.Logger.WithFields(logrus.Fields{"session": session.token}).Info("Session request (purged of attribute values): ", server.ToJson(purgeRequest(rrequest)))
+		s.conf().Logger.WithFields(logrus.Fields{"session": session.token}).Info("Session request (purged of attribute values): ", server.ToJson(purgeRequest(rrequest)))
+	}
+	expiry := irma.Timestamp(session.lastActive.Add(session.timeout()))
+	qr := &irma.Qr{
+		Type:   action,
+		URL:    s.conf().URL + "session/" + session.clientToken,
+		Expiry: &expiry,
+	}
+	if s.conf().QRRewriter != nil {
+		if qr = s.conf().QRRewriter(qr, session.token); qr == nil {
+			session.Lock()
+			session.handleDelete(false)
+			session.Unlock()
+			return nil, "", errors.New("QRRewriter returned no QR")
+		}
 	}
 	if handler != nil {
 		s.handlers[session.token] = handler
 	}
-	return &irma.Qr{
-		Type: action,
-		URL:  s.conf.URL + "session/" + session.clientToken,
-	}, session.token, nil
+	return qr, session.token, nil
 }
 
-// GetSessionResult retrieves the result of the specified IRMA session.
+// SetMaintenance enables or disables maintenance mode. In maintenance mode, StartSession() refuses
+// to start new sessions, returning ErrMaintenance, while existing sessions are handled normally.
+func SetMaintenance(enabled bool) {
+	s.SetMaintenance(enabled)
+}
+func (s *Server) SetMaintenance(enabled bool) {
+	var value int32
+	if enabled {
+		value = 1
+	}
+	atomic.StoreInt32(&s.maintenance, value)
+	s.conf().Logger.WithField("enabled", enabled).Info("Maintenance mode set")
+}
+
+// ReloadSchemes reparses the schemes in the schemes path, and uses them for all sessions started
+// afterwards. Sessions that are already running keep using the schemes with which they started,
+// so until these sessions are deleted the previous schemes are also kept in memory.
+// If the reloaded schemes are invalid, a *server.SchemesReloadError is returned and the
+// current schemes remain in use.
+func ReloadSchemes() error {
+	return s.ReloadSchemes()
+}
+func (s *Server) ReloadSchemes() error {
+	s.reloadLock.Lock()
+	defer s.reloadLock.Unlock()
+	conf, err := s.conf().ReloadSchemes()
+	if err != nil {
+		return err
+	}
+	s.config.Store(conf)
+	conf.Logger.WithField("schemes_path", conf.IrmaConfiguration.Path).Info("Schemes reloaded")
+	return nil
+}
+
+// conf returns the current configuration. Sessions keep using the configuration with which they
+// were started, also when it is replaced by ReloadSchemes() in the meantime.
+func (s *Server) conf() *server.Configuration {
+	return s.config.Load().(*server.Configuration)
+}
+
+// Configuration returns the current configuration of the server, which ReloadSchemes() replaces
+// by a copy containing the reloaded schemes.
+func (s *Server) Configuration() *server.Configuration {
+	return s.conf()
+}
+
+// updateSchemes downloads updates of the schemes and, if there are any, reloads them instead of
+// reparsing them in place, so that running sessions are not affected by the update.
+func (s *Server) updateSchemes() {
+	updated, err := s.conf().IrmaConfiguration.DownloadSchemeUpdates()
+	if err != nil {
+		s.conf().Logger.Error("Scheme autoupdater failed")
+		s.conf().LogSchemeTimeout(err)
+		_ = server.LogError(err)
+		return
+	}
+	if updated.Empty() {
+		return
+	}
+	if err = s.ReloadSchemes(); err != nil {
+		_ = server.LogError(err)
+	}
+}
+
+// Use adds an interceptor that wraps the handling of all messages from IRMA apps (see HandlerFunc()),
+// for cross-cutting behaviour such as authentication, metrics or logging. Interceptors are invoked in
+// the order in which they were added, and must be added before HandlerFunc() is first invoked.
+func Use(interceptor func(next http.Handler) http.Handler) {
+	s.Use(interceptor)
+}
+func (s *Server) Use(interceptor func(next http.Handler) http.Handler) {
+	if s.router != nil {
+		panic("irmaserver: interceptors must be added before HandlerFunc() is invoked")
+	}
+	s.interceptors = append(s.interceptors, interceptor)
+}
+
+// StartSessionFromTemplate starts an IRMA session using the specified request template from the
+// configuration, substituting placeholders of the form {{name}} in its required attribute values
+// and labels by the corresponding parameters. All placeholders must be substituted.
+func StartSessionFromTemplate(id string, params map[string]string, handler server.SessionHandler) (*irma.Qr, string, error) {
+	return s.StartSessionFromTemplate(id, params, handler)
+}
+func (s *Server) StartSessionFromTemplate(id string, params map[string]string, handler server.SessionHandler) (*irma.Qr, string, error) {
+	template := s.conf().RequestTemplateRequests[id]
+	if template == nil {
+		return nil, "", errors.Errorf("unknown request template %s", id)
+	}
+	rrequest, err := substituteTemplate(template, params)
+	if err != nil {
+		return nil, "", err
+	}
+	return s.StartSession(rrequest, handler)
+}
+
+// Stats returns cumulative session counters since the server was started: the total amount of
+// sessions, the amount per session type, and the amount of sessions that are currently active.
+func Stats() server.ServerStats {
+	return s.Stats()
+}
+func (s *Server) Stats() server.ServerStats {
+	return s.stats.get()
+}
+
+// IssuableCredentials returns the credential types that this server can issue, i.e., for which
+// it has a private key whose corresponding public key is present and not expired.
+func IssuableCredentials() []irma.CredentialTypeIdentifier {
+	return s.IssuableCredentials()
+}
+func (s *Server) IssuableCredentials() []irma.CredentialTypeIdentifier {
+	conf := s.conf().IrmaConfiguration
+	now := time.Now().Unix()
+	canIssue := map[irma.IssuerIdentifier]bool{}
+	var creds []irma.CredentialTypeIdentifier
+	for id := range conf.CredentialTypes {
+		issid := id.IssuerIdentifier()
+		can, checked := canIssue[issid]
+		if !checked {
+			if sk, err := conf.PrivateKeyLatest(issid); err == nil {
+				pk, err := conf.PublicKey(issid, sk.Counter)
+				can = err == nil && pk != nil && pk.ExpiryDate > now
+			}
+			canIssue[issid] = can
+		}
+		if can {
+			creds = append(creds, id)
+		}
+	}
+	sort.Slice(creds, func(i, j int) bool {
+		return creds[i].String() < creds[j].String()
+	})
+	return creds
+}
+
+// PublicKey returns the public key of the specified issuer with the specified counter, as used
+// by this server for issuance and verification.
+func PublicKey(issid irma.IssuerIdentifier, counter uint) (*gabi.PublicKey, error) {
+	return s.PublicKey(issid, counter)
+}
+func (s *Server) PublicKey(issid irma.IssuerIdentifier, counter uint) (*gabi.PublicKey, error) {
+	pk, err := s.conf().IrmaConfiguration.PublicKey(issid, counter)
+	if err != nil {
+		return nil, err
+	}
+	if pk == nil {
+		return nil, errors.Errorf("unknown public key %s-%d", issid, counter)
+	}
+	return pk, nil
+}
+
+// SelfTestIssuance checks that the latest private key of the specified issuer can be used to
+// issue credentials, by issuing a credential of a nonexistent type containing a random attribute
+// to a simulated client, which verifies the signature against the public key as the IRMA app does.
+func SelfTestIssuance(issid irma.IssuerIdentifier) error {
+	return s.SelfTestIssuance(issid)
+}
+func (s *Server) SelfTestIssuance(issid irma.IssuerIdentifier) error {
+	sk, err := s.conf().IrmaConfiguration.PrivateKeyLatest(issid)
+	if err != nil {
+		return err
+	}
+	pk, err := s.PublicKey(issid, sk.Counter)
+	if err != nil {
+		return err
+	}
+
+	secret := common.RandomBigInt(new(big.Int).Lsh(big.NewInt(1), uint(pk.Params.Lm)))
+	attrs := []*big.Int{
+		irma.NewMetadataAttribute(irma.GetMetadataVersion(irma.NewVersion(2, 7))).Int,
+		common.RandomBigInt(new(big.Int).Lsh(big.NewInt(1), uint(pk.Params.Lm))),
+	}
+	_, err = issueToSecret(sk, pk, secret, attrs)
+	return err
+}
+
+// IssueCustodial issues the specified credential without an IRMA app, to the specified secret key
+// held by the caller, e.g. in a custodial wallet holding credentials on behalf of its users. The
+// returned credential can be stored by the caller, and used to disclose its attributes.
+//
+// Note the security tradeoffs. Normally the secret key never leaves the IRMA app of the user, so
+// only the user can use their credentials; here, whoever holds the secret key can use the
+// credential without involvement of the user, so the caller must be trusted by users and verifiers
+// alike to keep it safe. For the same reason, credentials of schemes with a keyshare server, which
+// protects the credentials of IRMA apps with a PIN, are refused, as are credential types supporting
+// revocation. The attributes are not checked against any disclosure, so the caller is responsible
+// for their correctness, as with ordinary issuance requests.
+func IssueCustodial(cred *irma.CredentialRequest, secret *big.Int) (*gabi.Credential, error) {
+	return s.IssueCustodial(cred, secret)
+}
+func (s *Server) IssueCustodial(cred *irma.CredentialRequest, secret *big.Int) (*gabi.Credential, error) {
+	if !s.conf().ActionEnabled(irma.ActionIssuing) {
+		return nil, errors.New("issuing sessions are disabled on this server")
+	}
+	credtype := s.conf().IrmaConfiguration.CredentialTypes[cred.CredentialTypeID]
+	if credtype == nil {
+		return nil, errors.Errorf("unknown credential type %s", cred.CredentialTypeID)
+	}
+	if s.conf().IrmaConfiguration.SchemeManagers[credtype.SchemeManagerIdentifier()].Distributed() {
+		return nil, errors.Errorf("credential type %s belongs to a scheme with a keyshare server", cred.CredentialTypeID)
+	}
+	if credtype.RevocationSupported() {
+		return nil, errors.Errorf("credential type %s supports revocation", cred.CredentialTypeID)
+	}
+	if err := s.validateIssuanceRequest(irma.NewIssuanceRequest([]*irma.CredentialRequest{cred}), ""); err != nil {
+		return nil, err
+	}
+
+	iss := cred.CredentialTypeID.IssuerIdentifier()
+	sk, err := s.conf().IrmaConfiguration.PrivateKey(iss, cred.KeyCounter)
+	if err != nil {
+		return nil, err
+	}
+	pk, err := s.PublicKey(iss, cred.KeyCounter)
+	if err != nil {
+		return nil, err
+	}
+	attributes, err := cred.AttributeList(s.conf().IrmaConfiguration, 0x03, nil)
+	if err != nil {
+		return nil, err
+	}
+	s.conf().Logger.WithFields(logrus.Fields{"credential": cred.CredentialTypeID}).Info("Issuing custodial credential")
+	return issueToSecret(sk, pk, secret, attributes.Ints)
+}
+
+// GetSessionResult retrieves the result of the specified IRMA session, from the configured
+// ResultStore if the session is not present in this instance.
 func GetSessionResult(token string) *server.SessionResult {
 	return s.GetSessionResult(token)
 }
 func (s *Server) GetSessionResult(token string) *server.SessionResult {
 	session := s.sessions.get(token)
+	if session == nil && s.conf().ResultStore != nil {
+		result, err := s.conf().ResultStore.Get(token)
+		if err != nil {
+			_ = server.LogError(err)
+		}
+		if result != nil {
+			if result, err = decryptResult(result, s.conf().ResultEncryptionKey); err != nil {
+				_ = server.LogError(err)
+				return nil
+			}
+			return result
+		}
+	}
 	if session == nil {
-		s.conf.Logger.Warn("Session result requested of unknown session ", token)
+		s.conf().Logger.Warn("Session result requested of unknown session ", token)
 		return nil
 	}
 	return session.result
 }
 
+// GetClientInfo retrieves the IP address and user agent of the client of the specified IRMA
+// session, if recorded (see Configuration.RecordClientInfo).
+func GetClientInfo(token string) *server.ClientInfo {
+	return s.GetClientInfo(token)
+}
+func (s *Server) GetClientInfo(token string) *server.ClientInfo {
+	session := s.sessions.get(token)
+	if session == nil {
+		s.conf().Logger.Warn("Client info requested of unknown session ", token)
+		return nil
+	}
+	return session.client
+}
+
+// GetSessionDiagnostics retrieves how often the client of the specified IRMA session fetched
+// the session request and polled its status.
+func GetSessionDiagnostics(token string) *server.SessionDiagnostics {
+	return s.GetSessionDiagnostics(token)
+}
+func (s *Server) GetSessionDiagnostics(token string) *server.SessionDiagnostics {
+	session := s.sessions.get(token)
+	if session == nil {
+		s.conf().Logger.Warn("Diagnostics requested of unknown session ", token)
+		return nil
+	}
+	session.Lock()
+	defer session.Unlock()
+	return &server.SessionDiagnostics{
+		Status:         session.status,
+		RequestFetches: session.requestFetches,
+		StatusPolls:    session.statusPolls,
+		ProofAttempts:  session.proofAttempts,
+		Client:         session.client,
+	}
+}
+
+// GetVerificationError retrieves why the proofs or issuance commitments that the client sent in the
+// specified IRMA session were not accepted, or nil if they were or if the client sent none.
+func GetVerificationError(token string) *server.VerificationError {
+	return s.GetVerificationError(token)
+}
+func (s *Server) GetVerificationError(token string) *server.VerificationError {
+	session := s.sessions.get(token)
+	if session == nil {
+		s.conf().Logger.Warn("Verification error requested of unknown session ", token)
+		return nil
+	}
+	session.Lock()
+	defer session.Unlock()
+	return session.verification
+}
+
 // GetRequest retrieves the request submitted by the requestor that started the specified IRMA session.
 func GetRequest(token string) irma.RequestorRequest {
 	return s.GetRequest(token)
@@ -208,12 +601,26 @@ func GetRequest(token string) irma.RequestorRequest {
 func (s *Server) GetRequest(token string) irma.RequestorRequest {
 	session := s.sessions.get(token)
 	if session == nil {
-		s.conf.Logger.Warn("Session request requested of unknown session ", token)
+		s.conf().Logger.Warn("Session request requested of unknown session ", token)
 		return nil
 	}
 	return session.rrequest
 }
 
+// GetPairingCode returns the pairing code of the specified IRMA session, or an empty string if it
+// does not require pairing. The frontend shows it to the user, who enters it in the IRMA app.
+func GetPairingCode(token string) string {
+	return s.GetPairingCode(token)
+}
+func (s *Server) GetPairingCode(token string) string {
+	session := s.sessions.get(token)
+	if session == nil {
+		s.conf().Logger.Warn("Pairing code requested of unknown session ", token)
+		return ""
+	}
+	return session.pairingCode
+}
+
 // CancelSession cancels the specified IRMA session.
 func CancelSession(token string) error {
 	return s.CancelSession(token)
@@ -223,7 +630,167 @@ func (s *Server) CancelSession(token string) error {
 	if session == nil {
 		return server.LogError(errors.Errorf("can't cancel unknown session %s", token))
 	}
-	session.handleDelete()
+	session.handleDelete(false)
+	return nil
+}
+
+// ConfirmExternal confirms the issuance of the specified IRMA session, which was started with a
+// request requiring external confirmation. If the client has already sent its issuance commitments,
+// the credentials are now signed and returned to it; otherwise that happens as soon as it does.
+func ConfirmExternal(token string) error {
+	return s.ConfirmExternal(token)
+}
+func (s *Server) ConfirmExternal(token string) error {
+	session := s.sessions.get(token)
+	if session == nil {
+		return server.LogError(errors.Errorf("can't confirm unknown session %s", token))
+	}
+	session.Lock()
+	defer session.Unlock()
+	if !session.rrequest.Base().ExternalConfirmation {
+		return server.LogError(errors.Errorf("session %s does not require external confirmation", token))
+	}
+	if session.status.Finished() {
+		return server.LogError(errors.Errorf("can't confirm finished session %s", token))
+	}
+	session.confirmed = true
+	if session.confirmation != nil {
+		close(session.confirmation)
+		session.confirmation = nil
+	}
+	s.conf().Logger.WithFields(logrus.Fields{"session": token}).Info("Issuance confirmed externally")
+	return nil
+}
+
+// CancelSessionsByRequestor cancels all unfinished sessions that were started by the specified
+// requestor using StartSessionForRequestor(), returning how many sessions were cancelled.
+func CancelSessionsByRequestor(requestor string) (int, error) {
+	return s.CancelSessionsByRequestor(requestor)
+}
+func (s *Server) CancelSessionsByRequestor(requestor string) (int, error) {
+	if requestor == "" {
+		return 0, errors.New("no requestor specified")
+	}
+	count := s.cancelSessions(func(session *session) bool {
+		return session.requestor == requestor
+	})
+	s.conf().Logger.WithFields(logrus.Fields{"requestor": requestor, "count": count}).Info("Cancelled sessions of requestor")
+	return count, nil
+}
+
+// cancelSessions cancels the unfinished sessions selected by keep (see sessionStore.filter()),
+// returning how many sessions were cancelled.
+func (s *Server) cancelSessions(keep func(*session) bool) int {
+	count := 0
+	for _, session := range s.sessions.filter(keep) {
+		session.Lock()
+		if !session.status.Finished() {
+			session.handleDelete(false)
+			count++
+		}
+		session.Unlock()
+	}
+	return count
+}
+
+// WriteActiveSessions writes a JSON array containing a summary of each unfinished session to w,
+// optionally restricted to the sessions whose summary passes all specified filters. The summaries
+// are written as they are created, locking each session only while its summary is created.
+func WriteActiveSessions(w io.Writer, filters ...func(*server.SessionSummary) bool) error {
+	return s.WriteActiveSessions(w, filters...)
+}
+func (s *Server) WriteActiveSessions(w io.Writer, filters ...func(*server.SessionSummary) bool) error {
+	sessions := s.sessions.filter(func(*session) bool { return true })
+	if _, err := io.WriteString(w, "["); err != nil {
+		return err
+	}
+	first := true
+	for _, session := range sessions {
+		summary := session.summary()
+		if summary.Status.Finished() || !passes(summary, filters) {
+			continue
+		}
+		bts, err := json.Marshal(summary)
+		if err != nil {
+			return err
+		}
+		if !first {
+			bts = append([]byte(","), bts...)
+		}
+		first = false
+		if _, err = w.Write(bts); err != nil {
+			return err
+		}
+	}
+	_, err := io.WriteString(w, "]")
+	return err
+}
+
+func passes(summary *server.SessionSummary, filters []func(*server.SessionSummary) bool) bool {
+	for _, filter := range filters {
+		if !filter(summary) {
+			return false
+		}
+	}
+	return true
+}
+
+// ExportSessions serializes all sessions of the server, such that they can be continued by another
+// server using ImportSessions(), e.g. when replacing the server process without downtime. As the
+// sessions continue to change when they are handled, the server should no longer receive requests
+// when its sessions are exported.
+//
+// Exports can only be imported by servers of the same version or a later version, having the same
+// schemes, issuer private keys and URL. Handlers passed to StartSession() are not exported, so the
+// importing server does not invoke them; requestors should instead retrieve the session result
+// from the importing server.
+func ExportSessions() ([]byte, error) {
+	return s.ExportSessions()
+}
+func (s *Server) ExportSessions() ([]byte, error) {
+	export := sessionExport{Version: sessionExportVersion}
+	for _, session := range s.sessions.filter(func(*session) bool { return true }) {
+		exported, err := session.export()
+		if err != nil {
+			return nil, err
+		}
+		export.Sessions = append(export.Sessions, exported)
+	}
+	return json.Marshal(export)
+}
+
+// ImportSessions adds the sessions serialized by ExportSessions() to the server, after which they
+// can be continued at this server. See ExportSessions() for the compatibility requirements.
+func ImportSessions(bts []byte) error {
+	return s.ImportSessions(bts)
+}
+func (s *Server) ImportSessions(bts []byte) error {
+	var export sessionExport
+	if err := json.Unmarshal(bts, &export); err != nil {
+		return err
+	}
+	if export.Version != sessionExportVersion {
+		return errors.Errorf("unsupported session export version %d", export.Version)
+	}
+	sessions := make([]*session, 0, len(export.Sessions))
+	for _, exported := range export.Sessions {
+		if s.sessions.get(exported.Token) != nil || s.sessions.clientGet(exported.ClientToken) != nil {
+			return errors.Errorf("session %s already exists", exported.Token)
+		}
+		session, err := s.importSession(exported)
+		if err != nil {
+			return err
+		}
+		sessions = append(sessions, session)
+	}
+	for _, session := range sessions {
+		s.sessions.add(session)
+		// Count unfinished sessions as started here, as they are counted as finished when they finish
+		if !session.status.Finished() {
+			s.stats.started(session.action)
+		}
+	}
+	s.conf().Logger.WithField("count", len(sessions)).Info("Imported sessions")
 	return nil
 }
 
@@ -234,7 +801,18 @@ func Revoke(credid irma.CredentialTypeIdentifier, key string, issued time.Time)
 	return s.Revoke(credid, key, issued)
 }
 func (s *Server) Revoke(credid irma.CredentialTypeIdentifier, key string, issued time.Time) error {
-	return s.conf.IrmaConfiguration.Revocation.Revoke(credid, key, issued)
+	return s.conf().IrmaConfiguration.Revocation.Revoke(credid, key, issued)
+}
+
+// RevokeIssuedBetween revokes all credentials of the specified type that were issued between
+// from and to (inclusive), e.g. after the issuer private key is suspected to have been compromised,
+// and returns how many were revoked. (Like Revoke(), can only be used if this server is the
+// revocation server for the specified credential type.)
+func RevokeIssuedBetween(credid irma.CredentialTypeIdentifier, from, to time.Time) (int, error) {
+	return s.RevokeIssuedBetween(credid, from, to)
+}
+func (s *Server) RevokeIssuedBetween(credid irma.CredentialTypeIdentifier, from, to time.Time) (int, error) {
+	return s.conf().IrmaConfiguration.Revocation.RevokeIssuedBetween(credid, from, to)
 }
 
 // SubscribeServerSentEvents subscribes the HTTP client to server sent events on status updates
@@ -243,7 +821,7 @@ func SubscribeServerSentEvents(w http.ResponseWriter, r *http.Request, token str
 	return s.SubscribeServerSentEvents(w, r, token, requestor)
 }
 func (s *Server) SubscribeServerSentEvents(w http.ResponseWriter, r *http.Request, token string, requestor bool) error {
-	if !s.conf.EnableSSE {
+	if !s.conf().EnableSSE {
 		return errors.New("Server sent events disabled")
 	}
 
@@ -260,16 +838,34 @@ func (s *Server) SubscribeServerSentEvents(w http.ResponseWriter, r *http.Reques
 		return server.LogError(errors.Errorf("can't subscribe to server sent events of finished session %s", token))
 	}
 
+	// Count the connection until it is closed, refusing it if that exceeds one of the maximums
+	total := atomic.AddInt64(&s.sseConnections, 1)
+	defer atomic.AddInt64(&s.sseConnections, -1)
+	perSession := atomic.AddInt32(&session.sseConnections, 1)
+	defer atomic.AddInt32(&session.sseConnections, -1)
+	if (s.conf().MaxSSEConnections > 0 && total > int64(s.conf().MaxSSEConnections)) ||
+		(s.conf().MaxSessionSSEConnections > 0 && perSession > int32(s.conf().MaxSessionSSEConnections)) {
+		s.conf().Logger.WithFields(logrus.Fields{"session": session.token, "total": total - 1, "session_connections": perSession - 1}).
+			Warn("Refused server sent events subscription: too many connections")
+		return ErrTooManySSEConnections
+	}
+
 	// The EventSource.onopen Javascript callback is not consistently called across browsers (Chrome yes, Firefox+Safari no).
 	// However, when the SSE connection has been opened the webclient needs some signal so that it can early detect SSE failures.
 	// So we manually send an "open" event. Unfortunately:
 	// - we need to give the webclient that connected just now some time, otherwise it will miss the "open" event
 	// - the "open" event also goes to all other webclients currently listening, as we have no way to send this
 	//   event to just the webclient currently listening. (Thus the handler of this "open" event must be idempotent.)
+	// If the client disconnects in the meantime, we do not bother.
+	done := make(chan struct{})
+	defer close(done)
 	go func() {
-		time.Sleep(200 * time.Millisecond)
-		s.serverSentEvents.SendMessage("session/"+token, sse.NewMessage("", "", "open"))
+		select {
+		case <-time.After(200 * time.Millisecond):
+			s.serverSentEvents.SendMessage("session/"+token, sse.NewMessage("", "", "open"))
+		case <-done:
+		}
 	}()
-	s.serverSentEvents.ServeHTTP(w, r)
+	s.serveEvents(w, r)
 	return nil
 }
@@ -1,12 +1,15 @@
 package irmaserver
 
 import (
+	"bytes"
 	"context"
+	"crypto/subtle"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"net/http"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/go-chi/chi"
@@ -22,24 +25,55 @@ import (
 // Maintaining the session state is done here, as well as checking whether the session is in the
 // appropriate status before handling the request.
 
-func (session *session) handleDelete() {
+func (session *session) handleDelete(declined bool) {
 	if session.status.Finished() {
 		return
 	}
 	session.markAlive()
 
-	session.result = &server.SessionResult{Token: session.token, Status: server.StatusCancelled, Type: session.action}
-	session.setStatus(server.StatusCancelled)
+	status := server.StatusCancelled
+	if declined {
+		status = server.StatusDeclined
+	}
+	session.result = &server.SessionResult{Token: session.token, Status: status, Type: session.action}
+	session.setStatus(status)
 }
 
-func (session *session) handleGetRequest(min, max *irma.ProtocolVersion) (irma.SessionRequest, *irma.RemoteError) {
+func (session *session) handleAbort(message *irma.SessionAbortMessage) {
+	if session.status.Finished() {
+		return
+	}
+	session.markAlive()
+
+	status := server.StatusCancelled
+	if message.Reason == irma.AbortReasonDeclined {
+		status = server.StatusDeclined
+	}
+	session.conf.Logger.WithFields(logrus.Fields{"session": session.token, "reason": message.Reason}).
+		Info("Client aborted session")
+	session.result = &server.SessionResult{Token: session.token, Status: status, Type: session.action, Abort: message}
+	session.setStatus(status)
+}
+
+func (session *session) handleGetRequest(min, max *irma.ProtocolVersion, client *server.ClientInfo, useragent string) (irma.SessionRequest, *irma.RemoteError) {
 	if session.status != server.StatusInitialized {
 		return nil, server.RemoteError(server.ErrorUnexpectedRequest, "Session already started")
 	}
+	if !session.conf.UserAgentAllowed(useragent) {
+		// Don't fail the session, so that the user can still scan the QR with an allowed app
+		session.conf.Logger.WithFields(logrus.Fields{"session": session.token, "useragent": useragent}).
+			Warn("Refused session request to client with disallowed user agent")
+		return nil, server.RemoteError(server.ErrorClientNotAllowed, "")
+	}
 
 	session.markAlive()
 	logger := session.conf.Logger.WithFields(logrus.Fields{"session": session.token})
 
+	if client != nil {
+		session.client = client
+		logger.WithFields(logrus.Fields{"ip": client.IP, "useragent": client.UserAgent}).Info("Client connected")
+	}
+
 	// we include the latest revocation updates for the client here, as opposed to when the session
 	// was started, so that the client always gets the very latest revocation records
 	var err error
@@ -61,7 +95,18 @@ func (session *session) handleGetRequest(min, max *irma.ProtocolVersion) (irma.S
 	logger.WithFields(logrus.Fields{"version": session.version.String()}).Debugf("Protocol version negotiated")
 	session.request.Base().ProtocolVersion = session.version
 
-	session.setStatus(server.StatusConnected)
+	if session.pairingCode != "" {
+		// The frontend shows the pairing code to the user, who enters it in the client, which
+		// submits it to us; only then can the session proceed. The code is never sent to the
+		// client, so that whoever relays the QR to another user cannot complete the pairing.
+		session.request.Base().PairingRequired = true
+		session.setStatus(server.StatusPairing)
+	} else {
+		session.setStatus(server.StatusConnected)
+	}
+	if session.conf.OnClientConnected != nil {
+		go session.conf.OnClientConnected(session.token)
+	}
 
 	if session.version.Below(2, 5) {
 		logger.Info("Returning legacy session format")
@@ -81,11 +126,34 @@ func (session *session) handleGetRequest(min, max *irma.ProtocolVersion) (irma.S
 	for _, cred := range cpy.(*irma.IssuanceRequest).Credentials {
 		cred.RevocationKey = ""
 	}
+	if session.rrequest.Base().ExternalConfirmation {
+		// Let the client know how long our response to its commitments may take
+		cpy.(*irma.IssuanceRequest).ConfirmationTimeout = session.confirmationTimeout()
+	}
 	return cpy.(*irma.IssuanceRequest), nil
 }
 
+func (session *session) handlePostPairing(code string) *irma.RemoteError {
+	if session.status != server.StatusPairing {
+		return server.RemoteError(server.ErrorUnexpectedRequest, "Session not awaiting pairing")
+	}
+
+	if subtle.ConstantTimeCompare([]byte(code), []byte(session.pairingCode)) != 1 {
+		session.pairingAttempts++
+		if session.pairingAttempts >= maxPairingAttempts {
+			return session.fail(server.ErrorPairingFailed, "")
+		}
+		return server.RemoteError(server.ErrorPairingRejected, "")
+	}
+
+	session.markAlive()
+	session.setStatus(server.StatusConnected)
+	return nil
+}
+
 func (session *session) handleGetStatus() (server.Status, *irma.RemoteError) {
-	return session.status, nil
+	// Apps do not know the progress statuses
+	return session.status.Coarse(), nil
 }
 
 func (session *session) handlePostSignature(signature *irma.SignedMessage) (*irma.ProofStatus, *irma.RemoteError) {
@@ -93,6 +161,9 @@ func (session *session) handlePostSignature(signature *irma.SignedMessage) (*irm
 		return nil, server.RemoteError(server.ErrorUnexpectedRequest, "Session not yet started or already finished")
 	}
 	session.markAlive()
+	if rerr := session.startVerifying(); rerr != nil {
+		return nil, rerr
+	}
 
 	var err error
 	var rerr *irma.RemoteError
@@ -100,7 +171,13 @@ func (session *session) handlePostSignature(signature *irma.SignedMessage) (*irm
 	session.result.Disclosed, session.result.ProofStatus, err = signature.Verify(
 		session.conf.IrmaConfiguration, session.request.(*irma.SignatureRequest))
 	if err == nil {
-		session.setStatus(server.StatusDone)
+		if rerr = session.checkDisclosed(); rerr == nil {
+			rerr = session.checkNonceReuse()
+		}
+		if rerr == nil {
+			session.result.SignatureDetails = session.signatureDetails(signature)
+			session.setStatus(server.StatusDone)
+		}
 	} else {
 		if err == irma.ErrMissingPublicKey {
 			rerr = session.fail(server.ErrorUnknownPublicKey, err.Error())
@@ -108,6 +185,9 @@ func (session *session) handlePostSignature(signature *irma.SignedMessage) (*irm
 			rerr = session.fail(server.ErrorUnknown, err.Error())
 		}
 	}
+	if rerr != nil || session.result.ProofStatus != irma.ProofStatusValid {
+		session.recordVerificationError(signature.Signature, nil, err)
+	}
 	return &session.result.ProofStatus, rerr
 }
 
@@ -116,13 +196,25 @@ func (session *session) handlePostDisclosure(disclosure *irma.Disclosure) (*irma
 		return nil, server.RemoteError(server.ErrorUnexpectedRequest, "Session not yet started or already finished")
 	}
 	session.markAlive()
+	session.proofAttempts++
+	if rerr := session.startVerifying(); rerr != nil {
+		return nil, rerr
+	}
 
 	var err error
 	var rerr *irma.RemoteError
 	session.result.Disclosed, session.result.ProofStatus, err = disclosure.Verify(
 		session.conf.IrmaConfiguration, session.request.(*irma.DisclosureRequest))
+	if (err != nil || session.result.ProofStatus != irma.ProofStatusValid) && session.proofRetryAllowed() {
+		return session.rejectProofs(disclosure.Proofs, err)
+	}
 	if err == nil {
-		session.setStatus(server.StatusDone)
+		if rerr = session.checkDisclosed(); rerr == nil {
+			rerr = session.checkNonceReuse()
+		}
+		if rerr == nil {
+			session.setStatus(server.StatusDone)
+		}
 	} else {
 		if err == irma.ErrMissingPublicKey {
 			rerr = session.fail(server.ErrorUnknownPublicKey, err.Error())
@@ -130,14 +222,33 @@ func (session *session) handlePostDisclosure(disclosure *irma.Disclosure) (*irma
 			rerr = session.fail(server.ErrorUnknown, err.Error())
 		}
 	}
+	if rerr != nil || session.result.ProofStatus != irma.ProofStatusValid {
+		session.recordVerificationError(disclosure.Proofs, nil, err)
+	}
 	return &session.result.ProofStatus, rerr
 }
 
-func (session *session) handlePostCommitments(commitments *irma.IssueCommitmentMessage) ([]*gabi.IssueSignatureMessage, *irma.RemoteError) {
+// handlePostFinished handles proofs that are POSTed to a session that is already finished, e.g.
+// when the client retries its last message after the response to it got lost, or when it sent
+// its last message twice concurrently (a double tap) and the first one finished the session.
+// Instead of verifying the proofs again, we return the stored proof status: always if the
+// session finished less than retryTimeLimit ago, and afterwards only if so configured.
+func (session *session) handlePostFinished() (*irma.ProofStatus, *irma.RemoteError) {
+	duplicate := session.finishedAt.Add(retryTimeLimit).After(time.Now())
+	if session.status != server.StatusDone || !(duplicate || session.conf.ReplayFinishedSessions) {
+		return nil, server.RemoteError(server.ErrorUnexpectedRequest, "Session already finished")
+	}
+	return &session.result.ProofStatus, nil
+}
+
+func (session *session) handlePostCommitments(commitments *irma.IssueCommitmentMessage) (*irma.IssueSignatureMessages, *irma.RemoteError) {
 	if session.status != server.StatusConnected {
 		return nil, server.RemoteError(server.ErrorUnexpectedRequest, "Session not yet started or already finished")
 	}
 	session.markAlive()
+	if rerr := session.startVerifying(); rerr != nil {
+		return nil, rerr
+	}
 
 	request := session.request.(*irma.IssuanceRequest)
 
@@ -176,6 +287,10 @@ func (session *session) handlePostCommitments(commitments *irma.IssueCommitmentM
 	session.result.Disclosed, session.result.ProofStatus, err = commitments.Disclosure().VerifyAgainstRequest(
 		session.conf.IrmaConfiguration, request, request.GetContext(), request.GetNonce(nil), pubkeys, &now, false,
 	)
+	if err != nil || session.result.ProofStatus != irma.ProofStatusValid {
+		// Deferred so that the error with which the session fails below is included
+		defer session.recordVerificationError(commitments.Proofs, pubkeys, err)
+	}
 	if err != nil {
 		if err == irma.ErrMissingPublicKey {
 			return nil, session.fail(server.ErrorUnknownPublicKey, "")
@@ -189,27 +304,74 @@ func (session *session) handlePostCommitments(commitments *irma.IssueCommitmentM
 	if session.result.ProofStatus != irma.ProofStatusValid {
 		return nil, session.fail(server.ErrorInvalidProofs, "")
 	}
+	if rerr := session.checkDisclosed(); rerr != nil {
+		session.recordVerificationError(commitments.Proofs, pubkeys, nil)
+		return nil, rerr
+	}
+	if rerr := session.checkIssuanceValidity(); rerr != nil {
+		return nil, rerr
+	}
+
+	// Incorporate attribute values chosen by the client, if any, into the credentials to be issued
+	if err = request.SetClientAttributes(commitments.ClientAttributes); err != nil {
+		return nil, session.fail(server.ErrorMalformedInput, err.Error())
+	}
+	session.result.ClientAttributes = request.ClientAttributeValues()
+
+	if session.rrequest.Base().ExternalConfirmation {
+		if rerr := session.awaitConfirmation(); rerr != nil {
+			return nil, rerr
+		}
+	}
 
 	// Compute CL signatures
-	var sigs []*gabi.IssueSignatureMessage
+	sigs := &irma.IssueSignatureMessages{}
+	var issued []*server.CredentialIssuanceResult
 	for i, cred := range request.Credentials {
 		id := cred.CredentialTypeID.IssuerIdentifier()
-		pk, _ := session.conf.IrmaConfiguration.PublicKey(id, cred.KeyCounter)
-		sk, _ := session.conf.IrmaConfiguration.PrivateKeyLatest(id)
+		// Resolve the keys now instead of when the session was started, as the schemes or the
+		// private keys may have been updated in the meantime
+		sk, err := session.conf.IrmaConfiguration.PrivateKey(id, cred.KeyCounter)
+		if err != nil {
+			return nil, session.fail(server.ErrorIssuanceFailed, err.Error())
+		}
+		pk, err := session.conf.IrmaConfiguration.PublicKey(id, cred.KeyCounter)
+		if err != nil {
+			return nil, session.fail(server.ErrorIssuanceFailed, err.Error())
+		}
+		if pk == nil {
+			return nil, session.fail(server.ErrorUnknownPublicKey, fmt.Sprintf("%s-%d", id, cred.KeyCounter))
+		}
+		if err = checkKeyExpiry(session.conf, id, pk); err != nil {
+			return nil, session.fail(server.ErrorIssuanceFailed, err.Error())
+		}
 		issuer := gabi.NewIssuer(sk, pk, one)
 		proof, ok := commitments.Proofs[i+discloseCount].(*gabi.ProofU)
 		if !ok {
 			return nil, session.fail(server.ErrorMalformedInput, "Received invalid issuance commitment")
 		}
-		attrs, witness, err := session.computeAttributes(sk, cred)
-		if err != nil {
+		sig, err := session.issueCredential(issuer, sk, cred, proof, commitments.Nonce2)
+		if err != nil && !session.conf.AllowPartialIssuance {
 			return nil, session.fail(server.ErrorIssuanceFailed, err.Error())
 		}
-		sig, err := issuer.IssueSignature(proof.U, attrs, witness, commitments.Nonce2)
-		if err != nil {
-			return nil, session.fail(server.ErrorIssuanceFailed, err.Error())
+		if session.conf.AllowPartialIssuance {
+			// Report per credential whether it was issued, to the requestor and to the client
+			res := &server.CredentialIssuanceResult{Credential: cred.CredentialTypeID, Issued: err == nil}
+			if err != nil {
+				res.Err = err.Error()
+				sigs.Failed = append(sigs.Failed, i)
+			}
+			issued = append(issued, res)
 		}
-		sigs = append(sigs, sig)
+		if err == nil {
+			sigs.Signatures = append(sigs.Signatures, sig)
+		}
+	}
+	if session.conf.AllowPartialIssuance {
+		if len(sigs.Signatures) == 0 {
+			return nil, session.fail(server.ErrorIssuanceFailed, "none of the credentials could be issued")
+		}
+		session.result.Issued = issued
 	}
 
 	session.setStatus(server.StatusDone)
@@ -227,7 +389,12 @@ func (s *Server) handleSessionCommitments(w http.ResponseWriter, r *http.Request
 		server.WriteError(w, server.ErrorMalformedInput, err.Error())
 		return
 	}
-	res, rerr := r.Context().Value("session").(*session).handlePostCommitments(commitments)
+	session := r.Context().Value("session").(*session)
+	worker := s.newVerificationWorker()
+	defer worker.finish()
+	session.worker = worker
+	res, rerr := session.handlePostCommitments(commitments)
+	session.worker = nil
 	server.WriteResponse(w, res, rerr)
 }
 
@@ -240,6 +407,15 @@ func (s *Server) handleSessionProofs(w http.ResponseWriter, r *http.Request) {
 	session := r.Context().Value("session").(*session)
 	var res interface{}
 	var rerr *irma.RemoteError
+	if session.status.Finished() {
+		res, rerr = session.handlePostFinished()
+		server.WriteResponse(w, res, rerr)
+		return
+	}
+	worker := s.newVerificationWorker()
+	defer worker.finish()
+	session.worker = worker
+	defer func() { session.worker = nil }()
 	switch session.action {
 	case irma.ActionDisclosing:
 		disclosure := &irma.Disclosure{}
@@ -261,8 +437,38 @@ func (s *Server) handleSessionProofs(w http.ResponseWriter, r *http.Request) {
 	server.WriteResponse(w, res, rerr)
 }
 
+func (s *Server) handleSessionPairing(w http.ResponseWriter, r *http.Request) {
+	message := &irma.PairingMessage{}
+	bts, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		server.WriteError(w, server.ErrorMalformedInput, err.Error())
+		return
+	}
+	if err := json.Unmarshal(bts, message); err != nil {
+		server.WriteError(w, server.ErrorMalformedInput, err.Error())
+		return
+	}
+	rerr := r.Context().Value("session").(*session).handlePostPairing(message.PairingCode)
+	if rerr != nil {
+		server.WriteResponse(w, nil, rerr)
+		return
+	}
+	w.WriteHeader(200)
+}
+
 func (s *Server) handleSessionStatus(w http.ResponseWriter, r *http.Request) {
-	res, err := r.Context().Value("session").(*session).handleGetStatus()
+	session := r.Context().Value("session").(*session)
+	if session.status.Finished() {
+		if s.conf().StatusGoneAfter > 0 &&
+			session.finishedAt.Add(time.Duration(s.conf().StatusGoneAfter)*time.Second).Before(time.Now()) {
+			server.WriteError(w, server.ErrorSessionGone, "")
+			return
+		}
+		if s.conf().StatusPollingHint {
+			w.Header().Set("X-IRMA-Polling-Done", "true")
+		}
+	}
+	res, err := session.handleGetStatus()
 	server.WriteResponse(w, res, err)
 }
 
@@ -275,16 +481,40 @@ func (s *Server) handleSessionStatusEvents(w http.ResponseWriter, r *http.Reques
 		Arg:       session.clientToken,
 	}))
 	if err := s.SubscribeServerSentEvents(w, r, session.clientToken, false); err != nil {
+		if err == ErrTooManySSEConnections {
+			server.WriteError(w, server.ErrorOverloaded, err.Error())
+			return
+		}
 		server.WriteError(w, server.ErrorUnknown, err.Error())
 		return
 	}
 }
 
 func (s *Server) handleSessionDelete(w http.ResponseWriter, r *http.Request) {
-	r.Context().Value("session").(*session).handleDelete()
+	// The body is optional; if absent or unparseable, we treat this as an ordinary cancellation
+	message := &irma.SessionDeleteMessage{}
+	if bts, err := ioutil.ReadAll(r.Body); err == nil && len(bts) > 0 {
+		_ = json.Unmarshal(bts, message)
+	}
+	r.Context().Value("session").(*session).handleDelete(message.Declined)
 	w.WriteHeader(200)
 }
 
+func (s *Server) handleSessionAbort(w http.ResponseWriter, r *http.Request) {
+	bts, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		server.WriteError(w, server.ErrorMalformedInput, err.Error())
+		return
+	}
+	message := &irma.SessionAbortMessage{}
+	if err := irma.UnmarshalValidate(bts, message); err != nil {
+		server.WriteError(w, server.ErrorMalformedInput, err.Error())
+		return
+	}
+	r.Context().Value("session").(*session).handleAbort(message)
+	w.WriteHeader(http.StatusNoContent)
+}
+
 func (s *Server) handleSessionGet(w http.ResponseWriter, r *http.Request) {
 	var min, max irma.ProtocolVersion
 	if err := json.Unmarshal([]byte(r.Header.Get(irma.MinVersionHeader)), &min); err != nil {
@@ -295,18 +525,30 @@ func (s *Server) handleSessionGet(w http.ResponseWriter, r *http.Request) {
 		server.WriteError(w, server.ErrorMalformedInput, err.Error())
 		return
 	}
+	var client *server.ClientInfo
+	if s.conf().RecordClientInfo {
+		client = s.clientInfo(r)
+	}
 	session := r.Context().Value("session").(*session)
-	res, err := session.handleGetRequest(&min, &max)
+	res, err := session.handleGetRequest(&min, &max, client, r.UserAgent())
+	if strings.Contains(r.Header.Get("Accept"), server.CBORContentType) {
+		server.WriteCBORResponse(w, res, err)
+		return
+	}
 	server.WriteResponse(w, res, err)
 }
 
 func (s *Server) handleStaticMessage(w http.ResponseWriter, r *http.Request) {
-	rrequest := s.conf.StaticSessionRequests[chi.URLParam(r, "name")]
+	rrequest := s.conf().StaticSessionRequests[chi.URLParam(r, "name")]
 	if rrequest == nil {
 		server.WriteResponse(w, nil, server.RemoteError(server.ErrorInvalidRequest, "unknown static session"))
 		return
 	}
 	qr, _, err := s.StartSession(rrequest, s.doResultCallback)
+	if err == ErrMaintenance {
+		server.WriteError(w, server.ErrorMaintenance, "")
+		return
+	}
 	if err != nil {
 		server.WriteResponse(w, nil, server.RemoteError(server.ErrorMalformedInput, err.Error()))
 		return
@@ -314,6 +556,24 @@ func (s *Server) handleStaticMessage(w http.ResponseWriter, r *http.Request) {
 	server.WriteResponse(w, qr, nil)
 }
 
+// GET publickey/{issuer}/{counter}
+func (s *Server) handlePublicKey(w http.ResponseWriter, r *http.Request) {
+	issid := irma.NewIssuerIdentifier(chi.URLParam(r, "issuer"))
+	counter, _ := strconv.ParseUint(chi.URLParam(r, "counter"), 10, 32)
+	pk, err := s.PublicKey(issid, uint(counter))
+	if err != nil {
+		server.WriteError(w, server.ErrorPublicKeyNotFound, err.Error())
+		return
+	}
+	var buf bytes.Buffer
+	if _, err = pk.WriteTo(&buf); err != nil {
+		server.WriteError(w, server.ErrorUnknown, err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/xml")
+	_, _ = w.Write(buf.Bytes())
+}
+
 // GET revocation/events/{credtype}/{pkcounter}/{min}/{max}
 func (s *Server) handleRevocationGetEvents(w http.ResponseWriter, r *http.Request) {
 	cred := irma.NewCredentialTypeIdentifier(chi.URLParam(r, "id"))
@@ -321,11 +581,11 @@ func (s *Server) handleRevocationGetEvents(w http.ResponseWriter, r *http.Reques
 	min, _ := strconv.ParseUint(chi.URLParam(r, "min"), 10, 64)
 	max, _ := strconv.ParseUint(chi.URLParam(r, "max"), 10, 64)
 
-	if settings := s.conf.RevocationSettings[cred]; settings == nil || !settings.Server {
+	if settings := s.conf().RevocationSettings[cred]; settings == nil || !settings.Server {
 		server.WriteBinaryResponse(w, nil, server.RemoteError(server.ErrorInvalidRequest, "not supported by this server"))
 		return
 	}
-	events, err := s.conf.IrmaConfiguration.Revocation.Events(cred, uint(pkcounter), min, max)
+	events, err := s.conf().IrmaConfiguration.Revocation.Events(cred, uint(pkcounter), min, max)
 	if err != nil {
 		server.WriteBinaryResponse(w, nil, server.RemoteError(server.ErrorRevocation, err.Error()))
 		return
@@ -335,7 +595,7 @@ func (s *Server) handleRevocationGetEvents(w http.ResponseWriter, r *http.Reques
 }
 
 func (s *Server) handleRevocationUpdateEvents(w http.ResponseWriter, r *http.Request) {
-	if !s.conf.EnableSSE {
+	if !s.conf().EnableSSE {
 		server.WriteBinaryResponse(w, nil, server.RemoteError(server.ErrorInvalidRequest, "not supported by this server"))
 		return
 	}
@@ -346,7 +606,7 @@ func (s *Server) handleRevocationUpdateEvents(w http.ResponseWriter, r *http.Req
 			Arg:       id,
 		}))
 	}
-	s.serverSentEvents.ServeHTTP(w, r)
+	s.serveEvents(w, r)
 }
 
 // GET revocation/update/{credtype}/{count}[/{pkcounter}]
@@ -361,11 +621,11 @@ func (s *Server) handleRevocationGetUpdateLatest(w http.ResponseWriter, r *http.
 		counter = &k
 	}
 
-	if settings := s.conf.RevocationSettings[cred]; settings == nil || !settings.Server {
+	if settings := s.conf().RevocationSettings[cred]; settings == nil || !settings.Server {
 		server.WriteBinaryResponse(w, nil, server.RemoteError(server.ErrorInvalidRequest, "not supported by this server"))
 		return
 	}
-	updates, err := s.conf.IrmaConfiguration.Revocation.UpdateLatest(cred, count, counter)
+	updates, err := s.conf().IrmaConfiguration.Revocation.UpdateLatest(cred, count, counter)
 	if err != nil {
 		server.WriteBinaryResponse(w, nil, server.RemoteError(server.ErrorRevocation, err.Error()))
 		return
@@ -390,14 +650,14 @@ func (s *Server) handleRevocationPostIssuanceRecord(w http.ResponseWriter, r *ht
 	cred := irma.NewCredentialTypeIdentifier(chi.URLParam(r, "id"))
 	counter, _ := strconv.ParseUint(chi.URLParam(r, "counter"), 10, 32)
 
-	if settings := s.conf.RevocationSettings[cred]; settings == nil || !settings.Authority {
+	if settings := s.conf().RevocationSettings[cred]; settings == nil || !settings.Authority {
 		server.WriteBinaryResponse(w, nil, server.RemoteError(server.ErrorInvalidRequest, "not supported by this server"))
 		return
 	}
 
 	// Grab the counter-th issuer public key, with which the message should be signed,
 	// and verify and unmarshal the issuance record
-	pk, err := s.conf.IrmaConfiguration.Revocation.Keys.PublicKey(cred.IssuerIdentifier(), uint(counter))
+	pk, err := s.conf().IrmaConfiguration.Revocation.Keys.PublicKey(cred.IssuerIdentifier(), uint(counter))
 	if err != nil {
 		server.WriteBinaryResponse(w, nil, server.RemoteError(server.ErrorRevocation, err.Error()))
 		return
@@ -417,7 +677,7 @@ func (s *Server) handleRevocationPostIssuanceRecord(w http.ResponseWriter, r *ht
 		return
 	}
 
-	if err = s.conf.IrmaConfiguration.Revocation.AddIssuanceRecord(&rec); err != nil {
+	if err = s.conf().IrmaConfiguration.Revocation.AddIssuanceRecord(&rec); err != nil {
 		server.WriteBinaryResponse(w, nil, server.RemoteError(server.ErrorRevocation, err.Error()))
 	}
 	w.WriteHeader(200)
@@ -2,14 +2,29 @@ package irmaserver
 
 import (
 	"bytes"
+	"compress/gzip"
+	"compress/zlib"
 	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
 	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
+	"mime"
+	"net"
 	"net/http"
 	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/alexandrevicenzi/go-sse"
@@ -33,21 +48,344 @@ func (session *session) markAlive() {
 	session.conf.Logger.WithFields(logrus.Fields{"session": session.token}).Debugf("Session marked active, expiry delayed")
 }
 
+// recordVerificationError stores why the specified proofs, verified against the specified public
+// keys (extracted from the proofs if nil), were not accepted, for GetVerificationError().
+func (session *session) recordVerificationError(proofs gabi.ProofList, pubkeys []*gabi.PublicKey, err error) {
+	verr := &server.VerificationError{ProofStatus: session.result.ProofStatus, Time: time.Now()}
+	if rerr := session.result.Err; rerr != nil {
+		verr.Error = server.ErrorType(rerr.ErrorName)
+		verr.Reason = rerr.Message
+	}
+	if err != nil {
+		verr.Reason = err.Error()
+	}
+	if verr.Reason == "" {
+		verr.Reason = proofStatusReason(verr.ProofStatus)
+	}
+	if pubkeys == nil {
+		pubkeys, _ = irma.ProofList(proofs).ExtractPublicKeys(session.conf.IrmaConfiguration)
+	}
+	for _, pk := range pubkeys {
+		verr.PublicKeys = append(verr.PublicKeys, fmt.Sprintf("%s-%d", pk.Issuer, pk.Counter))
+	}
+	session.verification = verr
+	session.conf.Logger.WithFields(logrus.Fields{"session": session.token, "proofStatus": verr.ProofStatus}).
+		Info("Proofs not accepted: ", verr.Reason)
+}
+
+// proofStatusReason explains the specified proof status, for when no more specific reason is known.
+func proofStatusReason(status irma.ProofStatus) string {
+	switch status {
+	case irma.ProofStatusInvalid:
+		return "cryptographic verification of the proofs failed: invalid proof, proof not bound to the session nonce and context, missing nonrevocation proof, or duplicate singleton credential"
+	case irma.ProofStatusInvalidTimestamp:
+		return "the timestamp of the attribute-based signature is invalid"
+	case irma.ProofStatusUnmatchedRequest:
+		return "the proofs do not correspond to the session request"
+	case irma.ProofStatusMissingAttributes:
+		return "the proofs do not contain all requested attributes"
+	case irma.ProofStatusExpired:
+		return "the disclosed credentials were expired"
+	default:
+		return "the proofs were valid, but did not meet the requirements of the session"
+	}
+}
+
+// timeout returns the duration after the last activity of the session after which it expires.
+func (session *session) timeout() time.Duration {
+	if session.status == server.StatusInitialized && session.rrequest.Base().ClientTimeout != 0 {
+		return time.Duration(session.rrequest.Base().ClientTimeout) * time.Second
+	}
+	return maxSessionLifetime
+}
+
 func (session *session) setStatus(status server.Status) {
 	session.conf.Logger.WithFields(logrus.Fields{"session": session.token, "prevStatus": session.prevStatus, "status": status}).
 		Info("Session status updated")
+	finished := status.Finished() && !session.status.Finished()
+	if finished {
+		atomic.AddUint64(&session.stats.finished, 1)
+		session.finishedAt = time.Now()
+	}
 	session.status = status
 	session.result.Status = status
 	session.sessions.update(session)
+	if finished {
+		session.publishResult()
+		if session.confirmation != nil {
+			// Wake the handler awaiting confirmation, which will find the session finished
+			close(session.confirmation)
+			session.confirmation = nil
+		}
+	}
+}
+
+// startVerifying acquires a verification worker for the response of the client. While it waits
+// for the worker the session is unlocked, so that its status can be polled and it can be cancelled
+// meanwhile. If ProgressStatuses is enabled, the session has status StatusReceivedProof while it
+// waits for the worker, and StatusVerifying afterwards.
+func (session *session) startVerifying() *irma.RemoteError {
+	if session.conf.ProgressStatuses {
+		session.setStatus(server.StatusReceivedProof)
+	}
+	session.locked = false
+	session.Unlock()
+	session.worker.acquire()
+	session.Lock()
+	session.locked = true
+
+	// The requestor may have cancelled the session in the meantime
+	if session.status.Finished() {
+		return server.RemoteError(server.ErrorUnexpectedRequest, "Session finished while awaiting verification")
+	}
+	if session.conf.ProgressStatuses {
+		session.setStatus(server.StatusVerifying)
+	}
+	return nil
+}
+
+// logOutcome logs a one-line summary of the finished session at Info level, containing the
+// number of disclosed attributes, issued credentials and client-chosen attributes but not their values.
+func (session *session) logOutcome() {
+	attributes := 0
+	for _, attrs := range session.result.Disclosed {
+		attributes += len(attrs)
+	}
+	fields := logrus.Fields{
+		"session":    session.token,
+		"action":     session.action,
+		"status":     session.status,
+		"attributes": attributes,
+	}
+	if !session.startedAt.IsZero() {
+		fields["duration"] = session.finishedAt.Sub(session.startedAt).String()
+	}
+	if request, ok := session.request.(*irma.IssuanceRequest); ok && session.status == server.StatusDone {
+		fields["credentials"] = len(request.Credentials)
+		chosen := 0
+		for _, values := range session.result.ClientAttributes {
+			chosen += len(values)
+		}
+		if chosen > 0 {
+			fields["clientAttributes"] = chosen
+		}
+	}
+	if session.result.Err != nil {
+		fields["error"] = session.result.Err.ErrorName
+	}
+	session.conf.Logger.WithFields(fields).Info("Session finished")
+}
+
+// confirmationTimeout returns the amount of seconds that awaitConfirmation() waits.
+func (session *session) confirmationTimeout() int {
+	if session.conf.ConfirmationTimeout != 0 {
+		return session.conf.ConfirmationTimeout
+	}
+	return defaultConfirmationTimeout
+}
+
+// proofRetryAllowed returns whether the client may retry after its latest disclosure proofs
+// failed verification, instead of the session finishing.
+func (session *session) proofRetryAllowed() bool {
+	if !session.conf.AllowProofRetry {
+		return false
+	}
+	max := session.conf.MaxProofRetries
+	if max == 0 {
+		max = defaultMaxProofRetries
+	}
+	return session.proofAttempts <= max
+}
+
+// rejectProofs handles disclosure proofs that failed verification when the client may retry:
+// the failure is recorded, but the session remains open instead of finishing.
+func (session *session) rejectProofs(proofs gabi.ProofList, err error) (*irma.ProofStatus, *irma.RemoteError) {
+	session.recordVerificationError(proofs, nil, err)
+	status := session.result.ProofStatus
+	session.result.Disclosed, session.result.ProofStatus = nil, ""
+	if session.status != server.StatusConnected {
+		session.setStatus(server.StatusConnected)
+	}
+	session.conf.Logger.WithFields(logrus.Fields{"session": session.token, "attempt": session.proofAttempts}).
+		Info("Disclosure proofs failed verification, awaiting retry")
+	if err == irma.ErrMissingPublicKey {
+		return nil, server.RemoteError(server.ErrorUnknownPublicKey, err.Error())
+	} else if err != nil {
+		return nil, server.RemoteError(server.ErrorUnknown, err.Error())
+	}
+	return &status, nil
+}
+
+// awaitConfirmation blocks until the issuance of the session is confirmed using ConfirmExternal(),
+// unless that already happened. While waiting, the session has status StatusConfirming, and it is
+// unlocked and does not occupy a verification worker, so that the confirmation and other requests
+// can be handled. If the confirmation does not arrive within the confirmation timeout, the
+// session fails.
+func (session *session) awaitConfirmation() *irma.RemoteError {
+	if !session.confirmed {
+		timeout := time.Duration(session.confirmationTimeout()) * time.Second
+		confirmation := make(chan struct{})
+		session.confirmation = confirmation
+		session.setStatus(server.StatusConfirming)
+		session.conf.Logger.WithFields(logrus.Fields{"session": session.token}).Info("Awaiting external confirmation")
+
+		// Waiting is not verifying, so we don't keep other sessions from using our worker meanwhile
+		resume := session.worker.pause()
+		session.locked = false
+		session.Unlock()
+		select {
+		case <-confirmation:
+		case <-time.After(timeout):
+		}
+		resume()
+		session.Lock()
+		session.locked = true
+		session.confirmation = nil
+	}
+
+	// A confirmation that arrived after the timeout but before we got the lock back still counts
+	if session.status.Finished() {
+		return server.RemoteError(server.ErrorUnexpectedRequest, "Session finished while awaiting confirmation")
+	}
+	if !session.confirmed {
+		return session.fail(server.ErrorConfirmationTimeout, "")
+	}
+	session.markAlive()
+	return nil
+}
+
+// publishResult stores the result of the finished session in the configured ResultStore, if any.
+func (session *session) publishResult() {
+	if session.conf.ResultStore == nil {
+		return
+	}
+	result := session.result
+	if key := session.conf.ResultEncryptionKey; key != "" {
+		var err error
+		if result, err = encryptResult(result, key); err != nil {
+			session.conf.Logger.WithField("session", session.token).Error("Failed to encrypt session result")
+			_ = server.LogError(err)
+			return
+		}
+	}
+	if err := session.conf.ResultStore.Put(result); err != nil {
+		session.conf.Logger.WithField("session", session.token).Error("Failed to publish session result")
+		_ = server.LogError(err)
+	}
+}
+
+// resultAttributes contains the fields of a session result that contain attributes or other
+// personal data, which are encrypted before the result is stored if a ResultEncryptionKey is
+// configured. Of the remaining fields, the token, type, status and proof status are authenticated
+// along with the encrypted fields, so that they cannot be modified in the ResultStore unnoticed.
+type resultAttributes struct {
+	Disclosed        [][]*irma.DisclosedAttribute `json:"disclosed,omitempty"`
+	Signature        *irma.SignedMessage          `json:"signature,omitempty"`
+	SignatureDetails *server.SignatureDetails     `json:"signatureDetails,omitempty"`
+	Request          json.RawMessage              `json:"request,omitempty"`
+	ClientAttributes []map[string]string          `json:"clientAttributes,omitempty"`
+	Abort            *irma.SessionAbortMessage    `json:"abort,omitempty"`
+}
+
+// resultAssociatedData returns the fields of the result that are authenticated but not encrypted
+// by encryptResult(), see resultAttributes.
+func resultAssociatedData(result *server.SessionResult) ([]byte, error) {
+	return json.Marshal([]string{
+		result.Token, string(result.Type), string(result.Status), string(result.ProofStatus),
+	})
+}
+
+// encryptResult returns a copy of the result in which the fields of resultAttributes are replaced
+// by their encryption with AES-GCM, which also authenticates the token, type and statuses.
+func encryptResult(result *server.SessionResult, key string) (*server.SessionResult, error) {
+	aead, err := resultCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	plaintext, err := json.Marshal(resultAttributes{
+		Disclosed:        result.Disclosed,
+		Signature:        result.Signature,
+		SignatureDetails: result.SignatureDetails,
+		Request:          result.Request,
+		ClientAttributes: result.ClientAttributes,
+		Abort:            result.Abort,
+	})
+	if err != nil {
+		return nil, err
+	}
+	ad, err := resultAssociatedData(result)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err = rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	encrypted := *result
+	encrypted.Disclosed, encrypted.Signature, encrypted.SignatureDetails, encrypted.Request = nil, nil, nil, nil
+	encrypted.ClientAttributes, encrypted.Abort = nil, nil
+	encrypted.Encrypted = aead.Seal(nonce, nonce, plaintext, ad)
+	return &encrypted, nil
+}
+
+// decryptResult reverses encryptResult(), returning results that are not encrypted as they are.
+func decryptResult(result *server.SessionResult, key string) (*server.SessionResult, error) {
+	if result.Encrypted == nil {
+		return result, nil
+	}
+	if key == "" {
+		return nil, errors.New("cannot decrypt stored session result: no result encryption key configured")
+	}
+	aead, err := resultCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	size := aead.NonceSize()
+	if len(result.Encrypted) < size {
+		return nil, errors.New("encrypted session result too short")
+	}
+	ad, err := resultAssociatedData(result)
+	if err != nil {
+		return nil, err
+	}
+	plaintext, err := aead.Open(nil, result.Encrypted[:size], result.Encrypted[size:], ad)
+	if err != nil {
+		return nil, errors.WrapPrefix(err, "failed to decrypt stored session result", 0)
+	}
+	var attrs resultAttributes
+	if err = json.Unmarshal(plaintext, &attrs); err != nil {
+		return nil, err
+	}
+	decrypted := *result
+	decrypted.Encrypted = nil
+	decrypted.Disclosed, decrypted.Signature = attrs.Disclosed, attrs.Signature
+	decrypted.SignatureDetails, decrypted.Request = attrs.SignatureDetails, attrs.Request
+	decrypted.ClientAttributes, decrypted.Abort = attrs.ClientAttributes, attrs.Abort
+	return &decrypted, nil
+}
+
+func resultCipher(key string) (cipher.AEAD, error) {
+	bts, err := base64.StdEncoding.DecodeString(key)
+	if err != nil {
+		return nil, errors.WrapPrefix(err, "failed to decode result encryption key", 0)
+	}
+	block, err := aes.NewCipher(bts)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
 }
 
 func (session *session) onUpdate() {
 	if session.sse == nil {
 		return
 	}
-	session.sse.SendMessage("session/"+session.clientToken,
-		sse.SimpleMessage(fmt.Sprintf(`"%s"`, session.status)),
-	)
+	// Apps do not know the progress statuses, which they would see as StatusConnected anyway
+	if session.status.Coarse() == session.status {
+		session.sse.SendMessage("session/"+session.clientToken,
+			sse.SimpleMessage(fmt.Sprintf(`"%s"`, session.status)),
+		)
+	}
 	session.sse.SendMessage("session/"+session.token,
 		sse.SimpleMessage(fmt.Sprintf(`"%s"`, session.status)),
 	)
@@ -55,8 +393,13 @@ func (session *session) onUpdate() {
 
 func (session *session) fail(err server.Error, message string) *irma.RemoteError {
 	rerr := server.RemoteError(err, message)
+	result := &server.SessionResult{Err: rerr, Token: session.token, Status: server.StatusCancelled, Type: session.action}
+	if session.result != nil {
+		// Requestors need this especially when the session fails because of the thresholds
+		result.ThresholdsSatisfied = session.result.ThresholdsSatisfied
+	}
+	session.result = result
 	session.setStatus(server.StatusCancelled)
-	session.result = &server.SessionResult{Err: rerr, Token: session.token, Status: server.StatusCancelled, Type: session.action}
 	return rerr
 }
 
@@ -83,6 +426,322 @@ func (session *session) chooseProtocolVersion(minClient, maxClient *irma.Protoco
 	}
 }
 
+// checkDisclosed performs the checks on the disclosed attributes in the session result, failing
+// the session if one of them does not pass.
+func (session *session) checkDisclosed() *irma.RemoteError {
+	for _, check := range []func() *irma.RemoteError{
+		session.checkDisclosedValues,
+		session.checkAcceptedSchemes,
+		session.checkTrustedIssuers,
+		session.checkRemainingValidity,
+		session.checkThresholds,
+	} {
+		if rerr := check(); rerr != nil {
+			return rerr
+		}
+	}
+	session.localizeDisclosed()
+	session.hashDisclosed()
+	session.recordSchemeVersions()
+	return nil
+}
+
+// language returns the language of human-readable names and values in this session, if any.
+func (session *session) language() string {
+	if lang := session.rrequest.Base().Language; lang != "" {
+		return lang
+	}
+	return session.conf.DefaultLanguage
+}
+
+// attributeName returns the name of the specified attribute type in the language of the session,
+// for use in error messages, or its identifier if no language is set.
+func (session *session) attributeName(id irma.AttributeTypeIdentifier) string {
+	attrtype := session.conf.IrmaConfiguration.AttributeTypes[id]
+	lang := session.language()
+	if lang == "" || attrtype == nil {
+		return id.String()
+	}
+	return fmt.Sprintf("%s (%s)", attrtype.Name.Translate(lang), id)
+}
+
+// localizeDisclosed sets the name and value of the disclosed attributes in the session result
+// in the language of the session, if any.
+func (session *session) localizeDisclosed() {
+	lang := session.language()
+	if lang == "" {
+		return
+	}
+	for _, attrs := range session.result.Disclosed {
+		for _, attr := range attrs {
+			if attrtype := session.conf.IrmaConfiguration.AttributeTypes[attr.Identifier]; attrtype != nil {
+				attr.DisplayName = attrtype.Name.Translate(lang)
+			}
+			attr.DisplayValue = attr.Value.Translate(lang)
+		}
+	}
+}
+
+// hashedAttributes returns the attribute types of which the request asks to return the values hashed.
+func hashedAttributes(request irma.SessionRequest) map[irma.AttributeTypeIdentifier]bool {
+	hashed := map[irma.AttributeTypeIdentifier]bool{}
+	for _, discon := range request.Disclosure().Disclose {
+		for _, con := range discon {
+			for _, attr := range con {
+				if attr.ReturnHashed {
+					hashed[attr.Type] = true
+				}
+			}
+		}
+	}
+	return hashed
+}
+
+// validateHashedAttributes checks that a request asking to return attribute values hashed
+// specifies the key to hash them with, and is not a signature request, as the attribute-based
+// signature in the session result would contain the values anyway.
+func validateHashedAttributes(rrequest irma.RequestorRequest) error {
+	request := rrequest.SessionRequest()
+	if len(hashedAttributes(request)) == 0 {
+		return nil
+	}
+	if request.Action() == irma.ActionSigning {
+		return errors.New("returning hashed attribute values is not supported in signature sessions")
+	}
+	if rrequest.Base().HashSalt == "" {
+		return errors.New("hashSalt must be specified to return hashed attribute values")
+	}
+	return nil
+}
+
+// hashDisclosed replaces the values of the disclosed attributes that the request asks to return
+// hashed by their hex-encoded HMAC-SHA256, keyed with the HashSalt of the request.
+func (session *session) hashDisclosed() {
+	hashed := hashedAttributes(session.request)
+	if len(hashed) == 0 {
+		return
+	}
+	salt, lang := []byte(session.rrequest.Base().HashSalt), session.language()
+	for _, attrs := range session.result.Disclosed {
+		for _, attr := range attrs {
+			if !hashed[attr.Identifier] || attr.RawValue == nil {
+				continue
+			}
+			mac := hmac.New(sha256.New, salt)
+			mac.Write([]byte(*attr.RawValue))
+			value := hex.EncodeToString(mac.Sum(nil))
+			attr.RawValue = &value
+			attr.Value = irma.NewTranslatedString(&value)
+			if lang != "" {
+				attr.DisplayValue = value
+			}
+		}
+	}
+}
+
+// checkNonceReuse records the nonce of the session in the configured NonceCache, if any, failing
+// the session if proofs were already received for it.
+func (session *session) checkNonceReuse() *irma.RemoteError {
+	if session.conf.NonceCache == nil {
+		return nil
+	}
+	ttl := session.conf.NonceCacheTTL
+	if ttl == 0 {
+		ttl = defaultNonceCacheTTL
+	}
+	fresh, err := session.conf.NonceCache.Add(session.request.Base().Nonce.String(), time.Duration(ttl)*time.Second)
+	if err != nil {
+		return session.fail(server.ErrorUnknown, err.Error())
+	}
+	if !fresh {
+		return session.fail(server.ErrorNonceReused, "")
+	}
+	return nil
+}
+
+// recordSchemeVersions records in the session result the timestamp of the scheme of each
+// disclosed credential type, if the request asks for it.
+func (session *session) recordSchemeVersions() {
+	if !session.rrequest.Base().IncludeSchemeVersions {
+		return
+	}
+	session.result.SchemeVersions = nil
+	seen := map[irma.CredentialTypeIdentifier]bool{}
+	for _, attrs := range session.result.Disclosed {
+		for _, attr := range attrs {
+			credtype := attr.Identifier.CredentialTypeIdentifier()
+			if seen[credtype] {
+				continue
+			}
+			seen[credtype] = true
+			scheme := credtype.IssuerIdentifier().SchemeManagerIdentifier()
+			manager := session.conf.IrmaConfiguration.SchemeManagers[scheme]
+			if manager == nil {
+				continue
+			}
+			session.result.SchemeVersions = append(session.result.SchemeVersions, &server.CredentialSchemeVersion{
+				CredentialTypeID: credtype,
+				Scheme:           scheme,
+				Timestamp:        manager.Timestamp,
+			})
+		}
+	}
+}
+
+// signatureDetails describes the verification of the specified signature, which must be valid.
+func (session *session) signatureDetails(signature *irma.SignedMessage) *server.SignatureDetails {
+	details := &server.SignatureDetails{
+		Message:          signature.Message,
+		Attributes:       session.result.Disclosed,
+		VerifiedAt:       irma.Timestamp(time.Now()),
+		SignatureVersion: signature.Version(),
+		ProtocolVersion:  session.version,
+	}
+	// No error, as the signature was just verified against these keys
+	pubkeys, _ := irma.ProofList(signature.Signature).ExtractPublicKeys(session.conf.IrmaConfiguration)
+	for _, pk := range pubkeys {
+		details.PublicKeys = append(details.PublicKeys, server.PublicKeyIdentifier{
+			Issuer:  irma.NewIssuerIdentifier(pk.Issuer),
+			Counter: pk.Counter,
+		})
+	}
+	if signature.Timestamp != nil {
+		timestamp := irma.Timestamp(time.Unix(signature.Timestamp.Time, 0))
+		details.Timestamp = &timestamp
+		details.TimestampServer = signature.Timestamp.ServerUrl
+	}
+	return details
+}
+
+// checkAcceptedSchemes checks that all disclosed attributes in the session result come from
+// credentials of the schemes accepted by the requestor, if it specified any.
+func (session *session) checkAcceptedSchemes() *irma.RemoteError {
+	accepted := session.rrequest.Base().AcceptedSchemes
+	if len(accepted) == 0 {
+		return nil
+	}
+	for _, attrs := range session.result.Disclosed {
+		for _, attr := range attrs {
+			scheme := attr.Identifier.CredentialTypeIdentifier().IssuerIdentifier().SchemeManagerIdentifier()
+			found := false
+			for _, id := range accepted {
+				if id == scheme {
+					found = true
+					break
+				}
+			}
+			if !found {
+				return session.fail(server.ErrorSchemeNotAccepted,
+					fmt.Sprintf("attribute %s is from scheme %s, which is not accepted", session.attributeName(attr.Identifier), scheme))
+			}
+		}
+	}
+	return nil
+}
+
+// checkTrustedIssuers checks that all disclosed attributes in the session result come from
+// credentials of issuers trusted for the requestor of the session.
+func (session *session) checkTrustedIssuers() *irma.RemoteError {
+	for _, attrs := range session.result.Disclosed {
+		for _, attr := range attrs {
+			issuer := attr.Identifier.CredentialTypeIdentifier().IssuerIdentifier()
+			if !session.conf.IssuerTrusted(session.requestor, issuer) {
+				return session.fail(server.ErrorIssuerNotTrusted,
+					fmt.Sprintf("attribute %s is from issuer %s, which is not trusted", session.attributeName(attr.Identifier), issuer))
+			}
+		}
+	}
+	return nil
+}
+
+// checkRemainingValidity checks that all credentials from which attributes were disclosed remain
+// valid for at least as long as the requestor specified, if it did.
+func (session *session) checkRemainingValidity() *irma.RemoteError {
+	min := session.rrequest.Base().MinRemainingValidity
+	if min == 0 {
+		return nil
+	}
+	deadline := time.Now().Add(time.Duration(min) * time.Second)
+	for _, attrs := range session.result.Disclosed {
+		for _, attr := range attrs {
+			if attr.ExpiryTime != nil && time.Time(*attr.ExpiryTime).Before(deadline) {
+				return session.fail(server.ErrorAttributesExpired,
+					fmt.Sprintf("credential of attribute %s expires too soon", session.attributeName(attr.Identifier)))
+			}
+		}
+	}
+	return nil
+}
+
+// checkDisclosedValues checks that none of the disclosed attribute values in the session result
+// exceed the configured maximum length, failing the session if one does.
+func (session *session) checkDisclosedValues() *irma.RemoteError {
+	max := session.conf.MaxAttributeValueLength
+	if max == 0 {
+		return nil
+	}
+	for _, attrs := range session.result.Disclosed {
+		for _, attr := range attrs {
+			if attr.RawValue != nil && len(*attr.RawValue) > max {
+				return session.fail(server.ErrorMalformedInput,
+					fmt.Sprintf("value of attribute %s exceeds maximum length of %d", session.attributeName(attr.Identifier), max))
+			}
+		}
+	}
+	return nil
+}
+
+// checkThresholds checks that the disclosed attributes meet the disjunction thresholds of the
+// request, recording per threshold how many of its disjunctions were disclosed.
+func (session *session) checkThresholds() *irma.RemoteError {
+	thresholds := session.request.Disclosure().Thresholds
+	if len(thresholds) == 0 {
+		return nil
+	}
+	session.result.ThresholdsSatisfied = make([]int, len(thresholds))
+	for i, t := range thresholds {
+		session.result.ThresholdsSatisfied[i] = t.Satisfied(session.result.Disclosed)
+	}
+	for i, t := range thresholds {
+		if session.result.ThresholdsSatisfied[i] < t.Min {
+			return session.fail(server.ErrorAttributesMissing, fmt.Sprintf(
+				"%d of the disjunctions %v were disclosed, at least %d required",
+				session.result.ThresholdsSatisfied[i], t.Disjunctions, t.Min))
+		}
+	}
+	return nil
+}
+
+// checkIssuanceValidity checks the requested validity of the credentials to be issued against the
+// validity computed from the disclosed attributes by the configured IssuanceValidity function.
+func (session *session) checkIssuanceValidity() *irma.RemoteError {
+	validityFunc := session.conf.IssuanceValidity
+	if validityFunc == nil {
+		return nil
+	}
+	for _, cred := range session.request.(*irma.IssuanceRequest).Credentials {
+		validity, err := validityFunc(cred, session.result.Disclosed)
+		if err != nil {
+			return session.fail(server.ErrorIssuanceFailed, err.Error())
+		}
+		if validity == nil {
+			continue
+		}
+		requested := cred.Validity
+		if requested == nil {
+			// Default validity, see MetadataAttribute.setExpiryDate()
+			t := irma.Timestamp(time.Now().AddDate(0, 6, 0))
+			requested = &t
+		}
+		if requested.Floor().After(validity.Floor()) {
+			return session.fail(server.ErrorIssuanceFailed, fmt.Sprintf(
+				"validity of %s exceeds validity %s derived from disclosed attributes",
+				cred.CredentialTypeID, validity.String()))
+		}
+	}
+	return nil
+}
+
 const retryTimeLimit = 10 * time.Second
 
 // checkCache returns a previously cached response, for replaying against multiple requests from
@@ -103,6 +762,41 @@ func (session *session) checkCache(message []byte) (int, []byte) {
 
 // Issuance helpers
 
+func (session *session) issueCredential(
+	issuer *gabi.Issuer, sk *gabi.PrivateKey, cred *irma.CredentialRequest, proof *gabi.ProofU, nonce2 *big.Int,
+) (*gabi.IssueSignatureMessage, error) {
+	attrs, witness, err := session.computeAttributes(sk, cred)
+	if err != nil {
+		return nil, err
+	}
+	return issuer.IssueSignature(proof.U, attrs, witness, nonce2)
+}
+
+// issueToSecret issues a credential containing the specified attributes to the specified secret
+// key, acting both as the client and as the issuer. The client verifies the signature against the
+// public key, as the IRMA app does.
+func issueToSecret(sk *gabi.PrivateKey, pk *gabi.PublicKey, secret *big.Int, attrs []*big.Int) (*gabi.Credential, error) {
+	// Act as the client, committing to the secret key
+	nonce1 := common.RandomBigInt(new(big.Int).Lsh(big.NewInt(1), pk.Params.Lstatzk))
+	nonce2 := common.RandomBigInt(new(big.Int).Lsh(big.NewInt(1), pk.Params.Lstatzk))
+	builder := gabi.NewCredentialBuilder(pk, one, secret, nonce2)
+	proofs := gabi.ProofBuilderList{builder}.BuildProofList(one, nonce1, false)
+	if !proofs.Verify([]*gabi.PublicKey{pk}, one, nonce1, false, []string{"."}) {
+		return nil, errors.Errorf("commitment of %s-%d did not verify", pk.Issuer, sk.Counter)
+	}
+
+	// Act as the issuer, and then let the client verify the signature
+	sig, err := gabi.NewIssuer(sk, pk, one).IssueSignature(proofs[0].(*gabi.ProofU).U, attrs, nil, nonce2)
+	if err != nil {
+		return nil, errors.WrapPrefix(err, fmt.Sprintf("failed to sign using %s-%d", pk.Issuer, sk.Counter), 0)
+	}
+	cred, err := builder.ConstructCredential(sig, attrs)
+	if err != nil {
+		return nil, errors.WrapPrefix(err, fmt.Sprintf("signature of %s-%d did not verify", pk.Issuer, sk.Counter), 0)
+	}
+	return cred, nil
+}
+
 func (session *session) computeWitness(sk *gabi.PrivateKey, cred *irma.CredentialRequest) (*revocation.Witness, error) {
 	id := cred.CredentialTypeID
 	credtyp := session.conf.IrmaConfiguration.CredentialTypes[id]
@@ -181,28 +875,34 @@ func (session *session) computeAttributes(
 	return attributes.Ints, witness, nil
 }
 
-func (s *Server) validateIssuanceRequest(request *irma.IssuanceRequest) error {
+func (s *Server) validateIssuanceRequest(request *irma.IssuanceRequest, requestor string) error {
+	if max := s.maxCredentials(requestor); len(request.Credentials) > max {
+		return errors.Errorf("request issues %d credentials, exceeding the maximum of %d", len(request.Credentials), max)
+	}
 	for _, cred := range request.Credentials {
 		// Check that we have the appropriate private key
 		iss := cred.CredentialTypeID.IssuerIdentifier()
-		privatekey, err := s.conf.IrmaConfiguration.PrivateKeyLatest(iss)
+		privatekey, err := s.issuerPrivateKey(iss, cred.KeyCounter)
 		if err != nil {
 			return err
 		}
 		if privatekey == nil {
 			return errors.Errorf("missing private key of issuer %s", iss.String())
 		}
-		pubkey, err := s.conf.IrmaConfiguration.PublicKey(iss, privatekey.Counter)
+		pubkey, err := s.conf().IrmaConfiguration.PublicKey(iss, privatekey.Counter)
 		if err != nil {
 			return err
 		}
 		if pubkey == nil {
 			return errors.Errorf("missing public key of issuer %s", iss.String())
 		}
+		if err = checkKeyExpiry(s.conf(), iss, pubkey); err != nil {
+			return err
+		}
 		cred.KeyCounter = privatekey.Counter
 
-		if s.conf.IrmaConfiguration.CredentialTypes[cred.CredentialTypeID].RevocationSupported() {
-			settings := s.conf.RevocationSettings[cred.CredentialTypeID]
+		if s.conf().IrmaConfiguration.CredentialTypes[cred.CredentialTypeID].RevocationSupported() {
+			settings := s.conf().RevocationSettings[cred.CredentialTypeID]
 			if settings == nil || (settings.RevocationServerURL == "" && !settings.Server) {
 				return errors.Errorf("revocation enabled for %s but no revocation server configured", cred.CredentialTypeID)
 			}
@@ -212,9 +912,33 @@ func (s *Server) validateIssuanceRequest(request *irma.IssuanceRequest) error {
 		}
 
 		// Check that the credential is consistent with irma_configuration
-		if err := cred.Validate(s.conf.IrmaConfiguration); err != nil {
+		if err := cred.Validate(s.conf().IrmaConfiguration); err != nil {
 			return err
 		}
+		for attr, format := range cred.ClientAttributes {
+			if _, err := regexp.Compile(format); err != nil {
+				return errors.WrapPrefix(err, "invalid format of client attribute "+attr, 0)
+			}
+		}
+		for attr, format := range cred.AttributeFormats {
+			r, err := regexp.Compile("^(?:" + format + ")$")
+			if err != nil {
+				return errors.WrapPrefix(err, "invalid format of attribute "+attr, 0)
+			}
+			value, present := cred.Attributes[attr]
+			if !present {
+				return errors.Errorf("attribute %s has a format but no value", attr)
+			}
+			if !r.MatchString(value) {
+				return errors.Errorf("value of attribute %s of %s does not match expected pattern %s",
+					attr, cred.CredentialTypeID, format)
+			}
+		}
+		if s.conf().CrossAttributeValidator != nil {
+			if err := s.conf().CrossAttributeValidator(cred.CredentialTypeID, cred.Attributes); err != nil {
+				return err
+			}
+		}
 
 		// Ensure the credential has an expiry date
 		defaultValidity := irma.Timestamp(time.Now().AddDate(0, 6, 0))
@@ -224,6 +948,9 @@ func (s *Server) validateIssuanceRequest(request *irma.IssuanceRequest) error {
 		if cred.Validity.Before(irma.Timestamp(time.Now())) {
 			return errors.New("cannot issue expired credentials")
 		}
+		if err := s.checkCredentialValidity(cred); err != nil {
+			return err
+		}
 	}
 
 	return nil
@@ -266,20 +993,251 @@ func (s *Server) doResultCallback(result *server.SessionResult) {
 	}
 	server.DoResultCallback(url,
 		result,
-		s.conf.JwtIssuer,
+		s.conf().JwtIssuer,
 		s.GetRequest(result.Token).Base().ResultJwtValidity,
-		s.conf.JwtRSAPrivateKey,
+		s.conf().JwtRSAPrivateKey,
 	)
 }
 
+// clientInfo extracts the IP address and user agent of the client from the HTTP request.
+func (s *Server) clientInfo(r *http.Request) *server.ClientInfo {
+	ip := r.RemoteAddr
+	if host, _, err := net.SplitHostPort(ip); err == nil {
+		ip = host
+	}
+	if name := s.conf().ClientIPHeader; name != "" {
+		// Headers like X-Forwarded-For contain a list of addresses to which each proxy appends the
+		// address it received the request from, so only the rightmost entries are trustworthy
+		header := strings.Join(r.Header[http.CanonicalHeaderKey(name)], ",")
+		if header != "" {
+			entries := strings.Split(header, ",")
+			proxies := s.conf().ClientIPHeaderProxies
+			if proxies == 0 {
+				proxies = 1
+			}
+			i := len(entries) - proxies
+			if i < 0 {
+				i = 0
+			}
+			ip = strings.TrimSpace(entries[i])
+		}
+	}
+	return &server.ClientInfo{IP: ip, UserAgent: r.UserAgent()}
+}
+
+// validateSessionRequest checks the session request before a session is started with it, and
+// again after it is passed to OnSessionCreated.
+func (s *Server) validateSessionRequest(rrequest irma.RequestorRequest, requestor string) error {
+	request := rrequest.SessionRequest()
+	if err := s.validateRequest(request); err != nil {
+		return err
+	}
+	if request.Action() == irma.ActionIssuing {
+		if err := s.validateIssuanceRequest(request.(*irma.IssuanceRequest), requestor); err != nil {
+			return err
+		}
+	} else if rrequest.Base().ExternalConfirmation {
+		return errors.New("external confirmation is only supported in issuance sessions")
+	}
+	return validateHashedAttributes(rrequest)
+}
+
 func (s *Server) validateRequest(request irma.SessionRequest) error {
-	if _, err := s.conf.IrmaConfiguration.Download(request); err != nil {
+	if err := s.checkDisjunctionLimits(request); err != nil {
 		return err
 	}
-	if err := request.Base().Validate(s.conf.IrmaConfiguration); err != nil {
+	if _, err := s.conf().IrmaConfiguration.Download(request); err != nil {
 		return err
 	}
-	return request.Disclosure().Disclose.Validate(s.conf.IrmaConfiguration)
+	if err := request.Base().Validate(s.conf().IrmaConfiguration); err != nil {
+		return err
+	}
+	if request.Action() != irma.ActionIssuing && !s.conf().AllowEmptyDisclosure && emptyDisclosure(request) {
+		return errors.New("disclosure or signature request does not request any attributes")
+	}
+	if err := request.Disclosure().Disclose.Validate(s.conf().IrmaConfiguration); err != nil {
+		return err
+	}
+	if s.conf().StrictDisjunctions {
+		return s.checkDisjunctionConsistency(request)
+	}
+	return nil
+}
+
+// checkDisjunctionConsistency refuses requests containing a disjunction of which some options
+// require nonrevocation proofs while others do not, or of which some options contain attributes
+// from demo schemes while others do not. Empty options, making a disjunction optional, are skipped.
+func (s *Server) checkDisjunctionConsistency(request irma.SessionRequest) error {
+	revocation := request.Base().Revocation
+	for i, discon := range request.Disclosure().Disclose {
+		revoked, demo := map[bool]struct{}{}, map[bool]struct{}{}
+		for _, con := range discon {
+			if len(con) == 0 {
+				continue
+			}
+			var r, d bool
+			for _, attr := range con {
+				credid := attr.Type.CredentialTypeIdentifier()
+				if _, ok := revocation[credid]; ok {
+					r = true
+				}
+				scheme := s.conf().IrmaConfiguration.SchemeManagers[credid.IssuerIdentifier().SchemeManagerIdentifier()]
+				if scheme != nil && scheme.Demo {
+					d = true
+				}
+			}
+			revoked[r], demo[d] = struct{}{}, struct{}{}
+		}
+		if len(revoked) > 1 {
+			return errors.Errorf("disjunction %d of request mixes options requiring nonrevocation proofs with options that do not", i)
+		}
+		if len(demo) > 1 {
+			return errors.Errorf("disjunction %d of request mixes options containing attributes of demo schemes with options that do not", i)
+		}
+	}
+	return nil
+}
+
+// checkSessionRequestSize refuses session requests passed as JSON that are larger than configured,
+// before they are parsed.
+func (s *Server) checkSessionRequestSize(request interface{}) error {
+	max := s.conf().MaxSessionRequestSize
+	if max == 0 {
+		return nil
+	}
+	var size int
+	switch r := request.(type) {
+	case []byte:
+		size = len(r)
+	case string:
+		size = len(r)
+	default:
+		return nil
+	}
+	if size > max {
+		return errors.Errorf("session request of %d bytes exceeds the maximum size of %d bytes", size, max)
+	}
+	return nil
+}
+
+// checkCredentialValidity ensures that the validity of the credential lies within the configured
+// MinCredentialValidity and MaxCredentialValidity, either by refusing it or, if
+// ClampCredentialValidity is set, by adjusting it to the nearest bound. As the expiry date of
+// issued credentials is rounded down to an epoch boundary, that is what is checked, and the
+// minimum bound is rounded up to the next epoch boundary.
+func (s *Server) checkCredentialValidity(cred *irma.CredentialRequest) error {
+	now := time.Now()
+	expiry := irma.Timestamp(irma.FloorToEpochBoundary(time.Time(*cred.Validity)))
+	if min := s.conf().MinCredentialValidity; min > 0 {
+		minimum := now.Add(time.Duration(min) * time.Second)
+		bound := irma.Timestamp(irma.FloorToEpochBoundary(minimum))
+		if bound.Before(irma.Timestamp(minimum)) {
+			bound = irma.Timestamp(time.Time(bound).Add(irma.ExpiryFactor * time.Second))
+		}
+		if expiry.Before(bound) {
+			if !s.conf().ClampCredentialValidity {
+				return errors.Errorf("validity of credential %s is shorter than the minimum of %d seconds", cred.CredentialTypeID, min)
+			}
+			cred.Validity = &bound
+		}
+	}
+	if max := s.conf().MaxCredentialValidity; max > 0 {
+		bound := irma.Timestamp(now.Add(time.Duration(max) * time.Second))
+		if expiry.After(bound) {
+			if !s.conf().ClampCredentialValidity {
+				return errors.Errorf("validity of credential %s exceeds the maximum of %d seconds", cred.CredentialTypeID, max)
+			}
+			cred.Validity = &bound
+		}
+	}
+	return nil
+}
+
+// checkDisjunctionLimits refuses requests having more disjunctions, or more options within a
+// disjunction, than configured, as verifying these could be made arbitrarily expensive.
+func (s *Server) checkDisjunctionLimits(request irma.SessionRequest) error {
+	maxDiscons, maxOpts := s.conf().MaxDisjunctions, s.conf().MaxDisjunctionOptions
+	if maxDiscons == 0 {
+		maxDiscons = defaultMaxDisjunctions
+	}
+	if maxOpts == 0 {
+		maxOpts = defaultMaxDisjunctionOpts
+	}
+	disclose := request.Disclosure().Disclose
+	if len(disclose) > maxDiscons {
+		return errors.Errorf("request contains %d disjunctions, exceeding the maximum of %d", len(disclose), maxDiscons)
+	}
+	for i, discon := range disclose {
+		if len(discon) > maxOpts {
+			return errors.Errorf("disjunction %d of request contains %d options, exceeding the maximum of %d", i, len(discon), maxOpts)
+		}
+	}
+	return nil
+}
+
+// issuerPrivateKey returns the private key of the specified issuer with the specified key counter
+// as requested in an issuance request. Counter 0 is the default of CredentialRequest.KeyCounter,
+// meaning that no counter was requested, so then it returns the latest private key even if the
+// issuer has a key with counter 0.
+func (s *Server) issuerPrivateKey(iss irma.IssuerIdentifier, counter uint) (*gabi.PrivateKey, error) {
+	if counter == 0 {
+		return s.conf().IrmaConfiguration.PrivateKeyLatest(iss)
+	}
+	indices, err := s.conf().IrmaConfiguration.PrivateKeyIndices(iss)
+	if err != nil {
+		return nil, err
+	}
+	available := make([]string, 0, len(indices))
+	for _, i := range indices {
+		if i == counter {
+			return s.conf().IrmaConfiguration.PrivateKey(iss, counter)
+		}
+		available = append(available, strconv.FormatUint(uint64(i), 10))
+	}
+	if s.conf().KeyCounterFallback {
+		s.conf().Logger.WithFields(logrus.Fields{"issuer": iss, "counter": counter}).
+			Warn("Requested key counter not available, issuing using latest private key")
+		return s.conf().IrmaConfiguration.PrivateKeyLatest(iss)
+	}
+	if len(available) == 0 {
+		available = append(available, "none")
+	}
+	return nil, errors.Errorf("requested key counter %d for issuer %s not available; available: %s",
+		counter, iss, strings.Join(available, ", "))
+}
+
+// checkKeyExpiry returns an error if the specified public key has expired and AllowExpiredKeys
+// is not enabled, as credentials issued with its private key cannot be verified.
+func checkKeyExpiry(conf *server.Configuration, iss irma.IssuerIdentifier, pk *gabi.PublicKey) error {
+	if conf.AllowExpiredKeys || pk.ExpiryDate > time.Now().Unix() {
+		return nil
+	}
+	return errors.Errorf("public key %s-%d expired at %s, refusing to issue credentials that cannot be verified",
+		iss, pk.Counter, time.Unix(pk.ExpiryDate, 0).Format(time.RFC3339))
+}
+
+// maxCredentials returns the maximum number of credentials that issuance sessions of the
+// specified requestor may issue.
+func (s *Server) maxCredentials(requestor string) int {
+	if max, ok := s.conf().RequestorMaxCredentials[requestor]; ok && requestor != "" && max != 0 {
+		return max
+	}
+	if s.conf().MaxCredentialsPerIssuance != 0 {
+		return s.conf().MaxCredentialsPerIssuance
+	}
+	return defaultMaxCredentials
+}
+
+// emptyDisclosure returns true if the request does not contain any attribute requests.
+func emptyDisclosure(request irma.SessionRequest) bool {
+	for _, discon := range request.Disclosure().Disclose {
+		for _, con := range discon {
+			if len(con) > 0 {
+				return false
+			}
+		}
+	}
+	return true
 }
 
 func copyObject(i interface{}) (interface{}, error) {
@@ -294,6 +1252,53 @@ func copyObject(i interface{}) (interface{}, error) {
 	return cpy, nil
 }
 
+var templatePlaceholder = regexp.MustCompile(`{{[^{}]*}}`)
+
+// substituteTemplate returns a copy of the template in which placeholders of the form {{name}} in
+// the required attribute values and labels are replaced by the corresponding parameters.
+func substituteTemplate(template irma.RequestorRequest, params map[string]string) (irma.RequestorRequest, error) {
+	cpy, err := copyObject(template)
+	if err != nil {
+		return nil, err
+	}
+	rrequest := cpy.(irma.RequestorRequest)
+
+	pairs := make([]string, 0, 2*len(params))
+	for name, value := range params {
+		pairs = append(pairs, "{{"+name+"}}", value)
+	}
+	replacer := strings.NewReplacer(pairs...)
+	var missing []string
+	replace := func(str string) string {
+		missing = append(missing, templatePlaceholder.FindAllString(str, -1)...)
+		return replacer.Replace(str)
+	}
+
+	disclosure := rrequest.SessionRequest().Disclosure()
+	for _, discon := range disclosure.Disclose {
+		for _, con := range discon {
+			for i := range con {
+				if con[i].Value != nil {
+					value := replace(*con[i].Value)
+					con[i].Value = &value
+				}
+			}
+		}
+	}
+	for _, label := range disclosure.Labels {
+		for lang, str := range label {
+			label[lang] = replace(str)
+		}
+	}
+
+	for _, placeholder := range missing {
+		if _, ok := params[placeholder[2:len(placeholder)-2]]; !ok {
+			return nil, errors.Errorf("missing parameter for placeholder %s in request template", placeholder)
+		}
+	}
+	return rrequest, nil
+}
+
 // purgeRequest logs the request excluding any attribute values.
 func purgeRequest(request irma.RequestorRequest) irma.RequestorRequest {
 	// We want to log as much as possible of the request, but no attribute values.
@@ -350,12 +1355,212 @@ func eventServer(conf *server.Configuration) *sse.Server {
 	})
 }
 
+// sseWriter cancels the context of the server sent events request that it writes to as soon as
+// a write to the client fails. As the event server does not watch the request context but uses
+// http.CloseNotifier instead, sseWriter's CloseNotify() reports this context being done, so that
+// the client is unsubscribed immediately when it disconnects or when writing to it fails,
+// instead of continuing to send it events over a broken connection.
+type sseWriter struct {
+	http.ResponseWriter
+	ctx    context.Context
+	cancel context.CancelFunc
+	failed bool
+}
+
+func (w *sseWriter) CloseNotify() <-chan bool {
+	closed := make(chan bool, 1)
+	go func() {
+		<-w.ctx.Done()
+		closed <- true
+	}()
+	return closed
+}
+
+func (w *sseWriter) Write(bts []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(bts)
+	if err != nil && !w.failed {
+		w.failed = true
+		w.cancel()
+	}
+	return n, err
+}
+
+func (w *sseWriter) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// serveEvents subscribes the client to the server sent events of the channel specified in the
+// request context, returning when the client disconnects or fails to receive an event, or when
+// the channel is closed.
+func (s *Server) serveEvents(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	writer := &sseWriter{ResponseWriter: w, ctx: ctx, cancel: cancel}
+	s.serverSentEvents.ServeHTTP(writer, r.WithContext(ctx))
+
+	fields := logrus.Fields{"channel": r.Context().Value("sse")}
+	switch {
+	case writer.failed:
+		s.conf().Logger.WithFields(fields).Debug("Server sent events subscription ended: write to client failed")
+	case r.Context().Err() != nil:
+		s.conf().Logger.WithFields(fields).Debug("Server sent events subscription ended: client disconnected")
+	default:
+		s.conf().Logger.WithFields(fields).Debug("Server sent events subscription ended")
+	}
+}
+
 func errorWriter(err *irma.RemoteError, writer func(w http.ResponseWriter, object interface{}, rerr *irma.RemoteError)) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		writer(w, nil, err)
 	}
 }
 
+// pathMiddleware refuses requests with malformed paths, such as those sent by scanners and bots,
+// before they reach the router. These are logged at debug level only to prevent log spam.
+// It also normalizes the casing and aliases of session nouns, see normalizeSessionNoun().
+func (s *Server) pathMiddleware(next http.Handler) http.Handler {
+	unsupported := &irma.RemoteError{
+		Status:      server.ErrorUnsupported.Status,
+		ErrorName:   string(server.ErrorUnsupported.Type),
+		Description: server.ErrorUnsupported.Description,
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		components, err := server.ParsePath(r.URL.Path)
+		if err != nil {
+			s.conf().Logger.WithField("error", err).Debug("Refusing request with malformed path")
+			server.WriteResponse(w, nil, unsupported)
+			return
+		}
+		if path := s.normalizeSessionNoun(r.URL.Path, components); path != r.URL.Path {
+			r.URL.Path, r.URL.RawPath = path, ""
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// sessionNouns are the path components that may follow the session token in requests of the
+// IRMA app.
+var sessionNouns = map[string]bool{
+	"":             true,
+	"status":       true,
+	"statusevents": true,
+	"pairing":      true,
+	"abort":        true,
+	"commitments":  true,
+	"proofs":       true,
+}
+
+// sessionNounAliases maps alternative names of session nouns, as sent by some clients or proxies,
+// to the nouns themselves. Extended by the configured NounAliases.
+var sessionNounAliases = map[string]string{
+	"events": "statusevents",
+}
+
+// normalizeSessionNoun returns the path with its session noun, following the session token or,
+// if a SessionTokenHeader is configured, the session component, converted to lower case and
+// resolved if it is an alias. Paths with unknown nouns are returned unchanged, to be refused.
+func (s *Server) normalizeSessionNoun(path string, components []string) string {
+	i := len(components) - 1
+	if i < 1 {
+		return path
+	}
+	afterToken := i >= 2 && components[i-2] == "session"
+	if !afterToken && (components[i-1] != "session" || s.conf().SessionTokenHeader == "") {
+		return path
+	}
+	noun := strings.ToLower(components[i])
+	if alias, ok := s.conf().NounAliases[noun]; ok {
+		noun = alias
+	} else if alias, ok := sessionNounAliases[noun]; ok {
+		noun = alias
+	}
+	if noun == components[i] || !sessionNouns[noun] {
+		return path
+	}
+	j := strings.LastIndex(path, components[i])
+	return path[:j] + noun + path[j+len(components[i]):]
+}
+
+// insertSessionToken inserts the specified token into the path after its session component,
+// if the path lacks a session token. It returns false if the path was left unchanged.
+func insertSessionToken(path, token string) (string, bool) {
+	i := strings.LastIndex(path, "/session")
+	if i < 0 {
+		return path, false
+	}
+	rest := path[i+len("/session"):]
+	if rest != "" && rest[0] != '/' {
+		return path, false
+	}
+	noun := strings.Trim(rest, "/")
+	if !sessionNouns[noun] {
+		return path, false
+	}
+	path = path[:i] + "/session/" + token
+	if noun != "" {
+		path += "/" + noun
+	}
+	return path, true
+}
+
+// sessionTokenHeaderMiddleware routes requests whose path lacks a session token to the session
+// whose token is contained in the header configured in SessionTokenHeader, if present. As the
+// token is inserted into the path, requests whose header does not contain a well-formed session
+// token are refused.
+func (s *Server) sessionTokenHeaderMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var token string
+		if s.conf().SessionTokenHeader != "" {
+			token = r.Header.Get(s.conf().SessionTokenHeader)
+		}
+		if token == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		// When mounted in another chi router, ours routes on the remainder of the path
+		rctx := chi.RouteContext(r.Context())
+		mounted := rctx != nil && rctx.RoutePath != ""
+		path := r.URL.Path
+		if mounted {
+			path = rctx.RoutePath
+		}
+		path, ok := insertSessionToken(path, token)
+		if !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if !validSessionToken(token, s.conf().TokenPrefix) {
+			server.WriteError(w, server.ErrorSessionUnknown, "malformed session token in "+s.conf().SessionTokenHeader+" header")
+			return
+		}
+		if mounted {
+			rctx.RoutePath = path
+		} else {
+			r = r.Clone(r.Context())
+			r.URL.Path, r.URL.RawPath = path, ""
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// contentTypeMiddleware refuses POST requests whose body is not JSON, with an error stating so
+// instead of the less clear error that results from failing to parse the body.
+func contentTypeMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost {
+			ctype := r.Header.Get("Content-Type")
+			if mediatype, _, err := mime.ParseMediaType(ctype); err != nil || mediatype != "application/json" {
+				server.WriteError(w, server.ErrorUnsupportedContentType, ctype)
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
 func (s *Server) cacheMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		session := r.Context().Value("session").(*session)
@@ -369,6 +1574,18 @@ func (s *Server) cacheMiddleware(next http.Handler) http.Handler {
 		_ = r.Body.Close()
 		r.Body = ioutil.NopCloser(bytes.NewBuffer(message))
 
+		// If the session is unlocked while another request handling proofs or commitments awaits
+		// a verification worker or a confirmation, this is probably a retry of it, which should
+		// receive its response instead of being refused because of the status of the session
+		if session.worker != nil {
+			handled := session.worker.handled
+			session.locked = false
+			session.Unlock()
+			<-handled
+			session.Lock()
+			session.locked = true
+		}
+
 		// if a cache is set and applicable, return it
 		status, output := session.checkCache(message)
 		if status > 0 && len(output) > 0 {
@@ -392,6 +1609,210 @@ func (s *Server) cacheMiddleware(next http.Handler) http.Handler {
 	})
 }
 
+// bufferingWriter buffers the response written to it, so that it can be inspected afterwards.
+type bufferingWriter struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (w *bufferingWriter) WriteHeader(status int) {
+	w.status = status
+}
+
+func (w *bufferingWriter) Write(bts []byte) (int, error) {
+	return w.body.Write(bts)
+}
+
+// acceptedEncoding returns the compression that the client accepts according to its
+// Accept-Encoding header, preferring gzip over deflate, or "" if it accepts neither.
+func acceptedEncoding(r *http.Request) string {
+	accepted := map[string]bool{}
+	for _, part := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		fields := strings.Split(part, ";")
+		encoding := strings.ToLower(strings.TrimSpace(fields[0]))
+		q := 1.0
+		for _, param := range fields[1:] {
+			if param = strings.TrimSpace(param); strings.HasPrefix(param, "q=") {
+				q, _ = strconv.ParseFloat(param[2:], 64)
+			}
+		}
+		accepted[encoding] = q > 0
+	}
+	for _, encoding := range []string{"gzip", "deflate"} {
+		if accepted[encoding] {
+			return encoding
+		}
+	}
+	return ""
+}
+
+// compressionMiddleware compresses responses of at least compressionThreshold bytes if the
+// client accepts that, unless disabled.
+func (s *Server) compressionMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		encoding := acceptedEncoding(r)
+		if s.conf().DisableCompression || encoding == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		bw := &bufferingWriter{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(bw, r)
+		w.Header().Add("Vary", "Accept-Encoding")
+		if bw.body.Len() < compressionThreshold {
+			w.WriteHeader(bw.status)
+			_, _ = w.Write(bw.body.Bytes())
+			return
+		}
+
+		w.Header().Set("Content-Encoding", encoding)
+		w.Header().Del("Content-Length")
+		w.WriteHeader(bw.status)
+		var cw io.WriteCloser
+		if encoding == "gzip" {
+			cw = gzip.NewWriter(w)
+		} else {
+			// The deflate content coding is the zlib format (RFC 1950), not raw deflate data
+			cw = zlib.NewWriter(w)
+		}
+		if _, err := cw.Write(bw.body.Bytes()); err != nil {
+			s.conf().Logger.Warn("Failed to write compressed response: ", err)
+		}
+		_ = cw.Close()
+	})
+}
+
+// traceMiddleware creates a span for each request of the IRMA app, if a TracerProvider is configured.
+func (s *Server) traceMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.conf().TracerProvider == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		session := r.Context().Value("session").(*session)
+		noun := session.requestNoun(r)
+
+		ctx, span := s.conf().TracerProvider.StartSpan(r.Context(), "irma.HandleProtocolMessage")
+		defer span.End()
+		span.SetAttribute("action", string(session.action))
+		span.SetAttribute("method", r.Method)
+		span.SetAttribute("noun", noun)
+		span.SetAttribute("token", server.HashToken(session.token))
+		next.ServeHTTP(w, r.WithContext(ctx))
+		span.SetAttribute("status", string(session.status))
+	})
+}
+
+// requestNoun returns the part of the request path following the session token,
+// e.g. "status" or "" for the session request itself.
+func (session *session) requestNoun(r *http.Request) string {
+	return requestNoun(r, session.clientToken)
+}
+
+func requestNoun(r *http.Request, token string) string {
+	noun := r.URL.Path
+	if i := strings.LastIndex(noun, token); i >= 0 {
+		noun = strings.Trim(noun[i+len(token):], "/")
+	} else {
+		// The token was passed in a header, see sessionTokenHeaderMiddleware
+		noun = noun[strings.LastIndex(noun, "/")+1:]
+		if !sessionNouns[noun] {
+			noun = ""
+		}
+	}
+	return noun
+}
+
+// acquireWorker blocks until one of the configured verification workers is available to verify
+// proofs or commitments, returning a function that releases the worker again.
+func (s *Server) acquireWorker() func() {
+	if s.workers == nil {
+		return func() {}
+	}
+	s.workers <- struct{}{}
+	return func() { <-s.workers }
+}
+
+// verificationWorker is a verification worker of the server for a request handling proofs or
+// commitments, which the session acquires once it starts verifying them.
+type verificationWorker struct {
+	s       *Server
+	release func()
+	// Closed when the request has been handled, for retries of it awaiting its response
+	handled chan struct{}
+}
+
+func (s *Server) newVerificationWorker() *verificationWorker {
+	return &verificationWorker{s: s, handled: make(chan struct{})}
+}
+
+func (w *verificationWorker) acquire() {
+	if w != nil {
+		w.release = w.s.acquireWorker()
+	}
+}
+
+// pause releases the worker and the request's share in the verifications counter while the
+// request waits for something other than verification, returning a function that reacquires them.
+func (w *verificationWorker) pause() (resume func()) {
+	if w == nil || w.release == nil {
+		return func() {}
+	}
+	w.done()
+	atomic.AddInt64(&w.s.verifications, -1)
+	return func() {
+		atomic.AddInt64(&w.s.verifications, 1)
+		w.acquire()
+	}
+}
+
+// done releases the worker, if it was acquired.
+func (w *verificationWorker) done() {
+	if w.release != nil {
+		w.release()
+		w.release = nil
+	}
+}
+
+// finish releases the worker and wakes the retries awaiting the response of the request.
+func (w *verificationWorker) finish() {
+	w.done()
+	close(w.handled)
+}
+
+// overloaded returns whether the server is above one of the thresholds configured in LoadShedding.
+func (s *Server) overloaded() bool {
+	conf := s.conf().LoadShedding
+	if conf.MaxActiveSessions > 0 && s.stats.get().Active > uint64(conf.MaxActiveSessions) {
+		return true
+	}
+	return conf.MaxVerifications > 0 && atomic.LoadInt64(&s.verifications) > int64(conf.MaxVerifications)
+}
+
+// loadSheddingMiddleware asks apps to back off from fetching session requests and polling the
+// session status when the server is overloaded, and counts the proofs and commitments being handled.
+func (s *Server) loadSheddingMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		noun := requestNoun(r, chi.URLParam(r, "token"))
+		switch {
+		case r.Method == http.MethodPost && (noun == "proofs" || noun == "commitments"):
+			atomic.AddInt64(&s.verifications, 1)
+			defer atomic.AddInt64(&s.verifications, -1)
+		case r.Method == http.MethodGet && (noun == "" || noun == "status") && s.overloaded():
+			retryAfter := s.conf().LoadShedding.RetryAfter
+			if retryAfter == 0 {
+				retryAfter = defaultRetryAfter
+			}
+			w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+			server.WriteError(w, server.ErrorOverloaded, "")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
 func (s *Server) sessionMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		token := chi.URLParam(r, "token")
@@ -413,6 +1834,7 @@ func (s *Server) sessionMiddleware(next http.Handler) http.Handler {
 					*r.(*server.SessionResult) = *result
 				}
 				if session.status.Finished() {
+					session.logOutcome()
 					if handler := s.handlers[result.Token]; handler != nil {
 						go handler(result)
 						delete(s.handlers, token)
@@ -425,6 +1847,14 @@ func (s *Server) sessionMiddleware(next http.Handler) http.Handler {
 			}
 		}()
 
+		// Count these here, before the cache middleware may answer retried requests
+		switch noun := session.requestNoun(r); {
+		case r.Method == http.MethodGet && noun == "":
+			session.requestFetches++
+		case noun == "status" || noun == "statusevents":
+			session.statusPolls++
+		}
+
 		next.ServeHTTP(w, r.WithContext(context.WithValue(ctx, "session", session)))
 	})
 }
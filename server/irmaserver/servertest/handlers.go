@@ -0,0 +1,89 @@
+package servertest
+
+import (
+	"sync"
+
+	"github.com/go-errors/errors"
+	"github.com/privacybydesign/irmago"
+	"github.com/privacybydesign/irmago/irmaclient"
+)
+
+// clientHandler is an irmaclient.ClientHandler that ignores all events.
+type clientHandler struct{}
+
+func (h *clientHandler) UpdateConfiguration(new *irma.IrmaIdentifierSet)                       {}
+func (h *clientHandler) UpdateAttributes()                                                     {}
+func (h *clientHandler) Revoked(cred *irma.CredentialIdentifier)                               {}
+func (h *clientHandler) EnrollmentSuccess(manager irma.SchemeManagerIdentifier)                {}
+func (h *clientHandler) EnrollmentFailure(manager irma.SchemeManagerIdentifier, err error)     {}
+func (h *clientHandler) ChangePinSuccess(manager irma.SchemeManagerIdentifier)                 {}
+func (h *clientHandler) ChangePinFailure(manager irma.SchemeManagerIdentifier, err error)      {}
+func (h *clientHandler) ChangePinIncorrect(manager irma.SchemeManagerIdentifier, attempts int) {}
+func (h *clientHandler) ChangePinBlocked(manager irma.SchemeManagerIdentifier, timeout int)    {}
+
+// sessionHandler is an irmaclient.Handler that consents to everything, and reports on the channel
+// whether or not the session succeeded.
+type sessionHandler struct {
+	done chan error
+	once sync.Once
+}
+
+// finish reports the outcome of the session. Only the first outcome is reported, so that
+// callbacks invoked after it do not block on the channel.
+func (h *sessionHandler) finish(err error) {
+	h.once.Do(func() {
+		h.done <- err
+	})
+}
+
+func (h *sessionHandler) StatusUpdate(action irma.Action, status irma.Status) {}
+func (h *sessionHandler) ClientReturnURLSet(clientReturnURL string)           {}
+func (h *sessionHandler) Success(result string) {
+	h.finish(nil)
+}
+func (h *sessionHandler) Cancelled() {
+	h.finish(errors.New("session cancelled"))
+}
+func (h *sessionHandler) Failure(err *irma.SessionError) {
+	h.finish(err)
+}
+func (h *sessionHandler) UnsatisfiableRequest(request irma.SessionRequest, serverName irma.TranslatedString, missing irmaclient.MissingAttributes) {
+	h.finish(errors.New("client cannot satisfy session request"))
+}
+func (h *sessionHandler) KeyshareBlocked(manager irma.SchemeManagerIdentifier, duration int) {
+	h.finish(errors.Errorf("keyshare server of %s blocked", manager))
+}
+func (h *sessionHandler) KeyshareEnrollmentIncomplete(manager irma.SchemeManagerIdentifier) {
+	h.finish(errors.Errorf("keyshare enrollment of %s incomplete", manager))
+}
+func (h *sessionHandler) KeyshareEnrollmentMissing(manager irma.SchemeManagerIdentifier) {
+	h.finish(errors.Errorf("keyshare enrollment of %s missing", manager))
+}
+func (h *sessionHandler) KeyshareEnrollmentDeleted(manager irma.SchemeManagerIdentifier) {
+	h.finish(errors.Errorf("keyshare enrollment of %s deleted", manager))
+}
+func (h *sessionHandler) RequestIssuancePermission(request *irma.IssuanceRequest, candidates [][][]*irma.AttributeIdentifier, serverName irma.TranslatedString, callback irmaclient.PermissionHandler) {
+	h.RequestVerificationPermission(&request.DisclosureRequest, candidates, serverName, callback)
+}
+func (h *sessionHandler) RequestVerificationPermission(request *irma.DisclosureRequest, candidates [][][]*irma.AttributeIdentifier, serverName irma.TranslatedString, callback irmaclient.PermissionHandler) {
+	var choice irma.DisclosureChoice
+	for _, cand := range candidates {
+		choice.Attributes = append(choice.Attributes, cand[0])
+	}
+	callback(true, &choice)
+}
+func (h *sessionHandler) RequestSignaturePermission(request *irma.SignatureRequest, candidates [][][]*irma.AttributeIdentifier, serverName irma.TranslatedString, callback irmaclient.PermissionHandler) {
+	h.RequestVerificationPermission(&request.DisclosureRequest, candidates, serverName, callback)
+}
+func (h *sessionHandler) RequestSchemeManagerPermission(manager *irma.SchemeManager, callback func(proceed bool)) {
+	callback(true)
+}
+func (h *sessionHandler) RequestPin(remainingAttempts int, callback irmaclient.PinHandler) {
+	callback(false, "")
+}
+func (h *sessionHandler) RequestPairingCode(incorrect bool, callback irmaclient.PairingHandler) {
+	callback(false, "")
+}
+func (h *sessionHandler) RequestClientAttributes(request *irma.IssuanceRequest, callback irmaclient.ClientAttributesHandler) {
+	callback(false, nil)
+}
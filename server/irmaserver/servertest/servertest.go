@@ -0,0 +1,98 @@
+// Package servertest contains helpers for integration testing against an irmaserver.Server. Its
+// Client drives complete issuance, disclosure and signing sessions in-process against a Server,
+// using an irmaclient instance instead of the IRMA app, so that end-to-end tests can be written
+// without a phone. It is meant for tests only: in particular, the client always consents to
+// disclosure, choosing the first candidate of each disjunction.
+package servertest
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+
+	"github.com/go-errors/errors"
+	"github.com/privacybydesign/irmago"
+	"github.com/privacybydesign/irmago/irmaclient"
+	"github.com/privacybydesign/irmago/server"
+	"github.com/privacybydesign/irmago/server/irmaserver"
+)
+
+// Client is an in-process IRMA client that can perform sessions against an irmaserver.Server.
+type Client struct {
+	*irmaclient.Client
+}
+
+// NewClient creates a new Client that stores its attributes at storagePath, using the schemes
+// at irmaConfigurationPath (which must contain the schemes of the credentials used in sessions,
+// along with their public keys).
+func NewClient(storagePath, irmaConfigurationPath string) (*Client, error) {
+	client, err := irmaclient.New(storagePath, irmaConfigurationPath, &clientHandler{})
+	if err != nil {
+		return nil, err
+	}
+	return &Client{Client: client}, nil
+}
+
+// RunSession starts the specified session at the server and performs it with the client,
+// returning the session result as computed by the server.
+// The request parameter is anything accepted by irmaserver.Server.StartSession().
+func (c *Client) RunSession(serv *irmaserver.Server, request interface{}) (*server.SessionResult, error) {
+	// The session is performed against a test HTTP server that serves only this session,
+	// so that the server does not need to be reachable at its configured URL.
+	httpserv := httptest.NewServer(serv.HandlerFunc())
+	defer httpserv.Close()
+
+	results := make(chan *server.SessionResult, 1)
+	qr, _, err := serv.StartSession(request, func(result *server.SessionResult) {
+		results <- result
+	})
+	if err != nil {
+		return nil, err
+	}
+	index := strings.LastIndex(qr.URL, "session/")
+	if index < 0 {
+		return nil, errors.Errorf("unexpected session URL %s", qr.URL)
+	}
+	qr.URL = httpserv.URL + "/" + qr.URL[index:]
+
+	qrbts, err := json.Marshal(qr)
+	if err != nil {
+		return nil, err
+	}
+	done := make(chan error, 1)
+	c.NewSession(string(qrbts), &sessionHandler{done: done})
+	if err = <-done; err != nil {
+		return nil, err
+	}
+	return <-results, nil
+}
+
+// RunDisclosureSession performs a disclosure session using the specified request, which is anything
+// accepted by irmaserver.Server.StartSession() containing a disclosure request.
+func (c *Client) RunDisclosureSession(serv *irmaserver.Server, request interface{}) (*server.SessionResult, error) {
+	return c.runSession(serv, request, irma.ActionDisclosing)
+}
+
+// RunSigningSession performs an attribute-based signature session using the specified request,
+// which is anything accepted by irmaserver.Server.StartSession() containing a signature request.
+func (c *Client) RunSigningSession(serv *irmaserver.Server, request interface{}) (*server.SessionResult, error) {
+	return c.runSession(serv, request, irma.ActionSigning)
+}
+
+// RunIssuanceSession performs an issuance session using the specified request, which is anything
+// accepted by irmaserver.Server.StartSession() containing an issuance request. The server must
+// have the private keys of the issuers of the credentials to be issued.
+func (c *Client) RunIssuanceSession(serv *irmaserver.Server, request interface{}) (*server.SessionResult, error) {
+	return c.runSession(serv, request, irma.ActionIssuing)
+}
+
+func (c *Client) runSession(serv *irmaserver.Server, request interface{}, action irma.Action) (*server.SessionResult, error) {
+	rrequest, err := server.ParseSessionRequest(request)
+	if err != nil {
+		return nil, err
+	}
+	if a := rrequest.SessionRequest().Action(); a != action {
+		return nil, errors.Errorf("expected %s request, got %s request", action, a)
+	}
+	return c.RunSession(serv, rrequest)
+}
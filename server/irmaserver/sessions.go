@@ -2,10 +2,14 @@ package irmaserver
 
 import (
 	"crypto/rand"
+	"encoding/json"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/alexandrevicenzi/go-sse"
+	"github.com/go-errors/errors"
 	"github.com/privacybydesign/gabi"
 	"github.com/privacybydesign/gabi/big"
 	"github.com/privacybydesign/irmago"
@@ -32,13 +36,45 @@ type session struct {
 	sse           *sse.Server
 	responseCache responseCache
 
+	startedAt  time.Time
 	lastActive time.Time
+	finishedAt time.Time
 	result     *server.SessionResult
+	client     *server.ClientInfo
+	requestor  string // the requestor that started the session, if specified
+
+	requestFetches int
+	statusPolls    int
+	proofAttempts  int
+	sseConnections int32 // accessed atomically
 
 	kssProofs map[irma.SchemeManagerIdentifier]*gabi.ProofP
 
+	pairingCode     string
+	pairingAttempts int
+
+	// Whether the issuance was confirmed using ConfirmExternal(), and if the session is awaiting
+	// that, a channel that is closed when it happens or when the session finishes otherwise
+	confirmed    bool
+	confirmation chan struct{}
+
+	// While proofs or commitments are handled, the verification worker of the request
+	worker *verificationWorker
+
+	verification *server.VerificationError // why the client's proofs were not accepted, if so
+
+	// The configuration at the time the session was started. Scheme updates and reloads replace the
+	// server's configuration instead of modifying it, so that the session keeps using these schemes.
 	conf     *server.Configuration
 	sessions sessionStore
+	stats    *sessionStats
+}
+
+// sessionStats contains cumulative session counters, which are updated atomically.
+type sessionStats struct {
+	total    uint64
+	finished uint64
+	actions  map[irma.Action]*uint64
 }
 
 type responseCache struct {
@@ -48,10 +84,57 @@ type responseCache struct {
 	sessionStatus server.Status
 }
 
+// sessionExportVersion is the version of the format of exported sessions; see ExportSessions().
+const sessionExportVersion = 1
+
+type sessionExport struct {
+	Version  int                `json:"version"`
+	Sessions []*exportedSession `json:"sessions"`
+}
+
+// exportedSession contains the state of a session, as exported by ExportSessions().
+type exportedSession struct {
+	Action           irma.Action           `json:"action"`
+	Token            string                `json:"token"`
+	ClientToken      string                `json:"clientToken"`
+	Version          *irma.ProtocolVersion `json:"version,omitempty"`
+	Request          json.RawMessage       `json:"request"` // the RequestorRequest, including nonce and context
+	LegacyCompatible bool                  `json:"legacyCompatible"`
+	LegacySession    bool                  `json:"legacySession"`
+
+	Status        server.Status `json:"status"`
+	PrevStatus    server.Status `json:"prevStatus"`
+	CacheMessage  []byte        `json:"cacheMessage,omitempty"`
+	CacheResponse []byte        `json:"cacheResponse,omitempty"`
+	CacheStatus   int           `json:"cacheStatus,omitempty"`
+	CacheSession  server.Status `json:"cacheSessionStatus,omitempty"`
+
+	StartedAt  time.Time             `json:"startedAt"`
+	LastActive time.Time             `json:"lastActive"`
+	FinishedAt time.Time             `json:"finishedAt"`
+	Result     *server.SessionResult `json:"result"`
+	Client     *server.ClientInfo    `json:"client,omitempty"`
+	Requestor  string                `json:"requestor,omitempty"`
+
+	RequestFetches int `json:"requestFetches"`
+	StatusPolls    int `json:"statusPolls"`
+	ProofAttempts  int `json:"proofAttempts"`
+
+	KssProofs map[irma.SchemeManagerIdentifier]*gabi.ProofP `json:"kssProofs,omitempty"`
+
+	PairingCode     string `json:"pairingCode,omitempty"`
+	PairingAttempts int    `json:"pairingAttempts,omitempty"`
+
+	Confirmed bool `json:"confirmed,omitempty"`
+
+	Verification *server.VerificationError `json:"verificationError,omitempty"`
+}
+
 type sessionStore interface {
 	get(token string) *session
 	clientGet(token string) *session
 	add(session *session)
+	filter(keep func(*session) bool) []*session
 	update(session *session)
 	deleteExpired()
 	stop()
@@ -59,15 +142,28 @@ type sessionStore interface {
 
 type memorySessionStore struct {
 	sync.RWMutex
-	conf *server.Configuration
+	// conf returns the current configuration of the server, which ReloadSchemes() may replace
+	conf func() *server.Configuration
 
 	requestor map[string]*session
 	client    map[string]*session
 }
 
 const (
-	maxSessionLifetime = 5 * time.Minute // After this a session is cancelled
-	sessionChars       = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
+	maxSessionLifetime         = 5 * time.Minute // After this a session is cancelled
+	maxPairingAttempts         = 3               // After this many incorrect pairing codes a session is cancelled
+	compressionThreshold       = 1024            // Minimum size in bytes of responses to the IRMA app that are compressed
+	defaultExpiryCheckInterval = 10              // Default interval in seconds at which expired sessions are cleaned up
+	defaultMaxDisjunctions     = 100             // Default maximum number of disjunctions in a session request
+	defaultMaxDisjunctionOpts  = 100             // Default maximum number of options per disjunction
+	defaultMaxCredentials      = 50              // Default maximum number of credentials per issuance session
+	defaultRetryAfter          = 5               // Default amount of seconds after which apps retry when load is shed
+	defaultNonceCacheTTL       = 600             // Default amount of seconds that session nonces are remembered
+	defaultConfirmationTimeout = 60              // Default amount of seconds that issuance waits for external confirmation
+	defaultMaxProofRetries     = 3               // Default maximum number of retries of failing disclosure proofs, if allowed
+	sessionChars               = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
+	sessionTokenLength         = 20
+	pairingChars               = "0123456789"
 )
 
 var (
@@ -76,17 +172,33 @@ var (
 )
 
 func (s *memorySessionStore) get(t string) *session {
+	if !s.hasPrefix(t) {
+		return nil
+	}
 	s.RLock()
 	defer s.RUnlock()
 	return s.requestor[t]
 }
 
 func (s *memorySessionStore) clientGet(t string) *session {
+	if !s.hasPrefix(t) {
+		return nil
+	}
 	s.RLock()
 	defer s.RUnlock()
 	return s.client[t]
 }
 
+// hasPrefix returns whether the token has the configured TokenPrefix, logging it if not, as then
+// the token is probably of a server in another environment.
+func (s *memorySessionStore) hasPrefix(t string) bool {
+	if strings.HasPrefix(t, s.conf().TokenPrefix) {
+		return true
+	}
+	s.conf().Logger.WithFields(logrus.Fields{"session": t}).Warn("Session token lacks token prefix, is it of another environment?")
+	return false
+}
+
 func (s *memorySessionStore) add(session *session) {
 	s.Lock()
 	defer s.Unlock()
@@ -94,6 +206,20 @@ func (s *memorySessionStore) add(session *session) {
 	s.client[session.clientToken] = session
 }
 
+// filter returns the sessions for which keep returns true. As the store is locked meanwhile,
+// keep should not lock the session, and only inspect fields that do not change.
+func (s *memorySessionStore) filter(keep func(*session) bool) []*session {
+	s.RLock()
+	defer s.RUnlock()
+	var sessions []*session
+	for _, session := range s.requestor {
+		if keep(session) {
+			sessions = append(sessions, session)
+		}
+	}
+	return sessions
+}
+
 func (s *memorySessionStore) update(session *session) {
 	session.onUpdate()
 }
@@ -117,20 +243,24 @@ func (s *memorySessionStore) deleteExpired() {
 	for token, session := range s.requestor {
 		session.Lock()
 
-		timeout := maxSessionLifetime
-		if session.status == server.StatusInitialized && session.rrequest.Base().ClientTimeout != 0 {
-			timeout = time.Duration(session.rrequest.Base().ClientTimeout) * time.Second
-		}
-
-		if session.lastActive.Add(timeout).Before(time.Now()) {
-			if !session.status.Finished() {
-				s.conf.Logger.WithFields(logrus.Fields{"session": session.token}).Infof("Session expired")
-				session.markAlive()
-				session.setStatus(server.StatusTimeout)
-			} else {
-				s.conf.Logger.WithFields(logrus.Fields{"session": session.token}).Infof("Deleting session")
+		if session.status.Finished() {
+			// Keep finished sessions for a while so that the requestor can retrieve the result
+			retention := maxSessionLifetime
+			if s.conf().FinishedSessionRetention != 0 {
+				retention = time.Duration(s.conf().FinishedSessionRetention) * time.Second
+			}
+			if session.finishedAt.Add(retention).Before(time.Now()) {
+				s.conf().Logger.WithFields(logrus.Fields{"session": session.token}).Infof("Deleting session")
 				expired = append(expired, token)
 			}
+			session.Unlock()
+			continue
+		}
+
+		if session.lastActive.Add(session.timeout()).Before(time.Now()) {
+			s.conf().Logger.WithFields(logrus.Fields{"session": session.token}).Infof("Session expired")
+			session.markAlive()
+			session.setStatus(server.StatusTimeout)
 		}
 		session.Unlock()
 	}
@@ -150,23 +280,59 @@ func (s *memorySessionStore) deleteExpired() {
 	s.Unlock()
 }
 
+func newSessionStats() *sessionStats {
+	return &sessionStats{actions: map[irma.Action]*uint64{
+		irma.ActionDisclosing: new(uint64),
+		irma.ActionSigning:    new(uint64),
+		irma.ActionIssuing:    new(uint64),
+	}}
+}
+
+func (stats *sessionStats) started(action irma.Action) {
+	atomic.AddUint64(&stats.total, 1)
+	if count := stats.actions[action]; count != nil {
+		atomic.AddUint64(count, 1)
+	}
+}
+
+func (stats *sessionStats) get() server.ServerStats {
+	// Load finished before total, so that active can never become negative
+	finished := atomic.LoadUint64(&stats.finished)
+	total := atomic.LoadUint64(&stats.total)
+	actions := make(map[irma.Action]uint64, len(stats.actions))
+	for action, count := range stats.actions {
+		actions[action] = atomic.LoadUint64(count)
+	}
+	return server.ServerStats{
+		Total:    total,
+		Finished: finished,
+		Active:   total - finished,
+		Actions:  actions,
+	}
+}
+
 var one *big.Int = big.NewInt(1)
 
-func (s *Server) newSession(action irma.Action, request irma.RequestorRequest) *session {
-	token := newSessionToken()
-	clientToken := newSessionToken()
+func (s *Server) newSession(action irma.Action, request irma.RequestorRequest, requestor string) (*session, error) {
+	conf := s.conf()
+	token := conf.TokenPrefix + newSessionToken()
+	clientToken := conf.TokenPrefix + newSessionToken()
 
+	now := time.Now()
 	ses := &session{
 		action:      action,
 		rrequest:    request,
 		request:     request.SessionRequest(),
-		lastActive:  time.Now(),
+		startedAt:   now,
+		lastActive:  now,
 		token:       token,
 		clientToken: clientToken,
+		requestor:   requestor,
 		status:      server.StatusInitialized,
 		prevStatus:  server.StatusInitialized,
-		conf:        s.conf,
+		conf:        conf,
 		sessions:    s.sessions,
+		stats:       s.stats,
 		sse:         s.serverSentEvents,
 		result: &server.SessionResult{
 			LegacySession: request.SessionRequest().Base().Legacy(),
@@ -176,18 +342,156 @@ func (s *Server) newSession(action irma.Action, request irma.RequestorRequest) *
 		},
 	}
 
-	s.conf.Logger.WithFields(logrus.Fields{"session": ses.token}).Debug("New session started")
+	conf.Logger.WithFields(logrus.Fields{"session": ses.token}).Debug("New session started")
+	if request.Base().Pairing {
+		ses.pairingCode = newPairingCode()
+	}
 	nonce := common.RandomBigInt(new(big.Int).Lsh(big.NewInt(1), gabi.DefaultSystemParameters[2048].Lstatzk))
 	ses.request.Base().Nonce = nonce
 	ses.request.Base().Context = one
+	if conf.OnSessionCreated != nil {
+		conf.OnSessionCreated(token, request)
+		// The hook may have enriched the request, so we check it again
+		if err := s.validateSessionRequest(request, requestor); err != nil {
+			return nil, errors.WrapPrefix(err, "session request invalid after OnSessionCreated", 0)
+		}
+	}
 	s.sessions.add(ses)
+	s.stats.started(action)
+
+	return ses, nil
+}
 
-	return ses
+func (session *session) summary() *server.SessionSummary {
+	session.Lock()
+	defer session.Unlock()
+	return &server.SessionSummary{
+		Token:      session.token,
+		Type:       session.action,
+		Status:     session.status,
+		Requestor:  session.requestor,
+		LastActive: session.lastActive,
+	}
+}
+
+func (session *session) export() (*exportedSession, error) {
+	session.Lock()
+	defer session.Unlock()
+	request, err := json.Marshal(session.rrequest)
+	if err != nil {
+		return nil, err
+	}
+	return &exportedSession{
+		Action:           session.action,
+		Token:            session.token,
+		ClientToken:      session.clientToken,
+		Version:          session.version,
+		Request:          request,
+		LegacyCompatible: session.legacyCompatible,
+		LegacySession:    session.result.LegacySession,
+		Status:           session.status,
+		PrevStatus:       session.prevStatus,
+		CacheMessage:     session.responseCache.message,
+		CacheResponse:    session.responseCache.response,
+		CacheStatus:      session.responseCache.status,
+		CacheSession:     session.responseCache.sessionStatus,
+		StartedAt:        session.startedAt,
+		LastActive:       session.lastActive,
+		FinishedAt:       session.finishedAt,
+		Result:           session.result,
+		Client:           session.client,
+		Requestor:        session.requestor,
+		RequestFetches:   session.requestFetches,
+		StatusPolls:      session.statusPolls,
+		ProofAttempts:    session.proofAttempts,
+		KssProofs:        session.kssProofs,
+		PairingCode:      session.pairingCode,
+		PairingAttempts:  session.pairingAttempts,
+		Confirmed:        session.confirmed,
+		Verification:     session.verification,
+	}, nil
+}
+
+func (s *Server) importSession(exported *exportedSession) (*session, error) {
+	var rrequest irma.RequestorRequest
+	switch exported.Action {
+	case irma.ActionDisclosing:
+		rrequest = &irma.ServiceProviderRequest{}
+	case irma.ActionSigning:
+		rrequest = &irma.SignatureRequestorRequest{}
+	case irma.ActionIssuing:
+		rrequest = &irma.IdentityProviderRequest{}
+	default:
+		return nil, errors.Errorf("session %s has invalid type %s", exported.Token, exported.Action)
+	}
+	if err := json.Unmarshal(exported.Request, rrequest); err != nil {
+		return nil, err
+	}
+	if exported.Result == nil {
+		return nil, errors.Errorf("session %s has no result", exported.Token)
+	}
+	exported.Result.LegacySession = exported.LegacySession
+
+	return &session{
+		action:           exported.Action,
+		token:            exported.Token,
+		clientToken:      exported.ClientToken,
+		version:          exported.Version,
+		rrequest:         rrequest,
+		request:          rrequest.SessionRequest(),
+		legacyCompatible: exported.LegacyCompatible,
+		status:           exported.Status,
+		prevStatus:       exported.PrevStatus,
+		responseCache: responseCache{
+			message:       exported.CacheMessage,
+			response:      exported.CacheResponse,
+			status:        exported.CacheStatus,
+			sessionStatus: exported.CacheSession,
+		},
+		startedAt:       exported.StartedAt,
+		lastActive:      exported.LastActive,
+		finishedAt:      exported.FinishedAt,
+		result:          exported.Result,
+		client:          exported.Client,
+		requestor:       exported.Requestor,
+		requestFetches:  exported.RequestFetches,
+		statusPolls:     exported.StatusPolls,
+		proofAttempts:   exported.ProofAttempts,
+		kssProofs:       exported.KssProofs,
+		pairingCode:     exported.PairingCode,
+		pairingAttempts: exported.PairingAttempts,
+		confirmed:       exported.Confirmed,
+		verification:    exported.Verification,
+		conf:            s.conf(),
+		sessions:        s.sessions,
+		stats:           s.stats,
+		sse:             s.serverSentEvents,
+	}, nil
 }
 
 func newSessionToken() string {
-	count := 20
+	return randomString(sessionTokenLength, sessionChars)
+}
+
+// validSessionToken returns whether the token consists of the specified prefix followed by a
+// token as generated by newSessionToken().
+func validSessionToken(token, prefix string) bool {
+	if !strings.HasPrefix(token, prefix) || len(token) != len(prefix)+sessionTokenLength {
+		return false
+	}
+	for _, c := range token[len(prefix):] {
+		if !strings.ContainsRune(sessionChars, c) {
+			return false
+		}
+	}
+	return true
+}
+
+func newPairingCode() string {
+	return randomString(4, pairingChars)
+}
 
+func randomString(count int, chars string) string {
 	r := make([]byte, count)
 	_, err := rand.Read(r)
 	if err != nil {
@@ -196,7 +500,7 @@ func newSessionToken() string {
 
 	b := make([]byte, count)
 	for i := range b {
-		b[i] = sessionChars[r[i]%byte(len(sessionChars))]
+		b[i] = chars[r[i]%byte(len(chars))]
 	}
 	return string(b)
 }
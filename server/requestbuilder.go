@@ -0,0 +1,87 @@
+package server
+
+import (
+	"github.com/go-errors/errors"
+	"github.com/privacybydesign/irmago"
+)
+
+// DisclosureRequestBuilder constructs disclosure requests programmatically, e.g.
+//
+//	request, err := server.NewDisclosureRequest().
+//	    Require("pbdf.pbdf.email.email").
+//	    Optional("pbdf.pbdf.mobilenumber.mobilenumber").
+//	    WithValue("pbdf.pbdf.email.email", "example@example.com").
+//	    Build(conf)
+//
+// Mistakes such as unknown attribute types are reported by Build().
+type DisclosureRequestBuilder struct {
+	request *irma.DisclosureRequest
+	err     error
+}
+
+// NewDisclosureRequest returns a builder of a disclosure request without any attributes.
+func NewDisclosureRequest() *DisclosureRequestBuilder {
+	return &DisclosureRequestBuilder{request: irma.NewDisclosureRequest()}
+}
+
+// Require adds a disjunction requiring the specified attribute.
+func (b *DisclosureRequestBuilder) Require(attr string) *DisclosureRequestBuilder {
+	b.request.Disclose = append(b.request.Disclose, irma.AttributeDisCon{
+		irma.AttributeCon{irma.NewAttributeRequest(attr)},
+	})
+	return b
+}
+
+// Optional adds a disjunction of which the user may choose to disclose the specified attribute.
+func (b *DisclosureRequestBuilder) Optional(attr string) *DisclosureRequestBuilder {
+	b.request.Disclose = append(b.request.Disclose, irma.AttributeDisCon{
+		irma.AttributeCon{irma.NewAttributeRequest(attr)},
+		irma.AttributeCon{},
+	})
+	return b
+}
+
+// WithValue requires the specified attribute, which must have been added before using Require()
+// or Optional(), to have the specified value.
+func (b *DisclosureRequestBuilder) WithValue(attr string, value string) *DisclosureRequestBuilder {
+	id := irma.NewAttributeTypeIdentifier(attr)
+	found := false
+	for _, discon := range b.request.Disclose {
+		for _, con := range discon {
+			for i := range con {
+				if con[i].Type == id {
+					v := value
+					con[i].Value = &v
+					found = true
+				}
+			}
+		}
+	}
+	if !found && b.err == nil {
+		b.err = errors.Errorf("value specified for attribute %s, which was not added to the request", attr)
+	}
+	return b
+}
+
+// Build returns the disclosure request, after validating it against the specified configuration.
+func (b *DisclosureRequestBuilder) Build(conf *irma.Configuration) (*irma.DisclosureRequest, error) {
+	if b.err != nil {
+		return nil, b.err
+	}
+	err := b.request.Disclose.Iterate(func(attr *irma.AttributeRequest) error {
+		if !conf.ContainsAttributeType(attr.Type) {
+			return errors.Errorf("unknown attribute type %s", attr.Type)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err = b.request.Validate(); err != nil {
+		return nil, err
+	}
+	if err = b.request.Disclose.Validate(conf); err != nil {
+		return nil, err
+	}
+	return b.request, nil
+}
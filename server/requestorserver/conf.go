@@ -72,6 +72,11 @@ type Requestor struct {
 	AuthenticationMethod  AuthenticationMethod `json:"auth_method" mapstructure:"auth_method"`
 	AuthenticationKey     string               `json:"key" mapstructure:"key"`
 	AuthenticationKeyFile string               `json:"key_file" mapstructure:"key_file"`
+
+	// If nonzero, overrides max_credentials_per_issuance for this requestor
+	MaxCredentialsPerIssuance int `json:"max_credentials_per_issuance" mapstructure:"max_credentials_per_issuance"`
+	// If specified, overrides trusted_issuers for this requestor
+	TrustedIssuers []string `json:"trusted_issuers" mapstructure:"trusted_issuers"`
 }
 
 // CanIssue returns whether or not the specified requestor may issue the specified credentials.
@@ -133,11 +138,17 @@ func (conf *Configuration) CanVerifyOrSign(requestor string, action irma.Action,
 }
 
 func (conf *Configuration) CanRevoke(requestor string, cred irma.CredentialTypeIdentifier) (bool, string) {
+	return conf.canRevoke(conf.IrmaConfiguration, requestor, cred)
+}
+
+// canRevoke is CanRevoke() using the specified scheme configuration, which may have been reloaded
+// since the configuration was initialized.
+func (conf *Configuration) canRevoke(irmaconf *irma.Configuration, requestor string, cred irma.CredentialTypeIdentifier) (bool, string) {
 	permissions := append(conf.Requestors[requestor].Revoking, conf.Revoking...)
 	if len(permissions) == 0 { // requestor is not present in the permissions
 		return false, ""
 	}
-	_, err := conf.IrmaConfiguration.Revocation.Keys.PrivateKeyLatest(cred.IssuerIdentifier())
+	_, err := irmaconf.Revocation.Keys.PrivateKeyLatest(cred.IssuerIdentifier())
 	if err != nil {
 		return false, err.Error()
 	}
@@ -220,6 +231,29 @@ func (conf *Configuration) initialize() error {
 		return err
 	}
 
+	// The limit is enforced by the IRMA server library, which knows requestors only by name
+	for name, requestor := range conf.Requestors {
+		if requestor.MaxCredentialsPerIssuance < 0 {
+			return errors.Errorf("max_credentials_per_issuance of requestor %s must not be negative", name)
+		}
+		if requestor.MaxCredentialsPerIssuance == 0 {
+			continue
+		}
+		if conf.RequestorMaxCredentials == nil {
+			conf.RequestorMaxCredentials = map[string]int{}
+		}
+		conf.RequestorMaxCredentials[name] = requestor.MaxCredentialsPerIssuance
+	}
+	for name, requestor := range conf.Requestors {
+		if len(requestor.TrustedIssuers) == 0 {
+			continue
+		}
+		if conf.RequestorTrustedIssuers == nil {
+			conf.RequestorTrustedIssuers = map[string][]string{}
+		}
+		conf.RequestorTrustedIssuers[name] = requestor.TrustedIssuers
+	}
+
 	if conf.StaticPath != "" {
 		if err := common.AssertPathExists(conf.StaticPath); err != nil {
 			return errors.WrapPrefix(err, "Invalid static_path", 0)
@@ -11,6 +11,7 @@ import (
 	"encoding/json"
 	"encoding/pem"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"time"
@@ -18,6 +19,7 @@ import (
 	"github.com/dgrijalva/jwt-go"
 	"github.com/go-chi/chi"
 	"github.com/go-chi/cors"
+	"github.com/go-errors/errors"
 	"github.com/privacybydesign/irmago"
 	"github.com/privacybydesign/irmago/internal/common"
 	"github.com/privacybydesign/irmago/server"
@@ -193,6 +195,9 @@ func (s *Server) Handler() http.Handler {
 		if s.conf.Verbose >= 2 {
 			r.Use(server.LogMiddleware("requestor", log))
 		}
+		if s.conf.ErrorFormatter != nil {
+			r.Use(server.ErrorFormattingMiddleware(s.conf.ErrorFormatter))
+		}
 
 		// Server routes
 		r.Route("/session", func(r chi.Router) {
@@ -202,6 +207,7 @@ func (s *Server) Handler() http.Handler {
 				r.Get("/status", s.handleStatus)
 				r.Get("/statusevents", s.handleStatusEvents)
 				r.Get("/result", s.handleResult)
+				r.Get("/diagnostics", s.handleDiagnostics)
 				// Routes for getting signed JWTs containing the session result. Only work if configuration has a private key
 				r.Get("/result-jwt", s.handleJwtResult)
 				r.Get("/getproof", s.handleJwtProofs) // irma_api_server-compatible JWT
@@ -216,6 +222,9 @@ func (s *Server) Handler() http.Handler {
 		if s.conf.Verbose >= 2 {
 			r.Use(server.LogMiddleware("revocation", log))
 		}
+		if s.conf.ErrorFormatter != nil {
+			r.Use(server.ErrorFormattingMiddleware(s.conf.ErrorFormatter))
+		}
 		r.Post("/revocation", s.handleRevocation)
 	})
 
@@ -236,13 +245,24 @@ func (s *Server) StaticFilesHandler() http.Handler {
 }
 
 func (s *Server) handleCreateSession(w http.ResponseWriter, r *http.Request) {
-	body, err := ioutil.ReadAll(r.Body)
+	// Read at most one byte more than allowed, so that we can tell if the body is too large
+	reader := io.Reader(r.Body)
+	max := s.conf.MaxSessionRequestSize
+	if max > 0 {
+		reader = io.LimitReader(r.Body, int64(max)+1)
+	}
+	body, err := ioutil.ReadAll(reader)
 	if err != nil {
 		s.conf.Logger.Error("Could not read session request HTTP POST body")
 		_ = server.LogError(err)
 		server.WriteError(w, server.ErrorInvalidRequest, err.Error())
 		return
 	}
+	if max > 0 && len(body) > max {
+		s.conf.Logger.WithField("max", max).Warn("Refused session request exceeding maximum size")
+		server.WriteError(w, server.ErrorRequestTooLarge, "")
+		return
+	}
 
 	// Authenticate request: check if the requestor is known and allowed to submit requests.
 	// We do this by feeding the HTTP POST details to all known authenticators, and see if
@@ -311,6 +331,10 @@ func (s *Server) handleStatusEvents(w http.ResponseWriter, r *http.Request) {
 		Arg:       token,
 	}))
 	if err := s.irmaserv.SubscribeServerSentEvents(w, r, token, true); err != nil {
+		if err == irmaserver.ErrTooManySSEConnections {
+			server.WriteError(w, server.ErrorOverloaded, err.Error())
+			return
+		}
 		server.WriteResponse(w, nil, &irma.RemoteError{
 			Status:      server.ErrorUnsupported.Status,
 			ErrorName:   string(server.ErrorUnsupported.Type),
@@ -339,6 +363,15 @@ func (s *Server) handleResult(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+func (s *Server) handleDiagnostics(w http.ResponseWriter, r *http.Request) {
+	res := s.irmaserv.GetSessionDiagnostics(chi.URLParam(r, "token"))
+	if res == nil {
+		server.WriteError(w, server.ErrorSessionUnknown, "")
+		return
+	}
+	server.WriteJson(w, res)
+}
+
 func (s *Server) handleJwtResult(w http.ResponseWriter, r *http.Request) {
 	if s.conf.JwtRSAPrivateKey == nil {
 		s.conf.Logger.Warn("Session result JWT requested but no JWT private key is configured")
@@ -448,18 +481,49 @@ func (s *Server) handlePublicKey(w http.ResponseWriter, r *http.Request) {
 }
 
 func (s *Server) doResultCallback(result *server.SessionResult) {
-	url := s.irmaserv.GetRequest(result.Token).Base().CallbackURL
+	rrequest := s.irmaserv.GetRequest(result.Token)
+	url := rrequest.Base().CallbackURL
 	if url == "" {
 		return
 	}
+	if rrequest.Base().CallbackIncludeRequest {
+		request, err := callbackRequest(rrequest)
+		if err != nil {
+			_ = server.LogError(errors.WrapPrefix(err, "Failed to include session request in result callback", 0))
+			return
+		}
+		cpy := *result
+		cpy.Request = request
+		result = &cpy
+	}
 	server.DoResultCallback(url,
 		result,
 		s.conf.JwtIssuer,
-		s.irmaserv.GetRequest(result.Token).Base().ResultJwtValidity,
+		rrequest.Base().ResultJwtValidity,
 		s.conf.JwtRSAPrivateKey,
 	)
 }
 
+// callbackRequest returns the JSON of the session request for inclusion in the session result
+// posted to the callback URL, omitting the revocation keys of credentials to be issued.
+func callbackRequest(rrequest irma.RequestorRequest) (json.RawMessage, error) {
+	bts, err := json.Marshal(rrequest)
+	if err != nil {
+		return nil, err
+	}
+	if _, issuing := rrequest.(*irma.IdentityProviderRequest); !issuing {
+		return bts, nil
+	}
+	cpy := &irma.IdentityProviderRequest{}
+	if err = json.Unmarshal(bts, cpy); err != nil {
+		return nil, err
+	}
+	for _, cred := range cpy.Request.Credentials {
+		cred.RevocationKey = ""
+	}
+	return json.Marshal(cpy)
+}
+
 func (s *Server) createSession(w http.ResponseWriter, requestor string, rrequest irma.RequestorRequest) {
 	// Authorize request: check if the requestor is allowed to verify or issue
 	// the requested attributes or credentials
@@ -490,20 +554,32 @@ func (s *Server) createSession(w http.ResponseWriter, requestor string, rrequest
 	}
 
 	// Everything is authenticated and parsed, we're good to go!
-	qr, token, err := s.irmaserv.StartSession(rrequest, s.doResultCallback)
+	qr, token, err := s.irmaserv.StartSessionForRequestor(rrequest, s.doResultCallback, requestor)
+	if err == irmaserver.ErrMaintenance {
+		server.WriteError(w, server.ErrorMaintenance, "")
+		return
+	}
 	if err != nil {
 		server.WriteError(w, server.ErrorInvalidRequest, err.Error())
 		return
 	}
 
-	server.WriteJson(w, server.SessionPackage{
-		SessionPtr: qr,
-		Token:      token,
-	})
+	pkg := server.SessionPackage{
+		SessionPtr:  qr,
+		Token:       token,
+		PairingCode: s.irmaserv.GetPairingCode(token),
+	}
+	if s.conf.UniversalLinks {
+		if pkg.UniversalLink, err = qr.UniversalLink(); err != nil {
+			server.WriteError(w, server.ErrorUnknown, err.Error())
+			return
+		}
+	}
+	server.WriteJson(w, pkg)
 }
 
 func (s *Server) revoke(w http.ResponseWriter, requestor string, request *irma.RevocationRequest) {
-	allowed, reason := s.conf.CanRevoke(requestor, request.CredentialType)
+	allowed, reason := s.conf.canRevoke(s.irmaserv.Configuration().IrmaConfiguration, requestor, request.CredentialType)
 	if !allowed {
 		s.conf.Logger.WithFields(logrus.Fields{"requestor": requestor, "message": reason}).
 			Warn("Requestor not authorized to revoke credential; full request: ", server.ToJson(request))
@@ -151,6 +151,19 @@ func (transport *HTTPTransport) SetHeader(name, val string) {
 	transport.headers[name] = val
 }
 
+// SetTimeout sets the duration after which requests time out. Requests that time out are not
+// retried, and fail with an error of type ErrorTimeout.
+func (transport *HTTPTransport) SetTimeout(timeout time.Duration) {
+	transport.client.HTTPClient.Timeout = timeout
+	checkRetry := transport.client.CheckRetry
+	transport.client.CheckRetry = func(ctx context.Context, resp *http.Response, err error) (bool, error) {
+		if e, ok := err.(net.Error); ok && e.Timeout() {
+			return false, nil
+		}
+		return checkRetry(ctx, resp, err)
+	}
+}
+
 func (transport *HTTPTransport) request(
 	url string, method string, reader io.Reader, contenttype string,
 ) (response *http.Response, err error) {
@@ -169,6 +182,9 @@ func (transport *HTTPTransport) request(
 	}
 
 	res, err := transport.client.Do(&req)
+	if e, ok := err.(net.Error); ok && e.Timeout() {
+		return nil, &SessionError{ErrorType: ErrorTimeout, Err: err}
+	}
 	if err != nil {
 		return nil, &SessionError{ErrorType: ErrorTransport, Err: err}
 	}
@@ -251,7 +267,7 @@ func (transport *HTTPTransport) jsonRequest(url string, method string, result in
 func (transport *HTTPTransport) GetBytes(url string) ([]byte, error) {
 	res, err := transport.request(url, http.MethodGet, nil, "")
 	if err != nil {
-		return nil, &SessionError{ErrorType: ErrorTransport, Err: err}
+		return nil, err
 	}
 
 	if res.StatusCode != 200 {
@@ -278,3 +294,8 @@ func (transport *HTTPTransport) Get(url string, result interface{}) error {
 func (transport *HTTPTransport) Delete() {
 	_ = transport.jsonRequest("", http.MethodDelete, nil, nil)
 }
+
+// DeleteWithMessage performs a DELETE, including the specified object as body.
+func (transport *HTTPTransport) DeleteWithMessage(object interface{}) {
+	_ = transport.jsonRequest("", http.MethodDelete, nil, object)
+}
@@ -37,8 +37,14 @@ type DisclosedAttribute struct {
 	Identifier       AttributeTypeIdentifier `json:"id"`
 	Status           AttributeProofStatus    `json:"status"`
 	IssuanceTime     Timestamp               `json:"issuancetime"`
+	ExpiryTime       *Timestamp              `json:"expirytime,omitempty"` // Expiry date of the containing credential
 	NotRevoked       bool                    `json:"notrevoked,omitempty"`
 	NotRevokedBefore *Timestamp              `json:"notrevokedbefore,omitempty"`
+
+	// Name of the attribute type and value of the attribute in the language of the session, set by
+	// the IRMA server if a language is configured or requested
+	DisplayName  string `json:"displayname,omitempty"`
+	DisplayValue string `json:"displayvalue,omitempty"`
 }
 
 // ProofList is a gabi.ProofList with some extra methods.
@@ -325,12 +331,14 @@ func parseAttribute(index int, metadata *MetadataAttribute, attr *big.Int) (*Dis
 	if attrval == nil {
 		status = AttributeProofStatusNull
 	}
+	expiry := Timestamp(metadata.Expiry())
 	return &DisclosedAttribute{
 		Identifier:   attrid,
 		RawValue:     attrval,
 		Value:        NewTranslatedString(attrval),
 		Status:       status,
 		IssuanceTime: Timestamp(metadata.SigningDate()),
+		ExpiryTime:   &expiry,
 	}, attrval, nil
 }
 